@@ -0,0 +1,130 @@
+package gribdownloader
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// adaptiveDropRatio is how far the throughput of a window may fall below
+// that of the previous one before the added worker is taken back
+const adaptiveDropRatio = 0.8
+
+// adaptiveLimiter tunes the number of ranges downloaded at once from a host
+// in AIMD fashion: after each window of successful requests, one per
+// allowed worker, a worker is added unless throughput fell compared with the
+// previous window, in which case one is removed; a failed request halves
+// the workers. It is shared by all files downloaded from the host so that
+// what is learned carries over between files.
+type adaptiveLimiter struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	limit  int // Requests allowed at once
+	max    int
+	active int
+
+	windowStart time.Time
+	windowBytes int64
+	windowDone  int
+	lastRate    float64 // Bytes per second of the previous window
+	backedOff   bool    // Halved since the last successful request
+}
+
+// newAdaptiveLimiter returns a limiter starting at start workers, at most ceiling
+func newAdaptiveLimiter(start, ceiling int) *adaptiveLimiter {
+	l := &adaptiveLimiter{limit: min(start, ceiling), max: ceiling, windowStart: time.Now()}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+// acquire waits until a request may start, returning false if ctx is
+// cancelled first. A nil limiter does not limit.
+func (l *adaptiveLimiter) acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	stop := context.AfterFunc(ctx, func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.cond.Broadcast()
+	})
+	defer stop()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for l.active >= l.limit {
+		if ctx.Err() != nil {
+			return false
+		}
+		l.cond.Wait()
+	}
+	l.active++
+	return true
+}
+
+// release ends a request that transferred bytes, adjusting the limit by its
+// outcome, and reports the limit and whether it changed
+func (l *adaptiveLimiter) release(bytes int64, failed bool) (limit int, changed bool) {
+	if l == nil {
+		return 0, false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	defer l.cond.Broadcast()
+	l.active--
+	previous := l.limit
+
+	if failed {
+		// Back off once, not once per request in flight failing with it
+		if !l.backedOff {
+			l.limit = max(1, l.limit/2)
+			l.reset(0)
+			l.backedOff = true
+		}
+		return l.limit, l.limit != previous
+	}
+	l.backedOff = false
+
+	l.windowBytes += bytes
+	l.windowDone++
+	if l.windowDone < l.limit {
+		return l.limit, false
+	}
+	elapsed := time.Since(l.windowStart).Seconds()
+	if elapsed <= 0 {
+		return l.limit, false
+	}
+	rate := float64(l.windowBytes) / elapsed
+	switch {
+	case l.lastRate > 0 && rate < l.lastRate*adaptiveDropRatio:
+		l.limit = max(1, l.limit-1)
+	case l.limit < l.max:
+		l.limit++
+	}
+	l.reset(rate)
+	return l.limit, l.limit != previous
+}
+
+// reset starts a new window after one with the given throughput
+func (l *adaptiveLimiter) reset(rate float64) {
+	l.windowStart = time.Now()
+	l.windowBytes = 0
+	l.windowDone = 0
+	l.lastRate = rate
+}
+
+// adaptiveLimiterFor returns the limiter shared by the downloads from the
+// host of a URL, or nil when AdaptiveConcurrency is off
+func (d *Downloader) adaptiveLimiterFor(raw string) *adaptiveLimiter {
+	if d.AdaptiveConcurrency <= 0 {
+		return nil
+	}
+	host := raw
+	if u, err := url.Parse(raw); err == nil {
+		host = u.Host
+	}
+	start := min(d.concurrencyFor(raw), d.AdaptiveConcurrency)
+	limiter, _ := d.adaptive.LoadOrStore(host, newAdaptiveLimiter(start, d.AdaptiveConcurrency))
+	return limiter.(*adaptiveLimiter)
+}
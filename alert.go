@@ -0,0 +1,94 @@
+package gribdownloader
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"time"
+)
+
+// DefaultAlertAfterFailures is how many times in a row a file may fail to
+// download in watch mode before an alert is sent
+const DefaultAlertAfterFailures = 3
+
+// AlertConfig sends alerts to Slack or by email when watch keeps failing: a
+// file fails to download AfterFailures times in a row, or a cycle is still
+// incomplete LateAfter past its run time.
+type AlertConfig struct {
+	SlackWebhook  string       `json:"slack_webhook"` // Incoming webhook URL
+	Email         *EmailConfig `json:"email"`
+	AfterFailures int          `json:"after_failures"` // Default DefaultAlertAfterFailures
+	LateAfter     string       `json:"late_after"`     // e.g. "6h"; empty never alerts on late cycles
+}
+
+// EmailConfig sends alerts through an SMTP server, authenticating with
+// PLAIN when a username is given
+type EmailConfig struct {
+	SMTP     string   `json:"smtp"` // host:port
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+}
+
+// Failures returns the after_failures setting, or its default
+func (a *AlertConfig) Failures() int {
+	if a.AfterFailures == 0 {
+		return DefaultAlertAfterFailures
+	}
+	return a.AfterFailures
+}
+
+// Late returns the late_after setting, zero when not set
+func (a *AlertConfig) Late() time.Duration {
+	// Checked by validate
+	d, _ := time.ParseDuration(a.LateAfter)
+	return d
+}
+
+// validate checks the destinations and thresholds of the alerts
+func (a *AlertConfig) validate() error {
+	if a.SlackWebhook == "" && a.Email == nil {
+		return fmt.Errorf("set slack_webhook or email")
+	}
+	if a.SlackWebhook != "" {
+		u, err := url.Parse(a.SlackWebhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid slack_webhook %q: expected an http:// or https:// URL", a.SlackWebhook)
+		}
+	}
+	if a.Email != nil {
+		if err := a.Email.validate(); err != nil {
+			return fmt.Errorf("email: %v", err)
+		}
+	}
+	if a.AfterFailures < 0 {
+		return fmt.Errorf("invalid after_failures %d: must not be negative", a.AfterFailures)
+	}
+	if a.LateAfter != "" {
+		if d, err := time.ParseDuration(a.LateAfter); err != nil || d <= 0 {
+			return fmt.Errorf("invalid late_after %q: expected a duration such as 6h", a.LateAfter)
+		}
+	}
+	return nil
+}
+
+// validate checks the server and addresses of the email settings
+func (e *EmailConfig) validate() error {
+	if _, _, err := net.SplitHostPort(e.SMTP); err != nil {
+		return fmt.Errorf("invalid smtp %q: expected host:port", e.SMTP)
+	}
+	if _, err := mail.ParseAddress(e.From); err != nil {
+		return fmt.Errorf("invalid from %q: %v", e.From, err)
+	}
+	if len(e.To) == 0 {
+		return fmt.Errorf("to is required")
+	}
+	for _, to := range e.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("invalid to %q: %v", to, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package gribdownloader
+
+import "sort"
+
+// ParameterAlias is a friendly name for a commonly used field, standing in
+// for the GRIB parameter names and levels it is stored under
+type ParameterAlias struct {
+	Names       []string // Long name first, then short names
+	Description string
+	// Fields maps GRIB parameter names to levels. A field stored under
+	// different names by different models lists each of them.
+	Fields map[string][]string
+	Models []string // Models known to publish the field
+}
+
+var (
+	allModels = []string{"gfs", "hrrr", "gefs"}
+	gfsHRRR   = []string{"gfs", "hrrr"}
+	wafs      = []string{"wafs"}
+	waves     = []string{"gfswave", "gefswave"}
+)
+
+// parameterAliases are the built-in aliases for the NCEP models
+var parameterAliases = []ParameterAlias{
+	{[]string{"temperature_2m", "t2m"}, "2 m temperature", map[string][]string{"TMP": {"2 m above ground"}}, allModels},
+	{[]string{"dewpoint_2m", "d2m"}, "2 m dew point temperature", map[string][]string{"DPT": {"2 m above ground"}}, gfsHRRR},
+	{[]string{"relative_humidity_2m", "rh2m"}, "2 m relative humidity", map[string][]string{"RH": {"2 m above ground"}}, allModels},
+	{[]string{"u_wind_10m", "u10"}, "10 m U wind component", map[string][]string{"UGRD": {"10 m above ground"}}, allModels},
+	{[]string{"v_wind_10m", "v10"}, "10 m V wind component", map[string][]string{"VGRD": {"10 m above ground"}}, allModels},
+	{[]string{"wind_gust", "gust"}, "surface wind gust", map[string][]string{"GUST": {"surface"}}, gfsHRRR},
+	{[]string{"pressure_msl", "mslp"}, "mean sea level pressure", map[string][]string{"PRMSL": {"mean sea level"}, "MSLMA": {"mean sea level"}}, allModels},
+	{[]string{"surface_pressure", "sp"}, "surface pressure", map[string][]string{"PRES": {"surface"}}, allModels},
+	{[]string{"skin_temperature", "skt"}, "surface (skin) temperature", map[string][]string{"TMP": {"surface"}}, allModels},
+	{[]string{"orography", "orog"}, "surface geopotential height", map[string][]string{"HGT": {"surface"}}, allModels},
+	{[]string{"total_precipitation", "tp"}, "accumulated precipitation", map[string][]string{"APCP": {"surface"}}, allModels},
+	{[]string{"precipitation_rate", "prate"}, "precipitation rate", map[string][]string{"PRATE": {"surface"}}, gfsHRRR},
+	{[]string{"total_cloud_cover", "tcc"}, "total cloud cover", map[string][]string{"TCDC": {"entire atmosphere"}}, allModels},
+	{[]string{"precipitable_water", "pwat"}, "precipitable water", map[string][]string{"PWAT": {"entire atmosphere (considered as a single layer)"}}, allModels},
+	{[]string{"surface_cape", "cape"}, "surface based convective available potential energy", map[string][]string{"CAPE": {"surface"}}, allModels},
+	{[]string{"surface_cin", "cin"}, "surface based convective inhibition", map[string][]string{"CIN": {"surface"}}, allModels},
+	{[]string{"visibility", "vis"}, "surface visibility", map[string][]string{"VIS": {"surface"}}, gfsHRRR},
+	{[]string{"composite_reflectivity", "refc"}, "composite radar reflectivity", map[string][]string{"REFC": {"entire atmosphere"}}, gfsHRRR},
+	{[]string{"snow_depth", "sde"}, "snow depth", map[string][]string{"SNOD": {"surface"}}, allModels},
+	{[]string{"snow_water_equivalent", "sd"}, "water equivalent of accumulated snow depth", map[string][]string{"WEASD": {"surface"}}, allModels},
+	{[]string{"shortwave_down", "dswrf"}, "downward shortwave radiation flux at the surface", map[string][]string{"DSWRF": {"surface"}}, allModels},
+	{[]string{"longwave_down", "dlwrf"}, "downward longwave radiation flux at the surface", map[string][]string{"DLWRF": {"surface"}}, allModels},
+	{[]string{"geopotential_height_500", "z500"}, "500 hPa geopotential height", map[string][]string{"HGT": {"500 mb"}}, allModels},
+	{[]string{"temperature_850", "t850"}, "850 hPa temperature", map[string][]string{"TMP": {"850 mb"}}, allModels},
+	{[]string{"temperature_pl", "t_pl"}, "temperature on all pressure levels", map[string][]string{"TMP": {"* mb"}}, allModels},
+	{[]string{"geopotential_height_pl", "z_pl"}, "geopotential height on all pressure levels", map[string][]string{"HGT": {"* mb"}}, allModels},
+	{[]string{"relative_humidity_pl", "rh_pl"}, "relative humidity on all pressure levels", map[string][]string{"RH": {"* mb"}}, allModels},
+	{[]string{"u_wind_pl", "u_pl"}, "U wind component on all pressure levels", map[string][]string{"UGRD": {"* mb"}}, allModels},
+	{[]string{"v_wind_pl", "v_pl"}, "V wind component on all pressure levels", map[string][]string{"VGRD": {"* mb"}}, allModels},
+
+	// Aviation hazards of the WAFS gridded forecasts, on the flight levels
+	// the products are published for
+	{[]string{"icing_severity", "icing"}, "icing severity", map[string][]string{"ICESEV": {"* mb"}}, wafs},
+	{[]string{"icing_potential", "icip"}, "icing potential", map[string][]string{"ICIP": {"* mb"}}, wafs},
+	{[]string{"turbulence", "edr"}, "turbulence as eddy dissipation rate", map[string][]string{"EDPARM": {"* mb"}}, wafs},
+	{[]string{"clear_air_turbulence", "cat"}, "clear air turbulence", map[string][]string{"CATEDR": {"* mb"}}, wafs},
+	{[]string{"mountain_wave_turbulence", "mwt"}, "mountain wave turbulence", map[string][]string{"MWTURB": {"* mb"}}, wafs},
+	{[]string{"cumulonimbus_extent", "cb_extent"}, "horizontal extent of cumulonimbus", map[string][]string{"CBHE": {"entire atmosphere"}}, wafs},
+	{[]string{"cumulonimbus_base", "cb_base"}, "ICAO height of cumulonimbus bases", map[string][]string{"ICAHT": {"cumulonimbus base"}}, wafs},
+	{[]string{"cumulonimbus_top", "cb_top"}, "ICAO height of cumulonimbus tops", map[string][]string{"ICAHT": {"cumulonimbus top"}}, wafs},
+
+	// Sea state of the WAVEWATCH III based wave models. Swell is given per
+	// partition, as "1 in sequence" to "3 in sequence".
+	{[]string{"significant_wave_height", "swh"}, "significant height of combined wind waves and swell", map[string][]string{"HTSGW": {"surface"}}, waves},
+	{[]string{"peak_wave_period", "pp1d"}, "primary wave mean period", map[string][]string{"PERPW": {"surface"}}, waves},
+	{[]string{"peak_wave_direction", "dirpw"}, "primary wave direction", map[string][]string{"DIRPW": {"surface"}}, waves},
+	{[]string{"wind_wave_height", "shww"}, "significant height of wind waves", map[string][]string{"WVHGT": {"surface"}}, waves},
+	{[]string{"wind_wave_period", "mpww"}, "mean period of wind waves", map[string][]string{"WVPER": {"surface"}}, waves},
+	{[]string{"swell_height", "shts"}, "significant height of swell waves, per partition", map[string][]string{"SWELL": {"* in sequence"}}, waves},
+	{[]string{"swell_period", "mpts"}, "mean period of swell waves, per partition", map[string][]string{"SWPER": {"* in sequence"}}, waves},
+}
+
+// aliasesByName indexes the built-in aliases by each of their names
+var aliasesByName = func() map[string]ParameterAlias {
+	byName := map[string]ParameterAlias{}
+	for _, alias := range parameterAliases {
+		for _, name := range alias.Names {
+			byName[name] = alias
+		}
+	}
+	return byName
+}()
+
+// ParameterAliases returns the built-in aliases sorted by name
+func ParameterAliases() []ParameterAlias {
+	aliases := append([]ParameterAlias(nil), parameterAliases...)
+	sort.Slice(aliases, func(i, j int) bool { return aliases[i].Names[0] < aliases[j].Names[0] })
+	return aliases
+}
+
+// LookupAlias returns the built-in alias with the given name
+func LookupAlias(name string) (ParameterAlias, bool) {
+	alias, ok := aliasesByName[name]
+	return alias, ok
+}
+
+// expandAlias returns the GRIB parameters and levels a parameter entry of a
+// selection stands for: the fields of an alias, or the entry itself. An
+// alias selects its own levels, so an entry listing levels is taken as a
+// GRIB name, which the idx file must then have; some alias names, such as
+// "tp" and "sp", are also parameter names of the ECMWF open data.
+func expandAlias(name string, levels []string) (map[string][]string, bool) {
+	alias, ok := LookupAlias(name)
+	if !ok || len(levels) > 0 {
+		return map[string][]string{name: levels}, false
+	}
+	return alias.Fields, true
+}
@@ -0,0 +1,116 @@
+package gribdownloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RequestAuth holds extra headers and basic auth credentials sent with every
+// request for a URL starting with Prefix, and the provider of any expiring
+// credentials
+type RequestAuth struct {
+	Prefix   string // Source URL prefix, e.g. https://data.example.org/grib/
+	Headers  map[string]string
+	Username string
+	Password string
+	Provider AuthProvider
+}
+
+// apply adds the headers and credentials to a request
+func (a RequestAuth) apply(req *http.Request) {
+	for name, value := range a.Headers {
+		req.Header.Set(name, value)
+	}
+	if a.Username != "" {
+		req.SetBasicAuth(a.Username, a.Password)
+	}
+}
+
+// newRequest creates a request for an HTTP(S) URL, adding the headers and
+// credentials of every RequestAuth whose prefix it matches
+func (d *Downloader) newRequest(ctx context.Context, method, httpURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, httpURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("User-Agent", d.userAgent())
+	for _, auth := range d.Auth {
+		prefix, err := d.resolveURL(auth.Prefix)
+		if err == nil && strings.HasPrefix(httpURL, prefix) {
+			auth.apply(req)
+		}
+	}
+	return req, nil
+}
+
+// templatePrefix returns the fixed part of a URL template ahead of its
+// first placeholder
+func templatePrefix(template string) string {
+	if i := strings.Index(template, "{"); i >= 0 {
+		return template[:i]
+	}
+	return template
+}
+
+// hasAuth reports whether the dataset sets headers, credentials or an auth
+// provider
+func (ds *Dataset) hasAuth() bool {
+	return len(ds.Headers) > 0 || ds.Username != "" || ds.Password != "" || ds.AuthProvider != nil
+}
+
+// validateAuth checks the headers and credentials of the dataset and
+// creates its auth provider
+func (ds *Dataset) validateAuth() error {
+	if !ds.hasAuth() {
+		return nil
+	}
+	for name := range ds.Headers {
+		if name == "" || strings.ContainsAny(name, ": \t\r\n") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	if ds.Password != "" && ds.Username == "" {
+		return fmt.Errorf("password requires username")
+	}
+	if ds.AuthProvider != nil {
+		provider, err := NewAuthProvider(*ds.AuthProvider)
+		if err != nil {
+			return err
+		}
+		ds.authProvider = provider
+	}
+	// The credentials are matched by URL, so the host must not be templated
+	for _, template := range append([]string{ds.urlTemplate()}, ds.Mirrors...) {
+		prefix := templatePrefix(template)
+		u, err := url.Parse(prefix)
+		if err != nil || u.Host == "" || !strings.Contains(strings.TrimPrefix(prefix, u.Scheme+"://"), "/") {
+			return fmt.Errorf("headers, credentials and auth_provider require %s to start with a fixed host", template)
+		}
+	}
+	return nil
+}
+
+// Auth returns the headers, credentials and auth provider of the dataset for
+// each of its URL templates
+func (ds *Dataset) Auth() []RequestAuth {
+	if len(ds.Headers) == 0 && ds.Username == "" && ds.authProvider == nil {
+		return nil
+	}
+	var auths []RequestAuth
+	for _, template := range append([]string{ds.urlTemplate()}, ds.Mirrors...) {
+		if template == "" {
+			continue
+		}
+		auths = append(auths, RequestAuth{
+			Prefix:   templatePrefix(template),
+			Headers:  ds.Headers,
+			Username: ds.Username,
+			Password: ds.Password,
+			Provider: ds.authProvider,
+		})
+	}
+	return auths
+}
@@ -0,0 +1,292 @@
+package gribdownloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthProvider authorizes requests to mirrors whose credentials expire
+// during a run, such as short-lived access tokens or signed URLs
+type AuthProvider interface {
+	// Authorize prepares a request before it is sent, e.g. by adding a
+	// token header or replacing the URL with a signed one
+	Authorize(ctx context.Context, req *http.Request) error
+	// Refresh discards the credentials after the server rejected them with
+	// 401 or 403; the request is then authorized and sent once more
+	Refresh(ctx context.Context) error
+}
+
+// AuthProviderFactory creates an auth provider from the options given in
+// the config file
+type AuthProviderFactory func(options map[string]string) (AuthProvider, error)
+
+// AuthProviderConfig selects a registered auth provider and its options
+type AuthProviderConfig struct {
+	Name    string            `json:"name"`
+	Options map[string]string `json:"options"`
+}
+
+var (
+	authProvidersMu sync.RWMutex
+	authProviders   = map[string]AuthProviderFactory{
+		"token_command": newTokenCommandProvider,
+		"sign_command":  newSignCommandProvider,
+	}
+)
+
+// RegisterAuthProvider makes an auth provider available under the given
+// auth_provider name, replacing any provider already registered with that
+// name
+func RegisterAuthProvider(name string, factory AuthProviderFactory) {
+	authProvidersMu.Lock()
+	defer authProvidersMu.Unlock()
+	authProviders[name] = factory
+}
+
+// AuthProviders returns the names of the registered auth providers
+func AuthProviders() []string {
+	authProvidersMu.RLock()
+	defer authProvidersMu.RUnlock()
+
+	names := make([]string, 0, len(authProviders))
+	for name := range authProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewAuthProvider creates the auth provider registered under a name
+func NewAuthProvider(config AuthProviderConfig) (AuthProvider, error) {
+	authProvidersMu.RLock()
+	factory, ok := authProviders[config.Name]
+	authProvidersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown auth_provider %q: expected one of %s", config.Name, strings.Join(AuthProviders(), ", "))
+	}
+	provider, err := factory(config.Options)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth_provider %q: %v", config.Name, err)
+	}
+	return provider, nil
+}
+
+// authTransport authorizes the requests matching an auth provider's prefix,
+// refreshing the credentials and retrying once when they are rejected
+type authTransport struct {
+	base  http.RoundTripper
+	auths []RequestAuth // Those with a provider, with resolved prefixes
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var provider AuthProvider
+	for _, auth := range t.auths {
+		if strings.HasPrefix(req.URL.String(), auth.Prefix) {
+			provider = auth.Provider
+			break
+		}
+	}
+	if provider == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	for attempt := 0; ; attempt++ {
+		// RoundTrip must not modify the request it was given
+		authorized := req.Clone(req.Context())
+		if err := provider.Authorize(req.Context(), authorized); err != nil {
+			return nil, fmt.Errorf("error authorizing request: %v", err)
+		}
+		resp, err := t.base.RoundTrip(authorized)
+		if err != nil || attempt > 0 || req.Body != nil ||
+			(resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden) {
+			return resp, err
+		}
+		resp.Body.Close()
+		if err := provider.Refresh(req.Context()); err != nil {
+			return nil, fmt.Errorf("error refreshing credentials: %v", err)
+		}
+	}
+}
+
+// CloseIdleConnections closes the idle connections of the base transport
+func (t *authTransport) CloseIdleConnections() {
+	closeIdleConnections(t.base)
+}
+
+// providerAuths returns the auths with a provider, with their prefixes
+// resolved to HTTP URLs
+func (d *Downloader) providerAuths() []RequestAuth {
+	var auths []RequestAuth
+	for _, auth := range d.Auth {
+		if auth.Provider == nil {
+			continue
+		}
+		if prefix, err := d.resolveURL(auth.Prefix); err == nil {
+			auth.Prefix = prefix
+			auths = append(auths, auth)
+		}
+	}
+	return auths
+}
+
+// runCommand runs a command and returns its trimmed standard output
+func runCommand(ctx context.Context, command []string) (string, error) {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s failed: %v: %s", command[0], err, msg)
+		}
+		return "", fmt.Errorf("%s failed: %v", command[0], err)
+	}
+	out := strings.TrimSpace(stdout.String())
+	if out == "" {
+		return "", fmt.Errorf("%s printed nothing", command[0])
+	}
+	return out, nil
+}
+
+// commandOptions parses the command and ttl options shared by the built-in
+// providers
+func commandOptions(options map[string]string, defaultTTL time.Duration) ([]string, time.Duration, error) {
+	command := strings.Fields(options["command"])
+	if len(command) == 0 {
+		return nil, 0, fmt.Errorf("the command option is required")
+	}
+	ttl := defaultTTL
+	if value := options["ttl"]; value != "" {
+		var err error
+		ttl, err = time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return nil, 0, fmt.Errorf("invalid ttl %q: expected a duration such as 10m", value)
+		}
+	}
+	return command, ttl, nil
+}
+
+// DefaultTokenTTL is how long a token or signed URL minted by a command is
+// used before the command is run again
+const DefaultTokenTTL = 5 * time.Minute
+
+// tokenCommandProvider sends a token printed by a command, e.g.
+// "gcloud auth print-access-token", in a header. The options are command,
+// header (default Authorization), prefix (default "Bearer ", empty when the
+// header is not Authorization) and ttl.
+type tokenCommandProvider struct {
+	command []string
+	ttl     time.Duration
+	header  string
+	prefix  string
+
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newTokenCommandProvider implements AuthProviderFactory
+func newTokenCommandProvider(options map[string]string) (AuthProvider, error) {
+	command, ttl, err := commandOptions(options, DefaultTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	p := &tokenCommandProvider{command: command, ttl: ttl, header: "Authorization", prefix: "Bearer "}
+	if header, ok := options["header"]; ok {
+		p.header, p.prefix = header, ""
+	}
+	if prefix, ok := options["prefix"]; ok {
+		p.prefix = prefix
+	}
+	return p, nil
+}
+
+// Authorize implements AuthProvider
+func (p *tokenCommandProvider) Authorize(ctx context.Context, req *http.Request) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.token == "" || time.Now().After(p.expires) {
+		token, err := runCommand(ctx, p.command)
+		if err != nil {
+			return err
+		}
+		p.token, p.expires = token, time.Now().Add(p.ttl)
+	}
+	req.Header.Set(p.header, p.prefix+p.token)
+	return nil
+}
+
+// Refresh implements AuthProvider
+func (p *tokenCommandProvider) Refresh(ctx context.Context) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.token = ""
+	return nil
+}
+
+// signCommandProvider replaces each URL with a signed one printed by a
+// command given the URL as its last argument. The options are command and
+// ttl; signed URLs are reused until ttl has passed.
+type signCommandProvider struct {
+	command []string
+	ttl     time.Duration
+
+	mutex  sync.Mutex
+	signed map[string]signedURL // By unsigned URL
+}
+
+// signedURL is a signed URL and when it is due to be signed again
+type signedURL struct {
+	url     *url.URL
+	expires time.Time
+}
+
+// newSignCommandProvider implements AuthProviderFactory
+func newSignCommandProvider(options map[string]string) (AuthProvider, error) {
+	command, ttl, err := commandOptions(options, DefaultTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &signCommandProvider{command: command, ttl: ttl, signed: map[string]signedURL{}}, nil
+}
+
+// Authorize implements AuthProvider
+func (p *signCommandProvider) Authorize(ctx context.Context, req *http.Request) error {
+	unsigned := req.URL.String()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	signed, ok := p.signed[unsigned]
+	if !ok || time.Now().After(signed.expires) {
+		out, err := runCommand(ctx, append(p.command[:len(p.command):len(p.command)], unsigned))
+		if err != nil {
+			return err
+		}
+		u, err := url.Parse(out)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("%s printed an invalid URL %q", p.command[0], out)
+		}
+		signed = signedURL{url: u, expires: time.Now().Add(p.ttl)}
+		p.signed[unsigned] = signed
+	}
+	u := *signed.url
+	req.URL = &u
+	req.Host = u.Host
+	return nil
+}
+
+// Refresh implements AuthProvider
+func (p *signCommandProvider) Refresh(ctx context.Context) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	clear(p.signed)
+	return nil
+}
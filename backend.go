@@ -0,0 +1,136 @@
+package gribdownloader
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Backend maps the URLs of a storage service to HTTPS URLs that accept
+// ranged GET requests, allowing anonymous access to public buckets
+type Backend interface {
+	// HTTPURL returns the HTTPS URL for the object addressed by u
+	HTTPURL(u *url.URL) (string, error)
+	// Concurrency is the default number of range workers for the service
+	Concurrency() int
+}
+
+// DefaultS3Region is the region of the NOAA Open Data buckets on AWS
+const DefaultS3Region = "us-east-1"
+
+// S3Backend reads objects from public Amazon S3 buckets, e.g.
+// s3://noaa-gfs-bdp-pds/gfs.20241112/06/atmos/gfs.t06z.pgrb2.0p25.f001.idx
+type S3Backend struct {
+	Region string
+}
+
+// HTTPURL implements Backend. Objects are fetched with unsigned ranged
+// GetObject requests against the virtual-hosted bucket endpoint.
+func (b S3Backend) HTTPURL(u *url.URL) (string, error) {
+	if u.Host == "" {
+		return "", fmt.Errorf("missing bucket in %s", u)
+	}
+
+	region := b.Region
+	if region == "" {
+		region = DefaultS3Region
+	}
+
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", u.Host, region, strings.TrimPrefix(u.Path, "/")), nil
+}
+
+// Concurrency implements Backend. S3 scales well with parallel requests.
+func (S3Backend) Concurrency() int {
+	return 16
+}
+
+// GCSBackend reads objects from public Google Cloud Storage buckets, e.g.
+// gs://global-forecast-system/gfs.20241112/06/atmos/gfs.t06z.pgrb2.0p25.f001.idx
+type GCSBackend struct{}
+
+// HTTPURL implements Backend using the XML API endpoint, which serves
+// ranged reads of public objects without authentication
+func (GCSBackend) HTTPURL(u *url.URL) (string, error) {
+	if u.Host == "" {
+		return "", fmt.Errorf("missing bucket in %s", u)
+	}
+
+	return fmt.Sprintf("https://storage.googleapis.com/%s/%s", u.Host, strings.TrimPrefix(u.Path, "/")), nil
+}
+
+// Concurrency implements Backend
+func (GCSBackend) Concurrency() int {
+	return 16
+}
+
+// AzureBackend reads blobs from public Azure Blob Storage containers. URLs
+// take the form az://<account>/<container>/<blob>, e.g.
+// az://noaagfs/gfs/gfs.20241112/06/atmos/gfs.t06z.pgrb2.0p25.f001.idx
+type AzureBackend struct{}
+
+// azureHostSuffix is the host suffix of Azure Blob Storage endpoints
+const azureHostSuffix = ".blob.core.windows.net"
+
+// HTTPURL implements Backend
+func (AzureBackend) HTTPURL(u *url.URL) (string, error) {
+	if u.Host == "" {
+		return "", fmt.Errorf("missing storage account in %s", u)
+	}
+
+	return fmt.Sprintf("https://%s%s/%s", u.Host, azureHostSuffix, strings.TrimPrefix(u.Path, "/")), nil
+}
+
+// Concurrency implements Backend
+func (AzureBackend) Concurrency() int {
+	return 16
+}
+
+// backend returns the backend for a URL, or nil for plain HTTP(S) servers.
+// HTTPS URLs pointing directly at a blob endpoint use the Azure backend.
+func (d *Downloader) backend(u *url.URL) Backend {
+	if u.Scheme == "https" && strings.HasSuffix(u.Host, azureHostSuffix) {
+		return AzureBackend{}
+	}
+
+	switch u.Scheme {
+	case "s3":
+		return S3Backend{Region: d.S3Region}
+	case "gs":
+		return GCSBackend{}
+	case "az":
+		return AzureBackend{}
+	}
+	return nil
+}
+
+// resolveURL converts a source URL into an HTTP(S) URL
+func (d *Downloader) resolveURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %q: %v", raw, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return raw, nil
+	}
+
+	b := d.backend(u)
+	if b == nil {
+		return "", fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	return b.HTTPURL(u)
+}
+
+// concurrencyFor returns the number of range workers to use for a source URL
+func (d *Downloader) concurrencyFor(raw string) int {
+	if d.MaxConcurrency > 0 {
+		return d.MaxConcurrency
+	}
+	if u, err := url.Parse(raw); err == nil {
+		if b := d.backend(u); b != nil {
+			return b.Concurrency()
+		}
+	}
+	return DefaultMaxConcurrency
+}
@@ -0,0 +1,85 @@
+package gribdownloader
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// ErrChecksumMismatch is returned when a downloaded file does not match the
+// checksum published next to it
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumSidecars are the checksum files looked for next to a GRIB file,
+// in order of preference
+var checksumSidecars = []struct {
+	suffix string
+	hash   func() hash.Hash
+}{
+	{".sha256", sha256.New},
+	{".md5", md5.New},
+}
+
+// maxSidecarSize bounds the checksum files read; they hold a single line
+const maxSidecarSize = 4096
+
+// fileChecksum is a checksum published for a file
+type fileChecksum struct {
+	url  string // Of the sidecar file
+	sum  []byte
+	hash func() hash.Hash
+}
+
+// fetchChecksum downloads the checksum sidecar of a file, trying a .sha256
+// file before a .md5 one. It returns nil if neither exists.
+func (d *Downloader) fetchChecksum(ctx context.Context, url string) (*fileChecksum, error) {
+	for _, sidecar := range checksumSidecars {
+		sidecarURL := url + sidecar.suffix
+		resp, err := d.get(ctx, sidecarURL)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error fetching %s: %v", sidecarURL, err)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxSidecarSize))
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", sidecarURL, err)
+		}
+		sum, err := parseChecksum(string(data), sidecar.hash().Size())
+		if err != nil {
+			return nil, fmt.Errorf("invalid checksum file %s: %v", sidecarURL, err)
+		}
+		return &fileChecksum{url: sidecarURL, sum: sum, hash: sidecar.hash}, nil
+	}
+	return nil, nil
+}
+
+// parseChecksum parses the output of sha256sum or md5sum, a hex digest
+// optionally followed by the file name
+func parseChecksum(data string, size int) ([]byte, error) {
+	fields := strings.Fields(data)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty file")
+	}
+	sum, err := hex.DecodeString(fields[0])
+	if err != nil || len(sum) != size {
+		return nil, fmt.Errorf("expected a %d-byte hex digest, got %q", size, fields[0])
+	}
+	return sum, nil
+}
+
+// verify compares the digest of a downloaded file with the checksum
+func (c *fileChecksum) verify(h hash.Hash) error {
+	if got := h.Sum(nil); string(got) != string(c.sum) {
+		return fmt.Errorf("%w: got %x, %s has %x", ErrChecksumMismatch, got, c.url, c.sum)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package gribdownloader
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultReadTimeout is how long a request may go without receiving any
+// data when no read timeout is configured
+const DefaultReadTimeout = 60 * time.Second
+
+// idleTimeoutTransport fails requests that receive nothing for a while,
+// whether waiting for the response headers or reading the body. Unlike a
+// timeout on the whole request it lets large ranges complete on slow links
+// as long as data keeps arriving.
+type idleTimeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *idleTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	body := &idleTimeoutBody{timeout: t.timeout, cancel: cancel}
+	body.timer = time.AfterFunc(t.timeout, func() {
+		body.timedOut.Store(true)
+		cancel()
+	})
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		body.timer.Stop()
+		cancel()
+		return nil, body.wrap(err)
+	}
+	body.ReadCloser = resp.Body
+	body.timer.Reset(t.timeout)
+	resp.Body = body
+	return resp, nil
+}
+
+// CloseIdleConnections closes the idle connections of the base transport
+func (t *idleTimeoutTransport) CloseIdleConnections() {
+	closeIdleConnections(t.base)
+}
+
+// closeIdleConnections closes the idle connections of a transport that
+// keeps any, as http.Client does, so that wrapping transports can pass the
+// call on
+func closeIdleConnections(rt http.RoundTripper) {
+	if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// idleTimeoutBody is a response body that restarts the idle timer of its
+// request whenever data arrives
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	timedOut atomic.Bool
+	cancel   context.CancelFunc
+}
+
+// wrap describes an error caused by the idle timer
+func (b *idleTimeoutBody) wrap(err error) error {
+	if err != nil && b.timedOut.Load() {
+		return fmt.Errorf("no data received for %v: %w", b.timeout, err)
+	}
+	return err
+}
+
+// Read implements io.Reader
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.timedOut.Load() {
+		b.timer.Reset(b.timeout)
+	}
+	if err == io.EOF {
+		return n, err
+	}
+	return n, b.wrap(err)
+}
+
+// Close implements io.Closer
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// newTransport builds the transport shared by all requests of the downloader.
+// Connections are kept alive and reused across ranges and files, avoiding a
+// TLS handshake per range.
+func (d *Downloader) newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = d.MaxConnsPerHost
+
+	transport.MaxIdleConnsPerHost = d.MaxIdleConnsPerHost
+	if transport.MaxIdleConnsPerHost <= 0 {
+		transport.MaxIdleConnsPerHost = d.MaxConnsPerHost
+	}
+	if transport.MaxIdleConnsPerHost <= 0 {
+		// Keep enough idle connections for the busiest backend
+		transport.MaxIdleConnsPerHost = max(d.MaxConcurrency, d.MaxTotalConcurrency, d.AdaptiveConcurrency, S3Backend{}.Concurrency())
+	}
+	transport.MaxIdleConns = max(transport.MaxIdleConns, transport.MaxIdleConnsPerHost)
+
+	if d.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = d.IdleConnTimeout
+	}
+
+	if d.Proxy != nil {
+		transport.Proxy = http.ProxyURL(d.Proxy)
+	}
+	if d.RootCAs != nil || d.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:            d.RootCAs,
+			InsecureSkipVerify: d.InsecureSkipVerify,
+		}
+	}
+
+	if d.DisableHTTP2 {
+		// A non-nil empty map turns off the automatic HTTP/2 upgrade
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	} else {
+		transport.ForceAttemptHTTP2 = true
+	}
+
+	return transport
+}
+
+// ParseProxy parses a proxy URL such as http://proxy:3128 or
+// socks5://localhost:1080
+func ParseProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %v", raw, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy %q: expected an http, https or socks5 URL", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q: missing host", raw)
+	}
+	return u, nil
+}
+
+// LoadCertPool returns the system certificate authorities together with
+// those in a PEM bundle
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA bundle: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("CA bundle %s holds no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// httpClient returns the HTTP client shared by all requests of the downloader
+func (d *Downloader) httpClient() *http.Client {
+	d.once.Do(func() {
+		d.client = d.HTTPClient
+		if d.client == nil {
+			readTimeout := d.ReadTimeout
+			if readTimeout <= 0 {
+				readTimeout = DefaultReadTimeout
+			}
+			d.client = &http.Client{
+				Timeout:   d.RequestTimeout,
+				Transport: &idleTimeoutTransport{base: d.newTransport(), timeout: readTimeout},
+			}
+		}
+		if auths := d.providerAuths(); len(auths) > 0 {
+			base := d.client.Transport
+			if base == nil {
+				base = http.DefaultTransport
+			}
+			client := *d.client
+			client.Transport = &authTransport{base: base, auths: auths}
+			d.client = &client
+		}
+		if d.MaxRetryAfter >= 0 {
+			maxWait := d.MaxRetryAfter
+			if maxWait == 0 {
+				maxWait = DefaultMaxRetryAfter
+			}
+			base := d.client.Transport
+			if base == nil {
+				base = http.DefaultTransport
+			}
+			client := *d.client
+			throttle := &throttle{max: maxWait, logger: d.logger(), hosts: map[string]*hostCooldown{}}
+			client.Transport = &throttleTransport{base: base, throttle: throttle}
+			d.client = &client
+		}
+		if d.MaxTotalConcurrency > 0 {
+			d.slots = make(chan struct{}, d.MaxTotalConcurrency)
+		}
+		if d.MaxRate > 0 {
+			d.limiter = newRateLimiter(d.MaxRate)
+		}
+	})
+	return d.client
+}
+
+// Client returns the HTTP client shared by all requests of the downloader,
+// for other requests that should use the same connection settings
+func (d *Downloader) Client() *http.Client {
+	return d.httpClient()
+}
+
+// CloseIdleConnections closes keep-alive connections that are not in use,
+// e.g. between scheduled runs
+func (d *Downloader) CloseIdleConnections() {
+	d.httpClient().CloseIdleConnections()
+}
+
+// acquire waits for a free slot under MaxTotalConcurrency. It returns false
+// if ctx is cancelled first.
+func (d *Downloader) acquire(ctx context.Context) bool {
+	d.httpClient()
+	if d.slots == nil {
+		return true
+	}
+	select {
+	case d.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release frees a slot taken by acquire
+func (d *Downloader) release() {
+	if d.slots != nil {
+		<-d.slots
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"gribdownloader"
+)
+
+// alerter sends the alerts of watch to Slack and by email
+type alerter struct {
+	config *gribdownloader.AlertConfig
+	client *http.Client
+}
+
+// newAlerter returns an alerter for the alerts config, or nil if alerts are
+// not configured
+func newAlerter(config *gribdownloader.AlertConfig) *alerter {
+	if config == nil {
+		return nil
+	}
+	return &alerter{config: config, client: &http.Client{Timeout: webhookTimeout}}
+}
+
+// alert sends an alert to every destination. Failures are logged and do
+// not affect watching.
+func (a *alerter) alert(ctx context.Context, subject, details string) {
+	if a == nil {
+		return
+	}
+	slog.Warn("sending alert", "subject", subject)
+	if a.config.SlackWebhook != "" {
+		if err := a.slack(ctx, subject, details); err != nil {
+			slog.Warn("Slack alert failed", "error", err)
+		}
+	}
+	if a.config.Email != nil {
+		if err := a.email(subject, details); err != nil {
+			slog.Warn("email alert failed", "error", err)
+		}
+	}
+}
+
+// slack posts an alert to the Slack incoming webhook
+func (a *alerter) slack(ctx context.Context, subject, details string) error {
+	body, err := json.Marshal(map[string]string{"text": fmt.Sprintf("*%s*\n%s", subject, details)})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", a.config.SlackWebhook, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// email sends an alert through the SMTP server
+func (a *alerter) email(subject, details string) error {
+	config := a.config.Email
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(config.To, ", "))
+	fmt.Fprintf(&msg, "Subject: gribdownloader: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(details, "\n", "\r\n"))
+	msg.WriteString("\r\n")
+
+	var auth smtp.Auth
+	if config.Username != "" {
+		host, _, _ := net.SplitHostPort(config.SMTP)
+		auth = smtp.PlainAuth("", config.Username, config.Password, host)
+	}
+	if err := smtp.SendMail(config.SMTP, auth, config.From, config.To, msg.Bytes()); err != nil {
+		return fmt.Errorf("error sending email: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"gribdownloader"
+)
+
+// budget holds max_total_bytes and max_requests against the files a run
+// starts downloading, including those planned only once their idx file is
+// published
+type budget struct {
+	maxBytes    int64
+	maxRequests int
+
+	mutex    sync.Mutex
+	bytes    int64
+	requests int
+}
+
+// newBudget returns the budget of a run, or nil when no limit is set
+func newBudget(config *gribdownloader.Config) *budget {
+	maxBytes, maxRequests := config.TotalBytesLimit(), config.MaxRequests
+	if maxBytes <= 0 && maxRequests <= 0 {
+		return nil
+	}
+	return &budget{maxBytes: maxBytes, maxRequests: maxRequests}
+}
+
+// exceeded describes the limits that bytes and requests go over
+func (b *budget) exceeded(bytes int64, requests int) []string {
+	var exceeded []string
+	if b.maxBytes > 0 && bytes > b.maxBytes {
+		exceeded = append(exceeded, fmt.Sprintf("%s exceeds max_total_bytes of %s", mb(uint64(bytes)), mb(uint64(b.maxBytes))))
+	}
+	if b.maxRequests > 0 && requests > b.maxRequests {
+		exceeded = append(exceeded, fmt.Sprintf("%d range requests exceed max_requests of %d", requests, b.maxRequests))
+	}
+	return exceeded
+}
+
+// take counts the download of a plan, failing it if the run would go over
+// budget
+func (b *budget) take(plan *filePlan) error {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	bytes, requests := b.bytes+plan.totalSize(), b.requests+len(plan.ranges)
+	if exceeded := b.exceeded(bytes, requests); len(exceeded) > 0 {
+		return withExitCode(exitBudget, fmt.Errorf("downloading %s would put the run over budget: %s; check the selection, or raise the limits with --set",
+			plan.gribFileName, strings.Join(exceeded, ", ")))
+	}
+	b.bytes, b.requests = bytes, requests
+	return nil
+}
+
+// lift removes the limits, once the user chose to go over them
+func (b *budget) lift() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.maxBytes, b.maxRequests = 0, 0
+}
+
+// checkBudget fails before any GRIB data is transferred when the planned
+// download exceeds the budget. Interactive runs are asked whether to go
+// ahead instead, which lifts the limits for the rest of the run.
+func checkBudget(env *environment, b *budget, plans map[string]*filePlan) error {
+	if b == nil {
+		return nil
+	}
+
+	var bytes int64
+	var requests int
+	for _, plan := range plans {
+		bytes += plan.totalSize()
+		requests += len(plan.ranges)
+	}
+	exceeded := b.exceeded(bytes, requests)
+	if len(exceeded) == 0 {
+		return nil
+	}
+
+	message := fmt.Sprintf("the planned download of %d files is over budget: %s", len(plans), strings.Join(exceeded, ", "))
+	if env.askBudget && confirm(message+". Download anyway?") {
+		b.lift()
+		return nil
+	}
+	return withExitCode(exitBudget, fmt.Errorf("%s; check the selection, or raise the limits with --set", message))
+}
+
+// confirm asks a yes or no question on the terminal, defaulting to no
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gribdownloader"
+)
+
+// parseAge parses a duration such as 36h, additionally accepting whole days
+// such as 7d
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q: expected a duration such as 7d or 36h", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q: expected a duration such as 7d or 36h", s)
+	}
+	return d, nil
+}
+
+// runCachePrune implements the cache prune command
+func runCachePrune(args []string) error {
+	fs := flag.NewFlagSet("cache prune", flag.ExitOnError)
+	olderThan := fs.String("older-than", "", "remove cached files last used longer ago than this, e.g. 7d or 36h")
+	dir := fs.String("dir", "", "cache directory (default cache_dir from the config file)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gribdownloader cache prune --older-than AGE [--dir DIR | config.json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *olderThan == "" || (*dir == "") == (fs.NArg() == 0) || fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	age, err := parseAge(*olderThan)
+	if err != nil {
+		return err
+	}
+
+	if *dir == "" {
+		config, err := gribdownloader.ReadConfig(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if config.CacheDir == "" {
+			return fmt.Errorf("%s does not set cache_dir", fs.Arg(0))
+		}
+		*dir = config.CacheDir
+	}
+
+	cache := &gribdownloader.OutputCache{Dir: *dir}
+	removed, freed, err := cache.Prune(time.Now().Add(-age))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("removed %d cached files, freed %.2f MB\n", removed, float64(freed)/(1024*1024))
+	return nil
+}
+
+// runCache implements the cache command
+func runCache(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "prune" {
+		fmt.Fprintln(os.Stderr, "Usage: gribdownloader cache prune [flags]")
+		os.Exit(exitUsage)
+	}
+	return runCachePrune(args[1:])
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gribdownloader"
+)
+
+// pruneCycles removes the cycles of a dataset on disk that the retention no
+// longer keeps, returning them; with dryRun nothing is removed
+func pruneCycles(dataset *gribdownloader.Dataset, retention gribdownloader.Retention, lookback time.Duration, dryRun bool) ([]gribdownloader.CycleFiles, error) {
+	now := time.Now()
+	expired := retention.Expired(dataset.CyclesOnDisk(now, lookback), now)
+	if dryRun {
+		return expired, nil
+	}
+	for i, cycle := range expired {
+		if err := dataset.RemoveCycle(cycle); err != nil {
+			return expired[:i], err
+		}
+		slog.Info("removed cycle", "dataset", dataset.Name, "cycle", cycle.Run.Format("2006010215"), "files", len(cycle.Files))
+	}
+	return expired, nil
+}
+
+// datasetSuffix names a named dataset in the output of clean
+func datasetSuffix(dataset *gribdownloader.Dataset) string {
+	if dataset.Name == "" {
+		return ""
+	}
+	return fmt.Sprintf(" of %s", dataset.Name)
+}
+
+// runClean implements the clean command
+func runClean(ctx context.Context, args []string) error {
+	fs, opts := newFlagSet("clean")
+	dryRun := fs.Bool("dry-run", false, "list the cycles that would be removed without removing them")
+	keepCycles := fs.Int("keep-cycles", 0, "keep this many of the newest cycles (overrides keep_cycles)")
+	keepDays := fs.Int("keep-days", 0, "keep the cycles of this many days (overrides keep_days)")
+	lookback := fs.String("lookback", "30d", "how far past the retained cycles to look for old ones, e.g. 30d")
+
+	env, err := setup(fs, opts, args)
+	if err != nil {
+		return err
+	}
+	age, err := parseAge(*lookback)
+	if err != nil {
+		return err
+	}
+	if *keepCycles < 0 || *keepDays < 0 {
+		return withExitCode(exitUsage, fmt.Errorf("--keep-cycles and --keep-days must not be negative"))
+	}
+
+	var removed int
+	var freed int64
+	for _, dataset := range env.datasets {
+		if !dataset.UsesCycle() {
+			return fmt.Errorf("dataset %q: clean requires {yyyymmdd} or {cycle} in idx_url", dataset.Name)
+		}
+		retention := dataset.Retention()
+		if *keepCycles > 0 || *keepDays > 0 {
+			retention = gribdownloader.Retention{KeepCycles: *keepCycles, KeepDays: *keepDays}
+		}
+		if retention.IsZero() {
+			return fmt.Errorf("dataset %q: set keep_cycles or keep_days, or use --keep-cycles or --keep-days", dataset.Name)
+		}
+
+		cycles, err := pruneCycles(dataset, retention, age, *dryRun)
+		for _, cycle := range cycles {
+			if *dryRun {
+				fmt.Printf("would remove cycle %s%s: %d files, %.2f MB\n", cycle.Run.Format("2006010215"),
+					datasetSuffix(dataset), len(cycle.Files), float64(cycle.Bytes)/(1024*1024))
+			}
+			removed++
+			freed += cycle.Bytes
+		}
+		if err != nil {
+			return fmt.Errorf("dataset %q: %v", dataset.Name, err)
+		}
+	}
+
+	if *dryRun {
+		fmt.Printf("would remove %d cycles, freeing %.2f MB\n", removed, float64(freed)/(1024*1024))
+		return nil
+	}
+	fmt.Printf("removed %d cycles, freed %.2f MB\n", removed, float64(freed)/(1024*1024))
+	return nil
+}
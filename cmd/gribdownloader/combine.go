@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"gribdownloader"
+)
+
+// combinePart is a downloaded file to append to a combined file
+type combinePart struct {
+	hour   int
+	output string
+	files  []string // Every file written for the hour
+}
+
+// combineGroup collects the files of the forecast hours of a cycle
+type combineGroup struct {
+	dataset *gribdownloader.Dataset
+	target  gribdownloader.Target // Any of the hours, naming the cycle
+	parts   []combinePart
+	failed  int
+}
+
+// combiner collects the outcome of every downloaded file for --combine.
+// A nil combiner discards them.
+type combiner struct {
+	mutex   sync.Mutex
+	groups  map[string]*combineGroup // Keyed by combined file path
+	keepIdx bool
+}
+
+// add records the outcome of downloading a target
+func (c *combiner) add(dataset *gribdownloader.Dataset, target gribdownloader.Target, err error) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.groups == nil {
+		c.groups = map[string]*combineGroup{}
+	}
+	path := dataset.CombinedPath(target)
+	group := c.groups[path]
+	if group == nil {
+		group = &combineGroup{dataset: dataset, target: target}
+		c.groups[path] = group
+	}
+	if err != nil {
+		group.failed++
+		return
+	}
+	output := outputPath(target)
+	group.parts = append(group.parts, combinePart{hour: target.Hour, output: output, files: outputFiles(c.keepIdx, target, output)})
+}
+
+// combine writes the combined file of every cycle whose files were all
+// downloaded, appending the forecast hours in order. Datasets uploading
+// their output upload the combined file and remove the staged hours.
+func (c *combiner) combine(ctx context.Context, env *environment) error {
+	paths := make([]string, 0, len(c.groups))
+	for path := range c.groups {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var failed int
+	for _, path := range paths {
+		group := c.groups[path]
+		if err := group.combine(ctx, env, path); err != nil {
+			slog.Error("could not combine files", "file", path, "error", err)
+			failed++
+		}
+		// The hours were uploaded as they were downloaded
+		for _, part := range group.parts {
+			removeStaged(group.dataset, part.files)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d combined files were not written", failed, len(paths))
+	}
+	return nil
+}
+
+// combine writes the combined file of a group, then delivers and uploads it
+// as configured
+func (g *combineGroup) combine(ctx context.Context, env *environment, path string) error {
+	if g.failed > 0 {
+		return fmt.Errorf("%d forecast hours failed to download", g.failed)
+	}
+
+	sort.Slice(g.parts, func(i, j int) bool { return g.parts[i].hour < g.parts[j].hour })
+	inputs := make([]string, len(g.parts))
+	for i, part := range g.parts {
+		inputs[i] = part.output
+	}
+	manifest, err := gribdownloader.CombineFiles(path, inputs)
+	if err != nil {
+		return err
+	}
+	slog.Info("combined forecast hours", "file", path, "files", len(inputs), "messages", len(manifest.Messages))
+	files := []string{path, gribdownloader.ManifestPath(path)}
+	if err := deliverFiles(ctx, env, g.dataset, g.target, files); err != nil {
+		return err
+	}
+	return uploadFiles(ctx, env, g.dataset, files, false)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gribdownloader"
+)
+
+// options holds the flags shared by all subcommands
+type options struct {
+	date      string
+	cycle     string
+	dataset   string
+	all       bool
+	logLevel  string
+	logFormat string
+	maxRate   string
+	preset    string
+	idxURL    string
+	region    string
+	params    stringList
+	sets      stringList
+	keepIdx   bool
+	strict    bool
+	noDirect  bool
+}
+
+// stringList is a flag that may be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// newFlagSet creates the flag set of a subcommand with the shared flags registered
+func newFlagSet(name string) (*flag.FlagSet, *options) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	opts := &options{}
+	fs.StringVar(&opts.date, "date", "", "run date as YYYYMMDD, \"latest\" to probe for the newest cycle, or \"latest-complete\" for the newest with every forecast hour published")
+	fs.StringVar(&opts.cycle, "cycle", "", "cycle hour (e.g. 06)")
+	fs.StringVar(&opts.dataset, "dataset", "", "name of the dataset to use")
+	fs.BoolVar(&opts.all, "all", false, "use all datasets in sequence")
+	fs.StringVar(&opts.logLevel, "log-level", "info", "log level: debug, info, warn or error")
+	fs.StringVar(&opts.logFormat, "log-format", "text", "log format: text or json")
+	fs.StringVar(&opts.idxURL, "idx-url", "", "idx URL template (overrides idx_url)")
+	fs.StringVar(&opts.region, "region", "", "cut messages down to a bounding box given as lat1,lon1,lat2,lon2 (overrides region)")
+	fs.Var(&opts.params, "param", "select a parameter as NAME, NAME:LEVEL, NAME:LEVEL:TYPE:EXTRA (e.g. APCP:surface:0-6 hour acc fcst:prob >0.254) or an alias such as t2m (see params), replacing the configured parameters; may be repeated")
+	fs.Var(&opts.sets, "set", "override a config field as key=value, e.g. forecast_hours=0,6; may be repeated")
+	fs.StringVar(&opts.preset, "preset", "", "use a built-in dataset preset (see the presets command)")
+	fs.BoolVar(&opts.keepIdx, "keep-idx", false, "save the downloaded idx files next to the GRIB output")
+	fs.StringVar(&opts.maxRate, "max-rate", "", "limit the total download rate, e.g. 10MB/s (overrides max_rate)")
+	fs.BoolVar(&opts.noDirect, "no-direct-copy", false, "copy response data through small buffers instead of directly into the output, for debugging")
+	fs.BoolVar(&opts.strict, "strict", false, "fail files for which a requested parameter or level matches no idx record (only warn with strict \"warn\" in the config)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gribdownloader %s [flags] config.json\n", name)
+		fs.PrintDefaults()
+	}
+	return fs, opts
+}
+
+// environment is the state shared by the subcommands once flags are parsed
+type environment struct {
+	config     *gribdownloader.Config
+	datasets   []*gribdownloader.Dataset
+	downloader *gribdownloader.Downloader
+	notifier   *notifier
+	publisher  *publisher // Set when publish lists brokers
+	metrics    *metrics   // Set when metrics are served
+	logger     *slog.Logger
+	keepIdx    bool      // Save idx files next to the GRIB output
+	events     *eventLog // Set to collect the outcome of every file
+	stats      *runStats // Set to collect the statistics of the run report
+	combined   *combiner // Set to combine the forecast hours of each cycle
+	uploads    *uploaders
+	checkSpace bool // Check free disk space before downloading
+	askBudget  bool // Ask whether to go ahead with a download over budget
+
+	// skipExisting skips the targets whose output is already complete
+	skipExisting bool
+
+	// strict is what happens to files for which part of the selection
+	// matches no idx record; empty ignores it
+	strict gribdownloader.StrictMode
+
+	// converter, if set, converts each downloaded file to NetCDF, and
+	// kerchunk writes references to its remote messages; the GRIB file is
+	// kept alongside only with keepGRIB
+	converter gribdownloader.Converter
+	kerchunk  bool
+	keepGRIB  bool
+
+	// waitUntil, if set, is how long to poll for idx files that are not
+	// published yet, every waitInterval
+	waitUntil    time.Time
+	waitInterval time.Duration
+}
+
+// parseArgs parses the arguments, requiring a single positional argument,
+// and configures logging
+func parseArgs(fs *flag.FlagSet, opts *options, args []string) (*slog.Logger, error) {
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	logger, err := newLogger(opts.logLevel, opts.logFormat)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+	return logger, nil
+}
+
+// setup parses the arguments, configures logging and loads the config file
+func setup(fs *flag.FlagSet, opts *options, args []string) (*environment, error) {
+	logger, err := parseArgs(fs, opts, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return loadEnvironment(fs.Arg(0), opts, logger)
+}
+
+// overriddenDataset returns the dataset that overrides of dataset fields
+// apply to: the one chosen with --dataset, the only named dataset if there
+// is no top-level one, or else the top-level dataset
+func overriddenDataset(config *gribdownloader.Config, name string) *gribdownloader.Dataset {
+	if dataset := config.Datasets[name]; dataset != nil {
+		return dataset
+	}
+	if name == "" && config.IdxURL == "" && config.FieldURL == "" && config.Preset == "" && len(config.Datasets) == 1 {
+		return config.Datasets[config.DatasetNames()[0]]
+	}
+	return &config.Dataset
+}
+
+// applyOverrides applies the GRIBDL_* environment variables and then the
+// override flags to the config
+func applyOverrides(config *gribdownloader.Config, opts *options) error {
+	dataset := overriddenDataset(config, opts.dataset)
+
+	env := gribdownloader.EnvOverrides(os.Environ())
+	for _, key := range sortedKeys(env) {
+		if err := config.Override(dataset, key, env[key]); err != nil {
+			return fmt.Errorf("%s%s: %v", gribdownloader.EnvPrefix, strings.ToUpper(key), err)
+		}
+	}
+
+	for _, set := range opts.sets {
+		key, value, ok := strings.Cut(set, "=")
+		if !ok {
+			return fmt.Errorf("--set %q: expected key=value", set)
+		}
+		if err := config.Override(dataset, key, value); err != nil {
+			return err
+		}
+	}
+
+	if opts.preset != "" {
+		dataset.Preset = opts.preset
+	}
+	if opts.idxURL != "" {
+		dataset.IdxURL = opts.idxURL
+	}
+	if opts.region != "" {
+		region, err := gribdownloader.ParseRegion(opts.region)
+		if err != nil {
+			return err
+		}
+		dataset.Region = []float64{region.South, region.West, region.North, region.East}
+	}
+	if len(opts.params) > 0 {
+		dataset.Parameters = map[string][]string{}
+		dataset.Groups = nil
+		dataset.HourRules = nil
+		for _, param := range opts.params {
+			name, level, ok := strings.Cut(param, ":")
+			levels := dataset.Parameters[name]
+			if ok {
+				levels = append(levels, level)
+			}
+			dataset.Parameters[name] = levels
+		}
+	}
+
+	return nil
+}
+
+// loadEnvironment loads the config file and applies the shared flags
+func loadEnvironment(configPath string, opts *options, logger *slog.Logger) (*environment, error) {
+	config, err := gribdownloader.ReadConfig(configPath)
+	if err != nil {
+		return nil, withExitCode(exitConfig, fmt.Errorf("invalid configuration: %v", err))
+	}
+
+	if err := applyOverrides(config, opts); err != nil {
+		return nil, withExitCode(exitConfig, fmt.Errorf("invalid override: %v", err))
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, withExitCode(exitConfig, fmt.Errorf("invalid configuration: %v", err))
+	}
+
+	datasets, err := config.SelectDatasets(opts.dataset, opts.all)
+	if err != nil {
+		return nil, withExitCode(exitConfig, fmt.Errorf("invalid dataset selection: %v", err))
+	}
+
+	for _, dataset := range datasets {
+		if opts.date != "" {
+			dataset.Date = opts.date
+		}
+		if opts.cycle != "" {
+			dataset.Cycle = opts.cycle
+		}
+	}
+
+	downloader := config.NewDownloader()
+	downloader.Logger = logger
+	downloader.NoDirectCopy = opts.noDirect
+	if opts.maxRate != "" {
+		downloader.MaxRate, err = gribdownloader.ParseRate(opts.maxRate)
+		if err != nil {
+			return nil, withExitCode(exitConfig, err)
+		}
+	}
+
+	strict := config.Strict
+	if opts.strict && strict == "" {
+		strict = gribdownloader.StrictFail
+	}
+
+	return &environment{
+		config:     config,
+		datasets:   datasets,
+		downloader: downloader,
+		notifier:   newNotifier(config.Webhooks),
+		publisher:  newPublisher(config.Publish),
+		logger:     logger,
+		keepIdx:    opts.keepIdx,
+		strict:     strict,
+		uploads:    &uploaders{config: config, downloader: downloader, logger: logger},
+	}, nil
+}
+
+// forEachTarget calls fn for every target of the selected datasets, logging
+// failures. It returns an error if any target failed.
+func (env *environment) forEachTarget(ctx context.Context, fn func(dataset *gribdownloader.Dataset, target gribdownloader.Target, parser gribdownloader.IndexParser) error) error {
+	return env.forEachTargetParallel(ctx, 1, fn)
+}
+
+// forEachTargetParallel is like forEachTarget but calls fn for up to
+// parallel targets at once
+func (env *environment) forEachTargetParallel(ctx context.Context, parallel int, fn func(dataset *gribdownloader.Dataset, target gribdownloader.Target, parser gribdownloader.IndexParser) error) error {
+	return env.forEachResolved(ctx, env.resolveTargets(ctx), parallel, fn)
+}
+
+// resolvedTargets are the targets of a dataset, or why they could not be
+// resolved
+type resolvedTargets struct {
+	dataset *gribdownloader.Dataset
+	targets []gribdownloader.Target
+	parser  gribdownloader.IndexParser
+	err     error
+}
+
+// resolveTargets resolves the targets of the selected datasets, logging
+// failures. Resolving may probe for the latest cycle, so passes over the
+// same files share the result rather than resolving again.
+func (env *environment) resolveTargets(ctx context.Context) []resolvedTargets {
+	var resolved []resolvedTargets
+	for _, dataset := range env.datasets {
+		if ctx.Err() != nil {
+			break
+		}
+
+		r := resolvedTargets{dataset: dataset}
+		r.targets, r.err = dataset.Targets(ctx, env.downloader)
+		if r.err != nil {
+			slog.Error("could not resolve targets", "dataset", dataset.Name, "error", r.err)
+		} else if r.parser, r.err = gribdownloader.IndexParserFor(dataset.IndexFormat); r.err != nil {
+			slog.Error("invalid index format", "dataset", dataset.Name, "error", r.err)
+		}
+		resolved = append(resolved, r)
+	}
+	return resolved
+}
+
+// forEachResolved is forEachTargetParallel for targets resolved beforehand
+func (env *environment) forEachResolved(ctx context.Context, resolved []resolvedTargets, parallel int, fn func(dataset *gribdownloader.Dataset, target gribdownloader.Target, parser gribdownloader.IndexParser) error) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var wg sync.WaitGroup
+	var failed, notFound, total atomic.Int32
+	var unresolved, unresolvedNotFound int
+	sem := make(chan struct{}, parallel)
+
+	run := func(dataset *gribdownloader.Dataset, target gribdownloader.Target, parser gribdownloader.IndexParser) {
+		defer wg.Done()
+		defer func() { <-sem }()
+		if err := fn(dataset, target, parser); err != nil {
+			slog.Error("failed", "dataset", dataset.Name, "idx_url", target.IdxURL, "error", err)
+			failed.Add(1)
+			if errors.Is(err, gribdownloader.ErrNotFound) {
+				notFound.Add(1)
+			}
+		}
+	}
+
+	for _, r := range resolved {
+		if ctx.Err() != nil {
+			break
+		}
+		if r.err != nil {
+			unresolved++
+			if errors.Is(r.err, gribdownloader.ErrNotFound) {
+				unresolvedNotFound++
+			}
+			continue
+		}
+
+		for _, target := range r.targets {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			total.Add(1)
+			wg.Add(1)
+			go run(r.dataset, target, r.parser)
+		}
+	}
+
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if failed.Load() == 0 && unresolved == 0 {
+		return nil
+	}
+
+	// Datasets that could not be resolved have no files to count, so they
+	// are reported on their own
+	unpublished := notFound.Load() == failed.Load() && unresolvedNotFound == unresolved
+	var problems []string
+	if failed.Load() > 0 {
+		if unpublished {
+			problems = append(problems, fmt.Sprintf("%d of %d files are not published yet", failed.Load(), total.Load()))
+		} else {
+			problems = append(problems, fmt.Sprintf("%d of %d files failed", failed.Load(), total.Load()))
+		}
+	}
+	if unresolved > 0 {
+		if unpublished {
+			problems = append(problems, fmt.Sprintf("%d of %d datasets are not published yet", unresolved, len(resolved)))
+		} else {
+			problems = append(problems, fmt.Sprintf("could not resolve targets of %d of %d datasets", unresolved, len(resolved)))
+		}
+	}
+	if unpublished {
+		return withExitCode(exitNotPublished, errors.New(strings.Join(problems, ", ")))
+	}
+	return withExitCode(exitPartial, errors.New(strings.Join(problems, ", ")))
+}
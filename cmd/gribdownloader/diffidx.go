@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gribdownloader"
+)
+
+// idxField is a parameter and level of an idx file
+type idxField struct {
+	Parameter string `json:"parameter"`
+	Level     string `json:"level"`
+}
+
+// idxFieldTypes is a field of an idx file with the types of its records
+type idxFieldTypes struct {
+	idxField
+	Types []string `json:"types"` // With the extra fields, e.g. "anl:ENS=+05"
+}
+
+// idxChange is a field whose record types differ between two idx files
+type idxChange struct {
+	idxField
+	Old []string `json:"old"`
+	New []string `json:"new"`
+}
+
+// idxDiff is the difference between two idx files
+type idxDiff struct {
+	Old     string          `json:"old"`
+	New     string          `json:"new"`
+	Added   []idxFieldTypes `json:"added"`
+	Removed []idxFieldTypes `json:"removed"`
+	Changed []idxChange     `json:"changed"`
+}
+
+// empty reports whether the idx files hold the same fields and types
+func (d idxDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// idxFields groups the record types of an idx file by field, in the order
+// the fields first appear
+func idxFields(parameters []gribdownloader.GFSParameter) ([]idxField, map[idxField][]string) {
+	var order []idxField
+	types := map[idxField][]string{}
+	for _, p := range parameters {
+		field := idxField{Parameter: p.Parameter, Level: p.Level}
+		if _, ok := types[field]; !ok {
+			order = append(order, field)
+		}
+		t := strings.Join(append([]string{p.Type}, p.Extra...), ":")
+		if !slices.Contains(types[field], t) {
+			types[field] = append(types[field], t)
+		}
+	}
+	for _, t := range types {
+		slices.Sort(t)
+	}
+	return order, types
+}
+
+// diffIndex compares the records of two idx files by parameter and level:
+// fields only in the new file were added, fields only in the old one were
+// removed, and fields whose record types differ were changed
+func diffIndex(oldName string, older []gribdownloader.GFSParameter, newName string, newer []gribdownloader.GFSParameter) idxDiff {
+	d := idxDiff{Old: oldName, New: newName, Added: []idxFieldTypes{}, Removed: []idxFieldTypes{}, Changed: []idxChange{}}
+	oldOrder, oldTypes := idxFields(older)
+	newOrder, newTypes := idxFields(newer)
+	for _, field := range oldOrder {
+		newT, ok := newTypes[field]
+		switch {
+		case !ok:
+			d.Removed = append(d.Removed, idxFieldTypes{idxField: field, Types: oldTypes[field]})
+		case !slices.Equal(oldTypes[field], newT):
+			d.Changed = append(d.Changed, idxChange{idxField: field, Old: oldTypes[field], New: newT})
+		}
+	}
+	for _, field := range newOrder {
+		if _, ok := oldTypes[field]; !ok {
+			d.Added = append(d.Added, idxFieldTypes{idxField: field, Types: newTypes[field]})
+		}
+	}
+	return d
+}
+
+// printDiff writes a difference in the style of a unified diff
+func printDiff(d idxDiff) {
+	fmt.Printf("--- %s\n+++ %s\n", d.Old, d.New)
+	for _, f := range d.Removed {
+		fmt.Printf("- %s:%s (%s)\n", f.Parameter, f.Level, strings.Join(f.Types, ", "))
+	}
+	for _, f := range d.Added {
+		fmt.Printf("+ %s:%s (%s)\n", f.Parameter, f.Level, strings.Join(f.Types, ", "))
+	}
+	for _, f := range d.Changed {
+		fmt.Printf("~ %s:%s (%s -> %s)\n", f.Parameter, f.Level, strings.Join(f.Old, ", "), strings.Join(f.New, ", "))
+	}
+	if d.empty() {
+		fmt.Println("no differences")
+	}
+}
+
+// loadIndex reads an idx file of any format from a URL, fetched through the
+// downloader, or from a local path
+func loadIndex(ctx context.Context, downloader *gribdownloader.Downloader, source string, parser gribdownloader.IndexParser) ([]gribdownloader.GFSParameter, error) {
+	if strings.Contains(source, "://") {
+		return fetchIndex(ctx, downloader, gribdownloader.Target{IdxURL: source}, parser, false)
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("error opening idx file: %v", err)
+	}
+	defer f.Close()
+	parameters, err := parser.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", source, err)
+	}
+	return parameters, nil
+}
+
+// runDiffIdx implements the diff-idx command. It compares either two idx
+// files, given as URLs or paths, or the idx files of two cycles of the
+// datasets of a config file, forecast hour by forecast hour.
+func runDiffIdx(ctx context.Context, args []string) error {
+	fs, opts := newFlagSet("diff-idx")
+	from := fs.String("from", "", "old cycle as YYYYMMDDHH, comparing the idx files of a config file")
+	to := fs.String("to", "", "new cycle as YYYYMMDDHH (with --from)")
+	format := fs.String("index-format", gribdownloader.FormatAuto, "index format when comparing idx files")
+	asJSON := fs.Bool("json", false, "print the differences as JSON")
+	exitCode := fs.Bool("exit-code", false, "exit with status 1 if there are differences")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gribdownloader diff-idx [flags] <old-idx> <new-idx>")
+		fmt.Fprintln(fs.Output(), "       gribdownloader diff-idx [flags] --from YYYYMMDDHH --to YYYYMMDDHH config.json")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+	byCycle := *from != "" || *to != ""
+	if (byCycle && (fs.NArg() != 1 || *from == "" || *to == "")) || (!byCycle && fs.NArg() != 2) {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	logger, err := newLogger(opts.logLevel, opts.logFormat)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+
+	var diffs []idxDiff
+	if !byCycle {
+		parser, err := gribdownloader.IndexParserFor(*format)
+		if err != nil {
+			return err
+		}
+		downloader := &gribdownloader.Downloader{Logger: logger}
+		older, err := loadIndex(ctx, downloader, fs.Arg(0), parser)
+		if err != nil {
+			return err
+		}
+		newer, err := loadIndex(ctx, downloader, fs.Arg(1), parser)
+		if err != nil {
+			return err
+		}
+		diffs = append(diffs, diffIndex(fs.Arg(0), older, fs.Arg(1), newer))
+	} else {
+		oldRun, err := time.Parse("2006010215", *from)
+		if err != nil {
+			return withExitCode(exitUsage, fmt.Errorf("invalid --from %q: expected YYYYMMDDHH", *from))
+		}
+		newRun, err := time.Parse("2006010215", *to)
+		if err != nil {
+			return withExitCode(exitUsage, fmt.Errorf("invalid --to %q: expected YYYYMMDDHH", *to))
+		}
+		env, err := loadEnvironment(fs.Arg(0), opts, logger)
+		if err != nil {
+			return err
+		}
+
+		for _, dataset := range env.datasets {
+			if !dataset.UsesCycle() {
+				return fmt.Errorf("dataset %q: diff-idx --from requires {yyyymmdd} or {cycle} in idx_url", dataset.Name)
+			}
+			parser, err := gribdownloader.IndexParserFor(dataset.IndexFormat)
+			if err != nil {
+				return err
+			}
+			// The targets of both runs follow the same forecast hours
+			oldTargets, newTargets := dataset.TargetsForRun(oldRun), dataset.TargetsForRun(newRun)
+			for i := 0; i < min(len(oldTargets), len(newTargets)); i++ {
+				older, err := fetchIndex(ctx, env.downloader, oldTargets[i], parser, false)
+				if err != nil {
+					return fmt.Errorf("%s: %v", oldTargets[i].IdxURL, err)
+				}
+				newer, err := fetchIndex(ctx, env.downloader, newTargets[i], parser, false)
+				if err != nil {
+					return fmt.Errorf("%s: %v", newTargets[i].IdxURL, err)
+				}
+				diffs = append(diffs, diffIndex(oldTargets[i].IdxURL, older, newTargets[i].IdxURL, newer))
+			}
+		}
+	}
+
+	if *asJSON {
+		if err := printJSON(diffs); err != nil {
+			return err
+		}
+	} else {
+		for i, d := range diffs {
+			if i > 0 {
+				fmt.Println()
+			}
+			printDiff(d)
+		}
+	}
+
+	if *exitCode {
+		for _, d := range diffs {
+			if !d.empty() {
+				os.Exit(exitFailure)
+			}
+		}
+	}
+	return nil
+}
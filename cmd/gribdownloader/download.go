@@ -0,0 +1,670 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gribdownloader"
+)
+
+// downloadGRIB downloads the planned ranges and writes the manifest
+func downloadGRIB(ctx context.Context, env *environment, plan *filePlan) error {
+	downloader := env.downloader
+	doneFile := plan.gribFileName + ".done"
+	if env.config.DoneFile {
+		// A sentinel from an earlier run no longer describes the file
+		os.Remove(doneFile)
+	}
+
+	// Log the ranges
+	for i, r := range plan.ranges {
+		slog.Info("download range", "range", i+1, "start", r.Start, "end", r.End, "bytes", r.Size())
+	}
+	totalSize := plan.totalSize()
+	slog.Info("total download size", "ranges", len(plan.ranges), "bytes", totalSize,
+		"mb", fmt.Sprintf("%.2f", float64(totalSize)/(1024*1024)))
+
+	// Download the selected ranges
+	if err := os.MkdirAll(filepath.Dir(plan.gribFileName), 0755); err != nil {
+		return fmt.Errorf("error creating output directory: %v", err)
+	}
+	results, err := downloadRanges(ctx, env, plan)
+	var partial *gribdownloader.PartialError
+	if errors.As(err, &partial) {
+		err = keepPartial(env, plan, partial)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Record what was downloaded
+	manifest, err := gribdownloader.BuildManifest(plan.gribFileName, plan.gribURLs[0], plan.records, plan.ranges, downloader.OutputMode, results)
+	if err != nil {
+		return fmt.Errorf("error building manifest: %v", err)
+	}
+	manifest.AddMissing(plan.missing)
+
+	if plan.region != nil {
+		if err := subsetGRIB(plan, manifest); err != nil {
+			return err
+		}
+	}
+	if err := gribdownloader.WriteManifest(gribdownloader.ManifestPath(plan.gribFileName), manifest); err != nil {
+		return err
+	}
+
+	if env.converter != nil || env.kerchunk {
+		if err := convertGRIB(ctx, env, plan, manifest); err != nil {
+			return err
+		}
+	}
+
+	// Signal consumers that the file and its manifest are complete
+	if env.config.DoneFile {
+		if err := os.WriteFile(doneFile, nil, 0644); err != nil {
+			return fmt.Errorf("error writing done file: %v", err)
+		}
+	}
+
+	if len(env.config.PostHook) > 0 {
+		if err := runPostHook(ctx, env.config.PostHook, plan); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// refsOnly reports whether kerchunk references are the only output, so
+// that the messages need not be downloaded at all
+func (env *environment) refsOnly() bool {
+	return env.kerchunk && !env.keepGRIB && env.converter == nil
+}
+
+// writeRemoteRefs writes the kerchunk references of a plan, reading only
+// the headers of its messages from the remote file
+func writeRemoteRefs(ctx context.Context, env *environment, plan *filePlan) error {
+	doneFile := plan.gribFileName + ".done"
+	if env.config.DoneFile {
+		os.Remove(doneFile)
+	}
+	if err := os.MkdirAll(filepath.Dir(plan.gribFileName), 0755); err != nil {
+		return fmt.Errorf("error creating output directory: %v", err)
+	}
+
+	slog.Info("building kerchunk references", "file", plan.gribFileName, "records", len(plan.records))
+	refs, err := env.downloader.RemoteKerchunkRefs(ctx, plan.gribURLs, plan.records)
+	if err != nil {
+		return fmt.Errorf("error building kerchunk references: %v", err)
+	}
+	if err := gribdownloader.WriteKerchunkRefs(gribdownloader.KerchunkPath(plan.gribFileName), refs); err != nil {
+		return err
+	}
+
+	if env.config.DoneFile {
+		if err := os.WriteFile(doneFile, nil, 0644); err != nil {
+			return fmt.Errorf("error writing done file: %v", err)
+		}
+	}
+	if len(env.config.PostHook) > 0 {
+		if err := runPostHook(ctx, env.config.PostHook, plan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// existingOutput reports whether the output of a plan is already complete:
+// its manifest lists exactly the planned records with none missing, the GRIB
+// file is not truncated, and the requested conversions and done file exist.
+// When references are the only output, they and the done file suffice.
+func existingOutput(env *environment, plan *filePlan) bool {
+	if env.refsOnly() {
+		// No GRIB file or manifest is written, only the references
+		if _, err := os.Stat(gribdownloader.KerchunkPath(plan.gribFileName)); err != nil {
+			return false
+		}
+		if env.config.DoneFile {
+			if _, err := os.Stat(plan.gribFileName + ".done"); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+	manifest, err := gribdownloader.ReadManifest(gribdownloader.ManifestPath(plan.gribFileName))
+	if err != nil {
+		return false
+	}
+	region := ""
+	if plan.region != nil {
+		region = plan.region.String()
+	}
+	if manifest.Region != region || !manifest.Matches(plan.records) {
+		return false
+	}
+	info, err := os.Stat(plan.gribFileName)
+	if err != nil || info.Size() < manifest.MinSize() {
+		return false
+	}
+
+	var required []string
+	if env.converter != nil {
+		required = append(required, gribdownloader.NetCDFPath(plan.gribFileName))
+	}
+	if env.kerchunk {
+		required = append(required, gribdownloader.KerchunkPath(plan.gribFileName))
+	}
+	if env.config.DoneFile {
+		required = append(required, plan.gribFileName+".done")
+	}
+	for _, path := range required {
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// convertGRIB writes the NetCDF file and kerchunk references of a
+// downloaded GRIB file, removing the GRIB file and its manifest unless they
+// are kept alongside
+func convertGRIB(ctx context.Context, env *environment, plan *filePlan, manifest *gribdownloader.Manifest) error {
+	if env.converter != nil {
+		ncFile := gribdownloader.NetCDFPath(plan.gribFileName)
+		slog.Info("converting to NetCDF", "file", plan.gribFileName, "output", ncFile)
+		if err := env.converter.Convert(ctx, plan.gribFileName, ncFile); err != nil {
+			return fmt.Errorf("error converting to NetCDF: %v", err)
+		}
+	}
+	if env.kerchunk {
+		refs, err := gribdownloader.BuildKerchunkRefs(plan.gribFileName, manifest)
+		if err != nil {
+			return fmt.Errorf("error building kerchunk references: %v", err)
+		}
+		if err := gribdownloader.WriteKerchunkRefs(gribdownloader.KerchunkPath(plan.gribFileName), refs); err != nil {
+			return err
+		}
+	}
+	if env.keepGRIB {
+		return nil
+	}
+	for _, path := range []string{plan.gribFileName, gribdownloader.ManifestPath(plan.gribFileName)} {
+		if err := os.Remove(path); err != nil {
+			slog.Warn("could not remove GRIB output", "file", path, "error", err)
+		}
+	}
+	return nil
+}
+
+// outputFormats are the formats selected with the --to flag
+type outputFormats struct {
+	grib, netcdf, kerchunk bool
+}
+
+// parseFormats parses the --to flag
+func parseFormats(to string) (outputFormats, error) {
+	var formats outputFormats
+	for _, format := range strings.Split(to, ",") {
+		switch strings.TrimSpace(strings.ToLower(format)) {
+		case "grib":
+			formats.grib = true
+		case "netcdf":
+			formats.netcdf = true
+		case "kerchunk":
+			formats.kerchunk = true
+		default:
+			return formats, fmt.Errorf("invalid --to %q: expected a list of grib, netcdf and kerchunk", to)
+		}
+	}
+	return formats, nil
+}
+
+// downloadRanges downloads the planned ranges, or copies them from the
+// output cache when the same ranges were downloaded before
+func downloadRanges(ctx context.Context, env *environment, plan *filePlan) ([]gribdownloader.RangeResult, error) {
+	downloader := env.downloader
+	var cache *gribdownloader.OutputCache
+	var key string
+	if env.config.CacheDir != "" {
+		cache = &gribdownloader.OutputCache{Dir: env.config.CacheDir}
+		key = gribdownloader.CacheKey(plan.gribURLs[0], plan.ranges, downloader.OutputMode)
+		results, ok, err := cache.Load(key, plan.gribFileName)
+		if err != nil {
+			slog.Warn("could not use cached file", "file", plan.gribFileName, "error", err)
+		}
+		if ok {
+			slog.Info("copied GRIB data from cache", "file", plan.gribFileName, "key", key)
+			return results, nil
+		}
+	}
+
+	slog.Info("downloading GRIB data", "file", plan.gribFileName)
+	results, err := downloader.DownloadRangesFromMirrors(ctx, plan.gribURLs, plan.ranges, plan.gribFileName)
+	var partial *gribdownloader.PartialError
+	if errors.As(err, &partial) {
+		// Incomplete files are not worth caching
+		return results, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error downloading: %v", err)
+	}
+
+	if cache != nil {
+		if err := cache.Store(key, plan.gribFileName, plan.gribURLs[0], downloader.OutputMode, results); err != nil {
+			slog.Warn("could not cache downloaded file", "file", plan.gribFileName, "error", err)
+		}
+	}
+	return results, nil
+}
+
+// keepPartial decides whether a file with failed ranges is kept under
+// require_percent. A kept file is planned anew from the ranges that were
+// downloaded, with the lost records listed as missing.
+func keepPartial(env *environment, plan *filePlan, partial *gribdownloader.PartialError) error {
+	var kept, missing []gribdownloader.Record
+	for _, rec := range plan.records {
+		lost := false
+		for _, r := range partial.Failed {
+			if r.Contains(rec.Range.Start) {
+				lost = true
+				break
+			}
+		}
+		if lost {
+			missing = append(missing, rec)
+		} else {
+			kept = append(kept, rec)
+		}
+	}
+
+	percent := 100 * float64(len(kept)) / float64(len(plan.records))
+	if percent < env.config.RequirePercent {
+		os.Remove(plan.gribFileName)
+		return fmt.Errorf("error downloading: only %.1f%% of records downloaded, %g%% required: %v",
+			percent, env.config.RequirePercent, partial.Err)
+	}
+	slog.Warn("kept partial download", "file", plan.gribFileName, "records", len(kept),
+		"missing", len(missing), "error", partial.Err)
+
+	var ranges []gribdownloader.RangeDownload
+	for _, r := range plan.ranges {
+		if !slices.Contains(partial.Failed, r) {
+			ranges = append(ranges, r)
+		}
+	}
+	plan.records, plan.ranges, plan.missing = kept, ranges, missing
+	return nil
+}
+
+// subsetGRIB cuts the downloaded messages down to the region of the plan and
+// updates the manifest to match
+func subsetGRIB(plan *filePlan, manifest *gribdownloader.Manifest) error {
+	before, _ := os.Stat(plan.gribFileName)
+	results, err := gribdownloader.SubsetFile(plan.gribFileName, *plan.region)
+	if err != nil {
+		return fmt.Errorf("error subsetting: %v", err)
+	}
+	for _, result := range results {
+		if result.Skipped != nil {
+			slog.Warn("message kept whole", "file", plan.gribFileName, "offset", result.Offset, "reason", result.Skipped)
+		}
+	}
+	if err := manifest.ApplySubset(plan.gribFileName, *plan.region, results); err != nil {
+		return fmt.Errorf("error updating manifest: %v", err)
+	}
+
+	if after, err := os.Stat(plan.gribFileName); err == nil && before != nil {
+		slog.Info("subset to region", "file", plan.gribFileName, "region", plan.region.String(),
+			"bytes_before", before.Size(), "bytes_after", after.Size())
+	}
+	return nil
+}
+
+// idxPrefetchParallel is the number of idx files fetched at once when a
+// download is planned up front
+const idxPrefetchParallel = 8
+
+// planKey identifies the plan of a target of a dataset
+func planKey(dataset *gribdownloader.Dataset, target gribdownloader.Target) string {
+	return dataset.Name + "\x00" + target.Key()
+}
+
+// prefetchPlans fetches and parses the idx files of every target
+// concurrently, and reports the size of the whole download before any GRIB
+// data is transferred. Targets that cannot be planned are left out and
+// planned again when they are downloaded.
+func prefetchPlans(ctx context.Context, env *environment, resolved []resolvedTargets) map[string]*filePlan {
+	plans := map[string]*filePlan{}
+	var mutex sync.Mutex
+	var records int
+	var totalBytes int64
+	env.forEachResolved(ctx, resolved, idxPrefetchParallel, func(dataset *gribdownloader.Dataset, target gribdownloader.Target, parser gribdownloader.IndexParser) error {
+		plan, err := planTarget(ctx, env, target, parser, dataset.SelectionFor(target))
+		if errors.Is(err, gribdownloader.ErrNotFound) && !env.waitUntil.IsZero() {
+			slog.Info("idx file not published yet", "dataset", dataset.Name, "idx_url", target.IdxURL)
+			return nil
+		}
+		if err != nil {
+			slog.Warn("could not plan file", "dataset", dataset.Name, "idx_url", target.IdxURL, "error", err)
+			return nil
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		plans[planKey(dataset, target)] = plan
+		records += len(plan.records)
+		totalBytes += plan.totalSize()
+		return nil
+	})
+
+	slog.Info("download plan", "files", len(plans), "records", records, "bytes", totalBytes,
+		"mb", fmt.Sprintf("%.2f", float64(totalBytes)/(1024*1024)))
+	return plans
+}
+
+// downloadAll plans every target up front and then downloads up to parallel
+// files at once
+func downloadAll(ctx context.Context, env *environment, parallel int) error {
+	// Both passes use the same targets, so that the files downloaded are
+	// those just planned even when a newer cycle appears in between
+	resolved := env.resolveTargets(ctx)
+	plans := prefetchPlans(ctx, env, resolved)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	budget := newBudget(env.config)
+	if err := checkBudget(env, budget, plans); err != nil {
+		return err
+	}
+	if env.checkSpace {
+		if err := checkFreeSpace(env, plans); err != nil {
+			return err
+		}
+	}
+	return env.forEachResolved(ctx, resolved, parallel, downloadTarget(ctx, env, plans, budget))
+}
+
+// waitPublished polls until the idx file of a target is published, for as
+// long as --wait allows. Without --wait it returns at once.
+func waitPublished(ctx context.Context, env *environment, target gribdownloader.Target) error {
+	if env.waitUntil.IsZero() {
+		return nil
+	}
+	for {
+		ok, err := idxExists(ctx, env.downloader, target.IdxURLs())
+		if err != nil {
+			slog.Warn("could not probe idx file", "idx_url", target.IdxURL, "error", err)
+		}
+		if ok {
+			return nil
+		}
+
+		remaining := time.Until(env.waitUntil)
+		if remaining <= 0 {
+			return fmt.Errorf("idx file was not published before the wait timeout: %w", gribdownloader.ErrNotFound)
+		}
+		slog.Info("waiting for idx file", "idx_url", target.IdxURL, "remaining", remaining.Round(time.Second))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(min(env.waitInterval, remaining)):
+		}
+	}
+}
+
+// downloadTarget returns a forEachTarget callback that plans and downloads
+// each target, notifying the webhooks of its progress. Targets found in
+// plans are not planned again, and every download is counted against the
+// budget.
+func downloadTarget(ctx context.Context, env *environment, plans map[string]*filePlan, budget *budget) func(*gribdownloader.Dataset, gribdownloader.Target, gribdownloader.IndexParser) error {
+	return func(dataset *gribdownloader.Dataset, target gribdownloader.Target, parser gribdownloader.IndexParser) error {
+		start := time.Now()
+		env.notifier.send(ctx, newWebhookEvent("start", target))
+
+		var err error
+		stages := stageTimes{}
+		stageStart := start
+		plan := plans[planKey(dataset, target)]
+		if plan == nil {
+			err = waitPublished(ctx, env, target)
+			stageStart = stages.since("wait", stageStart)
+			if err == nil {
+				plan, err = planTarget(ctx, env, target, parser, dataset.SelectionFor(target))
+				stageStart = stages.since("plan", stageStart)
+			}
+		}
+		skipped := false
+		if err == nil {
+			plan.region = dataset.SubsetRegion()
+			if env.skipExisting && existingOutput(env, plan) {
+				slog.Info("skipping existing file", "file", plan.gribFileName, "records", len(plan.records))
+				skipped = true
+			} else if err = budget.take(plan); err == nil {
+				if env.refsOnly() {
+					err = writeRemoteRefs(ctx, env, plan)
+				} else {
+					err = downloadGRIB(ctx, env, plan)
+				}
+				stageStart = stages.since("download", stageStart)
+			}
+		}
+		if err == nil && !skipped {
+			files := outputFiles(env.keepIdx, target, plan.gribFileName)
+			err = deliverFiles(ctx, env, dataset, target, files)
+			stageStart = stages.since("deliver", stageStart)
+			if err == nil {
+				// Combining needs the staged files, which it removes itself
+				err = uploadFiles(ctx, env, dataset, files, env.combined != nil)
+				stages.since("upload", stageStart)
+			}
+		}
+
+		event := newWebhookEvent("success", target)
+		event.Duration = time.Since(start).Seconds()
+		if plan != nil {
+			event.Records = len(plan.records)
+			event.Missing = len(plan.missing)
+			event.Ranges = len(plan.ranges)
+			event.Bytes = plan.totalSize()
+		}
+		if skipped {
+			event.Event = "skipped"
+			event.Ranges, event.Bytes = 0, 0
+		}
+		if err != nil {
+			event.Event = "failure"
+			event.Error = err.Error()
+		}
+		env.metrics.observeFile(target, time.Since(start), err)
+		env.events.add(event)
+		env.stats.add(dataset, target, plan, stages, skipped, err)
+		env.combined.add(dataset, target, err)
+
+		// Report the outcome even when the run is being cancelled
+		env.notifier.send(context.WithoutCancel(ctx), event)
+		if err == nil && !skipped {
+			env.publisher.publish(context.WithoutCancel(ctx), newReadyEvent(plan))
+		}
+
+		return err
+	}
+}
+
+// streamTargets writes the selected messages of every target to w in record
+// order, without creating any files unless --keep-idx is given
+func streamTargets(ctx context.Context, env *environment, w io.Writer, showProgress bool) error {
+	if showProgress && isTerminal(os.Stderr) {
+		env.downloader.Progress = progressPrinter(os.Stderr)
+	}
+	budget := newBudget(env.config)
+
+	err := env.forEachTarget(ctx, func(dataset *gribdownloader.Dataset, target gribdownloader.Target, parser gribdownloader.IndexParser) error {
+		if dataset.Region != nil {
+			return fmt.Errorf("region subsetting is not available when streaming to stdout")
+		}
+
+		if err := waitPublished(ctx, env, target); err != nil {
+			return err
+		}
+		plan, err := planTarget(ctx, env, target, parser, dataset.SelectionFor(target))
+		if err != nil {
+			return err
+		}
+		if err := budget.take(plan); err != nil {
+			return err
+		}
+
+		// Records in index order, each written whole
+		ranges := make([]gribdownloader.RangeDownload, len(plan.records))
+		for i, rec := range plan.records {
+			ranges[i] = rec.Range
+		}
+
+		slog.Info("streaming GRIB data", "url", plan.gribURLs[0], "records", len(ranges))
+		if _, err := env.downloader.StreamRanges(ctx, plan.gribURLs, ranges, w); err != nil {
+			return fmt.Errorf("error streaming: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("stream completed successfully")
+	return nil
+}
+
+// runDownload implements the download command
+func runDownload(ctx context.Context, args []string) error {
+	fs, opts := newFlagSet("download")
+	quiet := fs.Bool("quiet", false, "suppress the progress display")
+	restart := fs.Bool("restart", false, "ignore state left by an interrupted run and download everything again")
+	dryRun := fs.Bool("dry-run", false, "show the matched records and ranges without downloading GRIB data")
+	asJSON := fs.Bool("json", false, "print the plan (with --dry-run) or the outcome of every file as JSON")
+	output := fs.String("output", "", "write the GRIB messages to stdout instead of files when set to \"-\"")
+	to := fs.String("to", "grib", "comma-separated output formats: grib, netcdf (converted) and kerchunk (references to the remote messages); without grib the GRIB file is removed, and kerchunk alone downloads only the message headers")
+	combine := fs.Bool("combine", false, "also append the forecast hours of each cycle, in order, into one file named by combined_filename")
+	parallel := fs.Int("parallel-files", 0, "number of files to download at once (default max_files from the config, or 1)")
+	wait := fs.Bool("wait", false, "poll for idx files that are not published yet instead of failing")
+	waitTimeout := fs.Duration("wait-timeout", time.Hour, "give up waiting for idx files after this long (with --wait)")
+	waitInterval := fs.Duration("wait-interval", time.Minute, "time between polls for unpublished idx files (with --wait)")
+	noSpaceCheck := fs.Bool("no-space-check", false, "skip checking that there is enough free disk space before downloading")
+	skipExisting := fs.Bool("skip-existing", false, "skip files whose output and manifest already hold the selected records, so that a failed batch can be re-run")
+	report := fs.String("report", "", "write a summary of the run per dataset as JSON to this file, and as text next to it with .txt")
+
+	env, err := setup(fs, opts, args)
+	if err != nil {
+		return err
+	}
+
+	// download_timeout was checked by Validate
+	timeout, _ := time.ParseDuration(env.config.DownloadTimeout)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if *dryRun {
+		return showPlans(ctx, env, *asJSON)
+	}
+
+	if *wait {
+		if *waitTimeout <= 0 || *waitInterval <= 0 {
+			return fmt.Errorf("--wait-timeout and --wait-interval must be positive")
+		}
+		env.waitUntil = time.Now().Add(*waitTimeout)
+		env.waitInterval = *waitInterval
+	}
+
+	if *output != "" && *output != "-" {
+		return fmt.Errorf("--output only accepts \"-\" (stdout); use output_dir and filename to name files")
+	}
+	if *output == "-" {
+		if *asJSON || *combine || *to != "grib" {
+			return fmt.Errorf("--json, --combine and --to cannot be used with --output -")
+		}
+		return streamTargets(ctx, env, os.Stdout, !*quiet)
+	}
+
+	if *parallel <= 0 {
+		*parallel = env.config.MaxFiles
+	}
+
+	formats, err := parseFormats(*to)
+	if err != nil {
+		return err
+	}
+	if !formats.grib && *combine {
+		return fmt.Errorf("--combine needs the GRIB files; add grib to --to")
+	}
+	if formats.netcdf {
+		// The converter was checked by Validate
+		env.converter, _ = gribdownloader.NetCDFConverter(env.config.Converter, env.config.ConverterCommand)
+	}
+	if formats.kerchunk {
+		// References point at whole messages of the remote files
+		for _, dataset := range env.datasets {
+			if dataset.Region != nil {
+				return fmt.Errorf("--to kerchunk cannot be used with a region, as the references point at the unsubset remote messages")
+			}
+		}
+	}
+	env.kerchunk = formats.kerchunk
+	env.keepGRIB = formats.grib
+	env.checkSpace = !*noSpaceCheck
+	env.skipExisting = *skipExisting
+	env.askBudget = isTerminal(os.Stdin) && isTerminal(os.Stderr)
+
+	// A single progress line cannot show several files at once
+	env.downloader.Resume = !*restart
+	if !*quiet && *parallel <= 1 && isTerminal(os.Stderr) {
+		env.downloader.Progress = progressPrinter(os.Stderr)
+	}
+
+	start := time.Now()
+	if *asJSON {
+		env.events = &eventLog{}
+	}
+	if *combine {
+		env.combined = &combiner{keepIdx: env.keepIdx}
+	}
+	if *report != "" {
+		env.stats = newRunStats(env.downloader)
+	}
+	err = downloadAll(ctx, env, *parallel)
+	if *combine && ctx.Err() == nil {
+		// Failures are logged as they happen, so the first error suffices
+		if combineErr := env.combined.combine(ctx, env); err == nil {
+			err = combineErr
+		}
+	}
+	if *asJSON {
+		if jsonErr := printJSON(env.events.report(time.Since(start), err)); jsonErr != nil {
+			return jsonErr
+		}
+	}
+	if *report != "" {
+		if reportErr := writeReport(*report, env.stats.report(err)); reportErr != nil {
+			return reportErr
+		}
+		slog.Info("wrote report", "json", *report, "text", textReportPath(*report))
+	}
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() != nil {
+		return fmt.Errorf("download_timeout of %v exceeded, re-run to resume: %w", timeout, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.Info("download completed successfully")
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import "errors"
+
+// Exit codes, so that wrapping scripts can tell failures apart and retry
+// only those worth retrying
+const (
+	exitFailure      = 1 // Any other error
+	exitUsage        = 2 // Invalid command line, as used by the flag package
+	exitConfig       = 3 // The configuration is invalid
+	exitNotPublished = 4 // Every failed file is not published (yet)
+	exitPartial      = 5 // Some files failed to download
+	exitVerify       = 6 // Downloaded files do not match their manifests
+	exitNoSpace      = 7 // Not enough free disk space for the planned files
+	exitBudget       = 8 // The planned download exceeds max_total_bytes or max_requests
+)
+
+// exitCodes describes the exit codes for the usage message
+var exitCodes = []struct {
+	code        int
+	description string
+}{
+	{0, "success"},
+	{exitFailure, "other error"},
+	{exitUsage, "invalid command line"},
+	{exitConfig, "invalid configuration"},
+	{exitNotPublished, "idx files not published yet; retry later"},
+	{exitPartial, "some files failed to download"},
+	{exitVerify, "verification failed"},
+	{exitNoSpace, "not enough free disk space"},
+	{exitBudget, "planned download exceeds max_total_bytes or max_requests"},
+}
+
+// exitError is an error that selects the exit code of the program
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// withExitCode attaches an exit code to a non-nil error
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+// exitCode returns the exit code for an error returned by a command
+func exitCode(err error) int {
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return exitFailure
+}
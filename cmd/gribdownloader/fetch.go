@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gribdownloader"
+)
+
+// filePlan describes what will be downloaded for a single target
+type filePlan struct {
+	target       gribdownloader.Target
+	gribURLs     []string
+	gribFileName string
+	parameters   []gribdownloader.GFSParameter
+	records      []gribdownloader.Record
+	ranges       []gribdownloader.RangeDownload
+	region       *gribdownloader.Region  // Region to cut the messages down to
+	missing      []gribdownloader.Record // Records lost with failed ranges
+}
+
+// totalSize returns the number of bytes covered by the planned ranges
+func (p *filePlan) totalSize() int64 {
+	var total int64
+	for _, r := range p.ranges {
+		total += r.Size()
+	}
+	return total
+}
+
+// fetchIdx fetches the idx file from the first mirror that serves it
+func fetchIdx(ctx context.Context, downloader *gribdownloader.Downloader, idxURLs []string) ([]byte, error) {
+	var errs []error
+	for _, idxURL := range idxURLs {
+		data, err := downloader.Fetch(ctx, idxURL)
+		if err == nil {
+			return data, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		slog.Warn("idx download failed", "url", idxURL, "error", err)
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("all mirrors failed: %v", errs)
+}
+
+// contentLength returns the GRIB file size reported by the first mirror that answers
+func contentLength(ctx context.Context, downloader *gribdownloader.Downloader, gribURLs []string) (int64, error) {
+	var errs []error
+	for _, gribURL := range gribURLs {
+		size, err := downloader.ContentLength(ctx, gribURL)
+		if err == nil {
+			return size, nil
+		}
+		errs = append(errs, err)
+	}
+	return 0, fmt.Errorf("all mirrors failed: %v", errs)
+}
+
+// sizeLastMessage returns a copy of the records of an idx file with the
+// length of the last message set, read from section 0 on the first mirror
+// that serves it, for when the size of the GRIB file is unknown. The
+// records given may be shared through the idx cache and are left alone.
+func sizeLastMessage(ctx context.Context, downloader *gribdownloader.Downloader, gribURLs []string, parameters []gribdownloader.GFSParameter) ([]gribdownloader.GFSParameter, error) {
+	var last int64
+	for _, p := range parameters {
+		last = max(last, p.Offset)
+	}
+	var errs []error
+	for _, gribURL := range gribURLs {
+		length, err := downloader.MessageLength(ctx, gribURL, last)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sized := slices.Clone(parameters)
+		for i := range sized {
+			if sized[i].Offset == last {
+				sized[i].Length = length
+			}
+		}
+		return sized, nil
+	}
+	return nil, fmt.Errorf("all mirrors failed: %v", errs)
+}
+
+// outputPath returns the local GRIB path of a target, defaulting to the file
+// name from the URL in the working directory
+func outputPath(target gribdownloader.Target) string {
+	if target.Output != "" {
+		return target.Output
+	}
+	return filepath.Base(gribdownloader.GribURL(target.IdxURL))
+}
+
+// fetchIndex downloads and parses the idx file of a target in memory, from
+// the first mirror that serves it. With keepIdx the idx file is also saved
+// next to the GRIB output. The file of a per-field target, which has no idx
+// file, is described as a single record instead.
+func fetchIndex(ctx context.Context, downloader *gribdownloader.Downloader, target gribdownloader.Target, parser gribdownloader.IndexParser, keepIdx bool) ([]gribdownloader.GFSParameter, error) {
+	if target.Field {
+		slog.Info("probing field file", "url", target.IdxURL)
+		return downloader.FieldIndex(ctx, target)
+	}
+	slog.Info("downloading idx file", "url", target.IdxURL)
+	var parameters []gribdownloader.GFSParameter
+	var data []byte
+	var errs []error
+	notFound := 0
+	for _, idxURL := range target.IdxURLs() {
+		var err error
+		parameters, data, err = downloader.FetchIndex(ctx, idxURL, parser)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		slog.Warn("idx download failed", "url", idxURL, "error", err)
+		errs = append(errs, err)
+		if errors.Is(err, gribdownloader.ErrNotFound) {
+			notFound++
+		}
+	}
+	if data == nil && notFound == len(errs) {
+		return nil, fmt.Errorf("idx file is not published on any mirror: %w", gribdownloader.ErrNotFound)
+	}
+	if data == nil {
+		return nil, fmt.Errorf("error downloading idx file: all mirrors failed: %v", errs)
+	}
+
+	if keepIdx {
+		dir := filepath.Dir(outputPath(target))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("error creating output directory: %v", err)
+		}
+		idxFileName := filepath.Join(dir, filepath.Base(target.IdxURL))
+		if err := os.WriteFile(idxFileName, data, 0644); err != nil {
+			return nil, fmt.Errorf("error saving idx file: %v", err)
+		}
+	}
+
+	return parameters, nil
+}
+
+// checkUnmatched warns about or fails, as strict says, the parts of the
+// selection that match none of the records of an idx file
+func checkUnmatched(strict gribdownloader.StrictMode, target gribdownloader.Target, selection gribdownloader.Selection, parameters []gribdownloader.GFSParameter) error {
+	if strict == "" {
+		return nil
+	}
+	unmatched, err := selection.Unmatched(parameters)
+	if err != nil {
+		return fmt.Errorf("error selecting records: %v", err)
+	}
+	if len(unmatched) == 0 {
+		return nil
+	}
+	if strict == gribdownloader.StrictFail {
+		return fmt.Errorf("matched no record of %s: %s", target.IdxURL, strings.Join(unmatched, ", "))
+	}
+	for _, u := range unmatched {
+		slog.Warn("matched no record", "idx_url", target.IdxURL, "selection", u)
+	}
+	return nil
+}
+
+// planTarget fetches the idx file of a target and works out the ranges to download
+func planTarget(ctx context.Context, env *environment, target gribdownloader.Target, parser gribdownloader.IndexParser, selection gribdownloader.Selection) (*filePlan, error) {
+	downloader := env.downloader
+
+	// Derive the GRIB URLs from the idx URLs
+	idxURLs := target.IdxURLs()
+	plan := &filePlan{
+		target:   target,
+		gribURLs: make([]string, len(idxURLs)),
+	}
+	for i, idxURL := range idxURLs {
+		plan.gribURLs[i] = gribdownloader.GribURL(idxURL)
+	}
+	plan.gribFileName = outputPath(target)
+
+	var err error
+	plan.parameters, err = fetchIndex(ctx, downloader, target, parser, env.keepIdx)
+	if err != nil {
+		return nil, err
+	}
+	if target.Field {
+		// The file holds just the field, which is downloaded whole
+		all := gribdownloader.SelectorFunc(func(gribdownloader.GFSParameter) bool { return true })
+		plan.records, err = gribdownloader.SelectRecordsBy(plan.parameters, all, 0)
+		if err != nil {
+			return nil, fmt.Errorf("error selecting records: %v", err)
+		}
+		plan.ranges = gribdownloader.MergeRanges(plan.records)
+		return plan, nil
+	}
+	if err := checkUnmatched(env.strict, target, selection, plan.parameters); err != nil {
+		return nil, err
+	}
+
+	// Select the records and generate download ranges. The size of the GRIB
+	// file is only needed when the last record is selected and its end is
+	// not given by the index.
+	plan.records, err = gribdownloader.SelectRecords(plan.parameters, selection, 0)
+	if errors.Is(err, gribdownloader.ErrUnknownEnd) {
+		var fileSize int64
+		fileSize, err = contentLength(ctx, downloader, plan.gribURLs)
+		if err == nil {
+			plan.records, err = gribdownloader.SelectRecords(plan.parameters, selection, fileSize)
+		} else {
+			slog.Warn("could not determine GRIB file size", "error", err)
+			plan.parameters, err = sizeLastMessage(ctx, downloader, plan.gribURLs, plan.parameters)
+			if err != nil {
+				return nil, fmt.Errorf("error sizing the last record: %v", err)
+			}
+			plan.records, err = gribdownloader.SelectRecords(plan.parameters, selection, 0)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error selecting records: %v", err)
+	}
+	plan.ranges = gribdownloader.MergeRanges(plan.records)
+
+	return plan, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+
+	"gribdownloader"
+)
+
+// hookVars returns the placeholders available to the post hook for a
+// downloaded file
+func hookVars(plan *filePlan) map[string]string {
+	return map[string]string{
+		"output":   plan.gribFileName,
+		"manifest": gribdownloader.ManifestPath(plan.gribFileName),
+		"dataset":  plan.target.Dataset,
+		"idx_url":  plan.target.IdxURL,
+		"grib_url": plan.gribURLs[0],
+		"date":     plan.target.Vars["yyyymmdd"],
+		"cycle":    plan.target.Vars["cycle"],
+		"fhr":      plan.target.Vars["fhr"],
+		"member":   plan.target.Vars["member"],
+		"netcdf":   gribdownloader.NetCDFPath(plan.gribFileName),
+		"kerchunk": gribdownloader.KerchunkPath(plan.gribFileName),
+	}
+}
+
+// runPostHook runs the configured post hook for a downloaded file. Each
+// argument is expanded with the hook variables, which are also passed in the
+// environment as GRIBDL_<NAME>. The command's output goes to stderr so that
+// stdout stays free for the tool's own output.
+func runPostHook(ctx context.Context, hook []string, plan *filePlan) error {
+	vars := hookVars(plan)
+	args := make([]string, len(hook))
+	for i, arg := range hook {
+		args[i] = gribdownloader.ExpandTemplate(arg, vars)
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	for name, value := range vars {
+		cmd.Env = append(cmd.Env, "GRIBDL_"+strings.ToUpper(name)+"="+value)
+	}
+
+	slog.Info("running post hook", "file", plan.gribFileName, "command", args)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("post hook failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gribdownloader"
+)
+
+// readIndex reads and parses an idx file from a local path or URL
+func readIndex(ctx context.Context, source string) ([]gribdownloader.GFSParameter, error) {
+	if !strings.Contains(source, "://") {
+		return gribdownloader.ParseIDXFile(source)
+	}
+	data, err := (&gribdownloader.Downloader{}).Fetch(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading idx file: %v", err)
+	}
+	return gribdownloader.ParseIndex(data, gribdownloader.NCEPParser{})
+}
+
+// compareIndex reports the records of the generated index that differ from
+// upstream and returns how many do
+func compareIndex(generated, upstream []gribdownloader.GFSParameter) int {
+	differences := 0
+	for i := 0; i < max(len(generated), len(upstream)); i++ {
+		switch {
+		case i >= len(upstream):
+			fmt.Fprintf(os.Stderr, "record %d: only in the GRIB file (offset %d %s:%s)\n", i+1, generated[i].Offset, generated[i].Parameter, generated[i].Level)
+		case i >= len(generated):
+			fmt.Fprintf(os.Stderr, "record %d: only upstream (offset %d %s:%s)\n", i+1, upstream[i].Offset, upstream[i].Parameter, upstream[i].Level)
+		default:
+			g, u := generated[i], upstream[i]
+			if g.Offset == u.Offset && g.Parameter == u.Parameter && g.Level == u.Level {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "record %d: offset %d %s:%s, upstream has offset %d %s:%s\n",
+				i+1, g.Offset, g.Parameter, g.Level, u.Offset, u.Parameter, u.Level)
+		}
+		differences++
+	}
+	return differences
+}
+
+// runIndex implements the index command
+func runIndex(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	output := fs.String("output", "", "write the idx file to this path instead of stdout")
+	compare := fs.String("compare", "", "compare the generated index with an upstream idx file (path or URL)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gribdownloader index [flags] file.grib2")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("error opening GRIB file: %v", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading GRIB file: %v", err)
+	}
+
+	messages, err := gribdownloader.ReadMessageInfo(file, info.Size())
+	if err != nil {
+		return err
+	}
+	var idx bytes.Buffer
+	if err := gribdownloader.WriteIndex(&idx, messages); err != nil {
+		return err
+	}
+
+	if *compare != "" {
+		generated, err := gribdownloader.ParseIDX(bytes.NewReader(idx.Bytes()))
+		if err != nil {
+			return err
+		}
+		upstream, err := readIndex(ctx, *compare)
+		if err != nil {
+			return err
+		}
+		if n := compareIndex(generated, upstream); n > 0 {
+			return fmt.Errorf("%d records differ from %s", n, *compare)
+		}
+		fmt.Fprintf(os.Stderr, "%d records match %s\n", len(generated), *compare)
+		return nil
+	}
+
+	if *output != "" {
+		if err := os.WriteFile(*output, idx.Bytes(), 0644); err != nil {
+			return fmt.Errorf("error writing idx file: %v", err)
+		}
+		return nil
+	}
+	_, err = io.Copy(os.Stdout, &idx)
+	return err
+}
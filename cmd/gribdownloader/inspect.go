@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"gribdownloader"
+)
+
+// inspectedFile is the JSON output of the inspect command for one file
+type inspectedFile struct {
+	File     string                       `json:"file"`
+	Messages []gribdownloader.MessageInfo `json:"messages"`
+}
+
+// idxLabel returns the idx description of the record at offset from the
+// manifest, if there is one
+func idxLabel(manifest *gribdownloader.Manifest, offset int64) (gribdownloader.ManifestMessage, bool) {
+	if manifest != nil {
+		for _, msg := range manifest.Messages {
+			if offset >= msg.Offset && offset < msg.Offset+msg.Length {
+				return msg, true
+			}
+		}
+	}
+	return gribdownloader.ManifestMessage{}, false
+}
+
+// idxHasParameter reports whether the manifest record, or any field of its
+// message, is the given parameter
+func idxHasParameter(rec gribdownloader.ManifestMessage, parameter string) bool {
+	if rec.Parameter == parameter {
+		return true
+	}
+	for _, field := range rec.Fields {
+		if strings.HasPrefix(field, parameter+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// inspectFile prints the metadata of the messages in a GRIB file. With a
+// manifest next to the file the idx description of each message is shown
+// too, and it returns the number of messages whose parameter disagrees.
+func inspectFile(path string, w *tabwriter.Writer) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("error opening GRIB file: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error reading GRIB file: %v", err)
+	}
+	messages, err := gribdownloader.ReadMessageInfo(file, info.Size())
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", path, err)
+	}
+	manifest, _ := gribdownloader.ReadManifest(gribdownloader.ManifestPath(path))
+
+	mismatches := 0
+	fmt.Fprintf(w, "%s\n", path)
+	fmt.Fprintln(w, "OFFSET\tPARAMETER\tLEVEL\tFORECAST\tREFERENCE\tGRID\tIDX")
+	for _, msg := range messages {
+		label := ""
+		rec, ok := idxLabel(manifest, msg.Offset)
+		if ok {
+			label = rec.Parameter + ":" + rec.Level
+		}
+		if msg.Edition != 2 {
+			fmt.Fprintf(w, "%d\tGRIB%d\t\t\t\t\t%s\n", msg.Offset, msg.Edition, label)
+			continue
+		}
+		for _, f := range msg.Fields {
+			// Only known abbreviations can be compared with the idx
+			note := label
+			if ok && !strings.Contains(f.Parameter, ".") && !idxHasParameter(rec, f.Parameter) {
+				mismatches++
+				note += " (mismatch)"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", msg.Offset, f.Parameter, f.Level, f.ForecastTime,
+				msg.ReferenceTime.Format("2006-01-02T15:04Z"), f.Grid, note)
+		}
+	}
+	return mismatches, nil
+}
+
+// runInspect implements the inspect command
+func runInspect(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the message metadata as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gribdownloader inspect [flags] file.grib2...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if *asJSON {
+		var files []inspectedFile
+		for _, path := range fs.Args() {
+			file, err := os.Open(path)
+			if err != nil {
+				return fmt.Errorf("error opening GRIB file: %v", err)
+			}
+			info, err := file.Stat()
+			if err == nil {
+				var messages []gribdownloader.MessageInfo
+				messages, err = gribdownloader.ReadMessageInfo(file, info.Size())
+				files = append(files, inspectedFile{File: path, Messages: messages})
+			}
+			file.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+		}
+		return printJSON(files)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	mismatches := 0
+	for _, path := range fs.Args() {
+		n, err := inspectFile(path, w)
+		if err != nil {
+			w.Flush()
+			return err
+		}
+		mismatches += n
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("%d messages do not match the parameter given by the idx file", mismatches)
+	}
+	return nil
+}
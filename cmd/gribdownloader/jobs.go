@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"gribdownloader"
+)
+
+// jobRun formats the run requested by a job, e.g. 2024111206
+func jobRun(j *job) string {
+	if j.Request.Date == "" && j.Request.Cycle == "" {
+		return "-"
+	}
+	return j.Request.Date + j.Request.Cycle
+}
+
+// jobDuration formats how long a job ran, or "-" if it has not started
+func jobDuration(j *job) string {
+	if j.Started == nil {
+		return "-"
+	}
+	end := time.Now()
+	if j.Finished != nil {
+		end = *j.Finished
+	}
+	return end.Sub(*j.Started).Round(time.Second).String()
+}
+
+// runJobs implements the jobs command
+func runJobs(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("jobs", flag.ExitOnError)
+	file := fs.String("file", "", "jobs file (default jobs_file from the config file)")
+	status := fs.String("status", "", "only list the jobs with this status, e.g. failed")
+	kind := fs.String("kind", "", "only list the jobs of this kind: download or watch")
+	limit := fs.Int("limit", 0, "only list this many of the newest jobs; 0 lists all")
+	asJSON := fs.Bool("json", false, "print the jobs as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gribdownloader jobs [flags] [--file FILE | config.json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if (*file == "") == (fs.NArg() == 0) || fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if *file == "" {
+		config, err := gribdownloader.ReadConfig(fs.Arg(0))
+		if err != nil {
+			return withExitCode(exitConfig, err)
+		}
+		if config.JobsFile == "" {
+			return withExitCode(exitConfig, fmt.Errorf("%s does not set jobs_file", fs.Arg(0)))
+		}
+		*file = config.JobsFile
+	}
+
+	store, err := openJobStore(*file)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	jobs, err := store.filterJobs(jobFilter{status: *status, kind: *kind, limit: *limit})
+	if err != nil {
+		return err
+	}
+	if jobs == nil {
+		jobs = []*job{}
+	}
+
+	if *asJSON {
+		return printJSON(jobs)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tSTATUS\tDATASET\tRUN\tATTEMPTS\tCREATED\tDURATION\tFILES\tERROR")
+	for _, j := range jobs {
+		files := "-"
+		if j.Result != nil {
+			files = fmt.Sprintf("%d/%d", j.Result.Succeeded+j.Result.Skipped, len(j.Result.Files))
+		}
+		dataset := j.Request.Dataset
+		if dataset == "" {
+			dataset = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n", j.ID, j.Kind, j.Status, dataset, jobRun(j),
+			j.Attempts, j.Created.Local().Format("2006-01-02 15:04:05"), jobDuration(j), files, j.Error)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Job kinds
+const (
+	jobDownload = "download" // Submitted to serve
+	jobWatch    = "watch"    // A cycle downloaded by watch
+)
+
+// watchRecord is the cycle being watched for a dataset and the idx URLs of
+// its files already downloaded
+type watchRecord struct {
+	Cycle string   `json:"cycle"` // YYYYMMDDHH
+	Done  []string `json:"done,omitempty"`
+}
+
+// jobSchema creates the tables of the jobs file. The request and result of
+// a job are kept as JSON.
+const jobSchema = `
+CREATE TABLE IF NOT EXISTS jobs (
+	id       TEXT PRIMARY KEY,
+	kind     TEXT NOT NULL,
+	status   TEXT NOT NULL,
+	created  TEXT NOT NULL,
+	started  TEXT,
+	finished TEXT,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	error    TEXT NOT NULL DEFAULT '',
+	request  TEXT NOT NULL,
+	result   TEXT
+);
+CREATE INDEX IF NOT EXISTS jobs_created ON jobs (created);
+CREATE TABLE IF NOT EXISTS watch (
+	dataset TEXT PRIMARY KEY,
+	cycle   TEXT NOT NULL,
+	done    TEXT NOT NULL
+);`
+
+// jobStore keeps the jobs of serve and watch, with their attempts and
+// results, in an SQLite database so that a restarted process resumes the
+// unfinished ones. The whole history is kept. A nil store keeps nothing.
+type jobStore struct {
+	path string
+	db   *sql.DB
+}
+
+// openJobStore opens the jobs file at path, creating it if it does not exist
+// yet. A jobs file written as JSON by earlier versions is imported and kept
+// next to the database with a .json suffix. An empty path returns a nil
+// store.
+func openJobStore(path string) (*jobStore, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	legacy, err := readLegacyJobs(path)
+	if err != nil {
+		return nil, err
+	}
+	if legacy != nil {
+		if err := os.Rename(path, path+".json"); err != nil {
+			return nil, fmt.Errorf("error moving JSON jobs file aside: %v", err)
+		}
+	}
+
+	// WAL lets the jobs command read while serve or watch writes
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("error opening jobs file: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(jobSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error opening jobs file %s: %v", path, err)
+	}
+	st := &jobStore{path: path, db: db}
+
+	if legacy != nil {
+		for _, j := range legacy.Jobs {
+			st.putJob(j)
+		}
+		for dataset, record := range legacy.Watch {
+			st.putWatch(dataset, record, nil)
+		}
+		slog.Info("imported JSON jobs file", "path", path, "jobs", len(legacy.Jobs), "backup", path+".json")
+	}
+	return st, nil
+}
+
+// legacyJobState is the content of a jobs file written as JSON
+type legacyJobState struct {
+	Jobs  []*job                 `json:"jobs"`
+	Watch map[string]watchRecord `json:"watch,omitempty"`
+}
+
+// readLegacyJobs reads the jobs file at path if it was written as JSON,
+// returning nil for a missing file or an SQLite database
+func readLegacyJobs(path string) (*legacyJobState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading jobs file: %v", err)
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return nil, nil
+	}
+	var state legacyJobState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error parsing jobs file %s: %v", path, err)
+	}
+	return &state, nil
+}
+
+// close closes the database
+func (st *jobStore) close() error {
+	if st == nil {
+		return nil
+	}
+	return st.db.Close()
+}
+
+// jobFilter selects the jobs listed by jobs; empty fields select all
+type jobFilter struct {
+	status string
+	kind   string
+	limit  int // Newest jobs; 0 for all
+}
+
+// jobs returns the stored jobs, oldest first
+func (st *jobStore) jobs() ([]*job, error) {
+	return st.filterJobs(jobFilter{})
+}
+
+// filterJobs returns the stored jobs selected by the filter, oldest first
+func (st *jobStore) filterJobs(filter jobFilter) ([]*job, error) {
+	if st == nil {
+		return nil, nil
+	}
+
+	var where []string
+	var args []any
+	if filter.status != "" {
+		where, args = append(where, "status = ?"), append(args, filter.status)
+	}
+	if filter.kind != "" {
+		where, args = append(where, "kind = ?"), append(args, filter.kind)
+	}
+	query := "SELECT id, kind, status, created, started, finished, attempts, error, request, result FROM jobs"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created DESC, rowid DESC"
+	if filter.limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.limit)
+	}
+
+	rows, err := st.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading jobs file: %v", err)
+	}
+	defer rows.Close()
+
+	var jobs []*job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error reading jobs file: %v", err)
+		}
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading jobs file: %v", err)
+	}
+
+	// Newest first in the query so the limit keeps the newest
+	for a, b := 0, len(jobs)-1; a < b; a, b = a+1, b-1 {
+		jobs[a], jobs[b] = jobs[b], jobs[a]
+	}
+	return jobs, nil
+}
+
+// scanJob reads a job from a row of the jobs table
+func scanJob(rows *sql.Rows) (*job, error) {
+	var j job
+	var created string
+	var started, finished, result sql.NullString
+	var request string
+	if err := rows.Scan(&j.ID, &j.Kind, &j.Status, &created, &started, &finished, &j.Attempts, &j.Error, &request, &result); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if j.Created, err = time.Parse(time.RFC3339Nano, created); err != nil {
+		return nil, fmt.Errorf("job %s: %v", j.ID, err)
+	}
+	if j.Started, err = parseNullTime(started); err != nil {
+		return nil, fmt.Errorf("job %s: %v", j.ID, err)
+	}
+	if j.Finished, err = parseNullTime(finished); err != nil {
+		return nil, fmt.Errorf("job %s: %v", j.ID, err)
+	}
+	if err := json.Unmarshal([]byte(request), &j.Request); err != nil {
+		return nil, fmt.Errorf("job %s: %v", j.ID, err)
+	}
+	if result.Valid {
+		if err := json.Unmarshal([]byte(result.String), &j.Result); err != nil {
+			return nil, fmt.Errorf("job %s: %v", j.ID, err)
+		}
+	}
+	return &j, nil
+}
+
+// formatNullTime formats an optional time for the database
+func formatNullTime(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: t.UTC().Format(time.RFC3339Nano), Valid: true}
+}
+
+// parseNullTime parses an optional time read from the database
+func parseNullTime(s sql.NullString) (*time.Time, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s.String)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// watchRecord returns the stored cycle of a watched dataset
+func (st *jobStore) watchRecord(dataset string) (watchRecord, bool) {
+	if st == nil {
+		return watchRecord{}, false
+	}
+	var record watchRecord
+	var done string
+	err := st.db.QueryRow("SELECT cycle, done FROM watch WHERE dataset = ?", dataset).Scan(&record.Cycle, &done)
+	if err == nil {
+		err = json.Unmarshal([]byte(done), &record.Done)
+	}
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Warn("could not read jobs file", "path", st.path, "error", err)
+		}
+		return watchRecord{}, false
+	}
+	return record, true
+}
+
+// putJob adds a job or replaces the stored one with the same ID. A failed
+// write is logged rather than failing the job.
+func (st *jobStore) putJob(j *job) {
+	if st == nil {
+		return
+	}
+	if err := st.exec(insertJob(j)); err != nil {
+		slog.Warn("could not write jobs file", "path", st.path, "job", j.ID, "error", err)
+	}
+}
+
+// putWatch stores the watched cycle of a dataset together with the job of
+// the cycle once complete. A failed write is logged.
+func (st *jobStore) putWatch(dataset string, record watchRecord, complete *job) {
+	if st == nil {
+		return
+	}
+	done, err := json.Marshal(append([]string{}, record.Done...))
+	if err != nil {
+		slog.Warn("could not write jobs file", "path", st.path, "error", err)
+		return
+	}
+	statements := []statement{{
+		"INSERT OR REPLACE INTO watch (dataset, cycle, done) VALUES (?, ?, ?)",
+		[]any{dataset, record.Cycle, string(done)},
+	}}
+	if complete != nil {
+		statements = append(statements, insertJob(complete))
+	}
+	if err := st.exec(statements...); err != nil {
+		slog.Warn("could not write jobs file", "path", st.path, "dataset", dataset, "error", err)
+	}
+}
+
+// statement is an SQL statement with its arguments
+type statement struct {
+	query string
+	args  []any
+}
+
+// insertJob returns the statement storing a job
+func insertJob(j *job) statement {
+	request, _ := json.Marshal(j.Request)
+	var result sql.NullString
+	if j.Result != nil {
+		data, _ := json.Marshal(j.Result)
+		result = sql.NullString{String: string(data), Valid: true}
+	}
+	return statement{
+		`INSERT OR REPLACE INTO jobs (id, kind, status, created, started, finished, attempts, error, request, result)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		[]any{j.ID, j.Kind, j.Status, j.Created.UTC().Format(time.RFC3339Nano), formatNullTime(j.Started),
+			formatNullTime(j.Finished), j.Attempts, j.Error, string(request), result},
+	}
+}
+
+// exec runs statements in a single transaction
+func (st *jobStore) exec(statements ...statement) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, s := range statements {
+		if _, err := tx.Exec(s.query, s.args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
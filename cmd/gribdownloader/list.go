@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"gribdownloader"
+)
+
+// listEntry is a distinct parameter, level and type combination in an idx file
+type listEntry struct {
+	Parameter string `json:"parameter"`
+	Level     string `json:"level"`
+	Type      string `json:"type"`
+	Records   int    `json:"records"`
+}
+
+// summarize returns the distinct parameter/level/type combinations in idx order
+func summarize(parameters []gribdownloader.GFSParameter) []listEntry {
+	var entries []listEntry
+	seen := make(map[[3]string]int)
+	for _, p := range parameters {
+		key := [3]string{p.Parameter, p.Level, p.Type}
+		if i, ok := seen[key]; ok {
+			entries[i].Records++
+			continue
+		}
+		seen[key] = len(entries)
+		entries = append(entries, listEntry{Parameter: p.Parameter, Level: p.Level, Type: p.Type, Records: 1})
+	}
+	return entries
+}
+
+// printIndex writes the contents of an idx file to stdout
+func printIndex(idxURL string, parameters []gribdownloader.GFSParameter, records, asJSON bool) error {
+	if asJSON {
+		var value any = summarize(parameters)
+		if records {
+			value = parameters
+		}
+		return printJSON(map[string]any{"idx_url": idxURL, "entries": value})
+	}
+
+	fmt.Printf("%s\n", idxURL)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if records {
+		fmt.Fprintln(w, "NUMBER\tOFFSET\tPARAMETER\tLEVEL\tTYPE\tEXTRA")
+		for _, p := range parameters {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", p.ID(), p.Offset, p.Parameter, p.Level, p.Type, strings.Join(p.Extra, ":"))
+		}
+	} else {
+		fmt.Fprintln(w, "PARAMETER\tLEVEL\tTYPE\tRECORDS")
+		for _, e := range summarize(parameters) {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", e.Parameter, e.Level, e.Type, e.Records)
+		}
+	}
+	return w.Flush()
+}
+
+// runList implements the list command. The argument is either an idx URL or
+// a config file whose targets are listed.
+func runList(ctx context.Context, args []string) error {
+	fs, opts := newFlagSet("list")
+	records := fs.Bool("records", false, "list every record with its offset instead of distinct parameter/level/type combinations")
+	asJSON := fs.Bool("json", false, "print the listing as JSON")
+	format := fs.String("index-format", gribdownloader.FormatAuto, "index format when listing an idx URL")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gribdownloader list [flags] <idx-url|config.json>")
+		fs.PrintDefaults()
+	}
+
+	logger, err := parseArgs(fs, opts, args)
+	if err != nil {
+		return err
+	}
+
+	if arg := fs.Arg(0); strings.Contains(arg, "://") {
+		parser, err := gribdownloader.IndexParserFor(*format)
+		if err != nil {
+			return err
+		}
+
+		downloader := &gribdownloader.Downloader{Logger: logger}
+		parameters, err := fetchIndex(ctx, downloader, gribdownloader.Target{IdxURL: arg}, parser, opts.keepIdx)
+		if err != nil {
+			return err
+		}
+		return printIndex(arg, parameters, *records, *asJSON)
+	}
+
+	env, err := loadEnvironment(fs.Arg(0), opts, logger)
+	if err != nil {
+		return err
+	}
+
+	return env.forEachTarget(ctx, func(_ *gribdownloader.Dataset, target gribdownloader.Target, parser gribdownloader.IndexParser) error {
+		parameters, err := fetchIndex(ctx, env.downloader, target, parser, env.keepIdx)
+		if err != nil {
+			return err
+		}
+		return printIndex(target.IdxURL, parameters, *records, *asJSON)
+	})
+}
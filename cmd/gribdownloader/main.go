@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// command is a gribdownloader subcommand
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, args []string) error
+}
+
+// commands lists the available subcommands; download is the default
+var commands = []command{
+	{"cache", "manage the output cache (cache prune --older-than 7d)", runCache},
+	{"clean", "remove the cycles older than keep_cycles or keep_days", runClean},
+	{"diff-idx", "compare the records of two idx files or cycles", runDiffIdx},
+	{"download", "download the configured GRIB subsets (default)", runDownload},
+	{"index", "generate an idx file for a local GRIB2 file", runIndex},
+	{"inspect", "show the metadata of the messages in local GRIB files", runInspect},
+	{"jobs", "list the jobs of serve and watch kept in jobs_file", runJobs},
+	{"list", "show the contents of the idx files", runList},
+	{"params", "list the built-in parameter aliases such as t2m", runParams},
+	{"plan", "show the ranges that would be downloaded", runPlan},
+	{"presets", "list the built-in dataset presets", runPresets},
+	{"serve", "run downloads submitted over an HTTP job API", runServe},
+	{"schedule", "run downloads on cron schedules", runSchedule},
+	{"validate", "check a configuration file for mistakes", runValidate},
+	{"verify", "check downloaded files against their manifests", runVerify},
+	{"watch", "poll for new cycles and download files as they are published", runWatch},
+}
+
+// newLogger creates the logger selected by the --log-level and --log-format flags
+func newLogger(level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q: expected text or json", format)
+	}
+}
+
+// usage prints the list of subcommands
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: gribdownloader [command] [flags] config.json")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run 'gribdownloader <command> -h' for the flags of a command.")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Exit codes:")
+	for _, e := range exitCodes {
+		fmt.Fprintf(os.Stderr, "  %-3d %s\n", e.code, e.description)
+	}
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage()
+		return
+	}
+
+	// Without a subcommand the arguments are passed to download
+	run := runDownload
+	for _, cmd := range commands {
+		if args[0] == cmd.name {
+			run = cmd.run
+			args = args[1:]
+			break
+		}
+	}
+
+	// Cancel in-flight downloads on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := run(ctx, args)
+	stop()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(exitCode(err))
+	}
+}
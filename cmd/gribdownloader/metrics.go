@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gribdownloader"
+)
+
+// durationBuckets are the histogram buckets, in seconds, for file download
+// durations
+var durationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800}
+
+// latencyBuckets are the histogram buckets, in seconds, for the time from
+// the nominal cycle time to the download of a file
+var latencyBuckets = []float64{1800, 3600, 2 * 3600, 3 * 3600, 4 * 3600, 5 * 3600, 6 * 3600, 9 * 3600, 12 * 3600, 24 * 3600}
+
+// histogram is a cumulative histogram in the Prometheus sense
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// newHistogram creates a histogram with the given upper bounds
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// observe adds a value to the histogram
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write prints the histogram samples in the text exposition format
+func (h *histogram) write(w io.Writer, name, labels string) {
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, trimComma(labels), h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, trimComma(labels), h.count)
+}
+
+// trimComma removes the separator left at the end of a label list
+func trimComma(labels string) string {
+	if n := len(labels); n > 0 && labels[n-1] == ',' {
+		return labels[:n-1]
+	}
+	return labels
+}
+
+// metrics collects the values exported on /metrics by long-running commands
+type metrics struct {
+	stats *gribdownloader.Stats
+
+	mu          sync.Mutex
+	filesDone   map[string]int64
+	filesFailed map[string]int64
+	durations   map[string]*histogram
+	latencies   map[string]*histogram
+}
+
+// newMetrics creates the metrics of a downloader's stats
+func newMetrics(stats *gribdownloader.Stats) *metrics {
+	return &metrics{
+		stats:       stats,
+		filesDone:   map[string]int64{},
+		filesFailed: map[string]int64{},
+		durations:   map[string]*histogram{},
+		latencies:   map[string]*histogram{},
+	}
+}
+
+// observeFile records the outcome of a file download; m may be nil
+func (m *metrics) observeFile(target gribdownloader.Target, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dataset := target.Dataset
+	if err != nil {
+		m.filesFailed[dataset]++
+		return
+	}
+	m.filesDone[dataset]++
+
+	if m.durations[dataset] == nil {
+		m.durations[dataset] = newHistogram(durationBuckets)
+	}
+	m.durations[dataset].observe(duration.Seconds())
+
+	// Latency is measured from the nominal cycle time
+	if run, err := gribdownloader.ParseCycle(target.Vars["yyyymmdd"], target.Vars["cycle"]); err == nil {
+		if m.latencies[dataset] == nil {
+			m.latencies[dataset] = newHistogram(latencyBuckets)
+		}
+		m.latencies[dataset].observe(time.Since(run).Seconds())
+	}
+}
+
+// sortedKeys returns the keys of a map in sorted order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	counters := []struct {
+		name, help string
+		value      int64
+	}{
+		{"gribdl_bytes_downloaded_total", "Bytes of GRIB data downloaded.", m.stats.BytesDownloaded.Load()},
+		{"gribdl_ranges_downloaded_total", "Byte ranges downloaded.", m.stats.RangesDownloaded.Load()},
+		{"gribdl_range_retries_total", "Range downloads retried after a failed attempt.", m.stats.RangeRetries.Load()},
+		{"gribdl_range_failures_total", "Ranges that failed on every mirror.", m.stats.RangeFailures.Load()},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP gribdl_files_downloaded_total Files downloaded successfully.")
+	fmt.Fprintln(w, "# TYPE gribdl_files_downloaded_total counter")
+	for _, dataset := range sortedKeys(m.filesDone) {
+		fmt.Fprintf(w, "gribdl_files_downloaded_total{dataset=%q} %d\n", dataset, m.filesDone[dataset])
+	}
+
+	fmt.Fprintln(w, "# HELP gribdl_files_failed_total Files that failed to download.")
+	fmt.Fprintln(w, "# TYPE gribdl_files_failed_total counter")
+	for _, dataset := range sortedKeys(m.filesFailed) {
+		fmt.Fprintf(w, "gribdl_files_failed_total{dataset=%q} %d\n", dataset, m.filesFailed[dataset])
+	}
+
+	fmt.Fprintln(w, "# HELP gribdl_file_download_seconds Time taken to download a file.")
+	fmt.Fprintln(w, "# TYPE gribdl_file_download_seconds histogram")
+	for _, dataset := range sortedKeys(m.durations) {
+		m.durations[dataset].write(w, "gribdl_file_download_seconds", fmt.Sprintf("dataset=%q,", dataset))
+	}
+
+	fmt.Fprintln(w, "# HELP gribdl_cycle_latency_seconds Time from the nominal cycle time until a file was downloaded.")
+	fmt.Fprintln(w, "# TYPE gribdl_cycle_latency_seconds histogram")
+	for _, dataset := range sortedKeys(m.latencies) {
+		m.latencies[dataset].write(w, "gribdl_cycle_latency_seconds", fmt.Sprintf("dataset=%q,", dataset))
+	}
+}
+
+// serveMetrics enables download statistics and serves them on addr under
+// /metrics until ctx is cancelled
+func serveMetrics(ctx context.Context, env *environment, addr string) error {
+	stats := &gribdownloader.Stats{}
+	env.downloader.Stats = stats
+	env.metrics = newMetrics(stats)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error starting metrics server: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", env.metrics)
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("metrics server failed", "error", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	slog.Info("serving metrics", "addr", listener.Addr().String())
+	return nil
+}
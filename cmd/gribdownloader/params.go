@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"gribdownloader"
+)
+
+// formatFields lists the GRIB parameters and levels of an alias, e.g.
+// "TMP:2 m above ground"
+func formatFields(fields map[string][]string) string {
+	var parts []string
+	for name, levels := range fields {
+		for _, level := range levels {
+			parts = append(parts, name+":"+level)
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// runParams implements the params command
+func runParams(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("params", flag.ExitOnError)
+	model := fs.String("model", "", "only show aliases published by this model (gfs, hrrr or gefs)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gribdownloader params [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ALIAS\tSHORT\tGRIB\tMODELS\tDESCRIPTION")
+	for _, alias := range gribdownloader.ParameterAliases() {
+		if *model != "" && !slices.Contains(alias.Models, strings.ToLower(*model)) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", alias.Names[0], strings.Join(alias.Names[1:], ", "),
+			formatFields(alias.Fields), strings.Join(alias.Models, ","), alias.Description)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"gribdownloader"
+)
+
+// planRecord is the JSON form of a matched idx record
+type planRecord struct {
+	Number    int                          `json:"number"`
+	Field     int                          `json:"field,omitempty"`
+	Parameter string                       `json:"parameter"`
+	Level     string                       `json:"level"`
+	Type      string                       `json:"type"`
+	Fields    []string                     `json:"fields,omitempty"` // All fields of a message holding several
+	Range     gribdownloader.RangeDownload `json:"range"`
+}
+
+// planJSON is the JSON form of a file plan
+type planJSON struct {
+	Dataset    string                         `json:"dataset,omitempty"`
+	Member     string                         `json:"member,omitempty"`
+	IdxURL     string                         `json:"idx_url"`
+	GribURL    string                         `json:"grib_url"`
+	Output     string                         `json:"output"`
+	Records    []planRecord                   `json:"records"`
+	Ranges     []gribdownloader.RangeDownload `json:"ranges"`
+	TotalBytes int64                          `json:"total_bytes"`
+}
+
+// toJSON converts the plan to its JSON form
+func (p *filePlan) toJSON() planJSON {
+	out := planJSON{
+		Dataset:    p.target.Dataset,
+		Member:     p.target.Vars["member"],
+		IdxURL:     p.target.IdxURL,
+		GribURL:    p.gribURLs[0],
+		Output:     p.gribFileName,
+		Records:    make([]planRecord, 0, len(p.records)),
+		Ranges:     p.ranges,
+		TotalBytes: p.totalSize(),
+	}
+	for _, rec := range p.records {
+		out.Records = append(out.Records, planRecord{
+			Number:    rec.Number,
+			Field:     rec.Field,
+			Parameter: rec.Parameter,
+			Level:     rec.Level,
+			Type:      rec.Type,
+			Fields:    rec.FieldNames(),
+			Range:     rec.Range,
+		})
+	}
+	return out
+}
+
+// print writes a human readable description of the plan to stdout
+func (p *filePlan) print() {
+	fmt.Printf("%s -> %s\n", p.target.IdxURL, p.gribFileName)
+	fmt.Println("  Records:")
+	for _, rec := range p.records {
+		fmt.Printf("    %s: %s %s %s (%d-%d)\n", rec.ID(), rec.Parameter, rec.Level, rec.Type, rec.Range.Start, rec.Range.End)
+		if len(rec.Fields) > 0 {
+			fmt.Printf("       message holds %s\n", strings.Join(rec.FieldNames(), ", "))
+		}
+	}
+	fmt.Println("  Ranges:")
+	for i, r := range p.ranges {
+		fmt.Printf("    Range %d: %d-%d (%.2f MB)\n", i+1, r.Start, r.End, float64(r.Size())/(1024*1024))
+	}
+	fmt.Printf("  %d records in %d ranges, %.2f MB\n", len(p.records), len(p.ranges), float64(p.totalSize())/(1024*1024))
+}
+
+// showPlans fetches the idx files of every target and prints what would be
+// downloaded without transferring any GRIB data
+func showPlans(ctx context.Context, env *environment, asJSON bool) error {
+	plans := []planJSON{}
+	var totalBytes int64
+	err := env.forEachTarget(ctx, func(dataset *gribdownloader.Dataset, target gribdownloader.Target, parser gribdownloader.IndexParser) error {
+		plan, err := planTarget(ctx, env, target, parser, dataset.SelectionFor(target))
+		if err != nil {
+			return err
+		}
+
+		totalBytes += plan.totalSize()
+		if asJSON {
+			plans = append(plans, plan.toJSON())
+		} else {
+			plan.print()
+		}
+		return nil
+	})
+
+	if asJSON {
+		if encErr := printJSON(plans); encErr != nil {
+			return encErr
+		}
+	} else {
+		fmt.Printf("Total download size: %.2f MB\n", float64(totalBytes)/(1024*1024))
+	}
+
+	return err
+}
+
+// runPlan implements the plan command
+func runPlan(ctx context.Context, args []string) error {
+	fs, opts := newFlagSet("plan")
+	asJSON := fs.Bool("json", false, "print the plan as JSON")
+
+	env, err := setup(fs, opts, args)
+	if err != nil {
+		return err
+	}
+
+	return showPlans(ctx, env, *asJSON)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"gribdownloader"
+)
+
+// formatHours summarizes a list of forecast hours, e.g. "0-120"
+func formatHours(hours []int) string {
+	if len(hours) == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d-%d", hours[0], hours[len(hours)-1])
+}
+
+// runPresets implements the presets command
+func runPresets(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("presets", flag.ExitOnError)
+	verbose := fs.Bool("v", false, "also show the URL template of each preset")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gribdownloader presets [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCYCLES\tHOURS\tDESCRIPTION")
+	for _, name := range gribdownloader.PresetNames() {
+		preset, _ := gribdownloader.LookupPreset(name)
+		fmt.Fprintf(w, "%s\tevery %dh\t%s\t%s\n", name, preset.Dataset.CycleInterval, formatHours(preset.AvailableHours), preset.Description)
+		if *verbose {
+			if preset.Dataset.PerField() {
+				fmt.Fprintf(w, "\t\t\t%s (one file per field)\n", preset.Dataset.FieldURL)
+			} else {
+				fmt.Fprintf(w, "\t\t\t%s\n", preset.Dataset.IdxURL)
+			}
+			if len(preset.Domains) > 0 {
+				fmt.Fprintf(w, "\t\t\tdomains: %s\n", strings.Join(preset.DomainNames(), ", "))
+			}
+		}
+	}
+	return w.Flush()
+}
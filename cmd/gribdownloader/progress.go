@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gribdownloader"
+)
+
+// progressBarWidth is the number of characters in the progress bar
+const progressBarWidth = 30
+
+// isTerminal reports whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressPrinter returns a Progress callback that redraws a single status
+// line on w, ending the line once every range of a file has finished
+func progressPrinter(w io.Writer) func(gribdownloader.Progress) {
+	finished := false
+	return func(p gribdownloader.Progress) {
+		complete := p.DoneRanges+p.FailedRanges == p.TotalRanges
+		if finished && complete {
+			return
+		}
+		finished = complete
+
+		fraction := 0.0
+		if p.TotalBytes > 0 {
+			fraction = float64(p.DoneBytes) / float64(p.TotalBytes)
+		}
+		if fraction > 1 {
+			fraction = 1
+		}
+		filled := int(fraction * progressBarWidth)
+		bar := strings.Repeat("#", filled) + strings.Repeat(" ", progressBarWidth-filled)
+
+		fmt.Fprintf(w, "\r[%s] %6.2f/%.2f MB  %.2f MB/s  ETA %-8s ranges %d/%d (%d active, %d failed)",
+			bar,
+			float64(p.DoneBytes)/(1024*1024), float64(p.TotalBytes)/(1024*1024),
+			p.Rate()/(1024*1024), p.ETA().Round(time.Second),
+			p.DoneRanges, p.TotalRanges, p.ActiveRanges, p.FailedRanges)
+
+		if complete {
+			fmt.Fprintln(w)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gribdownloader"
+)
+
+// readyEvent is the JSON payload published when a file is downloaded
+type readyEvent struct {
+	Event      string    `json:"event"` // Always "ready"
+	Time       time.Time `json:"time"`
+	Dataset    string    `json:"dataset,omitempty"`
+	Path       string    `json:"path"`
+	Manifest   string    `json:"manifest"`
+	IdxURL     string    `json:"idx_url"`
+	GribURL    string    `json:"grib_url"`
+	Date       string    `json:"date,omitempty"`
+	Cycle      string    `json:"cycle,omitempty"`
+	FHR        string    `json:"fhr,omitempty"`
+	Member     string    `json:"member,omitempty"`
+	Parameters []string  `json:"parameters"` // NAME:LEVEL of each field in the file
+	Records    int       `json:"records"`
+	Bytes      int64     `json:"bytes"`
+}
+
+// newReadyEvent describes a downloaded file
+func newReadyEvent(plan *filePlan) readyEvent {
+	target := plan.target
+	output := outputPath(target)
+	event := readyEvent{
+		Event:      "ready",
+		Time:       time.Now().UTC(),
+		Dataset:    target.Dataset,
+		Path:       output,
+		Manifest:   gribdownloader.ManifestPath(output),
+		IdxURL:     target.IdxURL,
+		GribURL:    gribdownloader.GribURL(target.IdxURL),
+		Date:       target.Vars["yyyymmdd"],
+		Cycle:      target.Vars["cycle"],
+		FHR:        target.Vars["fhr"],
+		Member:     target.Vars["member"],
+		Parameters: []string{},
+		Records:    len(plan.records) - len(plan.missing),
+		Bytes:      plan.totalSize(),
+	}
+
+	missing := map[int64]bool{}
+	for _, rec := range plan.missing {
+		missing[rec.Offset] = true
+	}
+	seen := map[string]bool{}
+	for _, rec := range plan.records {
+		if missing[rec.Offset] {
+			continue
+		}
+		fields := rec.Fields
+		if len(fields) == 0 {
+			fields = []gribdownloader.GFSParameter{rec.GFSParameter}
+		}
+		for _, field := range fields {
+			name := field.Parameter + ":" + field.Level
+			if !seen[name] {
+				seen[name] = true
+				event.Parameters = append(event.Parameters, name)
+			}
+		}
+	}
+	return event
+}
+
+// publisher sends ready events to the configured message brokers. NATS
+// connections are kept open between events.
+type publisher struct {
+	targets []gribdownloader.PublishTarget
+	client  *http.Client
+
+	mutex sync.Mutex
+	nats  map[string]*natsConn // Keyed by URL
+}
+
+// newPublisher returns a publisher for the given brokers, or nil if there
+// are none
+func newPublisher(targets []gribdownloader.PublishTarget) *publisher {
+	if len(targets) == 0 {
+		return nil
+	}
+	return &publisher{targets: targets, client: &http.Client{Timeout: webhookTimeout}, nats: map[string]*natsConn{}}
+}
+
+// publish sends an event to every broker. Failures are logged and do not
+// affect the download.
+func (p *publisher) publish(ctx context.Context, event readyEvent) {
+	if p == nil {
+		return
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.Warn("could not encode ready event", "error", err)
+		return
+	}
+
+	for _, target := range p.targets {
+		var err error
+		switch target.Broker {
+		case gribdownloader.BrokerNATS:
+			err = p.publishNATS(ctx, target, payload)
+		case gribdownloader.BrokerKafka:
+			err = p.publishKafka(ctx, target, event.Dataset, payload)
+		}
+		if err != nil {
+			slog.Warn("publishing failed", "broker", target.Broker, "topic", target.Topic, "path", event.Path, "error", err)
+		}
+	}
+}
+
+// publishNATS publishes a payload on a NATS subject, connecting again once
+// if the kept connection has failed
+func (p *publisher) publishNATS(ctx context.Context, target gribdownloader.PublishTarget, payload []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		conn := p.nats[target.URL]
+		if conn == nil {
+			var err error
+			conn, err = dialNATS(ctx, target.URL)
+			if err != nil {
+				return err
+			}
+			p.nats[target.URL] = conn
+		}
+		err := conn.publish(target.Topic, payload)
+		if err == nil {
+			return nil
+		}
+		conn.close()
+		delete(p.nats, target.URL)
+		if attempt > 0 {
+			return err
+		}
+	}
+}
+
+// publishKafka produces a record, keyed by dataset, to a Kafka topic through
+// the REST Proxy v2 API
+func (p *publisher) publishKafka(ctx context.Context, target gribdownloader.PublishTarget, key string, payload []byte) error {
+	record := map[string]any{"value": json.RawMessage(payload)}
+	if key != "" {
+		record["key"] = key
+	}
+	body, err := json.Marshal(map[string]any{"records": []any{record}})
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimSuffix(target.URL, "/") + "/topics/" + url.PathEscape(target.Topic)
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	// The proxy answers 200 even when producing a record failed
+	var result struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("error parsing response: %v", err)
+	}
+	for _, offset := range result.Offsets {
+		if offset.ErrorCode != nil {
+			return fmt.Errorf("error producing record: %s (code %d)", offset.Error, *offset.ErrorCode)
+		}
+	}
+	return nil
+}
+
+// close closes the kept broker connections
+func (p *publisher) close() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key, conn := range p.nats {
+		conn.close()
+		delete(p.nats, key)
+	}
+}
+
+// natsConn is a connection to a NATS server speaking the client protocol
+type natsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialNATS connects to a NATS server, authenticating with the user and
+// password or token of the URL
+func dialNATS(ctx context.Context, raw string) (*natsConn, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NATS URL %q: %v", raw, err)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to NATS: %v", err)
+	}
+	c := &natsConn{conn: conn, reader: bufio.NewReader(conn)}
+	if err := c.handshake(u); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// handshake reads the server's INFO, switches to TLS when asked to and
+// sends CONNECT
+func (c *natsConn) handshake(u *url.URL) error {
+	c.conn.SetDeadline(time.Now().Add(webhookTimeout))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("error reading NATS INFO: %v", err)
+	}
+	infoJSON, ok := strings.CutPrefix(strings.TrimSpace(line), "INFO ")
+	if !ok {
+		return fmt.Errorf("unexpected NATS greeting %q", strings.TrimSpace(line))
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err := json.Unmarshal([]byte(infoJSON), &info); err != nil {
+		return fmt.Errorf("error parsing NATS INFO: %v", err)
+	}
+
+	if info.TLSRequired || u.Scheme == "tls" {
+		tlsConn := tls.Client(c.conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("error starting TLS with NATS: %v", err)
+		}
+		c.conn, c.reader = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	options := map[string]any{"verbose": false, "pedantic": false, "name": "gribdownloader", "lang": "go"}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			options["user"], options["pass"] = u.User.Username(), password
+		} else {
+			options["auth_token"] = u.User.Username()
+		}
+	}
+	connect, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		return fmt.Errorf("error connecting to NATS: %v", err)
+	}
+	return c.waitPong()
+}
+
+// publish sends a message and waits for the server to acknowledge it with
+// the PONG answering the following PING
+func (c *natsConn) publish(subject string, payload []byte) error {
+	c.conn.SetDeadline(time.Now().Add(webhookTimeout))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "PUB %s %d\r\n", subject, len(payload))
+	buf.Write(payload)
+	buf.WriteString("\r\nPING\r\n")
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("error publishing to NATS: %v", err)
+	}
+	return c.waitPong()
+}
+
+// waitPong reads server messages up to the next PONG, failing on -ERR
+func (c *natsConn) waitPong() error {
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("error reading from NATS: %v", err)
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := c.conn.Write([]byte("PONG\r\n")); err != nil {
+				return fmt.Errorf("error writing to NATS: %v", err)
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		// +OK and INFO updates need no answer
+	}
+}
+
+// close closes the connection
+func (c *natsConn) close() {
+	c.conn.Close()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// eventLog collects the outcome of every downloaded file for --json output.
+// A nil log discards the events.
+type eventLog struct {
+	mutex  sync.Mutex
+	events []webhookEvent
+}
+
+// add records the outcome of a file
+func (l *eventLog) add(event webhookEvent) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.events = append(l.events, event)
+}
+
+// downloadReport is the JSON output of download --json
+type downloadReport struct {
+	Files     []webhookEvent `json:"files"`
+	Succeeded int            `json:"succeeded"`
+	Skipped   int            `json:"skipped"` // Already complete with --skip-existing
+	Failed    int            `json:"failed"`
+	Records   int            `json:"records"`
+	Bytes     int64          `json:"bytes"`
+	Duration  float64        `json:"duration_seconds"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// report summarizes the collected events of a run that took elapsed and
+// ended with err
+func (l *eventLog) report(elapsed time.Duration, err error) downloadReport {
+	r := downloadReport{Files: []webhookEvent{}, Duration: elapsed.Seconds()}
+	if l != nil {
+		l.mutex.Lock()
+		r.Files = append(r.Files, l.events...)
+		l.mutex.Unlock()
+	}
+	for _, event := range r.Files {
+		if event.Error != "" {
+			r.Failed++
+			continue
+		}
+		if event.Event == "skipped" {
+			r.Skipped++
+			continue
+		}
+		r.Succeeded++
+		r.Records += event.Records
+		r.Bytes += event.Bytes
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// verifyResult is the JSON form of the verification of a file
+type verifyResult struct {
+	Output   string `json:"output"`
+	Manifest string `json:"manifest"`
+	Messages int    `json:"messages,omitempty"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+}
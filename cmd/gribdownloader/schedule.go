@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gribdownloader"
+)
+
+// scheduledDataset runs the downloads of a dataset on its cron schedule
+type scheduledDataset struct {
+	dataset  *gribdownloader.Dataset
+	schedule *gribdownloader.Schedule
+	running  atomic.Bool
+}
+
+// run downloads the dataset once, skipping the run if the previous one is
+// still in progress
+func (sd *scheduledDataset) run(ctx context.Context, env *environment, wg *sync.WaitGroup) {
+	if !sd.running.CompareAndSwap(false, true) {
+		slog.Warn("previous run still in progress, skipping", "dataset", sd.dataset.Name)
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer sd.running.Store(false)
+		// Runs are hours apart, so do not hold connections in between
+		defer env.downloader.CloseIdleConnections()
+
+		slog.Info("scheduled run started", "dataset", sd.dataset.Name)
+		start := time.Now()
+		datasetEnv := *env
+		datasetEnv.datasets = []*gribdownloader.Dataset{sd.dataset}
+		if err := downloadAll(ctx, &datasetEnv, env.config.MaxFiles); err != nil {
+			slog.Error("scheduled run failed", "dataset", sd.dataset.Name, "error", err)
+			return
+		}
+		slog.Info("scheduled run completed", "dataset", sd.dataset.Name, "elapsed", time.Since(start).Round(time.Second))
+	}()
+}
+
+// loop triggers runs at the times given by the schedule until ctx is cancelled
+func (sd *scheduledDataset) loop(ctx context.Context, env *environment, wg *sync.WaitGroup) {
+	for {
+		next := sd.schedule.Next(time.Now().UTC())
+		if next.IsZero() {
+			slog.Warn("schedule never fires again", "dataset", sd.dataset.Name)
+			return
+		}
+		slog.Info("next run", "dataset", sd.dataset.Name, "at", next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		sd.run(ctx, env, wg)
+	}
+}
+
+// runSchedule implements the schedule command
+func runSchedule(ctx context.Context, args []string) error {
+	fs, opts := newFlagSet("schedule")
+	defaultSchedule := fs.String("schedule", "", "cron expression for datasets without their own schedule (e.g. \"15 */6 * * *\")")
+	runNow := fs.Bool("now", false, "also run every dataset once at startup")
+	metricsAddr := fs.String("metrics-addr", "", "serve Prometheus metrics on this address (e.g. :9090)")
+
+	env, err := setup(fs, opts, args)
+	if err != nil {
+		return err
+	}
+	env.downloader.Resume = true
+
+	if *metricsAddr != "" {
+		if err := serveMetrics(ctx, env, *metricsAddr); err != nil {
+			return err
+		}
+	}
+
+	scheduled := make([]*scheduledDataset, 0, len(env.datasets))
+	for _, dataset := range env.datasets {
+		expr := dataset.Schedule
+		if expr == "" {
+			expr = *defaultSchedule
+		}
+		if expr == "" {
+			return fmt.Errorf("dataset %q has no schedule, set schedule in the config or use --schedule", dataset.Name)
+		}
+
+		schedule, err := gribdownloader.ParseSchedule(expr)
+		if err != nil {
+			return err
+		}
+
+		// Scheduled runs fetch the newest cycle unless a date is pinned
+		if dataset.UsesCycle() && dataset.Date == "" {
+			dataset.Date = "latest"
+		}
+
+		scheduled = append(scheduled, &scheduledDataset{dataset: dataset, schedule: schedule})
+	}
+
+	// Schedules are evaluated in UTC, matching model cycle times
+	var wg sync.WaitGroup
+	for _, sd := range scheduled {
+		if *runNow {
+			sd.run(ctx, env, &wg)
+		}
+		wg.Add(1)
+		go func(sd *scheduledDataset) {
+			defer wg.Done()
+			sd.loop(ctx, env, &wg)
+		}(sd)
+	}
+
+	<-ctx.Done()
+	slog.Info("stopping scheduler, waiting for running downloads")
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gribdownloader"
+)
+
+// jobRequest is the JSON body of a submitted download job. Its fields
+// override the config file like the flags of the same names.
+type jobRequest struct {
+	Dataset    string            `json:"dataset,omitempty"`
+	Date       string            `json:"date,omitempty"`
+	Cycle      string            `json:"cycle,omitempty"`
+	Parameters []string          `json:"parameters,omitempty"` // NAME, NAME:LEVEL or aliases, as with --param
+	Region     string            `json:"region,omitempty"`
+	Set        map[string]string `json:"set,omitempty"` // Selection fields of jobSetKeys, as with --set
+}
+
+// jobSetKeys are the config fields a job may set. The API has no
+// authentication, so fields that run commands or choose where files go,
+// such as post_hook or output_dir, stay as the config file has them.
+var jobSetKeys = map[string]bool{
+	"forecast_hours": true,
+	"parameters":     true,
+	"types":          true,
+}
+
+// Job states
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// job is a download submitted to the service, or a cycle downloaded by watch
+type job struct {
+	ID       string          `json:"id"`
+	Kind     string          `json:"kind"`
+	Status   string          `json:"status"`
+	Request  jobRequest      `json:"request"`
+	Created  time.Time       `json:"created"`
+	Started  *time.Time      `json:"started,omitempty"`
+	Finished *time.Time      `json:"finished,omitempty"`
+	Attempts int             `json:"attempts"` // Times started, counting those interrupted by a restart
+	Error    string          `json:"error,omitempty"`
+	Result   *downloadReport `json:"result,omitempty"` // The outcome of its files once finished
+
+	env    *environment
+	cancel context.CancelFunc
+}
+
+// jobStatus is the JSON form of a job with the outcome of its files so far
+type jobStatus struct {
+	*job
+	Progress downloadReport `json:"progress"`
+}
+
+// service runs the jobs submitted over HTTP, up to a number at once
+type service struct {
+	ctx        context.Context // Cancelled, with every job, when the server stops
+	wg         sync.WaitGroup  // Running jobs
+	configPath string
+	opts       options // Defaults of every job, from the command line
+	logger     *slog.Logger
+	parallel   int
+	slots      chan struct{}
+	store      *jobStore
+
+	mutex sync.Mutex
+	jobs  map[string]*job
+}
+
+// maxJobRequestSize bounds the body of a submitted job
+const maxJobRequestSize = 1 << 20
+
+// newJobID returns a random job identifier
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating job ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// writeJSON writes v as the JSON response with the given status code
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeError writes an error as a JSON response
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// submit validates a job against the config file and queues it
+func (s *service) submit(req jobRequest) (*job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	j := &job{ID: id, Kind: jobDownload, Status: jobQueued, Request: req, Created: time.Now().UTC()}
+	if err := s.queue(j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// queue loads the environment of a job and starts waiting for a slot
+func (s *service) queue(j *job) error {
+	req := j.Request
+	opts := s.opts
+	opts.params = append(stringList(nil), s.opts.params...)
+	opts.sets = append(stringList(nil), s.opts.sets...)
+	if req.Dataset != "" {
+		opts.dataset, opts.all = req.Dataset, false
+	}
+	if req.Date != "" {
+		opts.date = req.Date
+	}
+	if req.Cycle != "" {
+		opts.cycle = req.Cycle
+	}
+	if req.Region != "" {
+		opts.region = req.Region
+	}
+	if len(req.Parameters) > 0 {
+		opts.params = req.Parameters
+	}
+	for _, key := range sortedKeys(req.Set) {
+		if !jobSetKeys[key] {
+			return fmt.Errorf("set: %q cannot be set by a job (allowed: %s)", key, strings.Join(sortedKeys(jobSetKeys), ", "))
+		}
+		opts.sets = append(opts.sets, key+"="+req.Set[key])
+	}
+
+	env, err := loadEnvironment(s.configPath, &opts, s.logger)
+	if err != nil {
+		return err
+	}
+	env.events = &eventLog{}
+	env.keepGRIB = true
+	env.checkSpace = true
+	env.downloader.Resume = true
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.mutex.Lock()
+	j.env, j.cancel = env, cancel
+	s.jobs[j.ID] = j
+	s.persist(j)
+	s.mutex.Unlock()
+
+	s.wg.Add(1)
+	go s.run(ctx, j)
+	return nil
+}
+
+// persist writes a job to the jobs file; the caller holds s.mutex
+func (s *service) persist(j *job) {
+	s.store.putJob(j)
+}
+
+// restore loads the jobs of the jobs file, queueing again those a previous
+// process left queued or running
+func (s *service) restore() error {
+	jobs, err := s.store.jobs()
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		if j.Kind != jobDownload {
+			continue
+		}
+		if j.Finished != nil {
+			s.jobs[j.ID] = j
+			continue
+		}
+
+		j.Status, j.Started = jobQueued, nil
+		if err := s.queue(j); err != nil {
+			// The config file changed in a way the job no longer fits
+			s.jobs[j.ID] = j
+			s.finish(j, err)
+			continue
+		}
+		slog.Info("job resumed", "job", j.ID, "attempts", j.Attempts)
+	}
+	return nil
+}
+
+// run waits for a free slot and downloads the files of a job
+func (s *service) run(ctx context.Context, j *job) {
+	defer s.wg.Done()
+	defer j.cancel()
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-ctx.Done():
+		s.finish(j, ctx.Err())
+		return
+	}
+
+	s.mutex.Lock()
+	started := time.Now().UTC()
+	j.Started = &started
+	j.Status = jobRunning
+	j.Attempts++
+	s.persist(j)
+	s.mutex.Unlock()
+
+	slog.Info("job started", "job", j.ID)
+	err := downloadAll(ctx, j.env, s.parallel)
+	j.env.publisher.close()
+	s.finish(j, err)
+}
+
+// finish records the outcome of a job
+func (s *service) finish(j *job, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil && s.ctx.Err() != nil {
+		// Stopped with the server rather than cancelled, so the jobs file
+		// keeps it unfinished for the next start to resume
+		slog.Info("job interrupted", "job", j.ID)
+		return
+	}
+	finished := time.Now().UTC()
+	j.Finished = &finished
+	if j.env != nil {
+		elapsed := time.Duration(0)
+		if j.Started != nil {
+			elapsed = finished.Sub(*j.Started)
+		}
+		result := j.env.events.report(elapsed, nil)
+		j.Result = &result
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		j.Status = jobCancelled
+	case err != nil:
+		j.Status = jobFailed
+		j.Error = err.Error()
+	default:
+		j.Status = jobSucceeded
+	}
+	s.persist(j)
+	slog.Info("job finished", "job", j.ID, "status", j.Status)
+}
+
+// status returns the state of a job
+func (s *service) status(j *job) jobStatus {
+	s.mutex.Lock()
+	copied := *j
+	s.mutex.Unlock()
+	if copied.env == nil {
+		// Finished before a restart
+		status := jobStatus{job: &copied}
+		if copied.Result != nil {
+			status.Progress = *copied.Result
+		}
+		return status
+	}
+
+	elapsed := time.Duration(0)
+	if copied.Started != nil {
+		end := time.Now()
+		if copied.Finished != nil {
+			end = *copied.Finished
+		}
+		elapsed = end.Sub(*copied.Started)
+	}
+	return jobStatus{job: &copied, Progress: j.env.events.report(elapsed, nil)}
+}
+
+// lookup finds a job by ID
+func (s *service) lookup(id string) *job {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.jobs[id]
+}
+
+// manifests returns the manifests of the files a job has downloaded so far
+func (s *service) manifests(j *job) []*gribdownloader.Manifest {
+	manifests := []*gribdownloader.Manifest{}
+	for _, event := range s.status(j).Progress.Files {
+		if event.Error != "" {
+			continue
+		}
+		manifest, err := gribdownloader.ReadManifest(gribdownloader.ManifestPath(event.Output))
+		if err != nil {
+			continue
+		}
+		manifests = append(manifests, manifest)
+	}
+	return manifests
+}
+
+// ServeHTTP implements the API:
+//
+//	POST   /jobs                 submit a job, answering with its ID
+//	GET    /jobs                 list the jobs
+//	GET    /jobs/{id}            show the status and progress of a job
+//	GET    /jobs/{id}/manifests  fetch the manifests of its files
+//	DELETE /jobs/{id}            cancel a job
+func (s *service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	if parts[0] != "jobs" || len(parts) > 3 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", r.URL.Path))
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodPost:
+			var req jobRequest
+			dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJobRequestSize))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&req); err != nil {
+				code := http.StatusBadRequest
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					code = http.StatusRequestEntityTooLarge
+				}
+				writeError(w, code, fmt.Errorf("invalid job: %v", err))
+				return
+			}
+			j, err := s.submit(req)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			writeJSON(w, http.StatusAccepted, s.status(j))
+		case http.MethodGet:
+			s.mutex.Lock()
+			jobs := make([]*job, 0, len(s.jobs))
+			for _, j := range s.jobs {
+				jobs = append(jobs, j)
+			}
+			s.mutex.Unlock()
+			sort.Slice(jobs, func(a, b int) bool { return jobs[a].Created.Before(jobs[b].Created) })
+			statuses := make([]jobStatus, len(jobs))
+			for i, j := range jobs {
+				statuses[i] = s.status(j)
+			}
+			writeJSON(w, http.StatusOK, statuses)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		}
+		return
+	}
+
+	j := s.lookup(parts[1])
+	if j == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown job %q", parts[1]))
+		return
+	}
+	switch {
+	case len(parts) == 3 && parts[2] == "manifests" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.manifests(j))
+	case len(parts) == 3:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", r.URL.Path))
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.status(j))
+	case r.Method == http.MethodDelete:
+		s.mutex.Lock()
+		cancel := j.cancel
+		s.mutex.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+		writeJSON(w, http.StatusOK, s.status(j))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// runServe implements the serve command
+func runServe(ctx context.Context, args []string) error {
+	fs, opts := newFlagSet("serve")
+	addr := fs.String("addr", "localhost:8080", "address to serve the job API on")
+	maxJobs := fs.Int("max-jobs", 1, "number of jobs run at once; later jobs wait in a queue")
+	parallel := fs.Int("parallel-files", 0, "number of files of a job downloaded at once (default max_files from the config, or 1)")
+
+	logger, err := parseArgs(fs, opts, args)
+	if err != nil {
+		return err
+	}
+	if *maxJobs < 1 {
+		return withExitCode(exitUsage, fmt.Errorf("--max-jobs must be at least 1"))
+	}
+
+	// Check the config file up front rather than with the first job
+	env, err := loadEnvironment(fs.Arg(0), opts, logger)
+	if err != nil {
+		return err
+	}
+	if *parallel <= 0 {
+		*parallel = env.config.MaxFiles
+	}
+	store, err := openJobStore(env.config.JobsFile)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	defer store.close()
+
+	s := &service{
+		ctx:        ctx,
+		configPath: fs.Arg(0),
+		opts:       *opts,
+		logger:     logger,
+		parallel:   *parallel,
+		slots:      make(chan struct{}, *maxJobs),
+		jobs:       map[string]*job{},
+		store:      store,
+	}
+	if err := s.restore(); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return fmt.Errorf("error starting server: %v", err)
+	}
+	server := &http.Server{Handler: s}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	slog.Info("serving job API", "addr", listener.Addr().String())
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("server failed: %v", err)
+	}
+
+	// The jobs were cancelled with ctx; interrupted files resume with the
+	// next download
+	s.wg.Wait()
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"gribdownloader"
+)
+
+// netcdfExpansion is a rough ratio of NetCDF to GRIB2 size: NetCDF holds
+// unpacked values where GRIB2 packs them into 12 to 16 bits
+const netcdfExpansion = 3
+
+// mb formats a size in megabytes for messages
+func mb(bytes uint64) string {
+	return fmt.Sprintf("%.1f MB", float64(bytes)/(1<<20))
+}
+
+// checkFreeSpace fails when a filesystem lacks room for the planned files,
+// along with the combined and converted files and cache copies, plus the
+// configured margin
+func checkFreeSpace(env *environment, plans map[string]*filePlan) error {
+	type filesystem struct {
+		dir        string // A directory on the filesystem, for messages
+		free, need uint64
+	}
+	filesystems := map[string]*filesystem{}
+	need := func(dir string, size uint64) error {
+		free, id, err := gribdownloader.FreeSpace(dir)
+		if err != nil {
+			return err
+		}
+		fs := filesystems[id]
+		if fs == nil {
+			fs = &filesystem{dir: dir, free: free}
+			filesystems[id] = fs
+		}
+		fs.need += size
+		return nil
+	}
+
+	for _, plan := range plans {
+		dir := filepath.Dir(plan.gribFileName)
+		size := uint64(plan.totalSize())
+		total := size
+		if env.combined != nil {
+			total += size
+		}
+		if env.converter != nil {
+			total += netcdfExpansion * size
+		}
+		err := need(dir, total)
+		if err == nil && env.config.CacheDir != "" {
+			err = need(env.config.CacheDir, size)
+		}
+		if errors.Is(err, errors.ErrUnsupported) {
+			slog.Debug("free space cannot be checked on this system")
+			return nil
+		}
+		if err != nil {
+			slog.Warn("could not check free space", "dir", dir, "error", err)
+			return nil
+		}
+	}
+
+	margin := uint64(env.config.SpaceMargin())
+	for _, fs := range filesystems {
+		if fs.need+margin > fs.free {
+			return withExitCode(exitNoSpace, fmt.Errorf("not enough free space for %s: the planned files need about %s and free_space_margin keeps %s free, but only %s is available",
+				fs.dir, mb(fs.need), mb(margin), mb(fs.free)))
+		}
+		slog.Debug("free space", "dir", fs.dir, "needed", fs.need, "free", fs.free)
+	}
+	return nil
+}
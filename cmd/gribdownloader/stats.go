@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gribdownloader"
+)
+
+// Stages of downloading a file, in the order they run
+var stageNames = []string{"wait", "plan", "download", "deliver", "upload"}
+
+// stageTimes is the time a file spent in each stage
+type stageTimes map[string]time.Duration
+
+// since adds the time since start to a stage and returns the current time,
+// which starts the next stage
+func (s stageTimes) since(stage string, start time.Time) time.Time {
+	now := time.Now()
+	s[stage] += now.Sub(start)
+	return now
+}
+
+// unmatchedSelector is a parameter, level or type of the config that
+// matched none of the records of some files
+type unmatchedSelector struct {
+	Selector string `json:"selector"`
+	Files    int    `json:"files"` // Files whose idx did not have it
+}
+
+// datasetStats summarizes the files of a dataset for the run report
+type datasetStats struct {
+	Dataset   string              `json:"dataset"`
+	Files     int                 `json:"files"`
+	Succeeded int                 `json:"succeeded"`
+	Skipped   int                 `json:"skipped"`
+	Failed    int                 `json:"failed"`
+	Selectors int                 `json:"selectors"` // Parameter and level entries requested by the config
+	Records   int                 `json:"records"`   // Records matched by them
+	Missing   int                 `json:"missing"`   // Matched records lost with failed ranges
+	Bytes     int64               `json:"bytes"`
+	Stages    map[string]float64  `json:"stages_seconds"` // Summed over the files
+	Unmatched []unmatchedSelector `json:"unmatched"`
+
+	planned   int            // Files whose idx was read
+	unmatched map[string]int // Files missing each selector
+}
+
+// runReport is the summary written by download --report
+type runReport struct {
+	Started       time.Time       `json:"started"`
+	Duration      float64         `json:"duration_seconds"`
+	Retries       int64           `json:"retries"`        // Range requests retried after failing
+	RangeFailures int64           `json:"range_failures"` // Ranges that failed on every mirror
+	Datasets      []*datasetStats `json:"datasets"`
+	Error         string          `json:"error,omitempty"`
+}
+
+// runStats collects the statistics of every file of a run for the report.
+// A nil collector discards them.
+type runStats struct {
+	started time.Time
+	stats   *gribdownloader.Stats
+
+	mutex    sync.Mutex
+	datasets map[string]*datasetStats
+}
+
+// newRunStats starts collecting statistics, counting the retries of the
+// downloader
+func newRunStats(downloader *gribdownloader.Downloader) *runStats {
+	if downloader.Stats == nil {
+		downloader.Stats = &gribdownloader.Stats{}
+	}
+	return &runStats{started: time.Now(), stats: downloader.Stats, datasets: map[string]*datasetStats{}}
+}
+
+// requestedSelectors counts the parameter and level entries of a selection,
+// an entry without levels counting once
+func requestedSelectors(selection gribdownloader.Selection) int {
+	n := 0
+	for name, levels := range selection.Parameters {
+		if strings.HasPrefix(name, "!") {
+			continue
+		}
+		n += max(1, len(levels))
+	}
+	return n
+}
+
+// add records the outcome of a file; plan is nil if it failed before its
+// idx was read
+func (s *runStats) add(dataset *gribdownloader.Dataset, target gribdownloader.Target, plan *filePlan, stages stageTimes, skipped bool, err error) {
+	if s == nil {
+		return
+	}
+	selection := dataset.SelectionFor(target)
+	var unmatched []string
+	if plan != nil {
+		// The selection was compiled when planning
+		unmatched, _ = selection.Unmatched(plan.parameters)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ds := s.datasets[dataset.Name]
+	if ds == nil {
+		ds = &datasetStats{Dataset: dataset.Name, Stages: map[string]float64{}, unmatched: map[string]int{}}
+		s.datasets[dataset.Name] = ds
+	}
+	ds.Files++
+	switch {
+	case err != nil:
+		ds.Failed++
+	case skipped:
+		ds.Skipped++
+	default:
+		ds.Succeeded++
+	}
+	ds.Selectors = max(ds.Selectors, requestedSelectors(selection))
+	if plan != nil {
+		ds.planned++
+		ds.Records += len(plan.records)
+		ds.Missing += len(plan.missing)
+		if !skipped && err == nil {
+			ds.Bytes += plan.totalSize()
+		}
+	}
+	for stage, d := range stages {
+		ds.Stages[stage] += d.Seconds()
+	}
+	for _, u := range unmatched {
+		ds.unmatched[u]++
+	}
+}
+
+// report summarizes the collected statistics of a run that ended with err
+func (s *runStats) report(err error) runReport {
+	r := runReport{
+		Started:       s.started.UTC(),
+		Duration:      time.Since(s.started).Seconds(),
+		Retries:       s.stats.RangeRetries.Load(),
+		RangeFailures: s.stats.RangeFailures.Load(),
+		Datasets:      []*datasetStats{},
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, name := range sortedKeys(s.datasets) {
+		ds := s.datasets[name]
+		ds.Unmatched = []unmatchedSelector{}
+		for _, selector := range sortedKeys(ds.unmatched) {
+			ds.Unmatched = append(ds.Unmatched, unmatchedSelector{Selector: selector, Files: ds.unmatched[selector]})
+		}
+		// Those missing from the most files first, as they are the likely
+		// mistakes
+		sort.SliceStable(ds.Unmatched, func(a, b int) bool { return ds.Unmatched[a].Files > ds.Unmatched[b].Files })
+		r.Datasets = append(r.Datasets, ds)
+	}
+	return r
+}
+
+// text formats the report for reading
+func (r runReport) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Run started %s, took %.1fs\n", r.Started.Format(time.RFC3339), r.Duration)
+	fmt.Fprintf(&b, "Retries: %d, ranges failed on every mirror: %d\n", r.Retries, r.RangeFailures)
+	if r.Error != "" {
+		fmt.Fprintf(&b, "Error: %s\n", r.Error)
+	}
+
+	for _, ds := range r.Datasets {
+		name := ds.Dataset
+		if name == "" {
+			name = "(default)"
+		}
+		fmt.Fprintf(&b, "\nDataset %s\n", name)
+		w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "  Files\t%d (%d succeeded, %d skipped, %d failed)\n", ds.Files, ds.Succeeded, ds.Skipped, ds.Failed)
+		fmt.Fprintf(w, "  Records\t%d matched by %d requested parameters and levels, %d lost\n", ds.Records, ds.Selectors, ds.Missing)
+		fmt.Fprintf(w, "  Downloaded\t%.2f MB\n", float64(ds.Bytes)/(1024*1024))
+		var stages []string
+		for _, stage := range stageNames {
+			if seconds, ok := ds.Stages[stage]; ok {
+				stages = append(stages, fmt.Sprintf("%s %.1fs", stage, seconds))
+			}
+		}
+		fmt.Fprintf(w, "  Time\t%s\n", strings.Join(stages, ", "))
+		w.Flush()
+
+		for _, u := range ds.Unmatched {
+			if u.Files == ds.planned {
+				fmt.Fprintf(&b, "  WARNING: %s matched nothing in any file\n", u.Selector)
+			} else {
+				fmt.Fprintf(&b, "  warning: %s matched nothing in %d of %d files\n", u.Selector, u.Files, ds.planned)
+			}
+		}
+	}
+	return b.String()
+}
+
+// textReportPath returns where the text form of a report at path is
+// written: next to it, with .json replaced by or extended with .txt
+func textReportPath(path string) string {
+	return strings.TrimSuffix(path, ".json") + ".txt"
+}
+
+// writeReport writes a report as JSON to path and as text next to it
+func writeReport(path string, r runReport) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	if err := os.WriteFile(textReportPath(path), []byte(r.text()), 0644); err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	return nil
+}
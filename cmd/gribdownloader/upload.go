@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gribdownloader"
+)
+
+// uploaders creates the uploader of each storage service on first use, so
+// that credentials are only required when files are uploaded
+type uploaders struct {
+	mutex      sync.Mutex
+	config     *gribdownloader.Config
+	downloader *gribdownloader.Downloader // Shares its connection settings
+	logger     *slog.Logger
+	byService  map[string]gribdownloader.Uploader
+}
+
+// get returns the uploader for the scheme of a storage URL
+func (u *uploaders) get(scheme string) (gribdownloader.Uploader, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if uploader, ok := u.byService[scheme]; ok {
+		return uploader, nil
+	}
+	uploader, err := u.config.NewUploader(scheme, u.downloader.Client(), u.logger)
+	if err != nil {
+		return nil, err
+	}
+	if u.byService == nil {
+		u.byService = map[string]gribdownloader.Uploader{}
+	}
+	u.byService[scheme] = uploader
+	return uploader, nil
+}
+
+// outputFiles returns the files that may be written for a GRIB output file,
+// in the order they are uploaded: the done file comes last so that it only
+// appears once the rest is in place
+func outputFiles(keepIdx bool, target gribdownloader.Target, gribFile string) []string {
+	files := []string{
+		gribFile,
+		gribdownloader.ManifestPath(gribFile),
+		gribdownloader.NetCDFPath(gribFile),
+		gribdownloader.KerchunkPath(gribFile),
+	}
+	if keepIdx && target.IdxURL != "" && !target.Field {
+		files = append(files, filepath.Join(filepath.Dir(gribFile), filepath.Base(target.IdxURL)))
+	}
+	return append(files, gribFile+".done")
+}
+
+// uploadFiles uploads those of the files that exist to the storage URLs
+// they are staged for, and then removes the staged copies unless keep is
+// set. It does nothing for datasets with a local output_dir.
+func uploadFiles(ctx context.Context, env *environment, dataset *gribdownloader.Dataset, files []string, keep bool) error {
+	var uploaded []string
+	for _, file := range files {
+		dest, ok := dataset.UploadURL(file)
+		if !ok {
+			return nil
+		}
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		u, err := url.Parse(dest)
+		if err != nil {
+			return fmt.Errorf("invalid upload URL %q: %v", dest, err)
+		}
+		uploader, err := env.uploads.get(u.Scheme)
+		if err != nil {
+			return err
+		}
+		slog.Info("uploading", "file", file, "url", dest)
+		if err := uploader.Upload(ctx, file, u); err != nil {
+			return fmt.Errorf("error uploading %s: %v", file, err)
+		}
+		uploaded = append(uploaded, file)
+	}
+
+	if !keep {
+		removeStaged(dataset, uploaded)
+	}
+	return nil
+}
+
+// removeStaged removes those of the files that exist from the staging
+// directory of a dataset that uploads its output
+func removeStaged(dataset *gribdownloader.Dataset, files []string) {
+	for _, file := range files {
+		if _, ok := dataset.UploadURL(file); !ok {
+			return
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			slog.Warn("could not remove staged file", "file", file, "error", err)
+		}
+	}
+}
+
+// deliverFiles pushes those of the files that exist to every deliver
+// directory of the dataset
+func deliverFiles(ctx context.Context, env *environment, dataset *gribdownloader.Dataset, target gribdownloader.Target, files []string) error {
+	if len(dataset.Deliver) == 0 {
+		return nil
+	}
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		for _, dest := range dataset.DeliveryURLs(target, file) {
+			u, err := url.Parse(dest)
+			if err != nil {
+				return fmt.Errorf("invalid deliver URL %q: %v", dest, err)
+			}
+			uploader, err := env.uploads.get(u.Scheme)
+			if err != nil {
+				return err
+			}
+			slog.Info("delivering", "file", file, "url", u.Redacted())
+			if err := uploader.Upload(ctx, file, u); err != nil {
+				return fmt.Errorf("error delivering %s to %s: %v", file, u.Redacted(), err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"gribdownloader"
+)
+
+// diagnostics collects the problems found by the validate command
+type diagnostics struct {
+	errors, warnings int
+}
+
+// errorf reports a problem that makes the configuration unusable
+func (d *diagnostics) errorf(format string, args ...any) {
+	d.errors++
+	fmt.Printf("error: "+format+"\n", args...)
+}
+
+// warnf reports a likely mistake
+func (d *diagnostics) warnf(format string, args ...any) {
+	d.warnings++
+	fmt.Printf("warning: "+format+"\n", args...)
+}
+
+// datasetLabel names a dataset in diagnostics
+func datasetLabel(dataset *gribdownloader.Dataset) string {
+	if dataset.Name == "" {
+		return "top-level dataset"
+	}
+	return fmt.Sprintf("dataset %q", dataset.Name)
+}
+
+// sampleTargets returns the targets of a dataset for checking its templates.
+// Datasets without a fixed date, or probing for the latest one when offline,
+// are expanded for the most recent nominal cycle.
+func sampleTargets(ctx context.Context, env *environment, dataset *gribdownloader.Dataset, offline bool) ([]gribdownloader.Target, error) {
+	probes := dataset.Date == "latest" || dataset.Date == "latest-complete"
+	if !dataset.UsesCycle() || (dataset.Date != "" && (!probes || !offline)) {
+		return dataset.Targets(ctx, env.downloader)
+	}
+
+	interval := dataset.CycleInterval
+	if interval <= 0 {
+		interval = gribdownloader.DefaultCycleInterval
+	}
+	run := time.Now().UTC().Truncate(time.Duration(interval) * time.Hour)
+	return dataset.TargetsForRun(run), nil
+}
+
+// checkTemplates reports placeholders left in the expanded URLs and paths
+func checkTemplates(diag *diagnostics, dataset *gribdownloader.Dataset, targets []gribdownloader.Target) {
+	seen := map[string]bool{}
+	for _, target := range targets {
+		for _, s := range append(target.IdxURLs(), target.Output) {
+			for _, p := range gribdownloader.UnresolvedPlaceholders(s) {
+				if !seen[p] {
+					seen[p] = true
+					diag.errorf("%s: unknown placeholder %s in %s", datasetLabel(dataset), p, s)
+				}
+			}
+		}
+	}
+}
+
+// checkSample downloads the idx file of the first target and reports the
+// parameters, levels and types of the selection that it does not contain.
+// Per-field datasets have no idx files, so the first field file is probed.
+func checkSample(ctx context.Context, diag *diagnostics, env *environment, dataset *gribdownloader.Dataset, target gribdownloader.Target) {
+	if target.Field {
+		if _, err := env.downloader.FieldIndex(ctx, target); err != nil {
+			diag.warnf("%s: sample field file %s: %v", datasetLabel(dataset), target.IdxURL, err)
+		}
+		return
+	}
+	data, err := fetchIdx(ctx, env.downloader, target.IdxURLs())
+	if err != nil {
+		diag.warnf("%s: could not download sample idx %s: %v", datasetLabel(dataset), target.IdxURL, err)
+		return
+	}
+
+	parser, _ := gribdownloader.IndexParserFor(dataset.IndexFormat)
+	parameters, err := gribdownloader.ParseIndex(data, parser)
+	if err != nil {
+		diag.errorf("%s: sample idx %s: %v", datasetLabel(dataset), target.IdxURL, err)
+		return
+	}
+
+	unmatched, err := dataset.SelectionFor(target).Unmatched(parameters)
+	if err != nil {
+		diag.errorf("%s: %v", datasetLabel(dataset), err)
+		return
+	}
+	for _, u := range unmatched {
+		diag.warnf("%s: %s does not appear in sample idx %s", datasetLabel(dataset), u, target.IdxURL)
+	}
+}
+
+// runValidate implements the validate command
+func runValidate(ctx context.Context, args []string) error {
+	fs, opts := newFlagSet("validate")
+	offline := fs.Bool("offline", false, "only check the configuration itself, without downloading a sample idx file")
+
+	logger, err := parseArgs(fs, opts, args)
+	if err != nil {
+		return err
+	}
+	configPath := fs.Arg(0)
+	if opts.dataset == "" {
+		opts.all = true
+	}
+
+	var diag diagnostics
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %v", err)
+	}
+	unknown, err := gribdownloader.UnknownKeys(data)
+	if err != nil {
+		diag.errorf("%v", err)
+	}
+	for _, key := range unknown {
+		diag.warnf("unknown key %q is ignored", key)
+	}
+
+	if diag.errors == 0 {
+		env, err := loadEnvironment(configPath, opts, logger)
+		if err != nil {
+			diag.errorf("%v", err)
+		} else {
+			if env.config.InsecureSkipVerify {
+				diag.warnf("insecure_skip_verify disables TLS certificate verification")
+			}
+			for _, dataset := range env.datasets {
+				if len(dataset.Parameters) == 0 && len(dataset.HourRules) == 0 {
+					diag.warnf("%s: no parameters are selected", datasetLabel(dataset))
+				}
+
+				targets, err := sampleTargets(ctx, env, dataset, *offline)
+				if err != nil {
+					diag.errorf("%s: %v", datasetLabel(dataset), err)
+					continue
+				}
+				checkTemplates(&diag, dataset, targets)
+
+				if !*offline && len(targets) > 0 {
+					checkSample(ctx, &diag, env, dataset, targets[0])
+				}
+			}
+		}
+	}
+
+	fmt.Printf("%s: %d errors, %d warnings\n", configPath, diag.errors, diag.warnings)
+	if diag.errors > 0 {
+		return withExitCode(exitConfig, fmt.Errorf("configuration is invalid"))
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"gribdownloader"
+)
+
+// verifyGRIB checks a previously downloaded file against its manifest and
+// returns the number of messages verified
+func verifyGRIB(target gribdownloader.Target) (int, error) {
+	gribFileName := outputPath(target)
+
+	manifest, err := gribdownloader.ReadManifest(gribdownloader.ManifestPath(gribFileName))
+	if err != nil {
+		return 0, err
+	}
+
+	if err := gribdownloader.VerifyManifest(gribFileName, manifest); err != nil {
+		return 0, err
+	}
+
+	if len(manifest.Missing) > 0 {
+		slog.Warn("file was kept with records missing", "file", gribFileName, "missing", len(manifest.Missing))
+	}
+	slog.Info("verified", "file", gribFileName, "messages", len(manifest.Messages))
+	return len(manifest.Messages), nil
+}
+
+// runVerify implements the verify command
+func runVerify(ctx context.Context, args []string) error {
+	fs, opts := newFlagSet("verify")
+	asJSON := fs.Bool("json", false, "print the outcome of every file as JSON")
+
+	env, err := setup(fs, opts, args)
+	if err != nil {
+		return err
+	}
+
+	results := []verifyResult{}
+	err = env.forEachTarget(ctx, func(_ *gribdownloader.Dataset, target gribdownloader.Target, _ gribdownloader.IndexParser) error {
+		messages, err := verifyGRIB(target)
+		result := verifyResult{
+			Output:   outputPath(target),
+			Manifest: gribdownloader.ManifestPath(outputPath(target)),
+			Messages: messages,
+			OK:       err == nil,
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+		return err
+	})
+	if *asJSON {
+		if jsonErr := printJSON(results); jsonErr != nil {
+			return jsonErr
+		}
+	}
+	if err != nil {
+		return withExitCode(exitVerify, err)
+	}
+
+	slog.Info("verification completed successfully")
+	return nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"gribdownloader"
+)
+
+// watchState tracks the cycle being watched for a dataset and which of its
+// files have been downloaded
+type watchState struct {
+	dataset   *gribdownloader.Dataset
+	parser    gribdownloader.IndexParser
+	run       time.Time
+	started   time.Time       // When watching run began
+	done      map[string]bool // Keyed by Target.Key
+	completed int             // Number of fully downloaded cycles
+	store     *jobStore
+
+	alerter  *alerter
+	failures map[string]int // Failed attempts in a row, keyed by Target.Key
+	late     bool           // Whether the watched cycle was reported late
+	budget   *budget        // Limits of the watched cycle
+}
+
+// failed counts a failed attempt at a file, alerting once when the failures
+// in a row reach after_failures
+func (st *watchState) failed(ctx context.Context, target gribdownloader.Target, err error) {
+	if st.alerter == nil {
+		return
+	}
+	st.failures[target.Key()]++
+	if st.failures[target.Key()] != st.alerter.config.Failures() {
+		return
+	}
+	st.alerter.alert(ctx, fmt.Sprintf("downloads of cycle %s%s keep failing", st.run.Format("2006010215"), datasetSuffix(st.dataset)),
+		fmt.Sprintf("%s failed %d times in a row.\nLast error: %v", target.IdxURL, st.failures[target.Key()], err))
+}
+
+// checkLate alerts once per cycle when the watched cycle is still
+// incomplete late_after past its run time
+func (st *watchState) checkLate(ctx context.Context, pending int) {
+	if st.alerter == nil || st.late {
+		return
+	}
+	late := st.alerter.config.Late()
+	if late <= 0 || time.Since(st.run) < late {
+		return
+	}
+	st.late = true
+	st.alerter.alert(ctx, fmt.Sprintf("cycle %s%s is late", st.run.Format("2006010215"), datasetSuffix(st.dataset)),
+		fmt.Sprintf("%d files are still missing %v after the cycle's run time.", pending, time.Since(st.run).Round(time.Minute)))
+}
+
+// persist writes the watched cycle to the jobs file, adding the job of a
+// cycle once complete
+func (st *watchState) persist(complete *job) {
+	record := watchRecord{Cycle: st.run.Format("2006010215"), Done: sortedKeys(st.done)}
+	st.store.putWatch(st.dataset.Name, record, complete)
+}
+
+// completedJob returns the job recording the download of the watched cycle
+func (st *watchState) completedJob() (*job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	finished := time.Now().UTC()
+	started := st.started.UTC()
+	return &job{
+		ID:       id,
+		Kind:     jobWatch,
+		Status:   jobSucceeded,
+		Request:  jobRequest{Dataset: st.dataset.Name, Date: st.run.Format("20060102"), Cycle: st.run.Format("15")},
+		Created:  started,
+		Started:  &started,
+		Finished: &finished,
+		Attempts: 1,
+	}, nil
+}
+
+// idxExists reports whether any of the mirrors serves the idx file
+func idxExists(ctx context.Context, downloader *gribdownloader.Downloader, idxURLs []string) (bool, error) {
+	var errs []error
+	for _, idxURL := range idxURLs {
+		ok, err := downloader.Exists(ctx, idxURL)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	if len(errs) == len(idxURLs) {
+		return false, fmt.Errorf("all mirrors failed: %v", errs)
+	}
+	return false, nil
+}
+
+// downloaded reports whether a target was already downloaded, i.e. its
+// manifest exists
+func downloaded(target gribdownloader.Target) bool {
+	_, err := os.Stat(gribdownloader.ManifestPath(outputPath(target)))
+	return err == nil
+}
+
+// poll downloads the newly published files of the watched cycle. Once every
+// file of the cycle is downloaded it moves on to the next cycle, until limit
+// cycles are complete (zero means no limit).
+func (st *watchState) poll(ctx context.Context, env *environment, limit int) {
+	for limit == 0 || st.completed < limit {
+		pending := 0
+		for _, target := range st.dataset.TargetsForRun(st.run) {
+			if st.done[target.Key()] {
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if downloaded(target) {
+				st.done[target.Key()] = true
+				st.persist(nil)
+				continue
+			}
+
+			ok, err := idxExists(ctx, env.downloader, target.IdxURLs())
+			if err != nil {
+				slog.Warn("could not probe idx file", "dataset", st.dataset.Name, "idx_url", target.IdxURL, "error", err)
+				st.failed(ctx, target, err)
+			}
+			if !ok {
+				pending++
+				continue
+			}
+
+			if err := downloadTarget(ctx, env, nil, st.budget)(st.dataset, target, st.parser); err != nil {
+				slog.Error("failed", "dataset", st.dataset.Name, "idx_url", target.IdxURL, "error", err)
+				st.failed(ctx, target, err)
+				pending++
+				continue
+			}
+			delete(st.failures, target.Key())
+			st.done[target.Key()] = true
+			st.persist(nil)
+		}
+
+		if pending > 0 {
+			slog.Debug("waiting for files", "dataset", st.dataset.Name, "cycle", st.run.Format("2006010215"), "pending", pending)
+			st.checkLate(ctx, pending)
+			return
+		}
+
+		slog.Info("cycle complete", "dataset", st.dataset.Name, "cycle", st.run.Format("2006010215"))
+		st.completed++
+		complete, err := st.completedJob()
+		if err != nil {
+			slog.Warn("could not record the completed cycle", "dataset", st.dataset.Name, "error", err)
+		}
+		if retention := st.dataset.Retention(); !retention.IsZero() {
+			if _, err := pruneCycles(st.dataset, retention, gribdownloader.DefaultRetentionLookback, false); err != nil {
+				slog.Warn("could not remove old cycles", "dataset", st.dataset.Name, "error", err)
+			}
+		}
+		st.run = st.dataset.NextCycle(st.run)
+		st.started = time.Now()
+		st.done = map[string]bool{}
+		st.failures = map[string]int{}
+		st.late = false
+		st.budget = newBudget(env.config)
+		st.persist(complete)
+	}
+}
+
+// runWatch implements the watch command
+func runWatch(ctx context.Context, args []string) error {
+	fs, opts := newFlagSet("watch")
+	interval := fs.Duration("interval", 5*time.Minute, "time between polls for new files")
+	cycles := fs.Int("cycles", 0, "stop after this many complete cycles per dataset; 0 watches indefinitely")
+	duration := fs.Duration("duration", 0, "stop after watching for this long; 0 watches indefinitely")
+	metricsAddr := fs.String("metrics-addr", "", "serve Prometheus metrics on this address (e.g. :9090)")
+
+	env, err := setup(fs, opts, args)
+	if err != nil {
+		return err
+	}
+	env.downloader.Resume = true
+
+	if *metricsAddr != "" {
+		if err := serveMetrics(ctx, env, *metricsAddr); err != nil {
+			return err
+		}
+	}
+
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	store, err := openJobStore(env.config.JobsFile)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	defer store.close()
+
+	alerts := newAlerter(env.config.Alerts)
+
+	// Resume the cycle of the jobs file, or start from the configured run or
+	// the latest published one
+	states := make([]*watchState, 0, len(env.datasets))
+	for _, dataset := range env.datasets {
+		if !dataset.UsesCycle() {
+			return fmt.Errorf("dataset %q: watch requires {yyyymmdd} or {cycle} in idx_url", dataset.Name)
+		}
+		if dataset.Date == "" {
+			dataset.Date = "latest"
+		}
+
+		parser, err := gribdownloader.IndexParserFor(dataset.IndexFormat)
+		if err != nil {
+			return err
+		}
+
+		st := &watchState{
+			dataset:  dataset,
+			parser:   parser,
+			started:  time.Now(),
+			done:     map[string]bool{},
+			store:    store,
+			alerter:  alerts,
+			failures: map[string]int{},
+			budget:   newBudget(env.config),
+		}
+		if record, ok := store.watchRecord(dataset.Name); ok {
+			run, err := time.Parse("2006010215", record.Cycle)
+			if err != nil {
+				return fmt.Errorf("dataset %q: invalid cycle %q in jobs file", dataset.Name, record.Cycle)
+			}
+			st.run = run
+			for _, idxURL := range record.Done {
+				st.done[idxURL] = true
+			}
+			slog.Info("resuming watch", "dataset", dataset.Name, "cycle", record.Cycle, "done", len(record.Done))
+		} else {
+			st.run, err = dataset.RunTime(ctx, env.downloader)
+			if err != nil {
+				return fmt.Errorf("dataset %q: %v", dataset.Name, err)
+			}
+			slog.Info("watching", "dataset", dataset.Name, "cycle", st.run.Format("2006010215"))
+		}
+		states = append(states, st)
+	}
+
+	for {
+		active := false
+		for _, st := range states {
+			st.poll(ctx, env, *cycles)
+			if *cycles == 0 || st.completed < *cycles {
+				active = true
+			}
+		}
+		if !active {
+			slog.Info("watch completed", "cycles", *cycles)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				slog.Info("watch duration elapsed")
+				return nil
+			}
+			return ctx.Err()
+		case <-time.After(*interval):
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"gribdownloader"
+)
+
+// webhookTimeout bounds each webhook request so a slow receiver cannot
+// stall downloads
+const webhookTimeout = 10 * time.Second
+
+// webhookEvent is the JSON body posted to webhooks
+type webhookEvent struct {
+	Event    string    `json:"event"` // start, success, skipped or failure
+	Time     time.Time `json:"time"`
+	Dataset  string    `json:"dataset,omitempty"`
+	IdxURL   string    `json:"idx_url"`
+	GribURL  string    `json:"grib_url"`
+	Output   string    `json:"output"`
+	Date     string    `json:"date,omitempty"`
+	Cycle    string    `json:"cycle,omitempty"`
+	FHR      string    `json:"fhr,omitempty"`
+	Member   string    `json:"member,omitempty"`
+	Records  int       `json:"records,omitempty"`
+	Missing  int       `json:"missing,omitempty"` // Records lost with failed ranges
+	Ranges   int       `json:"ranges,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Duration float64   `json:"duration_seconds,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// newWebhookEvent returns an event describing a target
+func newWebhookEvent(event string, target gribdownloader.Target) webhookEvent {
+	return webhookEvent{
+		Event:   event,
+		Time:    time.Now().UTC(),
+		Dataset: target.Dataset,
+		IdxURL:  target.IdxURL,
+		GribURL: gribdownloader.GribURL(target.IdxURL),
+		Output:  outputPath(target),
+		Date:    target.Vars["yyyymmdd"],
+		Cycle:   target.Vars["cycle"],
+		FHR:     target.Vars["fhr"],
+		Member:  target.Vars["member"],
+	}
+}
+
+// notifier posts events to the configured webhooks
+type notifier struct {
+	urls   []string
+	client *http.Client
+}
+
+// newNotifier returns a notifier for the given webhook URLs
+func newNotifier(urls []string) *notifier {
+	return &notifier{urls: urls, client: &http.Client{Timeout: webhookTimeout}}
+}
+
+// send posts an event to every webhook. Failures are logged and do not
+// affect the download.
+func (n *notifier) send(ctx context.Context, event webhookEvent) {
+	if n == nil || len(n.urls) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Warn("could not encode webhook event", "error", err)
+		return
+	}
+
+	for _, url := range n.urls {
+		if err := n.post(ctx, url, body); err != nil {
+			slog.Warn("webhook failed", "url", url, "event", event.Event, "error", err)
+		}
+	}
+}
+
+// post sends a single webhook request
+func (n *notifier) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
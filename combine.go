@@ -0,0 +1,65 @@
+package gribdownloader
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// CombineFiles concatenates the GRIB files inputs, in the order given, into
+// outputFile and writes its manifest, listing the messages of the manifests
+// of the inputs at their new offsets. Like downloads, the output is written
+// to a temporary file and moved into place once complete.
+func CombineFiles(outputFile string, inputs []string) (*Manifest, error) {
+	manifest := &Manifest{
+		File:    outputFile,
+		Created: time.Now().UTC(),
+	}
+
+	part := PartPath(outputFile)
+	out, err := os.Create(part)
+	if err != nil {
+		return nil, fmt.Errorf("error creating combined file: %v", err)
+	}
+	defer os.Remove(part)
+	defer out.Close()
+
+	var offset int64
+	for _, input := range inputs {
+		m, err := ReadManifest(ManifestPath(input))
+		if err != nil {
+			return nil, err
+		}
+		if manifest.Source == "" {
+			manifest.Source, manifest.Region = m.Source, m.Region
+		}
+		for _, msg := range m.Messages {
+			msg.Offset += offset
+			manifest.Messages = append(manifest.Messages, msg)
+		}
+		manifest.Missing = append(manifest.Missing, m.Missing...)
+
+		in, err := os.Open(input)
+		if err != nil {
+			return nil, fmt.Errorf("error opening %s: %v", input, err)
+		}
+		n, err := io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error copying %s: %v", input, err)
+		}
+		offset += n
+	}
+
+	if err := out.Close(); err != nil {
+		return nil, fmt.Errorf("error closing combined file: %v", err)
+	}
+	if err := os.Rename(part, outputFile); err != nil {
+		return nil, fmt.Errorf("error renaming combined file: %v", err)
+	}
+	if err := WriteManifest(ManifestPath(outputFile), manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
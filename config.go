@@ -0,0 +1,522 @@
+package gribdownloader
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config represents the structure of the configuration file. A single
+// dataset may be described with top-level fields, and any number of named
+// datasets under "datasets".
+type Config struct {
+	Dataset
+	Datasets map[string]*Dataset `json:"datasets"`
+	// ParameterGroups are named parameter selections that datasets include
+	// by listing them under "groups"
+	ParameterGroups map[string]map[string][]string `json:"parameter_groups"`
+
+	MaxConcurrency      int    `json:"max_concurrency"`
+	MaxTotalConcurrency int    `json:"max_total_concurrency"`
+	AdaptiveConcurrency int    `json:"adaptive_concurrency"` // Upper bound of the tuned concurrency
+	MaxConnsPerHost     int    `json:"max_conns_per_host"`
+	S3Region            string `json:"s3_region"`
+	MaxFiles            int    `json:"max_files"` // Files downloaded in parallel
+	MaxRate             string `json:"max_rate"`  // Bandwidth limit such as "10MB/s"
+	MergeGapBytes       int64  `json:"merge_gap_bytes"`
+	MultipartRanges     int    `json:"multipart_ranges"` // Ranges per request
+	InFlightBytes       string `json:"in_flight_bytes"`  // Data buffered ahead of the writer when streaming, e.g. "256MB"
+	MemoryMap           bool   `json:"mmap_output"`      // Write output files through a memory map
+
+	ReadTimeout         string `json:"read_timeout"`      // Without data, e.g. "60s"
+	RequestTimeout      string `json:"request_timeout"`   // Whole request, e.g. "10m"; none by default
+	DownloadTimeout     string `json:"download_timeout"`  // Whole download run, e.g. "2h"; none by default
+	IdleConnTimeout     string `json:"idle_conn_timeout"` // e.g. "90s"
+	MaxIdleConnsPerHost int    `json:"max_idle_conns_per_host"`
+	DisableHTTP2        bool   `json:"disable_http2"`
+	UserAgent           string `json:"user_agent"`      // Sent instead of the default gribdownloader/VERSION
+	MaxRetryAfter       string `json:"max_retry_after"` // Longest cooldown after 429/503, e.g. "5m"; default 2m
+
+	Proxy              string `json:"proxy"`   // e.g. "http://proxy:3128" or "socks5://localhost:1080"
+	CAFile             string `json:"ca_file"` // PEM bundle trusted in addition to the system roots
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+
+	OutputMode        OutputMode `json:"output_mode"`
+	SkipValidation    bool       `json:"skip_validation"`
+	WholeFileFallback bool       `json:"whole_file_fallback"` // For servers that ignore Range headers
+	VerifyChecksums   bool       `json:"verify_checksums"`    // Check whole files against .sha256/.md5 sidecars
+	DoneFile          bool       `json:"done_file"`
+	IdxCacheDir       string     `json:"idx_cache_dir"` // Revalidate idx files cached here with ETag/Last-Modified
+	CacheDir          string     `json:"cache_dir"`     // Keep copies of downloaded files here to skip repeated downloads
+	JobsFile          string     `json:"jobs_file"`     // SQLite database keeping the jobs of serve and watch so a restart resumes them
+
+	// PartialPolicy decides whether a file with failed ranges is kept;
+	// RequirePercent keeps it only when at least this share of its records
+	// was downloaded
+	PartialPolicy  PartialPolicy `json:"partial_policy"`
+	RequirePercent float64       `json:"require_percent"`
+
+	// Strict warns about or fails files for which a requested parameter,
+	// level or type matches no idx record; empty does neither unless
+	// --strict is given, which fails them
+	Strict StrictMode `json:"strict"`
+
+	// PostHook is a command and its arguments run after each file is
+	// downloaded; arguments may use {output}, {manifest}, {netcdf},
+	// {dataset}, {idx_url}, {grib_url}, {date}, {cycle}, {fhr} and {member}
+	PostHook []string `json:"post_hook"`
+	// Converter names the program converting GRIB to NetCDF for --to
+	// netcdf: "wgrib2" (the default) or "grib_to_netcdf" from ecCodes.
+	// ConverterCommand instead runs any command, with {input} and {output}
+	// placeholders.
+	Converter        string   `json:"converter"`
+	ConverterCommand []string `json:"converter_command"`
+	// Webhooks are URLs that receive a JSON POST when each file starts,
+	// succeeds or fails
+	Webhooks []string `json:"webhooks"`
+	// Publish lists message brokers sent a "ready" event with the path,
+	// cycle and parameters of each downloaded file
+	Publish []PublishTarget `json:"publish"`
+	// Alerts notify people by Slack or email when watch keeps failing
+	Alerts *AlertConfig `json:"alerts"`
+
+	// StagingDir holds the files of datasets whose output_dir is a storage
+	// URL (s3://, gs:// or az://) until they are uploaded
+	StagingDir       string `json:"staging_dir"`
+	UploadEndpoint   string `json:"upload_endpoint"`   // S3-compatible service, e.g. "http://localhost:9000"
+	UploadEncryption string `json:"upload_encryption"` // S3 server-side encryption: "AES256" or "aws:kms"
+	UploadKMSKeyID   string `json:"upload_kms_key_id"`
+	UploadPartSizeMB int    `json:"upload_part_size_mb"`
+	UploadRetries    int    `json:"upload_retries"`
+
+	// FreeSpaceMargin is the space, such as "1GB", that must remain free
+	// after the planned files are written; empty uses
+	// DefaultFreeSpaceMargin
+	FreeSpaceMargin string `json:"free_space_margin"`
+
+	// MaxTotalBytes, such as "50GB", and MaxRequests limit the data a run,
+	// or a cycle under watch, downloads, guarding against selections that
+	// pull far more data than intended; empty or zero means no limit
+	MaxTotalBytes string `json:"max_total_bytes"`
+	MaxRequests   int    `json:"max_requests"`
+}
+
+// DefaultFreeSpaceMargin is the space left free by the preflight check when
+// free_space_margin is not set
+const DefaultFreeSpaceMargin = 256 << 20
+
+// TotalBytesLimit returns max_total_bytes in bytes, or zero for no limit
+func (c *Config) TotalBytesLimit() int64 {
+	// Checked by Validate
+	limit, _ := ParseSize(c.MaxTotalBytes)
+	return limit
+}
+
+// SpaceMargin returns the free space margin in bytes
+func (c *Config) SpaceMargin() int64 {
+	if c.FreeSpaceMargin == "" {
+		return DefaultFreeSpaceMargin
+	}
+	// Checked by Validate
+	margin, _ := ParseSize(c.FreeSpaceMargin)
+	return margin
+}
+
+// LoadConfig reads, parses and validates a JSON configuration file
+func LoadConfig(path string) (*Config, error) {
+	config, err := ReadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ReadConfig reads and parses a JSON configuration file without validating
+// it, so that settings can be overridden before calling Validate
+func ReadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error parsing config file: %v", err)
+	}
+	return &config, nil
+}
+
+// Validate applies dataset presets and checks the configuration for
+// consistency
+func (c *Config) Validate() error {
+	if c.IdxURL == "" && c.FieldURL == "" && c.Preset == "" && len(c.Datasets) == 0 {
+		return fmt.Errorf("config defines neither idx_url, field_url, preset nor datasets")
+	}
+
+	stagingDir := c.StagingDir
+	if stagingDir == "" {
+		stagingDir = DefaultStagingDir()
+	}
+	c.Dataset.stagingDir = stagingDir
+
+	if c.IdxURL != "" || c.FieldURL != "" || c.Preset != "" {
+		if err := c.Dataset.applyGroups(c.ParameterGroups); err != nil {
+			return err
+		}
+		if err := c.Dataset.validate(); err != nil {
+			return err
+		}
+	} else if c.Dataset.hasAuth() {
+		// Named datasets do not inherit the top-level settings, which would
+		// otherwise be dropped without a word
+		return fmt.Errorf("top-level headers, username, password and auth_provider require idx_url, field_url or preset; set them on each dataset under \"datasets\" instead")
+	}
+
+	for name, dataset := range c.Datasets {
+		if dataset == nil {
+			return fmt.Errorf("dataset %q is empty", name)
+		}
+		dataset.Name = name
+		dataset.stagingDir = stagingDir
+		if err := dataset.applyGroups(c.ParameterGroups); err != nil {
+			return fmt.Errorf("dataset %q: %v", name, err)
+		}
+		if err := dataset.validate(); err != nil {
+			return fmt.Errorf("dataset %q: %v", name, err)
+		}
+	}
+
+	if c.MaxRate != "" {
+		if _, err := ParseRate(c.MaxRate); err != nil {
+			return fmt.Errorf("invalid max_rate: %v", err)
+		}
+	}
+
+	for name, value := range map[string]string{
+		"read_timeout":      c.ReadTimeout,
+		"request_timeout":   c.RequestTimeout,
+		"download_timeout":  c.DownloadTimeout,
+		"idle_conn_timeout": c.IdleConnTimeout,
+		"max_retry_after":   c.MaxRetryAfter,
+	} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			return fmt.Errorf("invalid %s %q: expected a duration such as 30s", name, value)
+		}
+	}
+
+	if c.Proxy != "" {
+		if _, err := ParseProxy(c.Proxy); err != nil {
+			return err
+		}
+	}
+
+	if c.CAFile != "" {
+		if _, err := LoadCertPool(c.CAFile); err != nil {
+			return fmt.Errorf("invalid ca_file: %v", err)
+		}
+	}
+
+	if c.InFlightBytes != "" {
+		if _, err := ParseSize(c.InFlightBytes); err != nil {
+			return fmt.Errorf("invalid in_flight_bytes: %v", err)
+		}
+	}
+
+	if c.FreeSpaceMargin != "" {
+		if _, err := ParseSize(c.FreeSpaceMargin); err != nil {
+			return fmt.Errorf("invalid free_space_margin: %v", err)
+		}
+	}
+
+	if c.MaxTotalBytes != "" {
+		if _, err := ParseSize(c.MaxTotalBytes); err != nil {
+			return fmt.Errorf("invalid max_total_bytes: %v", err)
+		}
+	}
+	if c.MaxRequests < 0 {
+		return fmt.Errorf("invalid max_requests %d: must not be negative", c.MaxRequests)
+	}
+
+	if c.AdaptiveConcurrency < 0 {
+		return fmt.Errorf("invalid adaptive_concurrency %d: must not be negative", c.AdaptiveConcurrency)
+	}
+
+	if c.MergeGapBytes < 0 {
+		return fmt.Errorf("invalid merge_gap_bytes %d: must not be negative", c.MergeGapBytes)
+	}
+
+	if len(c.PostHook) > 0 && c.PostHook[0] == "" {
+		return fmt.Errorf("post_hook has an empty command")
+	}
+
+	if _, err := NetCDFConverter(c.Converter, c.ConverterCommand); err != nil {
+		return err
+	}
+
+	if c.Alerts != nil {
+		if err := c.Alerts.validate(); err != nil {
+			return fmt.Errorf("alerts: %v", err)
+		}
+	}
+
+	for i, target := range c.Publish {
+		if err := target.validate(); err != nil {
+			return fmt.Errorf("publish[%d]: %v", i, err)
+		}
+	}
+
+	switch c.UploadEncryption {
+	case "", "AES256", "aws:kms":
+	default:
+		return fmt.Errorf("invalid upload_encryption %q: expected \"AES256\" or \"aws:kms\"", c.UploadEncryption)
+	}
+	if c.UploadKMSKeyID != "" && c.UploadEncryption != "aws:kms" {
+		return fmt.Errorf("upload_kms_key_id requires upload_encryption \"aws:kms\"")
+	}
+	// S3 rejects parts below 5 MB other than the last
+	if c.UploadPartSizeMB != 0 && c.UploadPartSizeMB < 5 {
+		return fmt.Errorf("invalid upload_part_size_mb %d: must be at least 5", c.UploadPartSizeMB)
+	}
+	if c.UploadRetries < 0 {
+		return fmt.Errorf("invalid upload_retries %d: must not be negative", c.UploadRetries)
+	}
+
+	switch c.OutputMode {
+	case "", OutputCompact, OutputSparse:
+	default:
+		return fmt.Errorf("invalid output_mode %q: expected %q or %q", c.OutputMode, OutputCompact, OutputSparse)
+	}
+
+	switch c.PartialPolicy {
+	case "", PartialFail, PartialKeep:
+	default:
+		return fmt.Errorf("invalid partial_policy %q: expected %q or %q", c.PartialPolicy, PartialFail, PartialKeep)
+	}
+	switch c.Strict {
+	case "", StrictWarn, StrictFail:
+	default:
+		return fmt.Errorf("invalid strict %q: expected %q or %q", c.Strict, StrictWarn, StrictFail)
+	}
+
+	if c.RequirePercent < 0 || c.RequirePercent > 100 {
+		return fmt.Errorf("invalid require_percent %g: must be between 0 and 100", c.RequirePercent)
+	}
+	if c.RequirePercent > 0 && c.PartialPolicy == PartialFail {
+		return fmt.Errorf("require_percent cannot be used with partial_policy %q", PartialFail)
+	}
+
+	// Subsetting rewrites the file message by message, which leaves no room
+	// for the gaps of sparse output
+	if c.OutputMode == OutputSparse {
+		if c.Region != nil {
+			return fmt.Errorf("region cannot be used with sparse output")
+		}
+		for name, dataset := range c.Datasets {
+			if dataset.Region != nil {
+				return fmt.Errorf("dataset %q: region cannot be used with sparse output", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// NewDownloader returns a Downloader configured from the download settings
+func (c *Config) NewDownloader() *Downloader {
+	// max_rate, in_flight_bytes, the timeouts, proxy and ca_file are checked
+	// by Validate
+	maxRate, _ := ParseRate(c.MaxRate)
+	inFlight, _ := ParseSize(c.InFlightBytes)
+	readTimeout, _ := time.ParseDuration(c.ReadTimeout)
+	requestTimeout, _ := time.ParseDuration(c.RequestTimeout)
+	idleConnTimeout, _ := time.ParseDuration(c.IdleConnTimeout)
+	maxRetryAfter, _ := time.ParseDuration(c.MaxRetryAfter)
+	var proxy *url.URL
+	if c.Proxy != "" {
+		proxy, _ = ParseProxy(c.Proxy)
+	}
+	var idxCache *IdxCache
+	if c.IdxCacheDir != "" {
+		idxCache = &IdxCache{Dir: c.IdxCacheDir}
+	}
+	var rootCAs *x509.CertPool
+	if c.CAFile != "" {
+		rootCAs, _ = LoadCertPool(c.CAFile)
+	}
+	return &Downloader{
+		ReadTimeout:         readTimeout,
+		RequestTimeout:      requestTimeout,
+		IdleConnTimeout:     idleConnTimeout,
+		MaxIdleConnsPerHost: c.MaxIdleConnsPerHost,
+		MergeGap:            c.MergeGapBytes,
+		MultipartRanges:     c.MultipartRanges,
+		DisableHTTP2:        c.DisableHTTP2,
+		UserAgent:           c.UserAgent,
+		MaxRetryAfter:       maxRetryAfter,
+		Proxy:               proxy,
+		RootCAs:             rootCAs,
+		InsecureSkipVerify:  c.InsecureSkipVerify,
+		Auth:                c.auth(),
+		MaxRate:             maxRate,
+		MaxConcurrency:      c.MaxConcurrency,
+		MaxTotalConcurrency: c.MaxTotalConcurrency,
+		AdaptiveConcurrency: c.AdaptiveConcurrency,
+		InFlightBytes:       inFlight,
+		MemoryMap:           c.MemoryMap,
+		MaxConnsPerHost:     c.MaxConnsPerHost,
+		OutputMode:          c.OutputMode,
+		S3Region:            c.S3Region,
+		SkipValidation:      c.SkipValidation,
+		WholeFileFallback:   c.WholeFileFallback,
+		VerifyChecksums:     c.VerifyChecksums,
+		KeepPartial:         c.KeepPartial(),
+		IdxCache:            idxCache,
+	}
+}
+
+// KeepPartial reports whether files with failed ranges are kept, either
+// always or subject to require_percent
+func (c *Config) KeepPartial() bool {
+	return c.PartialPolicy == PartialKeep || c.RequirePercent > 0
+}
+
+// auth collects the headers and credentials of every dataset
+func (c *Config) auth() []RequestAuth {
+	auths := c.Dataset.Auth()
+	for _, name := range c.DatasetNames() {
+		auths = append(auths, c.Datasets[name].Auth()...)
+	}
+	return auths
+}
+
+// DatasetNames returns the names of the named datasets in sorted order
+func (c *Config) DatasetNames() []string {
+	names := make([]string, 0, len(c.Datasets))
+	for name := range c.Datasets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SelectDatasets returns the datasets to download. With all set every named
+// dataset is returned in name order; otherwise name selects a named dataset.
+// An empty name selects the top-level dataset, or the only named dataset if
+// there is no top-level one.
+func (c *Config) SelectDatasets(name string, all bool) ([]*Dataset, error) {
+	if all {
+		var datasets []*Dataset
+		if c.IdxURL != "" || c.FieldURL != "" {
+			datasets = append(datasets, &c.Dataset)
+		}
+		for _, n := range c.DatasetNames() {
+			datasets = append(datasets, c.Datasets[n])
+		}
+		return datasets, nil
+	}
+
+	if name != "" {
+		dataset, ok := c.Datasets[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown dataset %q (available: %v)", name, c.DatasetNames())
+		}
+		return []*Dataset{dataset}, nil
+	}
+
+	if c.IdxURL != "" || c.FieldURL != "" {
+		return []*Dataset{&c.Dataset}, nil
+	}
+	if len(c.Datasets) == 1 {
+		return []*Dataset{c.Datasets[c.DatasetNames()[0]]}, nil
+	}
+	return nil, fmt.Errorf("config defines several datasets, choose one of %v", c.DatasetNames())
+}
+
+// jsonKeys returns the JSON object keys of a struct type, including those of
+// embedded structs
+func jsonKeys(t reflect.Type) map[string]bool {
+	keys := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			for key := range jsonKeys(field.Type) {
+				keys[key] = true
+			}
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			keys[name] = true
+		}
+	}
+	return keys
+}
+
+// unknownHourRuleKeys returns the unknown keys of the hour_rules of a
+// dataset, prefixed with the path of the dataset
+func unknownHourRuleKeys(prefix string, rules json.RawMessage) []string {
+	var entries []map[string]json.RawMessage
+	if len(rules) == 0 || json.Unmarshal(rules, &entries) != nil {
+		return nil // Malformed rules are reported when the config is parsed
+	}
+	var unknown []string
+	known := jsonKeys(reflect.TypeOf(HourRule{}))
+	for i, entry := range entries {
+		for key := range entry {
+			if !known[key] {
+				unknown = append(unknown, fmt.Sprintf("%shour_rules[%d].%s", prefix, i, key))
+			}
+		}
+	}
+	return unknown
+}
+
+// UnknownKeys returns the keys of a JSON configuration that do not
+// correspond to any setting, in sorted order. Keys of named datasets are
+// reported as "datasets.<name>.<key>".
+func UnknownKeys(data []byte) ([]string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing config file: %v", err)
+	}
+
+	var unknown []string
+	known := jsonKeys(reflect.TypeOf(Config{}))
+	for key := range raw {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	unknown = append(unknown, unknownHourRuleKeys("", raw["hour_rules"])...)
+
+	if datasets, ok := raw["datasets"]; ok {
+		var named map[string]map[string]json.RawMessage
+		if err := json.Unmarshal(datasets, &named); err != nil {
+			return nil, fmt.Errorf("error parsing datasets: %v", err)
+		}
+		known := jsonKeys(reflect.TypeOf(Dataset{}))
+		for name, dataset := range named {
+			for key := range dataset {
+				if !known[key] {
+					unknown = append(unknown, "datasets."+name+"."+key)
+				}
+			}
+			unknown = append(unknown, unknownHourRuleKeys("datasets."+name+".", dataset["hour_rules"])...)
+		}
+	}
+
+	sort.Strings(unknown)
+	return unknown, nil
+}
@@ -0,0 +1,95 @@
+package gribdownloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Converter converts a GRIB file into another format
+type Converter interface {
+	Convert(ctx context.Context, input, output string) error
+}
+
+// CommandConverter converts files by running an external program. The
+// arguments may use the {input} and {output} placeholders.
+type CommandConverter struct {
+	Command []string
+}
+
+// netcdfConverters are the built-in GRIB to NetCDF converters by name
+var netcdfConverters = map[string][]string{
+	"wgrib2":         {"wgrib2", "{input}", "-netcdf", "{output}"},
+	"grib_to_netcdf": {"grib_to_netcdf", "-o", "{output}", "{input}"}, // ecCodes
+}
+
+// DefaultNetCDFConverter is the converter used when none is configured
+const DefaultNetCDFConverter = "wgrib2"
+
+// NetCDFConverter returns the built-in converter with the given name, or
+// one running command when it is set
+func NetCDFConverter(name string, command []string) (Converter, error) {
+	if len(command) > 0 {
+		if command[0] == "" {
+			return nil, fmt.Errorf("converter_command has an empty command")
+		}
+		return CommandConverter{Command: command}, nil
+	}
+	if name == "" {
+		name = DefaultNetCDFConverter
+	}
+	args, ok := netcdfConverters[name]
+	if !ok {
+		names := make([]string, 0, len(netcdfConverters))
+		for n := range netcdfConverters {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown converter %q (available: %v, or set converter_command)", name, names)
+	}
+	return CommandConverter{Command: args}, nil
+}
+
+// Convert runs the command, writing to a temporary file that is moved to
+// output once the command succeeds
+func (c CommandConverter) Convert(ctx context.Context, input, output string) error {
+	part := PartPath(output)
+	vars := map[string]string{"input": input, "output": part}
+	args := make([]string, len(c.Command))
+	for i, arg := range c.Command {
+		args[i] = ExpandTemplate(arg, vars)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(part)
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s failed: %v: %s", filepath.Base(args[0]), err, msg)
+		}
+		return fmt.Errorf("%s failed: %v", filepath.Base(args[0]), err)
+	}
+
+	if err := os.Rename(part, output); err != nil {
+		os.Remove(part)
+		return fmt.Errorf("error renaming converted file: %v", err)
+	}
+	return nil
+}
+
+// NetCDFPath returns the path of the NetCDF file converted from a GRIB file,
+// replacing a GRIB extension with .nc
+func NetCDFPath(gribFile string) string {
+	for _, ext := range []string{".grib2", ".grb2", ".grib", ".grb"} {
+		if strings.HasSuffix(gribFile, ext) {
+			return strings.TrimSuffix(gribFile, ext) + ".nc"
+		}
+	}
+	return gribFile + ".nc"
+}
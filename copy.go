@@ -0,0 +1,54 @@
+package gribdownloader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// copyBufferSize is the size of the buffers used to copy response data to
+// output files. Large buffers need far fewer reads and positional writes
+// than the 32 KB of io.Copy on multi-gigabyte downloads.
+const copyBufferSize = 1 << 20
+
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// copyAt copies n bytes from r to out at offset off. Like io.CopyN it
+// returns io.EOF if r ends early. A memory-mapped output is read into
+// directly, without an intermediate buffer; other outputs are written from
+// a large pooled buffer. With NoDirectCopy it copies like io.CopyN instead.
+func (d *Downloader) copyAt(out rangeWriter, off int64, r io.Reader, n int64) (int64, error) {
+	if d.NoDirectCopy {
+		return io.CopyN(io.NewOffsetWriter(out, off), r, n)
+	}
+	if mapped, ok := out.(*mappedFile); ok {
+		return mapped.readFrom(r, off, n)
+	}
+
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	written, err := io.CopyBuffer(io.NewOffsetWriter(out, off), io.LimitReader(r, n), *buf)
+	if err == nil && written < n {
+		err = io.EOF
+	}
+	return written, err
+}
+
+// readFrom reads n bytes from r straight into the map at offset off,
+// returning io.EOF if r ends early
+func (m *mappedFile) readFrom(r io.Reader, off, n int64) (int64, error) {
+	if off < 0 || n < 0 || off+n > int64(len(m.data)) {
+		return 0, fmt.Errorf("write of %d bytes at offset %d exceeds mapped file of %d bytes", n, off, len(m.data))
+	}
+	read, err := io.ReadFull(r, m.data[off:off+n])
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return int64(read), err
+}
@@ -0,0 +1,136 @@
+package gribdownloader
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// DefaultCycleInterval is the spacing between model runs used when resolving
+// the latest cycle and no cycle_interval is configured
+const DefaultCycleInterval = 6
+
+// latestLookback limits how far back LatestCycle searches for a published run
+const latestLookback = 48 * time.Hour
+
+// ParseCycle parses a date in YYYYMMDD format and a cycle hour into a run time
+func ParseCycle(date, cycle string) (time.Time, error) {
+	day, err := time.Parse("20060102", date)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q: expected YYYYMMDD", date)
+	}
+
+	hour := 0
+	if cycle != "" {
+		hour, err = strconv.Atoi(cycle)
+		if err != nil || hour < 0 || hour > 23 {
+			return time.Time{}, fmt.Errorf("invalid cycle %q: expected hour 00-23", cycle)
+		}
+	}
+
+	return day.Add(time.Duration(hour) * time.Hour), nil
+}
+
+// CycleVars returns the template variables describing a run time
+func CycleVars(run time.Time) map[string]string {
+	return map[string]string{
+		"yyyymmdd": run.Format("20060102"),
+		"cycle":    run.Format("15"),
+	}
+}
+
+// LatestCycle walks back from now in steps of interval hours and returns the
+// most recent run whose idx file exists on the server. vars are applied to
+// urlTemplate in addition to the cycle variables (e.g. fhr).
+func (d *Downloader) LatestCycle(ctx context.Context, urlTemplate string, vars map[string]string, interval int, now time.Time) (time.Time, error) {
+	run, found, err := walkCycles(interval, now, func(run time.Time) (bool, error) {
+		return d.Exists(ctx, ExpandTemplate(ExpandTemplate(urlTemplate, CycleVars(run)), vars))
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !found {
+		return time.Time{}, fmt.Errorf("no published cycle found within the last %v: %w", latestLookback, ErrNotFound)
+	}
+	return run, nil
+}
+
+// LatestCompleteCycle walks back from now like LatestCycle and returns the
+// most recent run of the dataset for which the idx file of every forecast
+// hour and member is published on at least one mirror
+func (d *Downloader) LatestCompleteCycle(ctx context.Context, ds *Dataset, now time.Time) (time.Time, error) {
+	run, found, err := walkCycles(ds.CycleInterval, now, func(run time.Time) (bool, error) {
+		// The last hours are published last, so probing them first skips
+		// incomplete runs quickly
+		targets := ds.TargetsForRun(run)
+		for i := len(targets) - 1; i >= 0; i-- {
+			ok, err := d.anyExists(ctx, targets[i].IdxURLs())
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !found {
+		return time.Time{}, fmt.Errorf("no complete cycle found within the last %v: %w", latestLookback, ErrNotFound)
+	}
+	return run, nil
+}
+
+// anyExists reports whether any of the URLs exists. It fails only when
+// every mirror failed; a mirror that answered not found is enough to move
+// on to an older cycle.
+func (d *Downloader) anyExists(ctx context.Context, urls []string) (bool, error) {
+	var lastErr error
+	notFound := false
+	for _, url := range urls {
+		ok, err := d.Exists(ctx, url)
+		if ok {
+			return true, nil
+		}
+		if err != nil {
+			lastErr = err
+		} else {
+			notFound = true
+		}
+	}
+	if notFound {
+		return false, nil
+	}
+	return false, lastErr
+}
+
+// walkCycles calls published for the runs spaced interval hours apart from
+// now back to latestLookback, and returns the first run it accepts
+func walkCycles(interval int, now time.Time, published func(time.Time) (bool, error)) (time.Time, bool, error) {
+	if interval <= 0 {
+		interval = DefaultCycleInterval
+	}
+
+	now = now.UTC()
+	run := now.Truncate(time.Duration(interval) * time.Hour)
+	for ; now.Sub(run) <= latestLookback; run = run.Add(-time.Duration(interval) * time.Hour) {
+		ok, err := published(run)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		if ok {
+			return run, true, nil
+		}
+	}
+	return time.Time{}, false, nil
+}
+
+// NextCycle returns the run following run according to the cycle interval
+// of the dataset
+func (ds *Dataset) NextCycle(run time.Time) time.Time {
+	interval := ds.CycleInterval
+	if interval <= 0 {
+		interval = DefaultCycleInterval
+	}
+	return run.Add(time.Duration(interval) * time.Hour)
+}
@@ -0,0 +1,432 @@
+package gribdownloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Dataset describes a GRIB product to download: where its idx files live and
+// which records to take from them
+type Dataset struct {
+	Name          string              `json:"-"`
+	IdxURL        string              `json:"idx_url"`
+	FieldURL      string              `json:"field_url"` // Instead of idx_url for one file per field, with {param} and {level}
+	Mirrors       []string            `json:"mirrors"`
+	Parameters    map[string][]string `json:"parameters"`
+	Groups        []string            `json:"groups"` // Names of parameter_groups merged into parameters
+	HourRules     []HourRule          `json:"hour_rules"`
+	Types         []string            `json:"types"`
+	ForecastHours HourList            `json:"forecast_hours"` // e.g. [0, 6] or "0-120/3,123-384/12"
+	Minutes       []int               `json:"minutes"`        // Of sub-hourly files, e.g. [15, 30, 45, 0]
+	Date          string              `json:"date"`
+	Cycle         string              `json:"cycle"`
+	CycleInterval int                 `json:"cycle_interval"`
+	IndexFormat   string              `json:"index_format"`
+	OutputDir     string              `json:"output_dir"`
+	Filename      string              `json:"filename"`
+	Schedule      string              `json:"schedule"`
+	Members       []string            `json:"members"`
+	Domain        string              `json:"domain"` // Grid or nest of presets with several, e.g. "alaska"
+	Preset        string              `json:"preset"`
+	Region        []float64           `json:"region"`   // lat1, lon1, lat2, lon2
+	Headers       map[string]string   `json:"headers"`  // Sent with every request, e.g. an API key
+	Username      string              `json:"username"` // Basic auth credentials
+	Password      string              `json:"password"`
+	// AuthProvider mints or refreshes expiring credentials such as tokens
+	// and signed URLs during a run
+	AuthProvider *AuthProviderConfig `json:"auth_provider"`
+
+	// CombinedFilename names the file that --combine writes all forecast
+	// hours of a cycle to; it may use the placeholders of filename except
+	// {fhr}
+	CombinedFilename string `json:"combined_filename"`
+	// Deliver lists ftp:// and sftp:// directory URLs that every completed
+	// file is also pushed to; they accept the placeholders of output_dir
+	Deliver []string `json:"deliver"`
+	// KeepCycles and KeepDays bound the cycles kept on disk by the clean
+	// command and by watch
+	KeepCycles int `json:"keep_cycles"`
+	KeepDays   int `json:"keep_days"`
+
+	domainValue  string       // Value of {domain}, as mapped by the preset
+	stagingDir   string       // Local directory for output bound for a storage URL
+	authProvider AuthProvider // Created from AuthProvider by validate
+}
+
+// Target is a single idx file to download along with the template
+// variables used to build its URL
+type Target struct {
+	Dataset string
+	IdxURL  string   // Or the URL of the file itself for a per-field target
+	Mirrors []string // Alternative idx URLs serving identical files
+	Output  string   // Local path of the downloaded GRIB file
+	Hour    int      // Forecast hour, or -1 when the dataset has none
+	Minute  int      // Lead time in minutes of a sub-hourly target, or -1
+	Field   bool     // A file of a per-field dataset, downloaded whole
+	Vars    map[string]string
+}
+
+// Key identifies a target among those of a run: its idx URL, followed by
+// the lead time of sub-hourly targets, which share the idx file of their
+// forecast hour
+func (t Target) Key() string {
+	if fmin, ok := t.Vars["fmin"]; ok && t.Minute >= 0 {
+		return t.IdxURL + "#" + fmin + "min"
+	}
+	return t.IdxURL
+}
+
+// IdxURLs returns the primary idx URL followed by its mirrors
+func (t Target) IdxURLs() []string {
+	return append([]string{t.IdxURL}, t.Mirrors...)
+}
+
+// validate checks the dataset settings for consistency
+func (ds *Dataset) validate() error {
+	if err := ds.applyPreset(); err != nil {
+		return err
+	}
+
+	if ds.IdxURL == "" && ds.FieldURL == "" {
+		return fmt.Errorf("idx_url is not set")
+	}
+	if err := ds.validateFields(); err != nil {
+		return err
+	}
+
+	template := ds.urlTemplate()
+	if len(ds.ForecastHours) > 0 && !strings.Contains(template, "{fhr") {
+		return fmt.Errorf("forecast_hours requires a {fhr} or {fhr2} placeholder in %s", ds.urlSetting())
+	}
+
+	if _, err := IndexParserFor(ds.IndexFormat); err != nil {
+		return err
+	}
+	if strings.Contains(template, "{domain}") {
+		if ds.Domain == "" {
+			return fmt.Errorf("%s has a {domain} placeholder but no domain is set", ds.urlSetting())
+		}
+		if ds.domainValue == "" {
+			ds.domainValue = ds.Domain
+		}
+	}
+	if err := ds.validateMinutes(); err != nil {
+		return err
+	}
+
+	if _, err := ds.Selection().compile(); err != nil {
+		return err
+	}
+	for i, rule := range ds.HourRules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("hour_rules[%d]: %v", i, err)
+		}
+	}
+
+	if len(ds.Members) > 0 {
+		if !strings.Contains(template, "{member}") {
+			return fmt.Errorf("members requires a {member} placeholder in %s", ds.urlSetting())
+		}
+		if _, err := ExpandMembers(ds.Members); err != nil {
+			return err
+		}
+	}
+
+	if IsStorageURL(ds.OutputDir) {
+		if _, rest, _ := strings.Cut(ds.OutputDir, "://"); rest == "" || strings.HasPrefix(rest, "/") {
+			return fmt.Errorf("output_dir %q lacks a bucket", ds.OutputDir)
+		}
+	}
+
+	if ds.KeepCycles < 0 || ds.KeepDays < 0 {
+		return fmt.Errorf("keep_cycles and keep_days must not be negative")
+	}
+	if !ds.Retention().IsZero() && !ds.UsesCycle() {
+		return fmt.Errorf("keep_cycles and keep_days require {yyyymmdd} or {cycle} in %s", ds.urlSetting())
+	}
+
+	for _, dir := range ds.Deliver {
+		if err := validateDelivery(dir); err != nil {
+			return err
+		}
+	}
+
+	if ds.Schedule != "" {
+		if _, err := ParseSchedule(ds.Schedule); err != nil {
+			return err
+		}
+	}
+
+	if ds.Region != nil {
+		if _, err := NewRegion(ds.Region); err != nil {
+			return err
+		}
+	}
+
+	return ds.validateAuth()
+}
+
+// SubsetRegion returns the region downloaded messages are cut down to, or
+// nil to keep them whole
+func (ds *Dataset) SubsetRegion() *Region {
+	if ds.Region == nil {
+		return nil
+	}
+	// The region was checked by validate
+	region, _ := NewRegion(ds.Region)
+	return &region
+}
+
+// Selection returns the record selection described by the dataset
+func (ds *Dataset) Selection() Selection {
+	return Selection{
+		Parameters: ds.Parameters,
+		Types:      ds.Types,
+	}
+}
+
+// ParamsHash returns a short hash identifying the record selection, so that
+// files holding different subsets of the same run get distinct names
+func (ds *Dataset) ParamsHash() string {
+	data, _ := json.Marshal(ds.Selection())
+	if len(ds.HourRules) > 0 {
+		data, _ = json.Marshal(struct {
+			Selection
+			HourRules []HourRule
+		}{ds.Selection(), ds.HourRules})
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:4])
+}
+
+// model returns the name used for the {model} placeholder: the dataset name,
+// or the first dot-separated part of the GRIB file name. The files of a
+// per-field dataset are named up to their parameter, so that they share it.
+func (ds *Dataset) model(gribURL string, vars map[string]string) string {
+	if ds.Name != "" {
+		return ds.Name
+	}
+	base := filepath.Base(gribURL)
+	if param := vars["param"]; param != "" {
+		if prefix, _, ok := strings.Cut(base, param); ok && strings.Trim(prefix, "_-.") != "" {
+			return strings.Trim(prefix, "_-.")
+		}
+	}
+	if i := strings.Index(base, "."); i > 0 {
+		return base[:i]
+	}
+	return base
+}
+
+// OutputPath returns the local path of the GRIB file for an idx URL. The
+// filename template defaults to the GRIB file name from the URL and may use
+// {model}, {date}, {cycle}, {fhr}, {member}, {domain} and {params_hash},
+// {minute} and {fmin} for sub-hourly datasets, and {param} and {level} for
+// per-field datasets; output_dir accepts the same placeholders. Ensemble
+// members are written to a subdirectory per member unless the templates
+// use {member}. When output_dir is a storage URL, the file is placed in the
+// staging directory to be uploaded from there.
+func (ds *Dataset) OutputPath(idxURL string, vars map[string]string) string {
+	return ds.outputPath(idxURL, vars, ds.Filename)
+}
+
+// DefaultCombinedFilename names combined files when combined_filename is not
+// set
+const DefaultCombinedFilename = "{model}.{date}.t{cycle}z.grib2"
+
+// CombinedPath returns the local path of the file holding every forecast
+// hour of the run of a target. It is placed like the output of the target,
+// under the name given by combined_filename.
+func (ds *Dataset) CombinedPath(target Target) string {
+	filename := ds.CombinedFilename
+	if filename == "" {
+		filename = DefaultCombinedFilename
+	}
+	vars := make(map[string]string, len(target.Vars))
+	for k, v := range target.Vars {
+		if k != "fhr" && k != "fhr2" && k != "minute" && k != "fmin" {
+			vars[k] = v
+		}
+	}
+	return ds.outputPath(target.IdxURL, vars, filename)
+}
+
+// outputVars returns the values of the placeholders of output_dir and
+// filename for an idx URL and its template variables
+func (ds *Dataset) outputVars(idxURL string, vars map[string]string) map[string]string {
+	return map[string]string{
+		"model":       ds.model(GribURL(idxURL), vars),
+		"date":        vars["yyyymmdd"],
+		"cycle":       vars["cycle"],
+		"fhr":         vars["fhr"],
+		"member":      vars["member"],
+		"domain":      ds.Domain,
+		"minute":      vars["minute"],
+		"fmin":        vars["fmin"],
+		"param":       vars["param"],
+		"level":       vars["level"],
+		"params_hash": ds.ParamsHash(),
+	}
+}
+
+// outputPath returns the local path of a file for an idx URL, named by the
+// filename template or after the GRIB file when it is empty
+func (ds *Dataset) outputPath(idxURL string, vars map[string]string, filename string) string {
+	gribURL := GribURL(idxURL)
+	outputVars := ds.outputVars(idxURL, vars)
+
+	name := filepath.Base(gribURL)
+	if filename != "" {
+		name = ExpandTemplate(filename, outputVars)
+	}
+	dir := ExpandTemplate(ds.OutputDir, outputVars)
+	if IsStorageURL(dir) {
+		dir = stagingPath(ds.stagingDir, dir)
+	}
+	if member := vars["member"]; member != "" && !strings.Contains(ds.OutputDir+filename, "{member}") {
+		dir = filepath.Join(dir, member)
+	}
+	return filepath.Join(dir, name)
+}
+
+// UsesCycle reports whether the idx URL depends on the run date or cycle
+func (ds *Dataset) UsesCycle() bool {
+	template := ds.urlTemplate()
+	return strings.Contains(template, "{yyyymmdd}") || strings.Contains(template, "{cycle}")
+}
+
+// RunTime resolves the configured date and cycle. A date of "latest" probes
+// the server for the most recent published run, and "latest-complete" for
+// the most recent run with every forecast hour published.
+func (ds *Dataset) RunTime(ctx context.Context, d *Downloader) (time.Time, error) {
+	if ds.Date == "" {
+		return time.Time{}, fmt.Errorf("idx_url uses {yyyymmdd} or {cycle} but no date is set")
+	}
+
+	if ds.Date == "latest" {
+		vars := map[string]string{}
+		if ds.domainValue != "" {
+			vars["domain"] = ds.domainValue
+		}
+		hour := -1
+		if len(ds.ForecastHours) > 0 {
+			hour = ds.ForecastHours[0]
+			setHourVars(vars, hour)
+		}
+		if members, _ := ExpandMembers(ds.Members); len(members) > 0 {
+			vars["member"] = members[0]
+		}
+		if ds.PerField() {
+			if fields := ds.fields(hour); len(fields) > 0 {
+				setFieldVars(vars, fields[0])
+			}
+		}
+		return d.LatestCycle(ctx, ds.urlTemplate(), vars, ds.CycleInterval, time.Now())
+	}
+	if ds.Date == "latest-complete" {
+		return d.LatestCompleteCycle(ctx, ds, time.Now())
+	}
+
+	return ParseCycle(ds.Date, ds.Cycle)
+}
+
+// Targets expands the idx URL template into one target per forecast hour
+func (ds *Dataset) Targets(ctx context.Context, d *Downloader) ([]Target, error) {
+	if !ds.UsesCycle() {
+		return ds.targets(map[string]string{}), nil
+	}
+
+	run, err := ds.RunTime(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	return ds.TargetsForRun(run), nil
+}
+
+// TargetsForRun expands the idx URL template for the given run time
+func (ds *Dataset) TargetsForRun(run time.Time) []Target {
+	return ds.targets(CycleVars(run))
+}
+
+// targets returns one target per member and forecast hour, per minute of
+// sub-hourly datasets and per field of per-field datasets, with base
+// applied to the URL templates
+func (ds *Dataset) targets(base map[string]string) []Target {
+	hours := ds.ForecastHours
+	if len(hours) == 0 {
+		hours = []int{-1}
+	}
+	minutes := ds.Minutes
+	if len(minutes) == 0 {
+		minutes = []int{-1}
+	}
+
+	// Members were checked by validate
+	members, _ := ExpandMembers(ds.Members)
+	if len(members) == 0 {
+		members = []string{""}
+	}
+
+	targets := make([]Target, 0, len(members)*len(hours))
+	for _, member := range members {
+		for _, hour := range hours {
+			for _, minute := range minutes {
+				lead := -1
+				if minute >= 0 {
+					// The first file holds no minutes before the analysis
+					if lead = leadMinutes(hour, minute); lead < 0 {
+						continue
+					}
+				}
+				fields := []fieldFile{{}}
+				if ds.PerField() {
+					fields = ds.fields(hour)
+				}
+				for _, field := range fields {
+					vars := make(map[string]string, len(base)+6)
+					for k, v := range base {
+						vars[k] = v
+					}
+					if member != "" {
+						vars["member"] = member
+					}
+					if ds.domainValue != "" {
+						vars["domain"] = ds.domainValue
+					}
+					if hour >= 0 {
+						setHourVars(vars, hour)
+					}
+					if lead >= 0 {
+						setMinuteVars(vars, lead)
+					}
+					if ds.PerField() {
+						setFieldVars(vars, field)
+					}
+					mirrors := make([]string, 0, len(ds.Mirrors))
+					for _, mirror := range ds.Mirrors {
+						mirrors = append(mirrors, ExpandTemplate(mirror, vars))
+					}
+					idxURL := ExpandTemplate(ds.urlTemplate(), vars)
+					targets = append(targets, Target{
+						Dataset: ds.Name,
+						IdxURL:  idxURL,
+						Mirrors: mirrors,
+						Output:  ds.OutputPath(idxURL, vars),
+						Hour:    hour,
+						Minute:  lead,
+						Field:   ds.PerField(),
+						Vars:    vars,
+					})
+				}
+			}
+		}
+	}
+
+	return targets
+}
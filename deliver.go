@@ -0,0 +1,287 @@
+package gribdownloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// validateDelivery checks a deliver URL template, which names a directory
+// on an FTP or SFTP server
+func validateDelivery(dir string) error {
+	scheme, rest, ok := strings.Cut(dir, "://")
+	if !ok || (scheme != "ftp" && scheme != "sftp") {
+		return fmt.Errorf("invalid deliver URL %q: expected ftp:// or sftp://", dir)
+	}
+	if host, _, _ := strings.Cut(rest, "/"); host == "" || strings.ContainsAny(host, "{}") {
+		return fmt.Errorf("invalid deliver URL %q: the host must be given without placeholders", dir)
+	}
+	return nil
+}
+
+// DeliveryURLs returns the URLs a completed file written for target is
+// delivered to, one per deliver directory
+func (ds *Dataset) DeliveryURLs(target Target, file string) []string {
+	vars := ds.outputVars(target.IdxURL, target.Vars)
+	urls := make([]string, len(ds.Deliver))
+	for i, dir := range ds.Deliver {
+		urls[i] = strings.TrimSuffix(ExpandTemplate(dir, vars), "/") + "/" + path.Base(file)
+	}
+	return urls
+}
+
+// remotePath returns the path of a delivery URL. As in RFC 1738 it is
+// relative to the login directory; a double slash, as in
+// ftp://host//pub/grib, makes it absolute.
+func remotePath(u *url.URL) string {
+	return strings.TrimPrefix(u.Path, "/")
+}
+
+// FTPUploader delivers files to an FTP server in passive mode. Each file is
+// stored under a temporary name and renamed once complete, so that a
+// partner polling the directory never picks up a partial file. The user
+// name and password come from the URL, falling back to Password and the
+// anonymous user.
+type FTPUploader struct {
+	UploadOptions
+	Password string
+}
+
+// Upload implements Uploader
+func (u *FTPUploader) Upload(ctx context.Context, localPath string, dest *url.URL) error {
+	return u.retry(ctx, func() error {
+		return u.upload(ctx, localPath, dest)
+	})
+}
+
+// ftpConn is the control connection of an FTP session
+type ftpConn struct {
+	*textproto.Conn
+}
+
+// cmd sends a command and reads its reply, which must be of the class given
+// by the first digit of expect (0 accepts any reply)
+func (c *ftpConn) cmd(expect int, format string, args ...any) (int, string, error) {
+	if _, err := c.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	code, msg, err := c.ReadResponse(expect)
+	if err != nil {
+		verb, _, _ := strings.Cut(format, " ")
+		return code, msg, fmt.Errorf("FTP %s failed: %v", verb, err)
+	}
+	return code, msg, nil
+}
+
+// passive opens a data connection, with EPSV or else PASV. The address in a
+// PASV reply is ignored in favour of the control connection's host, which
+// also works behind NAT.
+func (c *ftpConn) passive(ctx context.Context, host string) (net.Conn, error) {
+	var port int
+	code, msg, err := c.cmd(0, "EPSV")
+	if err == nil && code == 229 {
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("invalid EPSV reply %q", msg)
+		}
+		port, err = strconv.Atoi(msg[start+4 : end])
+	} else {
+		port, err = c.pasv()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid passive mode port: %v", err)
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// pasv enters passive mode with PASV, returning the port from a reply such
+// as "227 Entering Passive Mode (192,168,1,2,195,80)"
+func (c *ftpConn) pasv() (int, error) {
+	_, msg, err := c.cmd(2, "PASV")
+	if err != nil {
+		return 0, err
+	}
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return 0, fmt.Errorf("reply %q", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0, fmt.Errorf("reply %q", msg)
+	}
+	hi, err := strconv.Atoi(strings.TrimSpace(fields[4]))
+	if err != nil {
+		return 0, err
+	}
+	lo, err := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if err != nil {
+		return 0, err
+	}
+	return hi<<8 | lo, nil
+}
+
+// upload stores a file in a single FTP session
+func (u *FTPUploader) upload(ctx context.Context, localPath string, dest *url.URL) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return &permanentError{fmt.Errorf("error opening delivery: %v", err)}
+	}
+	defer file.Close()
+
+	address := dest.Host
+	if dest.Port() == "" {
+		address = net.JoinHostPort(dest.Hostname(), "21")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return fmt.Errorf("error connecting to %s: %v", address, err)
+	}
+	defer conn.Close()
+	// Unblock reads and writes when the download is cancelled
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+
+	c := &ftpConn{textproto.NewConn(conn)}
+	if _, _, err := c.ReadResponse(2); err != nil {
+		return fmt.Errorf("FTP greeting failed: %v", err)
+	}
+
+	user, password := "anonymous", u.Password
+	if dest.User != nil {
+		user = dest.User.Username()
+		if p, ok := dest.User.Password(); ok {
+			password = p
+		}
+	}
+	code, _, err := c.cmd(0, "USER %s", user)
+	if err == nil && code == 331 {
+		code, _, err = c.cmd(0, "PASS %s", password)
+	}
+	if err != nil {
+		return err
+	}
+	if code/100 != 2 {
+		return &permanentError{fmt.Errorf("FTP login as %s failed with code %d", user, code)}
+	}
+
+	if _, _, err := c.cmd(2, "TYPE I"); err != nil {
+		return err
+	}
+
+	// Create the directory one level at a time, ignoring the errors for
+	// levels that exist
+	remote := remotePath(dest)
+	dir := path.Dir(remote)
+	for i := range dir {
+		if dir[i] == '/' && i > 0 {
+			c.cmd(0, "MKD %s", dir[:i])
+		}
+	}
+	if dir != "." && dir != "/" {
+		c.cmd(0, "MKD %s", dir)
+	}
+
+	data, err := c.passive(ctx, dest.Hostname())
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	part := PartPath(remote)
+	if _, _, err := c.cmd(1, "STOR %s", part); err != nil {
+		return err
+	}
+	_, err = io.Copy(data, file)
+	if closeErr := data.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error sending %s: %v", localPath, err)
+	}
+	if _, _, err := c.ReadResponse(2); err != nil {
+		return fmt.Errorf("FTP STOR failed: %v", err)
+	}
+
+	if _, _, err := c.cmd(3, "RNFR %s", part); err != nil {
+		return err
+	}
+	if _, _, err := c.cmd(2, "RNTO %s", remote); err != nil {
+		return err
+	}
+	c.cmd(0, "QUIT")
+	return nil
+}
+
+// SFTPUploader delivers files with the OpenSSH sftp client in batch mode,
+// authenticating with the keys or agent of the user running the tool. Like
+// FTPUploader, it stores each file under a temporary name and renames it
+// once complete.
+type SFTPUploader struct {
+	UploadOptions
+	// Command runs the sftp client; nil uses "sftp"
+	Command []string
+}
+
+// sftpQuote quotes an argument of an sftp batch command
+func sftpQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// Upload implements Uploader
+func (u *SFTPUploader) Upload(ctx context.Context, localPath string, dest *url.URL) error {
+	command := u.Command
+	if len(command) == 0 {
+		command = []string{"sftp"}
+	}
+	args := append(command[1:len(command):len(command)], "-b", "-", "-o", "BatchMode=yes")
+	if port := dest.Port(); port != "" {
+		args = append(args, "-P", port)
+	}
+	host := dest.Hostname()
+	if dest.User != nil {
+		host = dest.User.Username() + "@" + host
+	}
+	args = append(args, host)
+
+	// Commands prefixed with "-" may fail: the directories may exist, and
+	// the file may not
+	remote := remotePath(dest)
+	part := PartPath(remote)
+	var batch strings.Builder
+	dir := path.Dir(remote)
+	for i := range dir {
+		if dir[i] == '/' && i > 0 {
+			fmt.Fprintf(&batch, "-mkdir %s\n", sftpQuote(dir[:i]))
+		}
+	}
+	if dir != "." && dir != "/" {
+		fmt.Fprintf(&batch, "-mkdir %s\n", sftpQuote(dir))
+	}
+	fmt.Fprintf(&batch, "put %s %s\n", sftpQuote(localPath), sftpQuote(part))
+	fmt.Fprintf(&batch, "-rm %s\n", sftpQuote(remote))
+	fmt.Fprintf(&batch, "rename %s %s\n", sftpQuote(part), sftpQuote(remote))
+
+	return u.retry(ctx, func() error {
+		cmd := exec.CommandContext(ctx, command[0], args...)
+		cmd.Stdin = strings.NewReader(batch.String())
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return fmt.Errorf("sftp failed: %v: %s", err, msg)
+			}
+			return fmt.Errorf("sftp failed: %v", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,27 @@
+package gribdownloader
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// FreeSpace returns the space available to the user in the filesystem that
+// holds path, which need not exist yet, along with an identifier of the
+// filesystem. It returns errors.ErrUnsupported on systems where free space
+// cannot be queried.
+func FreeSpace(path string) (free uint64, filesystem string, err error) {
+	// Directories are created as files are written, so ask about the
+	// nearest one that already exists
+	dir := filepath.Clean(path)
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return statFilesystem(dir)
+}
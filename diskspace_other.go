@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package gribdownloader
+
+import "errors"
+
+// statFilesystem reports that free space cannot be queried on this system
+func statFilesystem(dir string) (uint64, string, error) {
+	return 0, "", errors.ErrUnsupported
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd
+
+package gribdownloader
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// statFilesystem returns the free space of the filesystem holding dir
+func statFilesystem(dir string) (uint64, string, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, "", err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), fmt.Sprint(stat.Fsid), nil
+}
@@ -0,0 +1,1027 @@
+package gribdownloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxConcurrency is the number of ranges downloaded at once when no
+// limit is configured
+const DefaultMaxConcurrency = 4
+
+// Downloader fetches byte ranges of a remote file with bounded concurrency
+type Downloader struct {
+	// MaxConcurrency limits the number of ranges downloaded at once; zero
+	// uses the default of the storage backend
+	MaxConcurrency int
+	// MaxTotalConcurrency limits the number of ranges downloaded at once
+	// across all files fetched concurrently with this downloader, bounding
+	// the total bandwidth used; zero means no limit beyond MaxConcurrency
+	MaxTotalConcurrency int
+	// MaxConnsPerHost limits the number of connections to a single host;
+	// zero leaves connections bounded only by the number of workers
+	MaxConnsPerHost int
+	// S3Region is the region used to address s3:// URLs
+	S3Region string
+	// MaxRate limits the combined transfer rate of all downloads in bytes
+	// per second; zero means unlimited
+	MaxRate int64
+	// Logger receives per-range progress; nil uses slog.Default()
+	Logger *slog.Logger
+	// Progress, if set, is called periodically while ranges download
+	Progress func(Progress)
+	// Stats, if set, accumulates counters over all downloads
+	Stats *Stats
+	// SkipValidation disables checking that each downloaded range consists
+	// of complete GRIB messages
+	SkipValidation bool
+	// Resume keeps a state file next to the output listing completed
+	// ranges, and skips those ranges when the same download is repeated
+	Resume bool
+	// OutputMode selects compact or sparse output; empty means compact
+	OutputMode OutputMode
+	// MergeGap coalesces ranges separated by at most this many bytes into a
+	// single request. The gap bytes are downloaded but not written.
+	MergeGap int64
+	// MultipartRanges is the number of ranges requested at once in a single
+	// Range header. Servers that do not answer with multipart/byteranges are
+	// remembered and sent one range per request. Zero or one disables it.
+	MultipartRanges int
+	// IdxCache, if set, keeps idx files fetched with FetchIndex so that
+	// unchanged files are revalidated instead of downloaded again
+	IdxCache *IdxCache
+	// WholeFileFallback downloads the whole file and extracts the ranges
+	// locally when no mirror honours Range headers
+	WholeFileFallback bool
+	// VerifyChecksums checks files downloaded whole by WholeFileFallback
+	// against the .sha256 or .md5 file published next to them, when there
+	// is one. Ranges are always checked against the byte counts of the
+	// Content-Range header.
+	VerifyChecksums bool
+	// KeepPartial keeps the output of a download in which some ranges
+	// failed, leaving the failed ranges out and returning a *PartialError
+	KeepPartial bool
+	// AdaptiveConcurrency, if positive, tunes the number of ranges
+	// downloaded at once from each host between one and this many, starting
+	// from MaxConcurrency: it grows while throughput does and halves when
+	// requests fail
+	AdaptiveConcurrency int
+	// InFlightBytes bounds the data that StreamRanges and MessageReader
+	// download ahead of the writer while earlier ranges are outstanding; a
+	// range larger than the bound is still downloaded, alone. Zero allows
+	// twice the number of workers ranges instead.
+	InFlightBytes int64
+	// MemoryMap maps the pre-allocated output file into memory so that
+	// range workers copy into it directly, which saves a system call per
+	// write on outputs of many ranges. It is ignored where memory mapping is
+	// not available.
+	MemoryMap bool
+	// NoDirectCopy copies response data through the 32 KB buffer of
+	// io.Copy instead of reading it into the memory map or a large pooled
+	// buffer, for debugging the copy path
+	NoDirectCopy bool
+
+	// HTTPClient, if set, is used for all requests instead of a client
+	// built from the connection settings below
+	HTTPClient *http.Client
+	// ReadTimeout fails a request that receives no data for this long,
+	// while waiting for the response or reading the body; zero uses
+	// DefaultReadTimeout
+	ReadTimeout time.Duration
+	// RequestTimeout bounds each request including reading the whole body;
+	// zero means no limit, so that large ranges may take as long as data
+	// keeps arriving
+	RequestTimeout time.Duration
+	// IdleConnTimeout is how long idle keep-alive connections are kept;
+	// zero uses the net/http default of 90 seconds
+	IdleConnTimeout time.Duration
+	// MaxIdleConnsPerHost is the number of idle connections kept per host;
+	// zero keeps enough for the configured concurrency
+	MaxIdleConnsPerHost int
+	// DisableHTTP2 restricts connections to HTTP/1.1. By default HTTP/2 is
+	// negotiated where the server supports it, multiplexing the ranges over
+	// a single connection.
+	DisableHTTP2 bool
+	// Proxy is the proxy used for all requests, with scheme http, https or
+	// socks5; nil honours HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	Proxy *url.URL
+	// RootCAs are the certificate authorities trusted for TLS; nil uses the
+	// system roots
+	RootCAs *x509.CertPool
+	// InsecureSkipVerify disables TLS certificate verification, e.g. behind
+	// an intercepting proxy whose certificate is not available
+	InsecureSkipVerify bool
+	// UserAgent is sent with every request; empty sends DefaultUserAgent
+	UserAgent string
+	// MaxRetryAfter is the longest cooldown after a server answers 429 or
+	// 503. Such a response pauses every request to the host, for the delay
+	// of its Retry-After header or a growing backoff without one, before
+	// the request is repeated. Zero uses DefaultMaxRetryAfter and a
+	// negative value turns the cooldown off.
+	MaxRetryAfter time.Duration
+	// Auth adds headers and basic auth credentials to the requests for
+	// matching URLs
+	Auth []RequestAuth
+
+	once    sync.Once
+	client  *http.Client
+	slots   chan struct{} // Semaphore enforcing MaxTotalConcurrency
+	limiter *rateLimiter  // Token bucket enforcing MaxRate
+
+	noMultipart sync.Map // Hosts that do not support multipart ranges
+	noRanges    sync.Map // Hosts that ignore Range headers
+	adaptive    sync.Map // *adaptiveLimiter by host
+}
+
+// OutputMode controls how downloaded ranges are laid out in the output file
+type OutputMode string
+
+const (
+	// OutputCompact writes GRIB messages back-to-back, producing a minimal
+	// valid GRIB file
+	OutputCompact OutputMode = "compact"
+	// OutputSparse writes each range at its original offset, leaving
+	// zero-filled gaps between records
+	OutputSparse OutputMode = "sparse"
+)
+
+// DefaultDownloader is the Downloader used by the package-level functions
+var DefaultDownloader = &Downloader{}
+
+// logger returns the logger of the downloader
+func (d *Downloader) logger() *slog.Logger {
+	if d.Logger != nil {
+		return d.Logger
+	}
+	return slog.Default()
+}
+
+// rangeJob is a range queued for download together with the offset in the
+// output file where its data is written
+type rangeJob struct {
+	RangeDownload
+	Dest int64
+}
+
+// layoutRanges assigns each range its offset in the output file and returns
+// the size of the output
+func layoutRanges(ranges []RangeDownload, mode OutputMode) ([]rangeJob, int64) {
+	jobs := make([]rangeJob, len(ranges))
+	var size int64
+	for i, r := range ranges {
+		dest := r.Start
+		if mode != OutputSparse {
+			dest = size
+		}
+		jobs[i] = rangeJob{RangeDownload: r, Dest: dest}
+		if end := dest + r.Size(); end > size {
+			size = end
+		}
+	}
+	return jobs, size
+}
+
+// rangeWriter is the destination of downloaded ranges: the output file, or
+// a memory buffer when streaming
+type rangeWriter interface {
+	io.WriterAt
+	io.ReaderAt
+}
+
+// rangeRequest is a single HTTP request covering one or more jobs whose
+// ranges are separated by small gaps
+type rangeRequest struct {
+	RangeDownload
+	Jobs []rangeJob
+}
+
+// groupJobs combines jobs whose ranges are at most gap bytes apart into
+// single requests. With a gap of zero every job gets its own request.
+func groupJobs(jobs []rangeJob, gap int64) []rangeRequest {
+	sorted := append([]rangeJob(nil), jobs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	var requests []rangeRequest
+	for _, job := range sorted {
+		if n := len(requests); n > 0 && gap > 0 {
+			last := &requests[n-1]
+			if job.Start > last.End && job.Start-last.End-1 <= gap {
+				last.Jobs = append(last.Jobs, job)
+				last.End = max(last.End, job.End)
+				continue
+			}
+		}
+		requests = append(requests, rangeRequest{RangeDownload: job.RangeDownload, Jobs: []rangeJob{job}})
+	}
+	return requests
+}
+
+// PartPath returns the temporary file an output is written to while downloading
+func PartPath(outputFile string) string {
+	return outputFile + ".part"
+}
+
+// DownloadFile downloads a file from URL to a local path using the
+// DefaultDownloader
+func DownloadFile(ctx context.Context, url, localPath string) error {
+	return DefaultDownloader.DownloadFile(ctx, url, localPath)
+}
+
+// get issues a GET request for the whole file, returning the response if the
+// server answered with 200 OK
+func (d *Downloader) get(ctx context.Context, url string) (*http.Response, error) {
+	url, err := d.resolveURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := d.newRequest(ctx, "GET", url)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading file: %v", err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return resp, nil
+	case isMissing(resp.StatusCode):
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w (status code %d)", ErrNotFound, resp.StatusCode)
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+}
+
+// DownloadFile downloads a file from URL to a local path
+func (d *Downloader) DownloadFile(ctx context.Context, url, localPath string) error {
+	resp, err := d.get(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	partPath := PartPath(localPath)
+	out, err := os.Create(partPath)
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+
+	if d.NoDirectCopy {
+		_, err = io.Copy(out, d.limit(ctx, resp.Body))
+	} else {
+		buf := copyBuffers.Get().(*[]byte)
+		_, err = io.CopyBuffer(out, d.limit(ctx, resp.Body), *buf)
+		copyBuffers.Put(buf)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partPath)
+		return fmt.Errorf("error saving file: %v", err)
+	}
+
+	if err := os.Rename(partPath, localPath); err != nil {
+		return fmt.Errorf("error renaming file: %v", err)
+	}
+
+	return nil
+}
+
+// Fetch downloads a small file, such as an idx file, into memory
+func (d *Downloader) Fetch(ctx context.Context, url string) ([]byte, error) {
+	resp, err := d.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(d.limit(ctx, resp.Body))
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	return data, nil
+}
+
+// ContentLength returns the total size of the remote file. It issues a HEAD
+// request and falls back to a one-byte ranged GET, parsing Content-Range, when
+// the server does not report a length. It returns ErrNotFound when the HEAD
+// request finds no file.
+func (d *Downloader) ContentLength(ctx context.Context, url string) (int64, error) {
+	url, err := d.resolveURL(url)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := d.newRequest(ctx, "HEAD", url)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error making HEAD request: %v", err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK && resp.ContentLength > 0:
+		return resp.ContentLength, nil
+	case isMissing(resp.StatusCode):
+		return 0, fmt.Errorf("%w (status code %d)", ErrNotFound, resp.StatusCode)
+	}
+
+	req, err = d.newRequest(ctx, "GET", url)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err = d.httpClient().Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error making request: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return parseContentRangeTotal(resp.Header.Get("Content-Range"))
+}
+
+// MessageLength returns the length of the GRIB message starting at offset
+// in a remote file, read from its indicator section (section 0) with a
+// ranged request for its first 16 bytes
+func (d *Downloader) MessageLength(ctx context.Context, url string, offset int64) (int64, error) {
+	url, err := d.resolveURL(url)
+	if err != nil {
+		return 0, err
+	}
+	req, err := d.newRequest(ctx, "GET", url)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+15))
+
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error making request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	header, err := io.ReadAll(io.LimitReader(resp.Body, 16))
+	if err != nil {
+		return 0, fmt.Errorf("error reading response: %v", err)
+	}
+	length, err := messageLength(bytes.NewReader(header), 0)
+	if err != nil {
+		return 0, err
+	}
+	if length < 16 {
+		return 0, fmt.Errorf("%w: message at offset %d has length %d", ErrInvalidGRIB, offset, length)
+	}
+	return length, nil
+}
+
+// fetchRange downloads bytes start to end, inclusive, of a remote file
+// into memory with a ranged request
+func (d *Downloader) fetchRange(ctx context.Context, url string, start, end int64) ([]byte, error) {
+	req, err := d.newRequest(ctx, "GET", url)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	data := make([]byte, end-start+1)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	return data, nil
+}
+
+// Exists reports whether the remote file exists, treating 404 and 403 (as
+// returned by S3 for missing public objects) as not found
+func (d *Downloader) Exists(ctx context.Context, url string) (bool, error) {
+	httpURL, err := d.resolveURL(url)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := d.newRequest(ctx, "HEAD", httpURL)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return false, fmt.Errorf("error probing %s: %v", url, err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return true, nil
+	case isMissing(resp.StatusCode):
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status code probing %s: %d", url, resp.StatusCode)
+	}
+}
+
+// parseContentRangeTotal extracts the complete length from a Content-Range
+// header such as "bytes 0-0/12345"
+func parseContentRangeTotal(header string) (int64, error) {
+	slash := strings.LastIndex(header, "/")
+	if slash < 0 {
+		return 0, fmt.Errorf("invalid Content-Range header: %q", header)
+	}
+
+	total, err := strconv.ParseInt(header[slash+1:], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Content-Range header: %q", header)
+	}
+
+	return total, nil
+}
+
+// ErrNotFound is returned when a file does not exist on the server, e.g.
+// because it has not been published yet
+var ErrNotFound = errors.New("not found")
+
+// isMissing reports whether a status code means the file does not exist:
+// 404, or 403 as S3 and GCS buckets answer for absent keys
+func isMissing(code int) bool {
+	return code == http.StatusNotFound || code == http.StatusForbidden
+}
+
+// ErrRangeIgnored is returned when a server answers a ranged request with
+// the whole file
+var ErrRangeIgnored = errors.New("server ignored the Range header")
+
+// ErrRangeMismatch is returned when a server sends a different span than
+// was requested
+var ErrRangeMismatch = errors.New("response does not match the requested range")
+
+// checkContentRange verifies that a Content-Range header covers the
+// requested span and returns the last byte position served. The span may
+// end early only at the end of the file, when the final range of a file was
+// requested past it.
+func checkContentRange(header string, start, end int64) (int64, error) {
+	first, last, err := parseContentRange(header)
+	if err != nil {
+		return 0, err
+	}
+	if first == start && last == end {
+		return last, nil
+	}
+	if total, err := parseContentRangeTotal(header); err == nil && first == start && last < end && last == total-1 {
+		return last, nil
+	}
+	return 0, fmt.Errorf("%w: requested bytes %d-%d, got %q", ErrRangeMismatch, start, end, header)
+}
+
+// downloadRequest downloads the span of a request from a URL and writes the
+// range of each of its jobs at the job's offset in the output file, skipping
+// the gaps in between. It returns the number of bytes written per job.
+func (d *Downloader) downloadRequest(ctx context.Context, url string, request rangeRequest, out rangeWriter, tracker *progressTracker) ([]int64, error) {
+	if d.rangesUnsupported(url) {
+		return nil, ErrRangeIgnored
+	}
+
+	req, err := d.newRequest(ctx, "GET", url)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set range header
+	rangeHeader := fmt.Sprintf("bytes=%d-%d", request.Start, request.End)
+	req.Header.Set("Range", rangeHeader)
+
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		d.markRangesUnsupported(url)
+		return nil, ErrRangeIgnored
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, ErrRangeIgnored
+	default:
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	last, err := checkContentRange(resp.Header.Get("Content-Range"), request.Start, request.End)
+	if err != nil {
+		return nil, err
+	}
+
+	var received atomic.Int64
+	body := &countingReader{r: resp.Body, total: &received}
+	written, err := d.writeRequest(d.limit(ctx, body), out, request, tracker)
+	if err != nil {
+		return written, err
+	}
+	if err := checkBodyLength(body, request.Start, last); err != nil {
+		tracker.doneBytes.Add(-sum(written))
+		return written, err
+	}
+	return written, nil
+}
+
+// checkBodyLength verifies that a response body held exactly the bytes
+// start to last once it has been read up to last
+func checkBodyLength(body *countingReader, start, last int64) error {
+	if n, _ := io.Copy(io.Discard, io.LimitReader(body, 1)); n > 0 {
+		return fmt.Errorf("%w: more data than bytes %d-%d", ErrRangeMismatch, start, last)
+	}
+	if body.read != last-start+1 {
+		return fmt.Errorf("%w: received %d bytes for bytes %d-%d", ErrRangeMismatch, body.read, start, last)
+	}
+	return nil
+}
+
+// sum adds up the bytes written per job
+func sum(written []int64) int64 {
+	var total int64
+	for _, n := range written {
+		total += n
+	}
+	return total
+}
+
+// writeRequest copies the response data of a request from r to out, writing
+// the range of each job at the job's offset and skipping the gaps in between.
+// It returns the number of bytes written per job. On error the bytes counted
+// as progress are taken back so a retry is not counted twice.
+func (d *Downloader) writeRequest(r io.Reader, out rangeWriter, request rangeRequest, tracker *progressTracker) ([]int64, error) {
+	// Gap bytes are read from r directly and not counted as progress
+	body := &countingReader{r: r, total: &tracker.doneBytes}
+	written := make([]int64, len(request.Jobs))
+	pos := request.Start
+	for i, job := range request.Jobs {
+		if gap := job.Start - pos; gap > 0 {
+			if _, err := io.CopyN(io.Discard, r, gap); err != nil {
+				tracker.doneBytes.Add(-body.read)
+				return written, fmt.Errorf("error skipping to range %d-%d: %v", job.Start, job.End, err)
+			}
+		}
+
+		// Write at the job's offset with positional writes, so workers
+		// share the file without locking. The final range may end early
+		// when it was requested past the end of the file.
+		n, err := d.copyAt(out, job.Dest, body, job.Size())
+		written[i] = n
+		pos = job.Start + n
+		if err == io.EOF && n > 0 && i == len(request.Jobs)-1 {
+			err = nil
+		}
+		if err != nil {
+			tracker.doneBytes.Add(-body.read)
+			return written, fmt.Errorf("error copying data: %v", err)
+		}
+
+		// Check that the range holds complete GRIB messages
+		if !d.SkipValidation {
+			if err := ValidateGRIB(io.NewSectionReader(out, job.Dest, n), n); err != nil {
+				tracker.doneBytes.Add(-body.read)
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// RangeResult records how a range was downloaded
+type RangeResult struct {
+	RangeDownload
+	Source string `json:"source"` // URL of the mirror the data came from
+	Bytes  int64  `json:"bytes"`  // Number of bytes written
+}
+
+// DownloadRanges downloads multiple ranges into a single file using the
+// DefaultDownloader
+func DownloadRanges(ctx context.Context, url string, ranges []RangeDownload, outputFile string) error {
+	return DefaultDownloader.DownloadRanges(ctx, url, ranges, outputFile)
+}
+
+// DownloadRanges downloads multiple ranges concurrently into a single file.
+// Ranges are queued and processed by at most MaxConcurrency workers. In
+// compact mode the ranges are written back-to-back in the order given.
+func (d *Downloader) DownloadRanges(ctx context.Context, url string, ranges []RangeDownload, outputFile string) error {
+	_, err := d.DownloadRangesFromMirrors(ctx, []string{url}, ranges, outputFile)
+	return err
+}
+
+// downloadRequestFromMirrors tries each mirror in turn until the request
+// is downloaded, returning the index of the mirror that succeeded
+func (d *Downloader) downloadRequestFromMirrors(ctx context.Context, urls []string, request rangeRequest, out rangeWriter, tracker *progressTracker) (int, []int64, error) {
+	var errs []error
+	ignored := 0
+	for i, url := range urls {
+		start := time.Now()
+		written, err := d.downloadRequest(ctx, url, request, out, tracker)
+		if errors.Is(err, ErrInvalidGRIB) {
+			// Corrupted data may be a transient transfer problem, so
+			// download the range once more before moving on
+			d.logger().Warn("range failed validation, downloading again",
+				"start", request.Start, "end", request.End, "source", url, "error", err)
+			d.Stats.retried()
+			written, err = d.downloadRequest(ctx, url, request, out, tracker)
+		}
+		if err == nil {
+			d.Stats.downloaded(written)
+			d.logger().Debug("range downloaded",
+				"start", request.Start, "end", request.End, "ranges", len(request.Jobs),
+				"duration", time.Since(start), "source", url, "attempt", i+1)
+			return i, written, nil
+		}
+		if ctx.Err() != nil {
+			return -1, nil, ctx.Err()
+		}
+		d.logger().Warn("range failed",
+			"start", request.Start, "end", request.End, "source", url,
+			"attempt", i+1, "remaining_mirrors", len(urls)-i-1, "error", err)
+		if errors.Is(err, ErrRangeIgnored) {
+			ignored++
+		}
+		if i < len(urls)-1 {
+			d.Stats.retried()
+		}
+		errs = append(errs, err)
+	}
+	if d.WholeFileFallback && ignored == len(urls) {
+		return -1, nil, fmt.Errorf("%w by every mirror", ErrRangeIgnored)
+	}
+	d.Stats.failed(len(request.Jobs))
+	return -1, nil, fmt.Errorf("all mirrors failed: %v", errs)
+}
+
+// DownloadRangesFromMirrors downloads ranges like DownloadRanges, but fails
+// over to the next mirror when a range cannot be fetched from the current
+// one. All mirrors must serve identical files. The returned results record
+// which mirror each successfully downloaded range came from.
+//
+// Data is written to a temporary file (see PartPath) that is renamed to
+// outputFile only once every range has been downloaded, so outputFile never
+// holds a partial download. When a range fails the temporary file is
+// removed, unless Resume keeps it for the next run. With KeepPartial set the
+// downloaded ranges are instead moved into place and a *PartialError
+// describes the missing ones.
+func (d *Downloader) DownloadRangesFromMirrors(ctx context.Context, mirrors []string, ranges []RangeDownload, outputFile string) ([]RangeResult, error) {
+	if len(mirrors) == 0 {
+		return nil, fmt.Errorf("no source URLs given")
+	}
+
+	workers := d.concurrencyFor(mirrors[0])
+	limiter := d.adaptiveLimiterFor(mirrors[0])
+	if limiter != nil {
+		workers = limiter.max
+	}
+	urls := make([]string, len(mirrors))
+	for i, mirror := range mirrors {
+		url, err := d.resolveURL(mirror)
+		if err != nil {
+			return nil, err
+		}
+		urls[i] = url
+	}
+
+	// Work out where each range goes and the total size needed
+	jobs, size := layoutRanges(ranges, d.OutputMode)
+
+	// Pick up a previous interrupted run of the same download
+	mode := d.OutputMode
+	if mode == "" {
+		mode = OutputCompact
+	}
+	var state *resumeState
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if d.Resume {
+		state = loadResumeState(outputFile, ranges, mode)
+		if state != nil {
+			flags &^= os.O_TRUNC
+			d.logger().Info("resuming download", "output", outputFile,
+				"completed_ranges", len(state.Completed), "total_ranges", len(ranges))
+		} else {
+			state = &resumeState{OutputMode: mode, Ranges: ranges}
+		}
+	}
+
+	// Create and pre-allocate the temporary output file
+	partFile := PartPath(outputFile)
+	file, err := os.OpenFile(partFile, flags, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error creating output file: %v", err)
+	}
+
+	defer file.Close()
+
+	// Pre-allocate the file with the required size
+	err = file.Truncate(size)
+	if err != nil {
+		return nil, fmt.Errorf("error pre-allocating file: %v", err)
+	}
+
+	// The workers write to out, the file or its map, which is released
+	// before the file is otherwise changed
+	var out rangeWriter = file
+	var mapped *mappedFile
+	if d.MemoryMap && size > 0 {
+		mapped, err = mapFile(file, size)
+		if err != nil {
+			d.logger().Debug("writing output without memory mapping", "output", outputFile, "error", err)
+		} else {
+			out = mapped
+			defer mapped.unmap()
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex // Guards results, actualEnd, whole and state; file writes need no lock
+	var actualEnd int64
+	var whole []rangeRequest // Requests to extract from the whole file
+	tracker := newProgressTracker(ranges)
+	results := make([]RangeResult, 0, len(ranges))
+
+	// Skip the ranges completed by a previous run
+	pending := jobs
+	if state != nil {
+		pending = nil
+		for _, job := range jobs {
+			result, ok := state.completed(job.RangeDownload)
+			if !ok {
+				pending = append(pending, job)
+				continue
+			}
+			tracker.doneRanges.Add(1)
+			tracker.doneBytes.Add(result.Bytes)
+			results = append(results, result)
+			if end := job.Dest + result.Bytes; end > actualEnd {
+				actualEnd = end
+			}
+		}
+	}
+
+	// Coalesce nearby ranges into single requests
+	requests := groupJobs(pending, d.MergeGap)
+	if len(requests) < len(pending) {
+		d.logger().Debug("coalesced ranges", "ranges", len(pending), "requests", len(requests), "merge_gap", d.MergeGap)
+	}
+
+	// Combine requests into multipart batches
+	batches := batchRequests(requests, d.MultipartRanges)
+
+	queue := make(chan []rangeRequest)
+	errors := make(chan error, len(requests))
+
+	// record stores the outcome of a downloaded request
+	record := func(request rangeRequest, mirror int, written []int64) {
+		tracker.doneRanges.Add(int32(len(request.Jobs)))
+		mutex.Lock()
+		defer mutex.Unlock()
+		for i, job := range request.Jobs {
+			if end := job.Dest + written[i]; end > actualEnd {
+				actualEnd = end
+			}
+			result := RangeResult{
+				RangeDownload: job.RangeDownload,
+				Source:        mirrors[mirror],
+				Bytes:         written[i],
+			}
+			results = append(results, result)
+			if state != nil {
+				state.Completed = append(state.Completed, result)
+			}
+		}
+		if state != nil {
+			if err := state.save(outputFile); err != nil {
+				d.logger().Warn("could not save resume state", "error", err)
+			}
+		}
+	}
+
+	// download fetches a single request, failing over between mirrors, and
+	// returns the bytes written and whether it failed
+	download := func(request rangeRequest) (int64, bool) {
+		mirror, written, err := d.downloadRequestFromMirrors(ctx, urls, request, out, tracker)
+		if rangeIgnored(err) {
+			mutex.Lock()
+			whole = append(whole, request)
+			mutex.Unlock()
+			return 0, false
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, false
+			}
+			tracker.failedRanges.Add(int32(len(request.Jobs)))
+			errors <- fmt.Errorf("error downloading range %d-%d: %v", request.Start, request.End, err)
+			return 0, true
+		}
+		record(request, mirror, written)
+		return sum(written), false
+	}
+
+	// Start a bounded pool of workers
+	if workers > len(batches) {
+		workers = len(batches)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range queue {
+				if ctx.Err() != nil || !limiter.acquire(ctx) {
+					continue
+				}
+				if !d.acquire(ctx) {
+					limiter.release(0, false)
+					continue
+				}
+				var count int32
+				for _, request := range batch {
+					count += int32(len(request.Jobs))
+				}
+				tracker.activeRanges.Add(count)
+
+				mirror, written, err := -1, [][]int64(nil), errMultipartUnsupported
+				if len(batch) > 1 {
+					mirror, written, err = d.downloadBatchFromMirrors(ctx, urls, batch, out, tracker)
+				}
+				var bytes int64
+				var failed bool
+				if err == nil {
+					for i, request := range batch {
+						record(request, mirror, written[i])
+						bytes += sum(written[i])
+					}
+				} else {
+					for _, request := range batch {
+						n, f := download(request)
+						bytes += n
+						failed = failed || f
+					}
+				}
+
+				tracker.activeRanges.Add(-count)
+				d.release()
+				if limit, changed := limiter.release(bytes, failed); changed {
+					d.logger().Debug("adjusted concurrency", "source", mirrors[0], "workers", limit)
+				}
+			}
+		}()
+	}
+
+	// Report progress while the workers run
+	reported := make(chan struct{})
+	finished := make(chan struct{})
+	if d.Progress != nil {
+		go func() {
+			tracker.report(d.Progress, finished)
+			close(reported)
+		}()
+	} else {
+		close(reported)
+	}
+
+	// Queue the requests
+queueing:
+	for _, batch := range batches {
+		select {
+		case queue <- batch:
+		case <-ctx.Done():
+			break queueing
+		}
+	}
+	close(queue)
+
+	wg.Wait()
+
+	// Extract the ranges that no mirror would serve from the whole file
+	if len(whole) > 0 && ctx.Err() == nil {
+		d.logger().Info("server ignores byte ranges, downloading the whole file",
+			"source", mirrors[0], "ranges", len(whole))
+		mirror, written, err := d.downloadWhole(ctx, urls, whole, out, tracker)
+		switch {
+		case err == nil:
+			for i, request := range whole {
+				record(request, mirror, written[i])
+			}
+		case ctx.Err() == nil:
+			for _, request := range whole {
+				tracker.failedRanges.Add(int32(len(request.Jobs)))
+			}
+			errors <- fmt.Errorf("error downloading whole file: %v", err)
+		}
+	}
+
+	close(errors)
+	close(finished)
+	<-reported
+
+	if err := mapped.unmap(); err != nil {
+		return results, err
+	}
+
+	// On cancellation keep the output only if it can be resumed
+	if ctx.Err() != nil {
+		file.Close()
+		if state != nil {
+			mutex.Lock()
+			if err := state.save(outputFile); err != nil {
+				d.logger().Warn("could not save resume state", "error", err)
+			}
+			mutex.Unlock()
+			d.logger().Info("download interrupted, re-run to resume", "output", outputFile,
+				"completed_ranges", len(state.Completed), "total_ranges", len(ranges))
+		} else if err := os.Remove(partFile); err != nil && !os.IsNotExist(err) {
+			d.logger().Warn("could not remove partial output", "error", err)
+		}
+		return results, fmt.Errorf("download cancelled: %w", ctx.Err())
+	}
+
+	// Collect any errors
+	var errorsList []error
+	for err := range errors {
+		errorsList = append(errorsList, err)
+	}
+
+	var partialErr error
+	if len(errorsList) > 0 {
+		err := fmt.Errorf("encountered %d errors during download: %v", len(errorsList), errorsList)
+		if !d.KeepPartial || len(results) == 0 {
+			file.Close()
+			if state == nil {
+				os.Remove(partFile)
+			}
+			return results, err
+		}
+
+		partialErr = &PartialError{Failed: missingRanges(ranges, results), Err: err}
+		if d.OutputMode != OutputSparse {
+			actualEnd, err = compactPartial(file, jobs, results)
+			if err != nil {
+				return results, err
+			}
+		}
+	}
+
+	// Trim the pre-allocated file to the bytes actually received
+	if err := file.Truncate(actualEnd); err != nil {
+		return results, fmt.Errorf("error truncating output file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return results, fmt.Errorf("error closing output file: %v", err)
+	}
+
+	// Move the complete file into place
+	if err := os.Rename(partFile, outputFile); err != nil {
+		return results, fmt.Errorf("error renaming output file: %v", err)
+	}
+
+	if state != nil {
+		if err := os.Remove(StatePath(outputFile)); err != nil && !os.IsNotExist(err) {
+			d.logger().Warn("could not remove resume state", "error", err)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Start < results[j].Start })
+	return results, partialErr
+}
@@ -0,0 +1,109 @@
+package gribdownloader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// EccodesParser parses the tables printed by ecCodes grib_ls, the usual way
+// to inventory GRIB files from producers that publish no idx files, such as
+// DWD ICON and MET Norway, e.g. from
+//
+//	grib_ls -p count,offset,totalLength,shortName,typeOfLevel,level,dataDate,dataTime file.grib2
+//
+// The columns are named by the header line, so any selection of keys in any
+// order is accepted as long as it includes offset and shortName. Levels use
+// the ecCodes naming as "<level> <typeOfLevel>" (e.g. "850 isobaricInhPa"),
+// or just the level type when there is no level column or the level is
+// missing; types are dataType with the ensemble number if present (e.g.
+// "fc number=5").
+type EccodesParser struct{}
+
+// isEccodesHeader reports whether a line is the column header of a grib_ls
+// table
+func isEccodesHeader(fields []string) bool {
+	var offset, shortName bool
+	for _, field := range fields {
+		offset = offset || field == "offset"
+		shortName = shortName || field == "shortName"
+	}
+	return offset && shortName
+}
+
+// Parse implements IndexParser
+func (EccodesParser) Parse(r io.Reader) ([]GFSParameter, error) {
+	var parameters []GFSParameter
+	var columns map[string]int
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if columns == nil {
+			// grib_ls prints the file name ahead of the header
+			if isEccodesHeader(fields) {
+				columns = make(map[string]int, len(fields))
+				for i, name := range fields {
+					columns[name] = i
+				}
+			}
+			continue
+		}
+		// Skip the message counts closing each table
+		if len(fields) != len(columns) {
+			continue
+		}
+		column := func(name string) string {
+			if i, ok := columns[name]; ok && fields[i] != "not_found" {
+				return fields[i]
+			}
+			return ""
+		}
+
+		offset, err := strconv.ParseInt(column("offset"), 10, 64)
+		if err != nil {
+			continue
+		}
+		number := len(parameters) + 1
+		if n, err := strconv.Atoi(column("count")); err == nil {
+			number = n
+		}
+		var length int64
+		if n, err := strconv.ParseInt(column("totalLength"), 10, 64); err == nil {
+			length = n
+		}
+
+		level := column("typeOfLevel")
+		if l := column("level"); l != "" && l != "MISSING" {
+			level = strings.TrimSpace(l + " " + level)
+		}
+
+		recordType := column("dataType")
+		if member := column("number"); member != "" && member != "MISSING" {
+			recordType = strings.TrimSpace(recordType + " number=" + member)
+		}
+
+		date := column("dataDate")
+		if t, err := strconv.Atoi(column("dataTime")); err == nil && date != "" {
+			date += fmt.Sprintf("%02d", t/100)
+		}
+
+		parameters = append(parameters, GFSParameter{
+			Number:    number,
+			Offset:    offset,
+			Length:    length,
+			Date:      date,
+			Parameter: column("shortName"),
+			Level:     level,
+			Type:      recordType,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading index file: %v", err)
+	}
+
+	return parameters, nil
+}
@@ -0,0 +1,47 @@
+package gribdownloader
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEccodesParser(t *testing.T) {
+	table := `icon-eu_europe_regular-lat-lon_pressure-level_2024111200_006_T.grib2
+count       offset      totalLength shortName   typeOfLevel    level       dataDate    dataTime    
+1           0           1059042     t           isobaricInhPa  850         20241112    1200        
+2           1059042     1058101     2t          heightAboveGround  2           20241112    1200        
+3           2117143     880123      sp          surface        0           20241112    1200        
+3 of 3 messages in icon-eu_europe_regular-lat-lon_pressure-level_2024111200_006_T.grib2
+
+3 of 3 total messages in 1 files
+`
+	if format := DetectIndexFormat([]byte(table)); format != FormatEccodes {
+		t.Fatalf("detected %q, want %q", format, FormatEccodes)
+	}
+
+	parameters, err := EccodesParser{}.Parse(bytes.NewReader([]byte(table)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []GFSParameter{
+		{Number: 1, Offset: 0, Length: 1059042, Date: "2024111212", Parameter: "t", Level: "850 isobaricInhPa"},
+		{Number: 2, Offset: 1059042, Length: 1058101, Date: "2024111212", Parameter: "2t", Level: "2 heightAboveGround"},
+		{Number: 3, Offset: 2117143, Length: 880123, Date: "2024111212", Parameter: "sp", Level: "0 surface"},
+	}
+	if !reflect.DeepEqual(parameters, want) {
+		t.Errorf("got %+v, want %+v", parameters, want)
+	}
+}
+
+func TestDetectIndexFormat(t *testing.T) {
+	for line, want := range map[string]string{
+		"1:0:d=2024111200:PRMSL:mean sea level:anl:":                                               FormatNCEP,
+		"1:0:d=24111200:TMP:kpds5=11:kpds6=100:kpds7=850:TR=0:P1=0:P2=0:TimeU=1:850 mb:anl:NAve=0": FormatWgrib,
+		`{"domain": "g", "date": "20241112", "param": "2t", "_offset": 0, "_length": 609069}`:      FormatECMWF,
+	} {
+		if got := DetectIndexFormat([]byte(line + "\n")); got != want {
+			t.Errorf("DetectIndexFormat(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package gribdownloader
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ecmwfRecord is a single line of an ECMWF open data .index file
+type ecmwfRecord struct {
+	Date     string `json:"date"`
+	Time     string `json:"time"`
+	Type     string `json:"type"`
+	Step     string `json:"step"`
+	Number   string `json:"number"`
+	Levelist string `json:"levelist"`
+	Levtype  string `json:"levtype"`
+	Param    string `json:"param"`
+	Offset   int64  `json:"_offset"`
+	Length   int64  `json:"_length"`
+}
+
+// ECMWFParser parses the JSON-lines .index files published with ECMWF open
+// data. Levels are reported as "<levelist> <levtype>" (e.g. "500 pl") or just
+// the level type for single-level fields (e.g. "sfc"), and types as the
+// ECMWF type with the ensemble number if present (e.g. "pf number=5").
+type ECMWFParser struct{}
+
+// Parse implements IndexParser
+func (ECMWFParser) Parse(r io.Reader) ([]GFSParameter, error) {
+	var parameters []GFSParameter
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var rec ecmwfRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			continue
+		}
+
+		level := rec.Levtype
+		if rec.Levelist != "" {
+			level = rec.Levelist + " " + rec.Levtype
+		}
+
+		recordType := rec.Type
+		if rec.Number != "" {
+			recordType += " number=" + rec.Number
+		}
+
+		date := rec.Date
+		if len(rec.Time) >= 2 {
+			date += rec.Time[:2]
+		}
+
+		parameters = append(parameters, GFSParameter{
+			Number:    len(parameters) + 1,
+			Offset:    rec.Offset,
+			Length:    rec.Length,
+			Date:      date,
+			Parameter: rec.Param,
+			Level:     level,
+			Type:      recordType,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading index file: %v", err)
+	}
+
+	return parameters, nil
+}
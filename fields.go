@@ -0,0 +1,174 @@
+package gribdownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// fieldFile is a field of a per-field dataset: a parameter at a level,
+// published in a file of its own
+type fieldFile struct {
+	param string
+	level string
+}
+
+// PerField reports whether the dataset is published as one file per field,
+// such as the MSC Datamart of Environment Canada. The files are listed from
+// field_url and the parameters instead of being read from idx files.
+func (ds *Dataset) PerField() bool {
+	return ds.FieldURL != ""
+}
+
+// urlTemplate returns the template of the URLs the targets are built from:
+// field_url for per-field datasets and idx_url otherwise
+func (ds *Dataset) urlTemplate() string {
+	if ds.PerField() {
+		return ds.FieldURL
+	}
+	return ds.IdxURL
+}
+
+// urlSetting names the setting holding the URL template, for messages
+func (ds *Dataset) urlSetting() string {
+	if ds.PerField() {
+		return "field_url"
+	}
+	return "idx_url"
+}
+
+// fields lists the files of the parameters selected for a forecast hour,
+// ordered by parameter and level. Each parameter is taken with each of its
+// levels, or once when it has none.
+func (ds *Dataset) fields(hour int) []fieldFile {
+	parameters := ds.SelectionFor(Target{Hour: hour, Minute: -1}).Parameters
+	var fields []fieldFile
+	for param, levels := range parameters {
+		if len(levels) == 0 {
+			fields = append(fields, fieldFile{param: param})
+		}
+		for _, level := range levels {
+			fields = append(fields, fieldFile{param: param, level: level})
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		if fields[i].param != fields[j].param {
+			return fields[i].param < fields[j].param
+		}
+		return fields[i].level < fields[j].level
+	})
+	return fields
+}
+
+// setFieldVars sets the template variables of a field: {param} and, if it
+// has one, {level}
+func setFieldVars(vars map[string]string, field fieldFile) {
+	vars["param"] = field.param
+	if field.level != "" {
+		vars["level"] = field.level
+	}
+}
+
+// validateFields checks the settings of a per-field dataset. Parameters and
+// levels are put into the URLs as written, so they cannot be patterns.
+func (ds *Dataset) validateFields() error {
+	if !ds.PerField() {
+		return nil
+	}
+	if ds.IdxURL != "" {
+		return fmt.Errorf("idx_url and field_url cannot both be set")
+	}
+	if !strings.Contains(ds.FieldURL, "{param}") {
+		return fmt.Errorf("field_url requires a {param} placeholder")
+	}
+	if len(ds.Types) > 0 {
+		return fmt.Errorf("types is not supported with field_url, as there are no idx records to filter")
+	}
+
+	hasLevel := strings.Contains(ds.FieldURL, "{level}")
+	check := func(parameters map[string][]string) error {
+		for param, levels := range parameters {
+			if strings.ContainsAny(param, "*?/") || strings.HasPrefix(param, "!") {
+				return fmt.Errorf("parameter %q: field_url takes parameter names as written in the file names, not patterns or exclusions", param)
+			}
+			if _, isAlias := expandAlias(param, levels); isAlias {
+				return fmt.Errorf("parameter %q: field_url takes parameter names as written in the file names, not aliases", param)
+			}
+			if hasLevel && len(levels) == 0 {
+				return fmt.Errorf("parameter %q lists no levels, which field_url requires for its {level} placeholder", param)
+			}
+			if !hasLevel && len(levels) > 0 {
+				return fmt.Errorf("parameter %q lists levels, which require a {level} placeholder in field_url", param)
+			}
+			for _, level := range levels {
+				if level == "" || strings.ContainsAny(level, "*?/!") {
+					return fmt.Errorf("parameter %q: field_url takes levels as written in the file names, not %q", param, level)
+				}
+			}
+		}
+		return nil
+	}
+	if err := check(ds.Parameters); err != nil {
+		return err
+	}
+	for i, rule := range ds.HourRules {
+		if err := check(rule.Parameters); err != nil {
+			return fmt.Errorf("hour_rules[%d]: %v", i, err)
+		}
+	}
+
+	// Every field is written to a file of its own
+	if ds.Filename != "" {
+		for _, p := range []string{"{param}", "{level}"} {
+			if strings.Contains(ds.FieldURL, p) && !strings.Contains(ds.Filename, p) {
+				return fmt.Errorf("filename requires a %s placeholder, as each field is written to its own file", p)
+			}
+		}
+	}
+	return nil
+}
+
+// fieldParameter describes the file of a per-field target as the single
+// record of an idx file, with the parameter and level it was listed with
+func fieldParameter(target Target, length int64) GFSParameter {
+	return GFSParameter{
+		Number:    1,
+		Offset:    0,
+		Length:    length,
+		Date:      target.Vars["yyyymmdd"] + target.Vars["cycle"],
+		Parameter: target.Vars["param"],
+		Level:     target.Vars["level"],
+	}
+}
+
+// FieldIndex stands in for the idx file of a per-field target: a single
+// record covering the whole file, sized by the first mirror that serves
+// it. A file may hold several messages, such as every member of an
+// ensemble, so a mirror that reports no size fails rather than being sized
+// from its first message. It returns ErrNotFound when no mirror has the
+// file.
+func (d *Downloader) FieldIndex(ctx context.Context, target Target) ([]GFSParameter, error) {
+	var errs []error
+	notFound := 0
+	for _, url := range target.IdxURLs() {
+		length, err := d.ContentLength(ctx, url)
+		if err == nil {
+			return []GFSParameter{fieldParameter(target, length)}, nil
+		}
+		if errors.Is(err, ErrNotFound) {
+			notFound++
+			err = fmt.Errorf("%s: %w", url, err)
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		d.logger().Warn("field file probe failed", "url", url, "error", err)
+		errs = append(errs, err)
+	}
+	if notFound == len(errs) {
+		return nil, fmt.Errorf("field file is not published on any mirror: %w", ErrNotFound)
+	}
+	return nil, fmt.Errorf("error sizing field file: all mirrors failed: %v", errs)
+}
@@ -1,3 +1,5 @@
 module gribdownloader
 
 go 1.21.1
+
+require github.com/mattn/go-sqlite3 v1.14.33
@@ -0,0 +1,70 @@
+package gribdownloader
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrInvalidGRIB is returned when downloaded data is not a sequence of
+// complete GRIB messages
+var ErrInvalidGRIB = errors.New("invalid GRIB data")
+
+// messageLength reads the total length of the GRIB message starting at
+// offset from section 0 (the indicator section)
+func messageLength(r io.ReaderAt, offset int64) (int64, error) {
+	header := make([]byte, 16)
+	n, err := r.ReadAt(header, offset)
+	if n < 8 {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, fmt.Errorf("%w: short indicator section at offset %d: %v", ErrInvalidGRIB, offset, err)
+	}
+
+	if string(header[:4]) != "GRIB" {
+		return 0, fmt.Errorf("%w: missing GRIB magic at offset %d", ErrInvalidGRIB, offset)
+	}
+
+	switch edition := header[7]; edition {
+	case 1:
+		return int64(header[4])<<16 | int64(header[5])<<8 | int64(header[6]), nil
+	case 2:
+		if n < 16 {
+			return 0, fmt.Errorf("%w: short indicator section at offset %d", ErrInvalidGRIB, offset)
+		}
+		return int64(binary.BigEndian.Uint64(header[8:16])), nil
+	default:
+		return 0, fmt.Errorf("%w: unsupported GRIB edition %d at offset %d", ErrInvalidGRIB, edition, offset)
+	}
+}
+
+// ValidateGRIB checks that the size bytes of r are made up of complete GRIB
+// messages: each must start with the GRIB magic, end with "7777", and the
+// lengths encoded in section 0 must add up to size exactly
+func ValidateGRIB(r io.ReaderAt, size int64) error {
+	trailer := make([]byte, 4)
+	var offset int64
+	for offset < size {
+		length, err := messageLength(r, offset)
+		if err != nil {
+			return err
+		}
+		if length < 16 || offset+length > size {
+			return fmt.Errorf("%w: message at offset %d has length %d but only %d bytes were downloaded",
+				ErrInvalidGRIB, offset, length, size-offset)
+		}
+
+		if _, err := r.ReadAt(trailer, offset+length-4); err != nil {
+			return fmt.Errorf("%w: error reading end section at offset %d: %v", ErrInvalidGRIB, offset+length-4, err)
+		}
+		if string(trailer) != "7777" {
+			return fmt.Errorf("%w: missing end section for message at offset %d", ErrInvalidGRIB, offset)
+		}
+
+		offset += length
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package gribdownloader
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// grib2Section is a section of a GRIB2 message. data holds the whole
+// section, including its length and number octets.
+type grib2Section struct {
+	number int
+	data   []byte
+}
+
+// grib2Sections splits a GRIB2 message into its sections. Section 0 and the
+// end section are included with numbers 0 and 8.
+func grib2Sections(msg []byte) ([]grib2Section, error) {
+	if len(msg) < 20 || string(msg[:4]) != "GRIB" {
+		return nil, fmt.Errorf("%w: missing GRIB magic", ErrInvalidGRIB)
+	}
+	if msg[7] != 2 {
+		return nil, fmt.Errorf("%w: not a GRIB2 message (edition %d)", ErrInvalidGRIB, msg[7])
+	}
+	if length := binary.BigEndian.Uint64(msg[8:16]); length != uint64(len(msg)) {
+		return nil, fmt.Errorf("%w: message length %d does not match the %d bytes given", ErrInvalidGRIB, length, len(msg))
+	}
+
+	sections := []grib2Section{{number: 0, data: msg[:16]}}
+	offset := 16
+	for {
+		if offset+4 <= len(msg) && string(msg[offset:offset+4]) == "7777" {
+			if offset+4 != len(msg) {
+				return nil, fmt.Errorf("%w: data after the end section", ErrInvalidGRIB)
+			}
+			sections = append(sections, grib2Section{number: 8, data: msg[offset:]})
+			return sections, nil
+		}
+		if offset+5 > len(msg) {
+			return nil, fmt.Errorf("%w: truncated section at offset %d", ErrInvalidGRIB, offset)
+		}
+		length := int(binary.BigEndian.Uint32(msg[offset:]))
+		if length < 5 || offset+length > len(msg) {
+			return nil, fmt.Errorf("%w: section at offset %d has invalid length %d", ErrInvalidGRIB, offset, length)
+		}
+		number := int(msg[offset+4])
+		if number < 1 || number > 7 {
+			return nil, fmt.Errorf("%w: unknown section %d at offset %d", ErrInvalidGRIB, number, offset)
+		}
+		sections = append(sections, grib2Section{number: number, data: msg[offset : offset+length]})
+		offset += length
+	}
+}
+
+// joinGRIB2 builds a message from its sections, setting the total length in
+// section 0
+func joinGRIB2(sections []grib2Section) []byte {
+	var msg []byte
+	for _, s := range sections {
+		msg = append(msg, s.data...)
+	}
+	binary.BigEndian.PutUint64(msg[8:16], uint64(len(msg)))
+	return msg
+}
+
+// newSection returns a section of the given number with room for length
+// bytes in total
+func newSection(number, length int) []byte {
+	data := make([]byte, length)
+	binary.BigEndian.PutUint32(data, uint32(length))
+	data[4] = byte(number)
+	return data
+}
+
+// signed decodes a GRIB sign-and-magnitude integer of len(b) bytes, where
+// the most significant bit is the sign
+func signed(b []byte) int64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	sign := uint64(1) << (8*len(b) - 1)
+	if v&sign != 0 {
+		return -int64(v &^ sign)
+	}
+	return int64(v)
+}
+
+// putSigned encodes v as a sign-and-magnitude integer filling b
+func putSigned(b []byte, v int64) {
+	u := uint64(v)
+	if v < 0 {
+		u = uint64(-v) | uint64(1)<<(8*len(b)-1)
+	}
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = byte(u)
+		u >>= 8
+	}
+}
+
+// bitReader reads big-endian bit fields
+type bitReader struct {
+	data []byte
+	pos  int // In bits
+}
+
+// read returns the next n bits, n <= 64
+func (r *bitReader) read(n int) (uint64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	if r.pos+n > 8*len(r.data) {
+		return 0, fmt.Errorf("%w: packed data is truncated", ErrInvalidGRIB)
+	}
+	var v uint64
+	for i := 0; i < n; i++ {
+		bit := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+		v = v<<1 | uint64(bit)
+		r.pos++
+	}
+	return v, nil
+}
+
+// align skips to the next octet boundary
+func (r *bitReader) align() {
+	r.pos = (r.pos + 7) / 8 * 8
+}
+
+// bitWriter writes big-endian bit fields
+type bitWriter struct {
+	data []byte
+	pos  int // In bits
+}
+
+// write appends the low n bits of v
+func (w *bitWriter) write(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if v>>i&1 != 0 {
+			w.data[w.pos/8] |= 1 << (7 - w.pos%8)
+		}
+		w.pos++
+	}
+}
@@ -0,0 +1,314 @@
+package gribdownloader
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// MessageInfo is the metadata read from the sections of a GRIB message
+type MessageInfo struct {
+	Offset        int64       `json:"offset"`
+	Length        int64       `json:"length"`
+	Edition       int         `json:"edition"`
+	Discipline    int         `json:"discipline"`
+	Centre        int         `json:"centre"`
+	ReferenceTime time.Time   `json:"reference_time"`
+	Fields        []FieldInfo `json:"fields"`
+}
+
+// FieldInfo describes one field of a GRIB2 message
+type FieldInfo struct {
+	Category     int    `json:"category"`
+	Number       int    `json:"number"`
+	Parameter    string `json:"parameter"` // Abbreviation, or discipline.category.number if unknown
+	ForecastTime string `json:"forecast_time"`
+	Type         string `json:"type"` // As in idx files, e.g. "anl" or "6 hour fcst"
+	Level        string `json:"level"`
+	Grid         string `json:"grid"`
+	Points       int    `json:"points"`
+}
+
+// parameterNames are the NCEP abbreviations of common parameters, keyed by
+// discipline, category and number
+var parameterNames = map[[3]int]string{
+	{0, 0, 0}:   "TMP",
+	{0, 0, 6}:   "DPT",
+	{0, 1, 0}:   "SPFH",
+	{0, 1, 1}:   "RH",
+	{0, 1, 3}:   "PWAT",
+	{0, 1, 8}:   "APCP",
+	{0, 2, 2}:   "UGRD",
+	{0, 2, 3}:   "VGRD",
+	{0, 2, 8}:   "VVEL",
+	{0, 2, 22}:  "GUST",
+	{0, 3, 0}:   "PRES",
+	{0, 3, 1}:   "PRMSL",
+	{0, 3, 5}:   "HGT",
+	{0, 6, 1}:   "TCDC",
+	{0, 7, 6}:   "CAPE",
+	{0, 7, 7}:   "CIN",
+	{0, 19, 0}:  "VIS",
+	{2, 0, 0}:   "LAND",
+	{10, 0, 3}:  "HTSGW",
+	{10, 0, 4}:  "WVDIR",
+	{10, 0, 5}:  "WVHGT",
+	{10, 0, 11}: "PERPW",
+	{10, 2, 0}:  "ICEC",
+}
+
+// surfaceNames are the idx-style names of common fixed surface types
+var surfaceNames = map[int]string{
+	1:   "surface",
+	2:   "cloud base",
+	3:   "cloud top",
+	4:   "0C isotherm",
+	7:   "tropopause",
+	8:   "top of atmosphere",
+	101: "mean sea level",
+	200: "entire atmosphere",
+}
+
+// timeUnits name the units of forecast times
+var timeUnits = map[int]string{
+	0:  "min",
+	1:  "hour",
+	2:  "day",
+	10: "3 hours",
+	11: "6 hours",
+	12: "12 hours",
+	13: "sec",
+}
+
+// statisticNames are the idx abbreviations of statistical processes
+var statisticNames = map[int]string{
+	0: "ave",
+	1: "acc",
+	2: "max",
+	3: "min",
+}
+
+// surfaceUnits are the units of fixed surfaces whose value is shown
+var surfaceUnits = map[int]string{
+	100: "mb",
+	102: "m above mean sea level",
+	103: "m above ground",
+	106: "m below ground",
+	108: "mb above ground",
+}
+
+// gridNames name the grid definition templates
+var gridNames = map[int]string{
+	0:  "lat/lon",
+	10: "mercator",
+	20: "polar stereographic",
+	30: "lambert conformal",
+	40: "gaussian",
+}
+
+// surfaceValue decodes a scaled fixed surface value, or reports false if it
+// is missing
+func surfaceValue(scale byte, value []byte) (float64, bool) {
+	if scale == 0xff || binary.BigEndian.Uint32(value) == math.MaxUint32 {
+		return 0, false
+	}
+	return float64(signed(value)) / math.Pow10(int(int8(scale))), true
+}
+
+// surfaceNumber formats the value of a fixed surface in the unit used by
+// idx files, or reports false if the surface has no value to show
+func surfaceNumber(surface, scale byte, value []byte) (string, bool) {
+	v, ok := surfaceValue(scale, value)
+	if !ok || surfaceUnits[int(surface)] == "" {
+		return "", false
+	}
+	if surface == 100 || surface == 108 { // Pa to mb
+		v /= 100
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64), true
+}
+
+// formatLevel describes the first and second fixed surfaces of a field the
+// way idx files do where possible, e.g. "850 mb" or "0-0.1 m below ground"
+func formatLevel(s []byte) string {
+	first, second := s[0], s[6]
+	v1, ok1 := surfaceNumber(first, s[1], s[2:6])
+	if second != 0xff && second == first {
+		if v2, ok2 := surfaceNumber(second, s[7], s[8:12]); ok1 && ok2 {
+			return v1 + "-" + v2 + " " + surfaceUnits[int(first)]
+		}
+	}
+	if ok1 {
+		return v1 + " " + surfaceUnits[int(first)]
+	}
+	if name, known := surfaceNames[int(first)]; known {
+		return name
+	}
+	return fmt.Sprintf("surface %d", first)
+}
+
+// describeGrid summarizes a grid definition section
+func describeGrid(s3 []byte) (string, int) {
+	if len(s3) < 14 {
+		return "", 0
+	}
+	points := int(binary.BigEndian.Uint32(s3[6:10]))
+	template := int(binary.BigEndian.Uint16(s3[12:14]))
+	name, ok := gridNames[template]
+	if !ok {
+		return fmt.Sprintf("template 3.%d", template), points
+	}
+	if len(s3) < 38 {
+		return name, points
+	}
+	desc := fmt.Sprintf("%s %dx%d", name, binary.BigEndian.Uint32(s3[30:34]), binary.BigEndian.Uint32(s3[34:38]))
+	if grid, err := parseLatLonGrid(s3); err == nil {
+		desc += fmt.Sprintf(" from %g,%g step %g", grid.la1, grid.lo1, grid.di)
+	}
+	return desc, points
+}
+
+// parseProduct reads the product definition section of a field
+func parseProduct(discipline int, s4 []byte) FieldInfo {
+	var f FieldInfo
+	if len(s4) < 11 {
+		return f
+	}
+	template := binary.BigEndian.Uint16(s4[7:9])
+	f.Category, f.Number = int(s4[9]), int(s4[10])
+	f.Parameter = parameterNames[[3]int{discipline, f.Category, f.Number}]
+	if f.Parameter == "" {
+		f.Parameter = fmt.Sprintf("%d.%d.%d", discipline, f.Category, f.Number)
+	}
+
+	// Templates 4.0 to 4.15 share the time and surface layout
+	if template > 15 || len(s4) < 34 {
+		return f
+	}
+	unit := timeUnits[int(s4[17])]
+	if unit == "" {
+		unit = fmt.Sprintf("unit %d", s4[17])
+	}
+	start := signed(s4[18:22])
+	f.ForecastTime = fmt.Sprintf("%d %s", start, unit)
+	f.Level = formatLevel(s4[22:34])
+
+	// Statistically processed fields (4.8, and 4.11 with ensemble
+	// information) describe the processing after the end time
+	f.Type = fmt.Sprintf("%d %s fcst", start, unit)
+	var ranges int
+	switch template {
+	case 8:
+		ranges = 46
+	case 11:
+		ranges = 49
+	}
+	switch {
+	case ranges > 0 && len(s4) >= ranges+7:
+		statistic := statisticNames[int(s4[ranges])]
+		if statistic == "" {
+			statistic = fmt.Sprintf("stat %d", s4[ranges])
+		}
+		length := int64(binary.BigEndian.Uint32(s4[ranges+3 : ranges+7]))
+		f.Type = fmt.Sprintf("%d-%d %s %s fcst", start, start+length, unit, statistic)
+	case start == 0 && s4[11] == 0: // Analysis
+		f.Type = "anl"
+	}
+	return f
+}
+
+// ParseMessageInfo reads the metadata of a single GRIB message. GRIB1
+// messages only report their edition.
+func ParseMessageInfo(msg []byte) (MessageInfo, error) {
+	info := MessageInfo{Length: int64(len(msg))}
+	if len(msg) < 8 || string(msg[:4]) != "GRIB" {
+		return info, fmt.Errorf("%w: missing GRIB magic", ErrInvalidGRIB)
+	}
+	info.Edition = int(msg[7])
+	if info.Edition != 2 {
+		return info, nil
+	}
+
+	sections, err := grib2Sections(msg)
+	if err != nil {
+		return info, err
+	}
+	info.Discipline = int(msg[6])
+
+	var grid string
+	var points int
+	for _, s := range sections {
+		switch s.number {
+		case 1:
+			if len(s.data) < 19 {
+				return info, fmt.Errorf("%w: short identification section", ErrInvalidGRIB)
+			}
+			info.Centre = int(binary.BigEndian.Uint16(s.data[5:7]))
+			year, month := int(binary.BigEndian.Uint16(s.data[12:14])), int(s.data[14])
+			if year < 1 || month < 1 || month > 12 {
+				return info, fmt.Errorf("%w: invalid reference time", ErrInvalidGRIB)
+			}
+			info.ReferenceTime = time.Date(year, time.Month(month), int(s.data[15]), int(s.data[16]), int(s.data[17]), int(s.data[18]), 0, time.UTC)
+		case 3:
+			grid, points = describeGrid(s.data)
+		case 4:
+			field := parseProduct(info.Discipline, s.data)
+			field.Grid, field.Points = grid, points
+			info.Fields = append(info.Fields, field)
+		}
+	}
+	return info, nil
+}
+
+// ReadMessageInfo reads the metadata of every message in the first size
+// bytes of r
+func ReadMessageInfo(r io.ReaderAt, size int64) ([]MessageInfo, error) {
+	var messages []MessageInfo
+	for offset := int64(0); offset < size; {
+		length, err := messageLength(r, offset)
+		if err != nil {
+			return messages, err
+		}
+		if length < 16 || offset+length > size {
+			return messages, fmt.Errorf("%w: message at offset %d has length %d beyond the end of the file", ErrInvalidGRIB, offset, length)
+		}
+
+		msg := make([]byte, length)
+		if _, err := r.ReadAt(msg, offset); err != nil {
+			return messages, fmt.Errorf("error reading message at offset %d: %v", offset, err)
+		}
+		info, err := ParseMessageInfo(msg)
+		info.Offset = offset
+		if err != nil {
+			return messages, fmt.Errorf("message at offset %d: %v", offset, err)
+		}
+		messages = append(messages, info)
+		offset += length
+	}
+	return messages, nil
+}
+
+// WriteIndex writes an NCEP-style idx file for the messages, e.g.
+// "1:0:d=2024111206:TMP:850 mb:anl:". The fields of messages holding several
+// are numbered 1.1, 1.2 and so on, sharing the offset of the message.
+func WriteIndex(w io.Writer, messages []MessageInfo) error {
+	for i, msg := range messages {
+		date := msg.ReferenceTime.Format("2006010215")
+		for j, f := range msg.Fields {
+			number := strconv.Itoa(i + 1)
+			if len(msg.Fields) > 1 {
+				number += "." + strconv.Itoa(j+1)
+			}
+			if _, err := fmt.Fprintf(w, "%s:%d:d=%s:%s:%s:%s:\n", number, msg.Offset, date, f.Parameter, f.Level, f.Type); err != nil {
+				return err
+			}
+		}
+		if len(msg.Fields) == 0 {
+			return fmt.Errorf("message %d at offset %d is not a GRIB2 message with fields", i+1, msg.Offset)
+		}
+	}
+	return nil
+}
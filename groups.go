@@ -0,0 +1,78 @@
+package gribdownloader
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// mergeParameters adds the parameters of src to dst. Levels of a parameter
+// found in both are combined, and an empty level list, which selects every
+// level, takes precedence.
+func mergeParameters(dst, src map[string][]string) {
+	for name, levels := range src {
+		existing, ok := dst[name]
+		switch {
+		case !ok:
+			dst[name] = append([]string(nil), levels...)
+		case len(existing) == 0 || len(levels) == 0:
+			dst[name] = nil
+		default:
+			for _, level := range levels {
+				if !slices.Contains(existing, level) {
+					existing = append(existing, level)
+				}
+			}
+			dst[name] = existing
+		}
+	}
+}
+
+// resolveGroups returns the parameters of the named groups merged together
+func resolveGroups(groups map[string]map[string][]string, names []string) (map[string][]string, error) {
+	parameters := map[string][]string{}
+	for _, name := range names {
+		group, ok := groups[name]
+		if !ok {
+			available := make([]string, 0, len(groups))
+			for g := range groups {
+				available = append(available, g)
+			}
+			sort.Strings(available)
+			return nil, fmt.Errorf("unknown parameter group %q (available: %v)", name, available)
+		}
+		mergeParameters(parameters, group)
+	}
+	return parameters, nil
+}
+
+// applyGroups merges the parameter groups the dataset refers to into its
+// parameters
+func (ds *Dataset) applyGroups(groups map[string]map[string][]string) error {
+	if len(ds.Groups) > 0 {
+		parameters, err := resolveGroups(groups, ds.Groups)
+		if err != nil {
+			return err
+		}
+		if ds.Parameters == nil {
+			ds.Parameters = map[string][]string{}
+		}
+		mergeParameters(ds.Parameters, parameters)
+	}
+
+	for i := range ds.HourRules {
+		rule := &ds.HourRules[i]
+		if len(rule.Groups) == 0 {
+			continue
+		}
+		parameters, err := resolveGroups(groups, rule.Groups)
+		if err != nil {
+			return fmt.Errorf("hour_rules[%d]: %v", i, err)
+		}
+		if rule.Parameters == nil {
+			rule.Parameters = map[string][]string{}
+		}
+		mergeParameters(rule.Parameters, parameters)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package gribdownloader
+
+import (
+	"fmt"
+)
+
+// HourRule adds parameters to the selection of the forecast hours it
+// covers: from From up to To (no limit when unset), every Every hours
+// counted from From
+type HourRule struct {
+	From       int                 `json:"from"`
+	To         *int                `json:"to"`
+	Every      int                 `json:"every"`
+	Parameters map[string][]string `json:"parameters"`
+	Groups     []string            `json:"groups"` // Names of parameter_groups merged into parameters
+}
+
+// Covers reports whether the rule applies to a forecast hour
+func (r HourRule) Covers(hour int) bool {
+	if hour < r.From || (r.To != nil && hour > *r.To) {
+		return false
+	}
+	return r.Every <= 1 || (hour-r.From)%r.Every == 0
+}
+
+// validate checks the hours and parameters of the rule
+func (r HourRule) validate() error {
+	if r.From < 0 {
+		return fmt.Errorf("from %d must not be negative", r.From)
+	}
+	if r.To != nil && *r.To < r.From {
+		return fmt.Errorf("to %d is before from %d", *r.To, r.From)
+	}
+	if r.Every < 0 {
+		return fmt.Errorf("every %d must not be negative", r.Every)
+	}
+	if len(r.Parameters) == 0 {
+		return fmt.Errorf("no parameters or groups")
+	}
+	_, err := Selection{Parameters: r.Parameters}.compile()
+	return err
+}
+
+// SelectionFor returns the record selection of a target: the parameters of
+// the dataset together with those of the hour rules covering its forecast
+// hour
+func (ds *Dataset) SelectionFor(target Target) Selection {
+	selection := ds.Selection()
+	if target.Minute >= 0 && len(ds.Minutes) > 0 {
+		selection.Types = ds.minuteTypes(target)
+		selection.derivedTypes = len(ds.Types) == 0
+	}
+	if len(ds.HourRules) == 0 || target.Hour < 0 {
+		return selection
+	}
+
+	parameters := map[string][]string{}
+	mergeParameters(parameters, ds.Parameters)
+	for _, rule := range ds.HourRules {
+		if rule.Covers(target.Hour) {
+			mergeParameters(parameters, rule.Parameters)
+		}
+	}
+	selection.Parameters = parameters
+	return selection
+}
@@ -0,0 +1,102 @@
+package gribdownloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxHourSpecHours bounds the number of hours a single spec expands to,
+// catching typos such as a missing step
+const maxHourSpecHours = 10000
+
+// ParseHours expands a forecast hour spec: a comma-separated list of hours
+// ("6"), ranges ("0-120", every hour) and ranges with a step ("123-384/3"),
+// e.g. "0-120/3,123-384/12". The hours are returned sorted, each once.
+func ParseHours(spec string) ([]int, error) {
+	var hours []int
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		bounds, stepText, hasStep := strings.Cut(item, "/")
+		firstText, lastText, isRange := strings.Cut(bounds, "-")
+		if !isRange {
+			lastText = firstText
+		}
+
+		first, errFirst := strconv.Atoi(firstText)
+		last, errLast := strconv.Atoi(lastText)
+		step := 1
+		var errStep error
+		if hasStep {
+			step, errStep = strconv.Atoi(stepText)
+		}
+		if errFirst != nil || errLast != nil || errStep != nil || first < 0 || step <= 0 || (hasStep && !isRange) {
+			return nil, fmt.Errorf("invalid forecast hours %q: expected hours such as 6, 0-120 or 0-120/3", item)
+		}
+		if last < first {
+			return nil, fmt.Errorf("invalid forecast hours %q: range ends before it starts", item)
+		}
+		if (last-first)/step+len(hours) >= maxHourSpecHours {
+			return nil, fmt.Errorf("invalid forecast hours %q: expands to too many hours", spec)
+		}
+		hours = append(hours, hourRange(first, last, step)...)
+	}
+	return uniqueHours(hours), nil
+}
+
+// uniqueHours sorts hours and drops those listed more than once, which would
+// otherwise become targets writing the same file
+func uniqueHours(hours []int) []int {
+	slices.Sort(hours)
+	return slices.Compact(hours)
+}
+
+// HourList is a list of forecast hours. In JSON it is given as an array of
+// hours and hour specs, or as a single spec string (see ParseHours).
+type HourList []int
+
+// UnmarshalJSON accepts a spec string or an array of hours and specs
+func (h *HourList) UnmarshalJSON(data []byte) error {
+	var spec string
+	if err := json.Unmarshal(data, &spec); err == nil {
+		return h.UnmarshalText([]byte(spec))
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return fmt.Errorf("expected an array of hours or a spec such as \"0-120/3\"")
+	}
+	var hours []int
+	for _, item := range items {
+		var hour int
+		if err := json.Unmarshal(item, &hour); err == nil {
+			if hour < 0 {
+				return fmt.Errorf("invalid forecast hour %d: must not be negative", hour)
+			}
+			hours = append(hours, hour)
+			continue
+		}
+		if err := json.Unmarshal(item, &spec); err != nil {
+			return fmt.Errorf("invalid forecast hour %s: expected a number or a spec such as \"0-120/3\"", item)
+		}
+		expanded, err := ParseHours(spec)
+		if err != nil {
+			return err
+		}
+		hours = append(hours, expanded...)
+	}
+	*h = uniqueHours(hours)
+	return nil
+}
+
+// UnmarshalText parses a spec, as given on the command line
+func (h *HourList) UnmarshalText(text []byte) error {
+	hours, err := ParseHours(string(text))
+	if err != nil {
+		return err
+	}
+	*h = hours
+	return nil
+}
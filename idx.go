@@ -0,0 +1,142 @@
+// Package gribdownloader downloads subsets of GRIB files using the byte
+// offsets published in their idx files.
+package gribdownloader
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// GFSParameter represents a single parameter in the idx file
+type GFSParameter struct {
+	Number    int
+	Field     int `json:",omitempty"` // Field within the message for entries such as "3.2", otherwise 0
+	Offset    int64
+	Length    int64 // Message length if the index provides it, otherwise 0
+	Date      string
+	Parameter string
+	Level     string
+	Type      string
+	// Extra holds fields following the type, such as "ENS=+1" in
+	// ensemble idx files or the thresholds of probability forecasts
+	Extra []string `json:",omitempty"`
+}
+
+// ID returns the record number as written in idx files, e.g. "3" or "3.2"
+func (p GFSParameter) ID() string {
+	if p.Field > 0 {
+		return fmt.Sprintf("%d.%d", p.Number, p.Field)
+	}
+	return strconv.Itoa(p.Number)
+}
+
+// String describes the record as "PARAMETER:level:type"
+func (p GFSParameter) String() string {
+	return p.Parameter + ":" + p.Level + ":" + p.Type
+}
+
+// IndexParser parses an index file into its records
+type IndexParser interface {
+	Parse(r io.Reader) ([]GFSParameter, error)
+}
+
+// NCEPParser parses NCEP colon-delimited idx files
+type NCEPParser struct{}
+
+// Parse implements IndexParser
+func (NCEPParser) Parse(r io.Reader) ([]GFSParameter, error) {
+	return ParseIDX(r)
+}
+
+// GribURL returns the URL of the GRIB file described by an index URL
+func GribURL(indexURL string) string {
+	if strings.HasSuffix(indexURL, ".index") {
+		return strings.TrimSuffix(indexURL, ".index") + ".grib2"
+	}
+	return strings.TrimSuffix(indexURL, ".idx")
+}
+
+// ParseIDX parses GFS idx records from a reader
+func ParseIDX(r io.Reader) ([]GFSParameter, error) {
+	var parameters []GFSParameter
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		parts := strings.Split(line, ":")
+
+		// The type and any further fields may be missing
+		if len(parts) < 5 {
+			continue
+		}
+
+		// Fields sharing a message are numbered 3.1, 3.2 and so on
+		id, sub, _ := strings.Cut(parts[0], ".")
+		number, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+		field := 0
+		if sub != "" {
+			if field, err = strconv.Atoi(sub); err != nil {
+				continue
+			}
+		}
+
+		offset, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		param := GFSParameter{
+			Number:    number,
+			Field:     field,
+			Offset:    offset,
+			Date:      strings.TrimPrefix(parts[2], "d="),
+			Parameter: parts[3],
+			Level:     parts[4],
+		}
+		if len(parts) > 5 {
+			param.Type = parts[5]
+		}
+		for _, extra := range parts[min(len(parts), 6):] {
+			if extra = strings.TrimSpace(extra); extra != "" {
+				param.Extra = append(param.Extra, extra)
+			}
+		}
+
+		parameters = append(parameters, param)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading idx file: %v", err)
+	}
+
+	return parameters, nil
+}
+
+// ParseIDXFile reads and parses a GFS idx file
+func ParseIDXFile(idxPath string) ([]GFSParameter, error) {
+	return ParseIndexFile(idxPath, NCEPParser{})
+}
+
+// ParseIndexFile reads and parses an index file with the given parser
+func ParseIndexFile(path string, parser IndexParser) ([]GFSParameter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening idx file: %v", err)
+	}
+	defer file.Close()
+
+	return parser.Parse(file)
+}
+
+// ParseIndex parses the contents of an index file with the given parser
+func ParseIndex(data []byte, parser IndexParser) ([]GFSParameter, error) {
+	return parser.Parse(bytes.NewReader(data))
+}
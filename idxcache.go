@@ -0,0 +1,204 @@
+package gribdownloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// IdxCache keeps fetched idx files on disk together with their ETag and
+// Last-Modified headers, so that a file is revalidated with a conditional
+// request instead of being downloaded again. Parsed records are also kept in
+// memory for as long as the cache is in use, e.g. across watch polls.
+type IdxCache struct {
+	Dir string
+
+	mu     sync.Mutex
+	parsed map[string]parsedIndex // Keyed by URL
+}
+
+// idxCacheEntry is the metadata stored next to a cached idx file
+type idxCacheEntry struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+// parsedIndex is an idx file parsed while its cache entry was current
+type parsedIndex struct {
+	entry      idxCacheEntry
+	parser     string
+	parameters []GFSParameter
+}
+
+// path returns the file a URL is cached in, without extension
+func (c *IdxCache) path(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:12]))
+}
+
+// load returns the cached file of a URL, if any
+func (c *IdxCache) load(url string) (idxCacheEntry, []byte, bool) {
+	var entry idxCacheEntry
+	meta, err := os.ReadFile(c.path(url) + ".json")
+	if err != nil || json.Unmarshal(meta, &entry) != nil || entry.URL != url {
+		return entry, nil, false
+	}
+	data, err := os.ReadFile(c.path(url) + ".idx")
+	if err != nil {
+		return entry, nil, false
+	}
+	return entry, data, true
+}
+
+// store saves a downloaded file under its URL
+func (c *IdxCache) store(entry idxCacheEntry, data []byte) error {
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	base := c.path(entry.URL)
+	if err := writeFileAtomic(base+".idx", data); err != nil {
+		return err
+	}
+	return writeFileAtomic(base+".json", meta)
+}
+
+// parsedFor returns the records parsed from the same cache entry of a URL
+// with the same parser, if any. Entries are told apart by their fetch time,
+// which a revalidated entry keeps.
+func (c *IdxCache) parsedFor(entry idxCacheEntry, parser IndexParser) ([]GFSParameter, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.parsed[entry.URL]
+	if !ok || p.parser != fmt.Sprintf("%T", parser) || p.entry.ETag != entry.ETag || p.entry.LastModified != entry.LastModified || !p.entry.Fetched.Equal(entry.Fetched) {
+		return nil, false
+	}
+	return p.parameters, true
+}
+
+// remember keeps the records parsed from a cache entry
+func (c *IdxCache) remember(entry idxCacheEntry, parser IndexParser, parameters []GFSParameter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.parsed == nil {
+		c.parsed = map[string]parsedIndex{}
+	}
+	c.parsed[entry.URL] = parsedIndex{entry: entry, parser: fmt.Sprintf("%T", parser), parameters: parameters}
+}
+
+// writeFileAtomic writes a file through a temporary file, so readers never
+// see it half written
+func writeFileAtomic(path string, data []byte) error {
+	part := PartPath(path)
+	if err := os.WriteFile(part, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(part, path); err != nil {
+		os.Remove(part)
+		return err
+	}
+	return nil
+}
+
+// fetchCached fetches a file through the idx cache, revalidating a cached
+// copy with If-None-Match and If-Modified-Since. It returns the cache entry
+// the data belongs to.
+func (d *Downloader) fetchCached(ctx context.Context, url string) (idxCacheEntry, []byte, error) {
+	cache := d.IdxCache
+	entry, cached, ok := cache.load(url)
+
+	httpURL, err := d.resolveURL(url)
+	if err != nil {
+		return entry, nil, err
+	}
+	req, err := d.newRequest(ctx, "GET", httpURL)
+	if err != nil {
+		return entry, nil, err
+	}
+	if ok {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return entry, nil, fmt.Errorf("error downloading file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && ok:
+		d.logger().Debug("idx file not modified", "url", url)
+		return entry, cached, nil
+	case isMissing(resp.StatusCode):
+		return entry, nil, fmt.Errorf("%w (status code %d)", ErrNotFound, resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return entry, nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(d.limit(ctx, resp.Body))
+	if err != nil {
+		return entry, nil, fmt.Errorf("error reading response: %v", err)
+	}
+
+	entry = idxCacheEntry{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Fetched:      time.Now().UTC(),
+	}
+	if entry.ETag != "" || entry.LastModified != "" {
+		if err := cache.store(entry, data); err != nil {
+			d.logger().Warn("could not cache idx file", "url", url, "error", err)
+		}
+	}
+	return entry, data, nil
+}
+
+// FetchIndex downloads and parses an index file. With an IdxCache set,
+// unchanged files are revalidated rather than downloaded again and their
+// records are parsed only once.
+func (d *Downloader) FetchIndex(ctx context.Context, url string, parser IndexParser) ([]GFSParameter, []byte, error) {
+	if d.IdxCache == nil {
+		data, err := d.Fetch(ctx, url)
+		if err != nil {
+			return nil, nil, err
+		}
+		parameters, err := ParseIndex(data, parser)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing idx file: %v", err)
+		}
+		return parameters, data, nil
+	}
+
+	entry, data, err := d.fetchCached(ctx, url)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parameters, ok := d.IdxCache.parsedFor(entry, parser); ok {
+		return parameters, data, nil
+	}
+	parameters, err := ParseIndex(data, parser)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing idx file: %v", err)
+	}
+	d.IdxCache.remember(entry, parser, parameters)
+	return parameters, data, nil
+}
@@ -0,0 +1,169 @@
+package gribdownloader
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Index formats understood by IndexParserFor
+const (
+	FormatAuto    = "auto"
+	FormatNCEP    = "ncep"
+	FormatWgrib   = "wgrib"
+	FormatECMWF   = "ecmwf"
+	FormatEccodes = "eccodes"
+)
+
+var (
+	parsersMu sync.RWMutex
+	parsers   = map[string]IndexParser{
+		FormatNCEP:    NCEPParser{},
+		FormatWgrib:   WgribParser{},
+		FormatECMWF:   ECMWFParser{},
+		FormatEccodes: EccodesParser{},
+	}
+)
+
+// RegisterIndexParser makes an index parser available under the given
+// index_format name, replacing any parser already registered with that name
+func RegisterIndexParser(name string, parser IndexParser) {
+	parsersMu.Lock()
+	defer parsersMu.Unlock()
+	parsers[name] = parser
+}
+
+// IndexFormats returns the names of the registered index formats
+func IndexFormats() []string {
+	parsersMu.RLock()
+	defer parsersMu.RUnlock()
+
+	names := make([]string, 0, len(parsers))
+	for name := range parsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IndexParserFor returns the parser registered for format. An empty format or
+// "auto" returns a parser that detects the format from the file contents.
+func IndexParserFor(format string) (IndexParser, error) {
+	if format == "" || format == FormatAuto {
+		return AutoParser{}, nil
+	}
+
+	parsersMu.RLock()
+	defer parsersMu.RUnlock()
+
+	parser, ok := parsers[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown index_format %q", format)
+	}
+	return parser, nil
+}
+
+// DetectIndexFormat guesses the index format from the first non-empty line,
+// or from the header of a grib_ls table following its file name
+func DetectIndexFormat(data []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lines := 0; scanner.Scan(); {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		lines++
+		switch {
+		case isEccodesHeader(strings.Fields(line)):
+			return FormatEccodes
+		case lines == 1 && !strings.Contains(line, ":"):
+			continue // The file name grib_ls prints ahead of its table
+		case strings.HasPrefix(line, "{"):
+			return FormatECMWF
+		case strings.Contains(line, ":kpds5=") || strings.Contains(line, ":TimeU="):
+			return FormatWgrib
+		default:
+			return FormatNCEP
+		}
+	}
+	return FormatNCEP
+}
+
+// AutoParser detects the index format from the contents and delegates to
+// the matching parser
+type AutoParser struct{}
+
+// Parse implements IndexParser
+func (AutoParser) Parse(r io.Reader) ([]GFSParameter, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading index file: %v", err)
+	}
+
+	parser, err := IndexParserFor(DetectIndexFormat(data))
+	if err != nil {
+		return nil, err
+	}
+	return parser.Parse(bytes.NewReader(data))
+}
+
+// WgribParser parses GRIB1 inventories written by wgrib, which carry the
+// PDS octets before the level and type columns, e.g.
+//
+//	1:0:d=24111200:TMP:kpds5=11:kpds6=100:kpds7=850:TR=0:P1=0:P2=0:TimeU=1:850 mb:anl:NAve=0
+type WgribParser struct{}
+
+// Parse implements IndexParser
+func (WgribParser) Parse(r io.Reader) ([]GFSParameter, error) {
+	var parameters []GFSParameter
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), ":")
+		if len(parts) < 6 {
+			continue
+		}
+
+		number, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+
+		offset, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		// Level and type follow the TimeU field
+		levelIndex := -1
+		for i, part := range parts {
+			if strings.HasPrefix(part, "TimeU=") {
+				levelIndex = i + 1
+				break
+			}
+		}
+		if levelIndex < 0 || levelIndex+1 >= len(parts) {
+			continue
+		}
+
+		parameters = append(parameters, GFSParameter{
+			Number:    number,
+			Offset:    offset,
+			Date:      strings.TrimPrefix(parts[2], "d="),
+			Parameter: parts[3],
+			Level:     parts[levelIndex],
+			Type:      parts[levelIndex+1],
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading idx file: %v", err)
+	}
+
+	return parameters, nil
+}
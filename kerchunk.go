@@ -0,0 +1,357 @@
+package gribdownloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// KerchunkRefs is a kerchunk reference set (version 1): a Zarr store whose
+// chunks are byte ranges of remote files, so that xarray can read the
+// messages lazily without a local copy
+type KerchunkRefs struct {
+	Version int            `json:"version"`
+	Refs    map[string]any `json:"refs"`
+}
+
+// KerchunkPath returns the path of the reference file for an output file
+func KerchunkPath(outputFile string) string {
+	return outputFile + ".refs.json"
+}
+
+// zarrArray is the .zarray metadata of a Zarr v2 array
+type zarrArray struct {
+	Chunks     []int  `json:"chunks"`
+	Compressor any    `json:"compressor"`
+	DType      string `json:"dtype"`
+	FillValue  any    `json:"fill_value"`
+	Filters    []any  `json:"filters"`
+	Order      string `json:"order"`
+	Shape      []int  `json:"shape"`
+	ZarrFormat int    `json:"zarr_format"`
+}
+
+// gribCodec is the kerchunk codec decoding a chunk holding a GRIB message
+type gribCodec struct {
+	ID    string `json:"id"`
+	Var   string `json:"var"`
+	DType string `json:"dtype"`
+}
+
+// nonName matches the characters replaced in variable names
+var nonName = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// gridDims returns the size of a grid as rows and columns for the grid
+// templates whose size is stored like template 3.0
+func gridDims(s3 []byte) (ny, nx int, err error) {
+	if len(s3) < 38 {
+		return 0, 0, fmt.Errorf("%w: short grid definition section", ErrInvalidGRIB)
+	}
+	template := int(binary.BigEndian.Uint16(s3[12:14]))
+	if _, ok := gridNames[template]; !ok || s3[10] != 0 {
+		return 0, 0, fmt.Errorf("%w: grid definition template 3.%d", ErrUnsupportedGRIB, template)
+	}
+	nx = int(binary.BigEndian.Uint32(s3[30:34]))
+	ny = int(binary.BigEndian.Uint32(s3[34:38]))
+	if nx <= 0 || ny <= 0 || nx == math.MaxUint32 || ny == math.MaxUint32 {
+		return 0, 0, fmt.Errorf("%w: grid without a regular size", ErrUnsupportedGRIB)
+	}
+	return ny, nx, nil
+}
+
+// float64Chunk encodes values as an inline little-endian chunk
+func float64Chunk(values []float64) string {
+	buf := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint64(buf[8*i:], math.Float64bits(v))
+	}
+	return "base64:" + base64.StdEncoding.EncodeToString(buf)
+}
+
+// kerchunkBuilder accumulates the references of a store
+type kerchunkBuilder struct {
+	refs  map[string]any
+	grids map[string][2]string // Dimension names by grid definition
+}
+
+// put stores JSON metadata under key
+func (b *kerchunkBuilder) put(key string, v any) error {
+	var buf strings.Builder
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	b.refs[key] = strings.TrimSuffix(buf.String(), "\n")
+	return nil
+}
+
+// coordinate adds an inline one-dimensional coordinate array
+func (b *kerchunkBuilder) coordinate(name, units string, values []float64) error {
+	err := b.put(name+"/.zarray", zarrArray{
+		Chunks: []int{len(values)}, DType: "<f8", Order: "C",
+		Shape: []int{len(values)}, ZarrFormat: 2,
+	})
+	if err != nil {
+		return err
+	}
+	if err := b.put(name+"/.zattrs", map[string]any{"_ARRAY_DIMENSIONS": []string{name}, "units": units}); err != nil {
+		return err
+	}
+	b.refs[name+"/0"] = float64Chunk(values)
+	return nil
+}
+
+// dims returns the dimension names of a grid, adding the latitude and
+// longitude coordinates of regular grids the first time a grid is seen
+func (b *kerchunkBuilder) dims(s3 []byte) ([2]string, error) {
+	if dims, ok := b.grids[string(s3)]; ok {
+		return dims, nil
+	}
+	suffix := ""
+	if n := len(b.grids); n > 0 {
+		suffix = fmt.Sprintf("_%d", n)
+	}
+
+	grid, err := parseLatLonGrid(s3)
+	if err != nil {
+		// Projected grids are described by their size alone
+		dims := [2]string{"y" + suffix, "x" + suffix}
+		b.grids[string(s3)] = dims
+		return dims, nil
+	}
+
+	dims := [2]string{"latitude" + suffix, "longitude" + suffix}
+	lats := make([]float64, grid.nj)
+	for j := range lats {
+		lats[j] = grid.la1 + float64(j)*grid.dj
+	}
+	lons := make([]float64, grid.ni)
+	for i := range lons {
+		lons[i] = grid.lo1 + float64(i)*grid.di
+	}
+	if err := b.coordinate(dims[0], "degrees_north", lats); err != nil {
+		return dims, err
+	}
+	if err := b.coordinate(dims[1], "degrees_east", lons); err != nil {
+		return dims, err
+	}
+	b.grids[string(s3)] = dims
+	return dims, nil
+}
+
+// BuildKerchunkRefs describes the messages of a downloaded file as a
+// kerchunk reference set pointing at their byte ranges in the source
+// files. Each message becomes a variable named after its parameter and
+// level, read with kerchunk's GRIB codec; regular latitude/longitude grids
+// also get coordinate arrays. The grids are read from the local file, which
+// must not have been subset.
+func BuildKerchunkRefs(outputFile string, manifest *Manifest) (*KerchunkRefs, error) {
+	if manifest.Region != "" {
+		return nil, fmt.Errorf("references cannot be built for messages subset to a region")
+	}
+
+	file, err := os.Open(outputFile)
+	if err != nil {
+		return nil, fmt.Errorf("error opening output file: %v", err)
+	}
+	defer file.Close()
+
+	grids := make([][]byte, len(manifest.Messages))
+	for i, msg := range manifest.Messages {
+		data := make([]byte, msg.Length)
+		if _, err := file.ReadAt(data, msg.Offset); err != nil {
+			return nil, fmt.Errorf("error reading record %d: %v", msg.Number, err)
+		}
+		sections, err := grib2Sections(data)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %v", msg.Number, err)
+		}
+		for _, s := range sections {
+			if s.number == 3 {
+				grids[i] = s.data
+				break
+			}
+		}
+	}
+	return buildKerchunkRefs(manifest, grids)
+}
+
+// RemoteKerchunkRefs describes the records of a remote GRIB file as a
+// kerchunk reference set, like BuildKerchunkRefs, without downloading them:
+// only the sections up to the grid definition of each message are read.
+// The mirrors are tried in order for each message.
+func (d *Downloader) RemoteKerchunkRefs(ctx context.Context, mirrors []string, records []Record) (*KerchunkRefs, error) {
+	if len(mirrors) == 0 {
+		return nil, fmt.Errorf("no source URLs given")
+	}
+	urls := make([]string, len(mirrors))
+	for i, mirror := range mirrors {
+		url, err := d.resolveURL(mirror)
+		if err != nil {
+			return nil, err
+		}
+		urls[i] = url
+	}
+
+	manifest := &Manifest{Source: mirrors[0], Created: time.Now().UTC()}
+	grids := make([][]byte, len(records))
+	for i, rec := range records {
+		var errs []error
+		for _, url := range urls {
+			s3, err := d.gridSection(ctx, url, rec.Range)
+			if err == nil {
+				grids[i] = s3
+				manifest.Messages = append(manifest.Messages, ManifestMessage{
+					Number:    rec.Number,
+					Parameter: rec.Parameter,
+					Level:     rec.Level,
+					Type:      rec.Type,
+					Range:     rec.Range,
+					Length:    rec.Range.Size(),
+					Source:    url,
+				})
+				break
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			errs = append(errs, err)
+		}
+		if len(errs) == len(urls) {
+			return nil, fmt.Errorf("error reading record %d: all mirrors failed: %v", rec.Number, errs)
+		}
+	}
+	return buildKerchunkRefs(manifest, grids)
+}
+
+// gridProbe is how much of a message is first requested to find its grid
+// definition, which follows the short identification section
+const gridProbe = 1024
+
+// gridSection reads the grid definition section (section 3) of the GRIB2
+// message in range r of a remote file, fetching the sections before it but
+// none of the data
+func (d *Downloader) gridSection(ctx context.Context, url string, r RangeDownload) ([]byte, error) {
+	size := r.Size()
+	buf, err := d.fetchRange(ctx, url, r.Start, r.Start+min(size, gridProbe)-1)
+	if err != nil {
+		return nil, err
+	}
+	// need makes sure the first n bytes of the message are read
+	need := func(n int64) error {
+		if n > size {
+			return fmt.Errorf("%w: message ends before its grid definition", ErrInvalidGRIB)
+		}
+		if n <= int64(len(buf)) {
+			return nil
+		}
+		more, err := d.fetchRange(ctx, url, r.Start+int64(len(buf)), r.Start+n-1)
+		buf = append(buf, more...)
+		return err
+	}
+
+	if err := need(16); err != nil {
+		return nil, err
+	}
+	if string(buf[:4]) != "GRIB" {
+		return nil, fmt.Errorf("%w: missing GRIB magic", ErrInvalidGRIB)
+	}
+	if buf[7] != 2 {
+		return nil, fmt.Errorf("%w: not a GRIB2 message (edition %d)", ErrInvalidGRIB, buf[7])
+	}
+	for offset := int64(16); ; {
+		if err := need(offset + 5); err != nil {
+			return nil, err
+		}
+		length := int64(binary.BigEndian.Uint32(buf[offset:]))
+		number := buf[offset+4]
+		if length < 5 || number < 1 || number > 3 {
+			return nil, fmt.Errorf("%w: no grid definition section", ErrInvalidGRIB)
+		}
+		if err := need(offset + length); err != nil {
+			return nil, err
+		}
+		if number == 3 {
+			return buf[offset : offset+length], nil
+		}
+		offset += length
+	}
+}
+
+// buildKerchunkRefs builds the references of the messages of a manifest
+// from their grid definition sections
+func buildKerchunkRefs(manifest *Manifest, grids [][]byte) (*KerchunkRefs, error) {
+	b := &kerchunkBuilder{refs: map[string]any{}, grids: map[string][2]string{}}
+	if err := b.put(".zgroup", map[string]int{"zarr_format": 2}); err != nil {
+		return nil, err
+	}
+	if err := b.put(".zattrs", map[string]any{"source": manifest.Source, "created": manifest.Created}); err != nil {
+		return nil, err
+	}
+
+	for i, msg := range manifest.Messages {
+		s3 := grids[i]
+		ny, nx, err := gridDims(s3)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %v", msg.Number, err)
+		}
+		dims, err := b.dims(s3)
+		if err != nil {
+			return nil, err
+		}
+
+		base := nonName.ReplaceAllString(msg.Parameter+"_"+msg.Level, "_")
+		name := base
+		for n := 2; b.refs[name+"/.zarray"] != nil; n++ {
+			name = fmt.Sprintf("%s_%d", base, n)
+		}
+		err = b.put(name+"/.zarray", zarrArray{
+			Chunks:     []int{ny, nx},
+			DType:      "<f8",
+			FillValue:  "NaN",
+			Filters:    []any{gribCodec{ID: "grib", Var: msg.Parameter, DType: "float64"}},
+			Order:      "C",
+			Shape:      []int{ny, nx},
+			ZarrFormat: 2,
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = b.put(name+"/.zattrs", map[string]any{
+			"_ARRAY_DIMENSIONS": dims,
+			"parameter":         msg.Parameter,
+			"level":             msg.Level,
+			"type":              msg.Type,
+			"record":            msg.Number,
+		})
+		if err != nil {
+			return nil, err
+		}
+		b.refs[name+"/0.0"] = []any{msg.Source, msg.Range.Start, msg.Length}
+	}
+
+	return &KerchunkRefs{Version: 1, Refs: b.refs}, nil
+}
+
+// WriteKerchunkRefs writes a reference set as JSON
+func WriteKerchunkRefs(path string, refs *KerchunkRefs) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(refs); err != nil {
+		return fmt.Errorf("error encoding references: %v", err)
+	}
+	if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+		return fmt.Errorf("error writing references: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package gribdownloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Manifest describes the GRIB messages written to an output file
+type Manifest struct {
+	File     string            `json:"file"`
+	Source   string            `json:"source"`
+	Created  time.Time         `json:"created"`
+	Region   string            `json:"region,omitempty"` // Set when messages were subset
+	Messages []ManifestMessage `json:"messages"`
+	Missing  []MissingRecord   `json:"missing,omitempty"` // Records lost with failed ranges
+}
+
+// ManifestMessage describes a single GRIB message in the output file
+type ManifestMessage struct {
+	Number    int           `json:"number"`
+	Parameter string        `json:"parameter"`
+	Level     string        `json:"level"`
+	Type      string        `json:"type"`
+	Fields    []string      `json:"fields,omitempty"` // All fields of a message holding several
+	Range     RangeDownload `json:"range"`            // Byte range in the source file
+	Offset    int64         `json:"offset"`           // Offset in the output file
+	Length    int64         `json:"length"`
+	SHA256    string        `json:"sha256"`
+	Source    string        `json:"source"` // URL the message was downloaded from
+}
+
+// MissingRecord describes a selected record that is not in the output file
+// because its range could not be downloaded
+type MissingRecord struct {
+	Number    int           `json:"number"`
+	Parameter string        `json:"parameter"`
+	Level     string        `json:"level"`
+	Type      string        `json:"type"`
+	Range     RangeDownload `json:"range"`
+}
+
+// AddMissing lists records that are not in the output file
+func (m *Manifest) AddMissing(records []Record) {
+	for _, rec := range records {
+		m.Missing = append(m.Missing, MissingRecord{
+			Number:    rec.Number,
+			Parameter: rec.Parameter,
+			Level:     rec.Level,
+			Type:      rec.Type,
+			Range:     rec.Range,
+		})
+	}
+}
+
+// Matches reports whether the manifest lists exactly the records, at the
+// same offsets in the source file, with none missing
+func (m *Manifest) Matches(records []Record) bool {
+	if len(m.Missing) > 0 || len(m.Messages) != len(records) {
+		return false
+	}
+	for i, rec := range records {
+		msg := m.Messages[i]
+		if msg.Number != rec.Number || msg.Parameter != rec.Parameter || msg.Level != rec.Level ||
+			msg.Type != rec.Type || msg.Range.Start != rec.Range.Start {
+			return false
+		}
+	}
+	return true
+}
+
+// MinSize returns the size the output file has at least: the end of its
+// last message
+func (m *Manifest) MinSize() int64 {
+	var size int64
+	for _, msg := range m.Messages {
+		size = max(size, msg.Offset+msg.Length)
+	}
+	return size
+}
+
+// ManifestPath returns the path of the manifest for an output file
+func ManifestPath(outputFile string) string {
+	return outputFile + ".manifest.json"
+}
+
+// hashSection returns the SHA-256 of length bytes of r starting at offset
+func hashSection(r io.ReaderAt, offset, length int64) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, offset, length)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// BuildManifest describes the records downloaded into outputFile. ranges and
+// mode must be those the file was downloaded with, and results the value
+// returned by DownloadRangesFromMirrors.
+func BuildManifest(outputFile, source string, records []Record, ranges []RangeDownload, mode OutputMode, results []RangeResult) (*Manifest, error) {
+	file, err := os.Open(outputFile)
+	if err != nil {
+		return nil, fmt.Errorf("error opening output file: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error reading output file: %v", err)
+	}
+
+	jobs, _ := layoutRanges(ranges, mode)
+	manifest := &Manifest{
+		File:    outputFile,
+		Source:  source,
+		Created: time.Now().UTC(),
+	}
+
+	for _, rec := range records {
+		msg := ManifestMessage{
+			Number:    rec.Number,
+			Parameter: rec.Parameter,
+			Level:     rec.Level,
+			Type:      rec.Type,
+			Range:     rec.Range,
+			Fields:    rec.FieldNames(),
+			Offset:    -1,
+			Length:    rec.Range.Size(),
+		}
+
+		for _, job := range jobs {
+			if job.Contains(rec.Range.Start) {
+				msg.Offset = job.Dest + rec.Range.Start - job.Start
+				break
+			}
+		}
+		if msg.Offset < 0 {
+			return nil, fmt.Errorf("record %d is not part of the downloaded ranges", rec.Number)
+		}
+
+		for _, result := range results {
+			if result.Contains(rec.Range.Start) {
+				msg.Source = result.Source
+				break
+			}
+		}
+
+		// The final record may be shorter than requested when the file size was unknown
+		if end := msg.Offset + msg.Length; end > info.Size() {
+			msg.Length = info.Size() - msg.Offset
+		}
+
+		msg.SHA256, err = hashSection(file, msg.Offset, msg.Length)
+		if err != nil {
+			return nil, fmt.Errorf("error hashing record %d: %v", rec.Number, err)
+		}
+
+		manifest.Messages = append(manifest.Messages, msg)
+	}
+
+	return manifest, nil
+}
+
+// ApplySubset updates the manifest of outputFile after SubsetFile rewrote
+// it: messages are moved to their new positions and hashed again
+func (m *Manifest) ApplySubset(outputFile string, region Region, results []SubsetResult) error {
+	file, err := os.Open(outputFile)
+	if err != nil {
+		return fmt.Errorf("error opening output file: %v", err)
+	}
+	defer file.Close()
+
+	m.Region = region.String()
+	for i := range m.Messages {
+		msg := &m.Messages[i]
+
+		// A record may span several messages
+		offset, length := int64(-1), int64(0)
+		for _, result := range results {
+			if result.Offset >= msg.Offset && result.Offset < msg.Offset+msg.Length {
+				if offset < 0 {
+					offset = result.NewOffset
+				}
+				length += result.NewLength
+			}
+		}
+		if offset < 0 {
+			return fmt.Errorf("record %d is not part of the subset file", msg.Number)
+		}
+		msg.Offset, msg.Length = offset, length
+
+		msg.SHA256, err = hashSection(file, msg.Offset, msg.Length)
+		if err != nil {
+			return fmt.Errorf("error hashing record %d: %v", msg.Number, err)
+		}
+	}
+
+	return nil
+}
+
+// WriteManifest writes the manifest as indented JSON
+func WriteManifest(path string, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding manifest: %v", err)
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+
+	return nil
+}
+
+// ReadManifest reads a manifest written by WriteManifest
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %v", err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("error parsing manifest: %v", err)
+	}
+
+	return &manifest, nil
+}
+
+// VerifyManifest re-computes the checksum of every message listed in the
+// manifest and returns an error describing any mismatches
+func VerifyManifest(outputFile string, manifest *Manifest) error {
+	file, err := os.Open(outputFile)
+	if err != nil {
+		return fmt.Errorf("error opening output file: %v", err)
+	}
+	defer file.Close()
+
+	var mismatches []string
+	for _, msg := range manifest.Messages {
+		sum, err := hashSection(file, msg.Offset, msg.Length)
+		if err != nil {
+			return fmt.Errorf("error hashing record %d: %v", msg.Number, err)
+		}
+		if sum != msg.SHA256 {
+			mismatches = append(mismatches, fmt.Sprintf("record %d (%s %s)", msg.Number, msg.Parameter, msg.Level))
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%d of %d messages failed verification: %v", len(mismatches), len(manifest.Messages), mismatches)
+	}
+
+	return nil
+}
@@ -0,0 +1,435 @@
+package gribdownloader
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fieldPattern matches idx level and type strings. A pattern is one of:
+//
+//   - an exact value, e.g. "850 mb"
+//   - a wildcard, e.g. "* mb" or "? m above ground"
+//   - a numeric range, e.g. "100-500 mb", matching single-valued levels
+//     with the same unit that fall within the bounds
+//   - a regular expression enclosed in slashes, e.g. "/^[0-9]+ mb$/"
+//   - a probability threshold, e.g. "prob >0.254", matching thresholds of
+//     equal value however the number is written
+type fieldPattern struct {
+	text string
+	re   *regexp.Regexp
+
+	isRange  bool
+	min, max float64
+	unit     string
+
+	threshold *probThreshold
+}
+
+// rangePattern recognises numeric range patterns such as "100-500 mb"
+var rangePattern = regexp.MustCompile(`^(-?[0-9.]+)-(-?[0-9.]+) (.+)$`)
+
+// singleLevel recognises single-valued levels such as "850 mb"
+var singleLevel = regexp.MustCompile(`^(-?[0-9.]+) (.+)$`)
+
+// compileFieldPattern parses a level or type pattern from the configuration
+func compileFieldPattern(pattern string) (fieldPattern, error) {
+	p := fieldPattern{text: pattern}
+
+	switch {
+	case len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return p, fmt.Errorf("invalid regex %q: %v", pattern, err)
+		}
+		p.re = re
+
+	case strings.ContainsAny(pattern, "*?"):
+		expr := regexp.QuoteMeta(pattern)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+		p.re = regexp.MustCompile("^" + expr + "$")
+
+	default:
+		if t, ok := parseThreshold(pattern); ok {
+			p.threshold = &t
+		}
+		if m := rangePattern.FindStringSubmatch(pattern); m != nil {
+			low, errLow := strconv.ParseFloat(m[1], 64)
+			high, errHigh := strconv.ParseFloat(m[2], 64)
+			if errLow == nil && errHigh == nil {
+				if low > high {
+					low, high = high, low
+				}
+				p.isRange = true
+				p.min, p.max = low, high
+				p.unit = m[3]
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// Match reports whether value satisfies the pattern
+func (p fieldPattern) Match(value string) bool {
+	if p.re != nil {
+		return p.re.MatchString(value)
+	}
+
+	// Exact matches take precedence so that layer levels such as
+	// "0-0.1 m below ground" can still be requested literally
+	if value == p.text {
+		return true
+	}
+
+	if p.threshold != nil {
+		t, ok := parseThreshold(value)
+		return ok && t == *p.threshold
+	}
+
+	if p.isRange {
+		m := singleLevel.FindStringSubmatch(value)
+		if m == nil || m[2] != p.unit {
+			return false
+		}
+		number, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			return false
+		}
+		return number >= p.min && number <= p.max
+	}
+
+	return false
+}
+
+// paramRule selects records by parameter name and level. Names may be given
+// exactly or as a regular expression enclosed in slashes. Levels prefixed
+// with "!" are excluded; if a rule lists no included levels every level of
+// the parameter matches. Levels may also restrict the type and extra fields
+// of the records, see levelPattern.
+type paramRule struct {
+	name    string
+	re      *regexp.Regexp
+	include []levelPattern
+	exclude []levelPattern
+	alias   string // Parameter alias the rule was expanded from, if any
+}
+
+// compileParamRule parses a parameter entry from the configuration
+func compileParamRule(name string, levels []string) (paramRule, error) {
+	rule := paramRule{name: name}
+
+	if len(name) >= 2 && strings.HasPrefix(name, "/") && strings.HasSuffix(name, "/") {
+		re, err := regexp.Compile(name[1 : len(name)-1])
+		if err != nil {
+			return rule, fmt.Errorf("invalid parameter regex %q: %v", name, err)
+		}
+		rule.re = re
+	}
+
+	for _, level := range levels {
+		excluded := strings.HasPrefix(level, "!")
+		p, err := compileLevelPattern(strings.TrimPrefix(level, "!"))
+		if err != nil {
+			return rule, err
+		}
+		if excluded {
+			rule.exclude = append(rule.exclude, p)
+		} else {
+			rule.include = append(rule.include, p)
+		}
+	}
+
+	return rule, nil
+}
+
+// Match reports whether the rule selects the given record
+func (r paramRule) Match(param GFSParameter) bool {
+	if r.re != nil {
+		if !r.re.MatchString(param.Parameter) {
+			return false
+		}
+	} else if r.name != param.Parameter {
+		return false
+	}
+
+	for _, p := range r.exclude {
+		if p.Match(param) {
+			return false
+		}
+	}
+
+	if len(r.include) == 0 { // No included levels means all levels
+		return true
+	}
+	for _, p := range r.include {
+		if p.Match(param) {
+			return true
+		}
+	}
+	return false
+}
+
+// Selection describes which idx records to download
+type Selection struct {
+	// Parameters maps parameter names to level patterns. Names may be
+	// regular expressions enclosed in slashes or parameter aliases such as
+	// "t2m", and are excluded when prefixed with "!"; an empty level list
+	// selects every level. An alias listed without levels is taken as a
+	// parameter name when a record of the idx file has that name; one
+	// listed with levels must be such a parameter name.
+	Parameters map[string][]string
+	// Types restricts the selection to records whose type column (e.g.
+	// "anl", "6 hour fcst") or one of whose extra fields (e.g. "ENS=+05")
+	// matches one of the patterns; empty means any type.
+	Types []string
+
+	// derivedTypes is set when Types was generated rather than configured,
+	// as for the lead times of sub-hourly files. Such types list every form
+	// a record type may take, so Unmatched does not report them.
+	derivedTypes bool
+}
+
+// selection is the compiled form of a Selection
+type selection struct {
+	include []paramRule
+	exclude []paramRule
+	aliases []aliasChoice
+	types   []fieldPattern
+}
+
+// aliasChoice is an entry whose name is both an alias and possibly a
+// parameter name of the idx files, such as "tp", which ECMWF uses for the
+// field NCEP calls APCP. It is settled by resolve once the records are
+// known.
+type aliasChoice struct {
+	literal    paramRule
+	fields     []paramRule
+	excluded   bool
+	withLevels bool // Listed with levels, so it cannot stand for the alias
+}
+
+// StrictMode decides what happens when part of a selection matches no
+// record of an idx file, which usually means a misspelled parameter or level
+type StrictMode string
+
+const (
+	// StrictWarn logs the unmatched parts and downloads the rest
+	StrictWarn StrictMode = "warn"
+	// StrictFail fails the file
+	StrictFail StrictMode = "fail"
+)
+
+// compile compiles the selection for matching against idx records
+func (s Selection) compile() (*selection, error) {
+	sel := &selection{}
+	for name, levels := range s.Parameters {
+		excluded := strings.HasPrefix(name, "!")
+		name = strings.TrimPrefix(name, "!")
+		literal, err := compileParamRule(name, levels)
+		if err != nil {
+			return nil, err
+		}
+		fields, isAlias := expandAlias(name, levels)
+		if _, ok := LookupAlias(name); ok && !isAlias {
+			// Given levels, an alias name is valid only as a parameter name
+			// of the idx file, which resolve checks
+			sel.aliases = append(sel.aliases, aliasChoice{literal: literal, excluded: excluded, withLevels: true})
+			continue
+		}
+		if !isAlias {
+			if excluded {
+				sel.exclude = append(sel.exclude, literal)
+			} else {
+				sel.include = append(sel.include, literal)
+			}
+			continue
+		}
+		choice := aliasChoice{literal: literal, excluded: excluded}
+		for field, levels := range fields {
+			rule, err := compileParamRule(field, levels)
+			if err != nil {
+				return nil, err
+			}
+			rule.alias = name
+			choice.fields = append(choice.fields, rule)
+		}
+		sel.aliases = append(sel.aliases, choice)
+	}
+	for _, t := range s.Types {
+		p, err := compileFieldPattern(t)
+		if err != nil {
+			return nil, err
+		}
+		sel.types = append(sel.types, p)
+	}
+	return sel, nil
+}
+
+// matchType reports whether the record type or one of its extra fields
+// passes the type filter
+func (s *selection) matchType(param GFSParameter) bool {
+	if len(s.types) == 0 {
+		return true
+	}
+	for _, p := range s.types {
+		if p.Match(param.Type) {
+			return true
+		}
+		for _, extra := range param.Extra {
+			if p.Match(extra) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolve settles the aliases of the selection for the records of an idx
+// file: a name that is the parameter of some record is taken as written,
+// and otherwise stands for the fields of its alias. An alias listed with
+// levels must be the parameter of some record, as it selects its own levels.
+func (s *selection) resolve(parameters []GFSParameter) (*selection, error) {
+	if len(s.aliases) == 0 {
+		return s, nil
+	}
+	resolved := &selection{
+		include: slices.Clone(s.include),
+		exclude: slices.Clone(s.exclude),
+		types:   s.types,
+	}
+	for _, choice := range s.aliases {
+		rules := choice.fields
+		if slices.ContainsFunc(parameters, func(p GFSParameter) bool { return p.Parameter == choice.literal.name }) {
+			rules = []paramRule{choice.literal}
+		} else if choice.withLevels {
+			return nil, fmt.Errorf("parameter alias %q selects its own levels; use the GRIB name to choose levels", choice.literal.name)
+		}
+		if choice.excluded {
+			resolved.exclude = append(resolved.exclude, rules...)
+		} else {
+			resolved.include = append(resolved.include, rules...)
+		}
+	}
+	return resolved, nil
+}
+
+// Match reports whether a record is selected. Aliases not yet settled by
+// resolve match both the name as written and the fields of the alias.
+func (s *selection) Match(param GFSParameter) bool {
+	if !s.matchType(param) {
+		return false
+	}
+	for _, rule := range s.exclude {
+		if rule.Match(param) {
+			return false
+		}
+	}
+	for _, choice := range s.aliases {
+		if choice.excluded && choice.match(param) {
+			return false
+		}
+	}
+	for _, rule := range s.include {
+		if rule.Match(param) {
+			return true
+		}
+	}
+	for _, choice := range s.aliases {
+		if !choice.excluded && choice.match(param) {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether the name as written or a field of the alias
+// selects the record
+func (c aliasChoice) match(param GFSParameter) bool {
+	if c.literal.Match(param) {
+		return true
+	}
+	return slices.ContainsFunc(c.fields, func(rule paramRule) bool { return rule.Match(param) })
+}
+
+// Unmatched describes the parts of the selection that match none of the
+// given records: parameters that do not occur, levels that no record of the
+// parameter has, aliases none of whose fields occur, and types that do not
+// occur, unless they were generated. Exclusions are not checked.
+func (s Selection) Unmatched(parameters []GFSParameter) ([]string, error) {
+	sel, err := s.compile()
+	if err != nil {
+		return nil, err
+	}
+	if sel, err = sel.resolve(parameters); err != nil {
+		return nil, err
+	}
+
+	var unmatched []string
+	aliasFound := map[string]bool{}
+	for _, rule := range sel.include {
+		if rule.alias != "" {
+			found := aliasFound[rule.alias]
+			for _, param := range parameters {
+				if found {
+					break
+				}
+				found = rule.Match(param)
+			}
+			aliasFound[rule.alias] = found
+			continue
+		}
+
+		var records []GFSParameter
+		for _, param := range parameters {
+			if (paramRule{name: rule.name, re: rule.re}).Match(param) {
+				records = append(records, param)
+			}
+		}
+		if len(records) == 0 {
+			unmatched = append(unmatched, fmt.Sprintf("parameter %q", rule.name))
+			continue
+		}
+		for _, p := range rule.include {
+			found := false
+			for _, param := range records {
+				if p.Match(param) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				unmatched = append(unmatched, fmt.Sprintf("level %q of parameter %q", p.text, rule.name))
+			}
+		}
+	}
+
+	for alias, found := range aliasFound {
+		if !found {
+			unmatched = append(unmatched, fmt.Sprintf("parameter alias %q", alias))
+		}
+	}
+
+	for _, p := range sel.types {
+		if s.derivedTypes {
+			break
+		}
+		found := false
+		for _, param := range parameters {
+			if (&selection{types: []fieldPattern{p}}).matchType(param) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unmatched = append(unmatched, fmt.Sprintf("type %q", p.text))
+		}
+	}
+
+	sort.Strings(unmatched)
+	return unmatched, nil
+}
@@ -0,0 +1,41 @@
+package gribdownloader
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAliasWithLevels(t *testing.T) {
+	ncep := []GFSParameter{
+		{Number: 1, Offset: 0, Parameter: "TMP", Level: "2 m above ground", Type: "anl"},
+		{Number: 2, Offset: 100, Parameter: "TMP", Level: "850 mb", Type: "anl"},
+	}
+	ecmwf := []GFSParameter{
+		{Number: 1, Offset: 0, Parameter: "tp", Level: "sfc", Type: "fc"},
+		{Number: 2, Offset: 100, Parameter: "t", Level: "850 pl", Type: "fc"},
+	}
+
+	// An alias given levels selects nothing it could stand for
+	_, err := SelectRecords(ncep, Selection{Parameters: map[string][]string{"t2m": {"850 mb"}}}, 200)
+	if err == nil || !strings.Contains(err.Error(), "selects its own levels") {
+		t.Errorf("t2m with levels: got error %v", err)
+	}
+
+	// It is a parameter name where the idx file has one
+	records, err := SelectRecords(ecmwf, Selection{Parameters: map[string][]string{"tp": {"sfc"}}}, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Parameter != "tp" {
+		t.Errorf("tp with levels selected %+v", records)
+	}
+
+	// Without levels, an alias stands for its fields
+	records, err = SelectRecords(ncep, Selection{Parameters: map[string][]string{"t2m": nil}}, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Level != "2 m above ground" {
+		t.Errorf("t2m selected %+v", records)
+	}
+}
@@ -0,0 +1,66 @@
+package gribdownloader
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GEFSMembers is the number of perturbed members of the GEFS ensemble
+const GEFSMembers = 30
+
+// gefsMembers returns the GEFS control and perturbed members
+func gefsMembers() []string {
+	members := []string{"gec00"}
+	for i := 1; i <= GEFSMembers; i++ {
+		members = append(members, fmt.Sprintf("gep%02d", i))
+	}
+	return members
+}
+
+// splitMember splits a member name into its prefix and numeric suffix,
+// e.g. "gep05" into "gep" and "05"
+func splitMember(member string) (string, string) {
+	i := len(member)
+	for i > 0 && member[i-1] >= '0' && member[i-1] <= '9' {
+		i--
+	}
+	return member[:i], member[i:]
+}
+
+// ExpandMembers expands the members list of a dataset. Entries are member
+// names, ranges such as "gep01..gep30" that keep the prefix and zero padding,
+// or "all" for the GEFS control and perturbed members (gec00, gep01..gep30).
+func ExpandMembers(entries []string) ([]string, error) {
+	var members []string
+	for _, entry := range entries {
+		if entry == "all" {
+			members = append(members, gefsMembers()...)
+			continue
+		}
+
+		first, last, ok := strings.Cut(entry, "..")
+		if !ok {
+			if entry == "" {
+				return nil, fmt.Errorf("empty member name")
+			}
+			members = append(members, entry)
+			continue
+		}
+
+		prefix, from := splitMember(first)
+		lastPrefix, to := splitMember(last)
+		if from == "" || to == "" || lastPrefix != prefix {
+			return nil, fmt.Errorf("invalid member range %q: expected e.g. gep01..gep30", entry)
+		}
+		start, _ := strconv.Atoi(from)
+		end, _ := strconv.Atoi(to)
+		if end < start {
+			return nil, fmt.Errorf("invalid member range %q: end before start", entry)
+		}
+		for n := start; n <= end; n++ {
+			members = append(members, fmt.Sprintf("%s%0*d", prefix, len(from), n))
+		}
+	}
+	return members, nil
+}
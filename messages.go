@@ -0,0 +1,78 @@
+package gribdownloader
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// Message is a selected GRIB message of a remote file, whose data is read
+// from the embedded Reader
+type Message struct {
+	io.Reader
+	Record        // The idx record of the message, with its byte range
+	Source string // URL the message was downloaded from
+}
+
+// MessageReader yields the selected messages of a remote file one at a
+// time, in record order, while the following ones are downloaded in the
+// background. Like StreamRanges it holds at most InFlightBytes, or twice
+// the number of workers ranges, in memory and writes nothing to disk.
+type MessageReader struct {
+	messages chan Message
+	done     chan struct{} // Closed when the download has ended
+	cancel   context.CancelFunc
+	err      error // Set before done is closed
+}
+
+// NewMessageReader starts downloading the records, as selected with
+// SelectRecords, from the first mirror that serves each of them. The reader
+// must be closed once it is no longer needed.
+func (d *Downloader) NewMessageReader(ctx context.Context, mirrors []string, records []Record) *MessageReader {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &MessageReader{
+		messages: make(chan Message),
+		done:     make(chan struct{}),
+		cancel:   cancel,
+	}
+
+	ranges := make([]RangeDownload, len(records))
+	for i, rec := range records {
+		ranges[i] = rec.Range
+	}
+	go func() {
+		defer close(r.done)
+		next := 0
+		r.err = d.streamRanges(ctx, mirrors, ranges, func(data []byte, result RangeResult) error {
+			msg := Message{Reader: bytes.NewReader(data), Record: records[next], Source: result.Source}
+			next++
+			select {
+			case r.messages <- msg:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return r
+}
+
+// Next returns the next message, or io.EOF once every message was read
+func (r *MessageReader) Next() (*Message, error) {
+	select {
+	case msg := <-r.messages:
+		return &msg, nil
+	case <-r.done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return nil, io.EOF
+	}
+}
+
+// Close stops the download and releases its resources
+func (r *MessageReader) Close() error {
+	r.cancel()
+	<-r.done
+	return nil
+}
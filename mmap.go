@@ -0,0 +1,60 @@
+package gribdownloader
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// mappedFile is an output file mapped into memory, so that range workers
+// write by copying into the map instead of with a system call per write
+type mappedFile struct {
+	data []byte
+}
+
+// mapFile maps the first size bytes of a file opened for reading and
+// writing. It returns errors.ErrUnsupported where memory mapping is not
+// available.
+func mapFile(file *os.File, size int64) (*mappedFile, error) {
+	if size <= 0 || size > math.MaxInt {
+		return nil, fmt.Errorf("cannot map %d bytes", size)
+	}
+	data, err := mmapFile(file, int(size))
+	if err != nil {
+		return nil, err
+	}
+	return &mappedFile{data: data}, nil
+}
+
+func (m *mappedFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(m.data)) {
+		return 0, fmt.Errorf("write of %d bytes at offset %d exceeds mapped file of %d bytes", len(p), off, len(m.data))
+	}
+	return copy(m.data[off:], p), nil
+}
+
+func (m *mappedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// unmap releases the map, after which the written data is seen through the
+// file. It may be called more than once.
+func (m *mappedFile) unmap() error {
+	if m == nil || m.data == nil {
+		return nil
+	}
+	err := munmap(m.data)
+	m.data = nil
+	if err != nil {
+		return fmt.Errorf("error unmapping output file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || freebsd)
+
+package gribdownloader
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile reports that memory mapping is not available on this system
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// munmap is never called without mmapFile
+func munmap(data []byte) error {
+	return errors.ErrUnsupported
+}
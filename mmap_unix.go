@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package gribdownloader
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps size bytes of a file for shared reading and writing
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+// munmap releases a map created by mmapFile
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
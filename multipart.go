@@ -0,0 +1,207 @@
+package gribdownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// errMultipartUnsupported is returned when a server answers a request for
+// several ranges with anything other than the requested parts
+var errMultipartUnsupported = errors.New("server does not support multipart ranges")
+
+// batchRequests splits requests into batches of at most size requests, each
+// fetched with one multipart request
+func batchRequests(requests []rangeRequest, size int) [][]rangeRequest {
+	if size < 1 {
+		size = 1
+	}
+	batches := make([][]rangeRequest, 0, (len(requests)+size-1)/size)
+	for len(requests) > 0 {
+		n := min(size, len(requests))
+		batches = append(batches, requests[:n])
+		requests = requests[n:]
+	}
+	return batches
+}
+
+// parseContentRange extracts the first and last byte positions from a
+// Content-Range header such as "bytes 0-99/12345"
+func parseContentRange(header string) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range header: %q", header)
+	}
+	spec, _, _ = strings.Cut(spec, "/")
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range header: %q", header)
+	}
+
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if err1 != nil || err2 != nil || end < start {
+		return 0, 0, fmt.Errorf("invalid Content-Range header: %q", header)
+	}
+	return start, end, nil
+}
+
+// multipartUnsupported reports whether a host is known not to serve
+// multipart ranges
+func (d *Downloader) multipartUnsupported(rawURL string) bool {
+	host, err := urlHost(rawURL)
+	if err != nil {
+		return true
+	}
+	_, ok := d.noMultipart.Load(host)
+	return ok
+}
+
+// downloadMultipart fetches every request of a batch with a single request
+// listing all of their ranges, and writes the parts of the multipart/byteranges
+// response. It returns the bytes written per job of each request.
+func (d *Downloader) downloadMultipart(ctx context.Context, url string, batch []rangeRequest, out rangeWriter, tracker *progressTracker) ([][]int64, error) {
+	req, err := d.newRequest(ctx, "GET", url)
+	if err != nil {
+		return nil, err
+	}
+
+	specs := make([]string, len(batch))
+	for i, request := range batch {
+		specs[i] = fmt.Sprintf("%d-%d", request.Start, request.End)
+	}
+	req.Header.Set("Range", "bytes="+strings.Join(specs, ","))
+
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the ranges and is sending the whole file
+		return nil, errMultipartUnsupported
+	default:
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" || params["boundary"] == "" {
+		return nil, errMultipartUnsupported
+	}
+
+	// Parts may arrive in any order, so match them by their first byte
+	written := make([][]int64, len(batch))
+	var counted int64
+	fail := func(err error) ([][]int64, error) {
+		tracker.doneBytes.Add(-counted)
+		return nil, err
+	}
+
+	reader := multipart.NewReader(d.limit(ctx, resp.Body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(fmt.Errorf("error reading multipart response: %v", err))
+		}
+
+		start, end, err := parseContentRange(part.Header.Get("Content-Range"))
+		if err != nil {
+			return fail(err)
+		}
+		i := -1
+		for j, request := range batch {
+			if request.Start == start && end <= request.End && written[j] == nil {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			// The server merged or reordered ranges in a way that cannot
+			// be mapped back to the requests
+			return fail(errMultipartUnsupported)
+		}
+
+		last, err := checkContentRange(part.Header.Get("Content-Range"), batch[i].Start, batch[i].End)
+		if err != nil {
+			return fail(err)
+		}
+
+		var received atomic.Int64
+		body := &countingReader{r: part, total: &received}
+		written[i], err = d.writeRequest(body, out, batch[i], tracker)
+		if err != nil {
+			return fail(err)
+		}
+		counted += sum(written[i])
+		if err := checkBodyLength(body, batch[i].Start, last); err != nil {
+			return fail(err)
+		}
+	}
+
+	for i, request := range batch {
+		if written[i] == nil {
+			return fail(fmt.Errorf("multipart response is missing range %d-%d", request.Start, request.End))
+		}
+	}
+
+	return written, nil
+}
+
+// downloadBatchFromMirrors fetches a batch with multipart requests, trying
+// each mirror in turn. Mirrors that do not support multipart ranges are
+// remembered and skipped. It returns the index of the mirror that succeeded,
+// or errMultipartUnsupported if the batch has to be fetched range by range.
+func (d *Downloader) downloadBatchFromMirrors(ctx context.Context, urls []string, batch []rangeRequest, out rangeWriter, tracker *progressTracker) (int, [][]int64, error) {
+	for i, url := range urls {
+		if d.multipartUnsupported(url) {
+			continue
+		}
+
+		start := time.Now()
+		written, err := d.downloadMultipart(ctx, url, batch, out, tracker)
+		if err == nil {
+			for _, w := range written {
+				d.Stats.downloaded(w)
+			}
+			d.logger().Debug("multipart ranges downloaded",
+				"ranges", len(batch), "duration", time.Since(start), "source", url, "attempt", i+1)
+			return i, written, nil
+		}
+		if ctx.Err() != nil {
+			return -1, nil, ctx.Err()
+		}
+		if errors.Is(err, errMultipartUnsupported) {
+			if host, err := urlHost(url); err == nil {
+				d.noMultipart.Store(host, true)
+			}
+			d.logger().Info("multipart ranges not supported, requesting ranges separately", "source", url)
+			continue
+		}
+		d.logger().Warn("multipart request failed", "source", url, "attempt", i+1, "error", err)
+	}
+	return -1, nil, errMultipartUnsupported
+}
+
+// urlHost returns the host part of a URL
+func urlHost(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	return u.Host, nil
+}
@@ -0,0 +1,163 @@
+package gribdownloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// OutputCache keeps copies of downloaded GRIB files keyed by their source
+// URL and the ranges taken from it, so that downloading the same data again,
+// possibly to another output path, is a local copy
+type OutputCache struct {
+	Dir string
+}
+
+// outputCacheEntry is the metadata stored next to a cached GRIB file
+type outputCacheEntry struct {
+	URL     string        `json:"url"`
+	Mode    OutputMode    `json:"output_mode"`
+	Size    int64         `json:"size"`
+	Results []RangeResult `json:"results"`
+	Created time.Time     `json:"created"`
+}
+
+// CacheKey identifies the data downloaded from url for a set of ranges and
+// output mode
+func CacheKey(url string, ranges []RangeDownload, mode OutputMode) string {
+	if mode == "" {
+		mode = OutputCompact
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", url, mode)
+	for _, r := range ranges {
+		fmt.Fprintf(h, "%d-%d\n", r.Start, r.End)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// path returns the cache files of a key, without extension
+func (c *OutputCache) path(key string) string {
+	return filepath.Join(c.Dir, key)
+}
+
+// Load copies the cached file of a key to outputFile and returns the range
+// results recorded when it was downloaded. It reports false if the key is
+// not cached.
+func (c *OutputCache) Load(key, outputFile string) ([]RangeResult, bool, error) {
+	var entry outputCacheEntry
+	meta, err := os.ReadFile(c.path(key) + ".json")
+	if err != nil || json.Unmarshal(meta, &entry) != nil {
+		return nil, false, nil
+	}
+	info, err := os.Stat(c.path(key) + ".grib")
+	if err != nil || info.Size() != entry.Size {
+		return nil, false, nil
+	}
+
+	if err := copyFile(c.path(key)+".grib", outputFile); err != nil {
+		return nil, false, fmt.Errorf("error copying cached file: %v", err)
+	}
+
+	// Prune by last use rather than by creation
+	now := time.Now()
+	os.Chtimes(c.path(key)+".json", now, now)
+	return entry.Results, true, nil
+}
+
+// Store copies a downloaded file into the cache under key
+func (c *OutputCache) Store(key, outputFile, url string, mode OutputMode, results []RangeResult) error {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return fmt.Errorf("error creating cache directory: %v", err)
+	}
+	if err := copyFile(outputFile, c.path(key)+".grib"); err != nil {
+		return fmt.Errorf("error copying file to cache: %v", err)
+	}
+	info, err := os.Stat(c.path(key) + ".grib")
+	if err != nil {
+		return fmt.Errorf("error reading cached file: %v", err)
+	}
+
+	if mode == "" {
+		mode = OutputCompact
+	}
+	meta, err := json.MarshalIndent(outputCacheEntry{
+		URL:     url,
+		Mode:    mode,
+		Size:    info.Size(),
+		Results: results,
+		Created: time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.path(key)+".json", meta); err != nil {
+		return fmt.Errorf("error writing cache metadata: %v", err)
+	}
+	return nil
+}
+
+// Prune removes the entries last used before cutoff. It returns the number
+// of entries removed and the bytes freed.
+func (c *OutputCache) Prune(cutoff time.Time) (int, int64, error) {
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading cache directory: %v", err)
+	}
+
+	var removed int
+	var freed int64
+	for _, e := range entries {
+		key, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if grib, err := os.Stat(c.path(key) + ".grib"); err == nil {
+			freed += grib.Size()
+		}
+		if err := os.Remove(c.path(key) + ".grib"); err != nil && !os.IsNotExist(err) {
+			return removed, freed, err
+		}
+		if err := os.Remove(c.path(key) + ".json"); err != nil {
+			return removed, freed, err
+		}
+		removed++
+	}
+	return removed, freed, nil
+}
+
+// copyFile copies src to dst through a temporary file
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	part := PartPath(dst)
+	out, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(part, dst)
+	}
+	if err != nil {
+		os.Remove(part)
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package gribdownloader
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the names of environment variables overriding config
+// fields, e.g. GRIBDL_IDX_URL for idx_url
+const EnvPrefix = "GRIBDL_"
+
+// setField sets the field of the struct v with the given JSON key. Strings
+// are taken as is, numbers and booleans are parsed, lists may be given
+// comma-separated or as JSON, types implementing encoding.TextUnmarshaler
+// parse their own text, and anything else must be JSON. It reports
+// false if the struct has no such field; embedded structs are not searched.
+func setField(v reflect.Value, key, value string) (bool, error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name != key {
+			continue
+		}
+
+		f := v.Field(i)
+		if u, ok := f.Addr().Interface().(encoding.TextUnmarshaler); ok && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			if err := u.UnmarshalText([]byte(value)); err != nil {
+				return true, fmt.Errorf("invalid %s: %v", key, err)
+			}
+			return true, nil
+		}
+		switch {
+		case f.Kind() == reflect.String:
+			f.SetString(value)
+			return true, nil
+
+		case f.CanInt():
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return true, fmt.Errorf("invalid %s %q: expected an integer", key, value)
+			}
+			f.SetInt(n)
+			return true, nil
+
+		case f.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return true, fmt.Errorf("invalid %s %q: expected true or false", key, value)
+			}
+			f.SetBool(b)
+			return true, nil
+
+		case f.Kind() == reflect.Slice && !strings.HasPrefix(strings.TrimSpace(value), "["):
+			// A comma-separated list, converted to JSON values
+			items := strings.Split(value, ",")
+			for j, item := range items {
+				item = strings.TrimSpace(item)
+				if f.Type().Elem().Kind() == reflect.String {
+					item = strconv.Quote(item)
+				}
+				items[j] = item
+			}
+			value = "[" + strings.Join(items, ",") + "]"
+		}
+
+		target := reflect.New(f.Type())
+		if err := json.Unmarshal([]byte(value), target.Interface()); err != nil {
+			return true, fmt.Errorf("invalid %s %q: %v", key, value, err)
+		}
+		f.Set(target.Elem())
+		return true, nil
+	}
+	return false, nil
+}
+
+// Override sets a config field by its JSON key. Dataset fields such as
+// idx_url or forecast_hours are set on dataset, which is normally the
+// top-level dataset or one of the named ones; other fields are set on the
+// config. Overrides must be applied before Validate.
+func (c *Config) Override(dataset *Dataset, key, value string) error {
+	if key == "datasets" {
+		return fmt.Errorf("datasets cannot be overridden")
+	}
+	if ok, err := setField(reflect.ValueOf(dataset).Elem(), key, value); ok {
+		return err
+	}
+	if ok, err := setField(reflect.ValueOf(c).Elem(), key, value); ok {
+		return err
+	}
+	return fmt.Errorf("unknown config field %q", key)
+}
+
+// EnvOverrides returns the config fields overridden by environment
+// variables, given as "NAME=value" strings as from os.Environ. Variables
+// with the EnvPrefix that name no config field are ignored.
+func EnvOverrides(environ []string) map[string]string {
+	known := jsonKeys(reflect.TypeOf(Config{}))
+	overrides := map[string]string{}
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(name, EnvPrefix))
+		if known[key] && key != "datasets" {
+			overrides[key] = value
+		}
+	}
+	return overrides
+}
@@ -0,0 +1,372 @@
+package gribdownloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"math/bits"
+)
+
+// ErrUnsupportedGRIB is returned for GRIB2 messages using grids or packing
+// methods that cannot be decoded
+var ErrUnsupportedGRIB = errors.New("unsupported GRIB2 encoding")
+
+// packing holds the scaling parameters shared by the data representation
+// templates: values are (R + X*2^E) / 10^D for packed integers X
+type packing struct {
+	template  int
+	count     int // Number of packed values
+	reference float64
+	binary    int
+	decimal   int
+	nbits     int
+	original  byte // Type of the original field values
+}
+
+// parsePacking reads the data representation section
+func parsePacking(s5 []byte) (packing, error) {
+	if len(s5) < 21 {
+		return packing{}, fmt.Errorf("%w: short data representation section", ErrInvalidGRIB)
+	}
+	return packing{
+		template:  int(binary.BigEndian.Uint16(s5[9:11])),
+		count:     int(binary.BigEndian.Uint32(s5[5:9])),
+		reference: float64(math.Float32frombits(binary.BigEndian.Uint32(s5[11:15]))),
+		binary:    int(signed(s5[15:17])),
+		decimal:   int(signed(s5[17:19])),
+		nbits:     int(s5[19]),
+		original:  s5[20],
+	}, nil
+}
+
+// value scales a packed integer
+func (p packing) value(x float64) float64 {
+	return (p.reference + x*math.Exp2(float64(p.binary))) / math.Pow10(p.decimal)
+}
+
+// decodeField returns the values of every grid point of a field, with NaN
+// for missing points. bitmap is nil when all points are present.
+func decodeField(s5 []byte, bitmap []byte, s7 []byte, points int) ([]float64, error) {
+	p, err := parsePacking(s5)
+	if err != nil {
+		return nil, err
+	}
+
+	var packed []float64
+	switch p.template {
+	case 0:
+		packed, err = decodeSimple(p, s7[5:])
+	case 2, 3:
+		packed, err = decodeComplex(p, s5, s7[5:])
+	case 41:
+		packed, err = decodePNG(p, s7[5:])
+	default:
+		return nil, fmt.Errorf("%w: data representation template 5.%d", ErrUnsupportedGRIB, p.template)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if bitmap == nil {
+		if len(packed) != points {
+			return nil, fmt.Errorf("%w: %d values packed for %d grid points", ErrInvalidGRIB, len(packed), points)
+		}
+		return packed, nil
+	}
+
+	values := make([]float64, points)
+	if len(bitmap)*8 < points {
+		return nil, fmt.Errorf("%w: bitmap is shorter than the grid", ErrInvalidGRIB)
+	}
+	n := 0
+	for i := range values {
+		if bitmap[i/8]>>(7-i%8)&1 == 0 {
+			values[i] = math.NaN()
+			continue
+		}
+		if n >= len(packed) {
+			return nil, fmt.Errorf("%w: bitmap selects more points than are packed", ErrInvalidGRIB)
+		}
+		values[i] = packed[n]
+		n++
+	}
+	return values, nil
+}
+
+// decodeSimple unpacks template 5.0, simple packing
+func decodeSimple(p packing, data []byte) ([]float64, error) {
+	r := bitReader{data: data}
+	values := make([]float64, p.count)
+	for i := range values {
+		x, err := r.read(p.nbits)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = p.value(float64(x))
+	}
+	return values, nil
+}
+
+// decodeComplex unpacks templates 5.2 and 5.3, complex packing with and
+// without spatial differencing
+func decodeComplex(p packing, s5 []byte, data []byte) ([]float64, error) {
+	if len(s5) < 47 || (p.template == 3 && len(s5) < 49) {
+		return nil, fmt.Errorf("%w: short data representation section", ErrInvalidGRIB)
+	}
+	missingMode := s5[22]
+	groups := int(binary.BigEndian.Uint32(s5[31:35]))
+	widthRef := uint64(s5[35])
+	widthBits := int(s5[36])
+	lengthRef := uint64(binary.BigEndian.Uint32(s5[37:41]))
+	lengthIncrement := uint64(s5[41])
+	lastLength := uint64(binary.BigEndian.Uint32(s5[42:46]))
+	lengthBits := int(s5[46])
+	if missingMode > 2 {
+		return nil, fmt.Errorf("%w: missing value management %d", ErrUnsupportedGRIB, missingMode)
+	}
+
+	r := bitReader{data: data}
+
+	// Spatial differencing keeps the first values and the minimum difference
+	// ahead of the groups
+	var order, octets int
+	var first []int64
+	var minimum int64
+	if p.template == 3 {
+		order, octets = int(s5[47]), int(s5[48])
+		if order < 1 || order > 2 || octets < 1 || octets > 4 {
+			return nil, fmt.Errorf("%w: spatial differencing of order %d with %d octets", ErrUnsupportedGRIB, order, octets)
+		}
+		if len(data) < (order+1)*octets {
+			return nil, fmt.Errorf("%w: packed data is truncated", ErrInvalidGRIB)
+		}
+		for i := 0; i < order; i++ {
+			first = append(first, signed(data[i*octets:(i+1)*octets]))
+		}
+		minimum = signed(data[order*octets : (order+1)*octets])
+		r.pos = 8 * (order + 1) * octets
+	}
+
+	refs := make([]uint64, groups)
+	widths := make([]int, groups)
+	lengths := make([]int, groups)
+	for i := range refs {
+		v, err := r.read(p.nbits)
+		if err != nil {
+			return nil, err
+		}
+		refs[i] = v
+	}
+	r.align()
+	for i := range widths {
+		v, err := r.read(widthBits)
+		if err != nil {
+			return nil, err
+		}
+		widths[i] = int(widthRef + v)
+	}
+	r.align()
+	total := 0
+	for i := range lengths {
+		v, err := r.read(lengthBits)
+		if err != nil {
+			return nil, err
+		}
+		lengths[i] = int(lengthRef + v*lengthIncrement)
+		if i == groups-1 {
+			lengths[i] = int(lastLength)
+		}
+		total += lengths[i]
+	}
+	r.align()
+	if total != p.count {
+		return nil, fmt.Errorf("%w: groups hold %d values but %d are packed", ErrInvalidGRIB, total, p.count)
+	}
+
+	// Unpack the groups, marking missing values
+	ints := make([]int64, 0, total)
+	missing := make([]bool, 0, total)
+	for g := range refs {
+		width := widths[g]
+		for k := 0; k < lengths[g]; k++ {
+			var isMissing bool
+			var x uint64
+			if width == 0 {
+				if missingMode > 0 {
+					all := uint64(1)<<p.nbits - 1
+					isMissing = refs[g] == all || (missingMode == 2 && refs[g] == all-1)
+				}
+			} else {
+				v, err := r.read(width)
+				if err != nil {
+					return nil, err
+				}
+				if missingMode > 0 {
+					all := uint64(1)<<width - 1
+					isMissing = v == all || (missingMode == 2 && v == all-1)
+				}
+				x = v
+			}
+			ints = append(ints, int64(refs[g]+x))
+			missing = append(missing, isMissing)
+		}
+	}
+
+	// Undo the spatial differencing over the present values
+	if p.template == 3 {
+		var prev []int64
+		n := 0
+		for i := range ints {
+			if missing[i] {
+				continue
+			}
+			switch {
+			case n < order:
+				ints[i] = first[n]
+			case order == 1:
+				ints[i] += minimum + prev[len(prev)-1]
+			default:
+				ints[i] += minimum + 2*prev[len(prev)-1] - prev[len(prev)-2]
+			}
+			prev = append(prev, ints[i])
+			n++
+		}
+	}
+
+	values := make([]float64, total)
+	for i, x := range ints {
+		if missing[i] {
+			values[i] = math.NaN()
+		} else {
+			values[i] = p.value(float64(x))
+		}
+	}
+	return values, nil
+}
+
+// decodePNG unpacks template 5.41, PNG compression
+func decodePNG(p packing, data []byte) ([]float64, error) {
+	values := make([]float64, 0, p.count)
+	if p.nbits == 0 {
+		for i := 0; i < p.count; i++ {
+			values = append(values, p.value(0))
+		}
+		return values, nil
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: error decoding PNG data: %v", ErrInvalidGRIB, err)
+	}
+
+	// image/png scales gray samples of fewer than 8 bits up to 8 bits, so
+	// divide the scaling back out using the bit depth from the IHDR chunk
+	grayScale := uint64(1)
+	if _, ok := img.(*image.Gray); ok && len(data) > 24 && data[24] < 8 {
+		grayScale = 0xff / (1<<data[24] - 1)
+	}
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y && len(values) < p.count; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X && len(values) < p.count; x++ {
+			var v uint64
+			switch img := img.(type) {
+			case *image.Gray:
+				v = uint64(img.GrayAt(x, y).Y) / grayScale
+			case *image.Gray16:
+				v = uint64(img.Gray16At(x, y).Y)
+			case *image.RGBA:
+				c := img.RGBAAt(x, y)
+				v = uint64(c.R)<<16 | uint64(c.G)<<8 | uint64(c.B)
+			case *image.NRGBA:
+				c := img.NRGBAAt(x, y)
+				v = uint64(c.R)<<24 | uint64(c.G)<<16 | uint64(c.B)<<8 | uint64(c.A)
+			default:
+				return nil, fmt.Errorf("%w: PNG color model %T", ErrUnsupportedGRIB, img)
+			}
+			values = append(values, p.value(float64(v)))
+		}
+	}
+	if len(values) != p.count {
+		return nil, fmt.Errorf("%w: PNG holds %d of %d values", ErrInvalidGRIB, len(values), p.count)
+	}
+	return values, nil
+}
+
+// encodeSimple packs values with template 5.0, keeping the binary and
+// decimal scale factors of p. It returns the data representation, bitmap
+// and data sections; missing (NaN) values are left out through the bitmap.
+func encodeSimple(p packing, values []float64) (s5, s6, s7 []byte) {
+	scale := math.Pow10(p.decimal)
+	step := math.Exp2(float64(p.binary))
+
+	present := make([]float64, 0, len(values))
+	var bitmap []byte
+	for i, v := range values {
+		if math.IsNaN(v) {
+			if bitmap == nil {
+				bitmap = make([]byte, (len(values)+7)/8)
+				for j := 0; j < i; j++ {
+					bitmap[j/8] |= 1 << (7 - j%8)
+				}
+			}
+			continue
+		}
+		if bitmap != nil {
+			bitmap[i/8] |= 1 << (7 - i%8)
+		}
+		present = append(present, v*scale)
+	}
+
+	// The reference value is the minimum, rounded down to a float32
+	var reference float32
+	if len(present) > 0 {
+		low := present[0]
+		for _, v := range present {
+			low = math.Min(low, v)
+		}
+		reference = float32(low)
+		if float64(reference) > low {
+			reference = math.Nextafter32(reference, float32(math.Inf(-1)))
+		}
+	}
+
+	packed := make([]uint64, len(present))
+	var high uint64
+	for i, v := range present {
+		x := math.Round((v - float64(reference)) / step)
+		packed[i] = uint64(math.Max(x, 0))
+		high = max(high, packed[i])
+	}
+	nbits := bits.Len64(high)
+
+	s5 = newSection(5, 21)
+	binary.BigEndian.PutUint32(s5[5:9], uint32(len(present)))
+	binary.BigEndian.PutUint16(s5[9:11], 0)
+	binary.BigEndian.PutUint32(s5[11:15], math.Float32bits(reference))
+	putSigned(s5[15:17], int64(p.binary))
+	putSigned(s5[17:19], int64(p.decimal))
+	s5[19] = byte(nbits)
+	s5[20] = p.original
+
+	if bitmap == nil {
+		s6 = newSection(6, 6)
+		s6[5] = 255
+	} else {
+		s6 = append(newSection(6, 6), bitmap...)
+		binary.BigEndian.PutUint32(s6, uint32(len(s6)))
+	}
+
+	w := bitWriter{}
+	for _, x := range packed {
+		w.write(x, nbits)
+	}
+	s7 = append(newSection(7, 5), w.data...)
+	binary.BigEndian.PutUint32(s7, uint32(len(s7)))
+
+	return s5, s6, s7
+}
@@ -0,0 +1,221 @@
+package gribdownloader
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"testing"
+)
+
+// grayPNG encodes samples as a single-channel PNG of the given bit depth,
+// which image/png cannot write below 8 bits
+func grayPNG(t *testing.T, samples []uint64, width, depth int) []byte {
+	t.Helper()
+	height := (len(samples) + width - 1) / width
+
+	var raw bytes.Buffer
+	for y := 0; y < height; y++ {
+		w := bitWriter{}
+		for x := 0; x < width; x++ {
+			var v uint64
+			if i := y*width + x; i < len(samples) {
+				v = samples[i]
+			}
+			w.write(v, depth)
+		}
+		raw.WriteByte(0) // No filter
+		raw.Write(w.data)
+	}
+	var idat bytes.Buffer
+	z := zlib.NewWriter(&idat)
+	if _, err := z.Write(raw.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := []byte("\x89PNG\r\n\x1a\n")
+	chunk := func(kind string, data []byte) {
+		out = binary.BigEndian.AppendUint32(out, uint32(len(data)))
+		body := append([]byte(kind), data...)
+		out = append(out, body...)
+		out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(body))
+	}
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = byte(depth) // Color type 0, gray
+	chunk("IHDR", ihdr)
+	chunk("IDAT", idat.Bytes())
+	chunk("IEND", nil)
+	return out
+}
+
+func TestDecodePNGBitDepths(t *testing.T) {
+	for _, depth := range []int{1, 2, 4, 8, 16} {
+		samples := make([]uint64, 23)
+		for i := range samples {
+			samples[i] = uint64(i*7) % (1 << depth)
+		}
+		p := packing{template: 41, count: len(samples), reference: 1, binary: 1, decimal: 1, nbits: depth}
+
+		values, err := decodePNG(p, grayPNG(t, samples, 5, depth))
+		if err != nil {
+			t.Fatalf("depth %d: %v", depth, err)
+		}
+		for i, x := range samples {
+			if want := p.value(float64(x)); values[i] != want {
+				t.Errorf("depth %d: value %d is %g, want %g", depth, i, values[i], want)
+			}
+		}
+	}
+}
+
+func TestDecodePNGConstant(t *testing.T) {
+	p := packing{template: 41, count: 4, reference: 2.5}
+	values, err := decodePNG(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range values {
+		if v != 2.5 {
+			t.Errorf("value %d is %g, want 2.5", i, v)
+		}
+	}
+}
+
+func TestSigned(t *testing.T) {
+	for _, v := range []int64{0, 1, -1, 300, -300, 32767, -32767} {
+		b := make([]byte, 2)
+		putSigned(b, v)
+		if got := signed(b); got != v {
+			t.Errorf("signed(putSigned(%d)) = %d", v, got)
+		}
+	}
+	if got := signed([]byte{0x80, 0x05}); got != -5 {
+		t.Errorf("signed(0x8005) = %d, want -5", got)
+	}
+}
+
+// complexSection returns a data representation section for complex packing
+// of one or more groups
+func complexSection(template, count, nbits, groups int, missingMode byte, lastLength int, order, octets byte) []byte {
+	s5 := newSection(5, 49)
+	binary.BigEndian.PutUint32(s5[5:9], uint32(count))
+	binary.BigEndian.PutUint16(s5[9:11], uint16(template))
+	binary.BigEndian.PutUint32(s5[11:15], math.Float32bits(1))
+	putSigned(s5[15:17], 1)
+	putSigned(s5[17:19], 1)
+	s5[19] = byte(nbits)
+	s5[22] = missingMode
+	binary.BigEndian.PutUint32(s5[31:35], uint32(groups))
+	s5[36] = 8 // Group width bits
+	s5[41] = 1 // Group length increment
+	binary.BigEndian.PutUint32(s5[42:46], uint32(lastLength))
+	s5[46] = 8 // Group length bits
+	s5[47] = order
+	s5[48] = octets
+	return s5
+}
+
+func TestDecodeComplexMissing(t *testing.T) {
+	s5 := complexSection(2, 5, 3, 2, 1, 2, 0, 0)
+
+	w := bitWriter{}
+	w.write(5, 3) // Group references
+	w.write(7, 3)
+	data := w.data
+	data = append(data, 2, 0) // Group widths
+	data = append(data, 3, 0) // Group lengths, the last one from s5
+	w = bitWriter{}
+	for _, x := range []uint64{0, 3, 1} {
+		w.write(x, 2)
+	}
+	data = append(data, w.data...)
+
+	p, err := parsePacking(s5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := decodeComplex(p, s5, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{p.value(5), math.NaN(), p.value(6), math.NaN(), math.NaN()}
+	assertValues(t, values, want)
+}
+
+func TestDecodeComplexSpatialDifferencing(t *testing.T) {
+	for _, tt := range []struct {
+		order  byte
+		packed []uint64
+		want   []int64
+	}{
+		// Differences -2, 1, -4, 0, 2 from a minimum of -4
+		{order: 1, packed: []uint64{0, 2, 5, 0, 4, 6}, want: []int64{10, 8, 9, 5, 5, 7}},
+		// Second differences 3, -5, 4, 2 from a minimum of -5
+		{order: 2, packed: []uint64{0, 0, 8, 0, 9, 7}, want: []int64{10, 8, 9, 5, 5, 7}},
+	} {
+		s5 := complexSection(3, len(tt.packed), 3, 1, 0, len(tt.packed), tt.order, 2)
+
+		var data []byte
+		first := tt.want[:tt.order]
+		minimum := int64(-4)
+		if tt.order == 2 {
+			minimum = -5
+		}
+		for _, v := range append(append([]int64{}, first...), minimum) {
+			b := make([]byte, 2)
+			putSigned(b, v)
+			data = append(data, b...)
+		}
+		data = append(data, 0)    // Group reference, 3 bits
+		data = append(data, 4, 0) // Group width and length
+		w := bitWriter{}
+		for _, x := range tt.packed {
+			w.write(x, 4)
+		}
+		data = append(data, w.data...)
+
+		p, err := parsePacking(s5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values, err := decodeComplex(p, s5, data)
+		if err != nil {
+			t.Fatalf("order %d: %v", tt.order, err)
+		}
+		want := make([]float64, len(tt.want))
+		for i, x := range tt.want {
+			want[i] = p.value(float64(x))
+		}
+		assertValues(t, values, want)
+	}
+}
+
+func TestEncodeSimpleRoundTrip(t *testing.T) {
+	p := packing{binary: 0, decimal: 2}
+	in := []float64{-1.25, 0, math.NaN(), 3.5, 280.17}
+
+	s5, s6, s7 := encodeSimple(p, in)
+	values, err := decodeField(s5, s6[6:], s7, len(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertValues(t, values, in)
+}
+
+func assertValues(t *testing.T, got, want []float64) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d values, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if math.IsNaN(want[i]) != math.IsNaN(got[i]) || (!math.IsNaN(want[i]) && math.Abs(got[i]-want[i]) > 1e-9) {
+			t.Errorf("value %d is %g, want %g", i, got[i], want[i])
+		}
+	}
+}
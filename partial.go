@@ -0,0 +1,80 @@
+package gribdownloader
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// PartialPolicy decides what happens to an output file when some of its
+// ranges cannot be downloaded
+type PartialPolicy string
+
+const (
+	// PartialFail fails the download and leaves no output file
+	PartialFail PartialPolicy = "fail"
+	// PartialKeep keeps the ranges that were downloaded and reports the
+	// missing ones
+	PartialKeep PartialPolicy = "keep-partial"
+)
+
+// PartialError is returned by DownloadRangesFromMirrors when KeepPartial is
+// set and some ranges failed. The output file holds the ranges that were
+// downloaded, and Failed lists the others.
+type PartialError struct {
+	Failed []RangeDownload
+	Err    error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d ranges missing: %v", len(e.Failed), e.Err)
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// missingRanges returns the ranges without a result
+func missingRanges(ranges []RangeDownload, results []RangeResult) []RangeDownload {
+	done := make(map[RangeDownload]bool, len(results))
+	for _, result := range results {
+		done[result.RangeDownload] = true
+	}
+	var missing []RangeDownload
+	for _, r := range ranges {
+		if !done[r] {
+			missing = append(missing, r)
+		}
+	}
+	return missing
+}
+
+// compactPartial moves the downloaded ranges of a compact output file over
+// the space reserved for failed ones, so that the file again holds its
+// messages back-to-back in the layout of the downloaded ranges alone. It
+// returns the size of the data.
+func compactPartial(file *os.File, jobs []rangeJob, results []RangeResult) (int64, error) {
+	written := make(map[RangeDownload]int64, len(results))
+	for _, result := range results {
+		written[result.RangeDownload] = result.Bytes
+	}
+
+	// Ranges only ever move towards the start of the file, so copying them in
+	// order never overwrites data still to be moved
+	var dest, size int64
+	for _, job := range jobs {
+		n, ok := written[job.RangeDownload]
+		if !ok {
+			continue
+		}
+		if job.Dest != dest {
+			src := io.NewSectionReader(file, job.Dest, n)
+			if _, err := io.Copy(io.NewOffsetWriter(file, dest), src); err != nil {
+				return 0, fmt.Errorf("error compacting output file: %v", err)
+			}
+		}
+		size = dest + n
+		dest += job.Size()
+	}
+	return size, nil
+}
@@ -0,0 +1,313 @@
+package gribdownloader
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Preset is a built-in description of a well-known product, supplying the
+// URL templates, cycle frequency and published forecast hours so that a
+// dataset only needs a date, cycle and parameters
+type Preset struct {
+	Description string
+	// Dataset holds the settings applied to datasets using the preset
+	Dataset Dataset
+	// AvailableHours lists the forecast hours published for each cycle
+	AvailableHours []int
+	// Domains maps the domains of a product with several grids or nests to
+	// the value of the {domain} placeholder of its URLs; datasets using the
+	// preset must choose one
+	Domains map[string]string
+}
+
+// DomainNames returns the domains of the preset in sorted order
+func (p Preset) DomainNames() []string {
+	names := make([]string, 0, len(p.Domains))
+	for name := range p.Domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hourRange returns the hours from first to last in steps of step
+func hourRange(first, last, step int) []int {
+	var hours []int
+	for h := first; h <= last; h += step {
+		hours = append(hours, h)
+	}
+	return hours
+}
+
+// gfsHours are the forecast hours of the GFS: hourly to 120, then 3-hourly
+// to 384
+var gfsHours = append(hourRange(0, 120, 1), hourRange(123, 384, 3)...)
+
+// gfsPreset returns the preset of a GFS resolution such as "0p25"
+func gfsPreset(resolution string, hours []int) Preset {
+	file := "gfs.t{cycle}z.pgrb2." + resolution + ".f{fhr}.idx"
+	return Preset{
+		Description: "GFS " + resolution + " pressure level and surface fields",
+		Dataset: Dataset{
+			IdxURL:        "s3://noaa-gfs-bdp-pds/gfs.{yyyymmdd}/{cycle}/atmos/" + file,
+			Mirrors:       []string{"https://nomads.ncep.noaa.gov/pub/data/nccf/com/gfs/prod/gfs.{yyyymmdd}/{cycle}/atmos/" + file},
+			CycleInterval: 6,
+			IndexFormat:   FormatNCEP,
+		},
+		AvailableHours: hours,
+	}
+}
+
+// hrrrHours are the forecast hours of HRRR: 18 hours every cycle, 48 hours
+// for the 00, 06, 12 and 18 cycles
+var hrrrHours = hourRange(0, 48, 1)
+
+// hrrrPreset returns the preset of an HRRR CONUS product such as "wrfsfc"
+func hrrrPreset(product, description string, hours []int) Preset {
+	file := "hrrr.t{cycle}z." + product + "f{fhr2}.grib2.idx"
+	return Preset{
+		Description: "HRRR CONUS " + description,
+		Dataset: Dataset{
+			IdxURL:        "s3://noaa-hrrr-bdp-pds/hrrr.{yyyymmdd}/conus/" + file,
+			Mirrors:       []string{"https://nomads.ncep.noaa.gov/pub/data/nccf/com/hrrr/prod/hrrr.{yyyymmdd}/conus/" + file},
+			CycleInterval: 1,
+			IndexFormat:   FormatNCEP,
+		},
+		AvailableHours: hours,
+	}
+}
+
+// nbmPreset returns the preset of a CONUS National Blend of Models product:
+// "core" with the deterministic blend or "qmd" with its percentiles and
+// probabilities, selected with level patterns such as
+// "surface:0-6 hour acc fcst:prob >0.254"
+func nbmPreset(product, description string, hours []int) Preset {
+	file := "blend.t{cycle}z." + product + ".f{fhr}.co.grib2.idx"
+	return Preset{
+		Description: "National Blend of Models CONUS " + description,
+		Dataset: Dataset{
+			IdxURL:        "s3://noaa-nbm-grib2-pds/blend.{yyyymmdd}/{cycle}/" + product + "/" + file,
+			Mirrors:       []string{"https://nomads.ncep.noaa.gov/pub/data/nccf/com/blend/prod/blend.{yyyymmdd}/{cycle}/" + product + "/" + file},
+			CycleInterval: 1,
+			IndexFormat:   FormatNCEP,
+		},
+		AvailableHours: hours,
+	}
+}
+
+// namNestPreset is the preset of the high resolution NAM nests
+var namNestPreset = func() Preset {
+	file := "nam.t{cycle}z.{domain}nest.hiresf{fhr2}.tm00.grib2.idx"
+	return Preset{
+		Description: "NAM 3 km nests, by domain",
+		Dataset: Dataset{
+			IdxURL:        "s3://noaa-nam-pds/nam.{yyyymmdd}/" + file,
+			Mirrors:       []string{"https://nomads.ncep.noaa.gov/pub/data/nccf/com/nam/prod/nam.{yyyymmdd}/" + file},
+			CycleInterval: 6,
+			IndexFormat:   FormatNCEP,
+		},
+		AvailableHours: hourRange(0, 60, 1),
+		Domains: map[string]string{
+			"conus":       "conus",
+			"alaska":      "alaska",
+			"hawaii":      "hawaii",
+			"puerto-rico": "prico",
+		},
+	}
+}()
+
+// rapPreset is the preset of the RAP pressure level grids
+var rapPreset = func() Preset {
+	file := "rap.t{cycle}z.{domain}f{fhr2}.grib2.idx"
+	return Preset{
+		Description: "RAP pressure level fields, by domain",
+		Dataset: Dataset{
+			IdxURL:        "s3://noaa-rap-pds/rap.{yyyymmdd}/" + file,
+			Mirrors:       []string{"https://nomads.ncep.noaa.gov/pub/data/nccf/com/rap/prod/rap.{yyyymmdd}/" + file},
+			CycleInterval: 1,
+			IndexFormat:   FormatNCEP,
+		},
+		// 21 hours every cycle, 51 hours for the 03, 09, 15 and 21 cycles
+		AvailableHours: hourRange(0, 51, 1),
+		Domains: map[string]string{
+			"conus":         "awp130pgrb", // 13 km
+			"conus-20km":    "awp252pgrb",
+			"alaska":        "awp242",
+			"puerto-rico":   "awp200",
+			"north-america": "awip32",
+		},
+	}
+}()
+
+// gfsWavePreset is the preset of the gridded GFS-Wave output, whose regional
+// grids are chosen with domain
+var gfsWavePreset = func() Preset {
+	file := "gfswave.t{cycle}z.{domain}.f{fhr}.grib2.idx"
+	return Preset{
+		Description: "GFS-Wave (WAVEWATCH III) sea state, by grid",
+		Dataset: Dataset{
+			IdxURL:        "s3://noaa-gfs-bdp-pds/gfs.{yyyymmdd}/{cycle}/wave/gridded/" + file,
+			Mirrors:       []string{"https://nomads.ncep.noaa.gov/pub/data/nccf/com/gfs/prod/gfs.{yyyymmdd}/{cycle}/wave/gridded/" + file},
+			CycleInterval: 6,
+			IndexFormat:   FormatNCEP,
+		},
+		AvailableHours: gfsHours,
+		Domains: map[string]string{
+			"global":       "global.0p25",
+			"global-0p16":  "global.0p16",
+			"atlantic":     "atlocn.0p16",
+			"east-pacific": "epacif.0p16",
+			"west-coast":   "wcoast.0p16",
+			"arctic":       "arctic.9km",
+			"south":        "gsouth.0p25",
+		},
+	}
+}()
+
+// presets are the built-in dataset presets by name
+var presets = map[string]Preset{
+	"gfs-0p25":       gfsPreset("0p25", gfsHours),
+	"gfs-0p50":       gfsPreset("0p50", hourRange(0, 384, 3)),
+	"gfs-1p00":       gfsPreset("1p00", hourRange(0, 384, 3)),
+	"hrrr-conus-sfc": hrrrPreset("wrfsfc", "surface fields", hrrrHours),
+	"hrrr-conus-prs": hrrrPreset("wrfprs", "pressure level fields", hrrrHours),
+	"hrrr-conus-nat": hrrrPreset("wrfnat", "native level fields", hrrrHours),
+	// Sub-hourly files hold 15-minute surface fields; select them with
+	// minutes and a filename using {minute} or {fmin}
+	"hrrr-conus-subh": hrrrPreset("wrfsubh", "15-minute surface fields", hourRange(0, 18, 1)),
+	"gefs-0p50": {
+		Description: "GEFS 0.5 degree common fields (pgrb2a) for all members",
+		Dataset: Dataset{
+			IdxURL:        "s3://noaa-gefs-pds/gefs.{yyyymmdd}/{cycle}/atmos/pgrb2ap5/{member}.t{cycle}z.pgrb2a.0p50.f{fhr}.idx",
+			Mirrors:       []string{"https://nomads.ncep.noaa.gov/pub/data/nccf/com/gens/prod/gefs.{yyyymmdd}/{cycle}/atmos/pgrb2ap5/{member}.t{cycle}z.pgrb2a.0p50.f{fhr}.idx"},
+			CycleInterval: 6,
+			IndexFormat:   FormatNCEP,
+			Members:       []string{"all"},
+		},
+		AvailableHours: append(hourRange(0, 240, 3), hourRange(246, 384, 6)...),
+	},
+	// The blend has no analysis: hourly to 36, 3-hourly to 192, then
+	// 6-hourly to 264
+	"nbm-conus-core": nbmPreset("core", "deterministic fields", append(append(hourRange(1, 36, 1), hourRange(39, 192, 3)...), hourRange(198, 264, 6)...)),
+	"nam-nest":       namNestPreset,
+	"gfs-wave":       gfsWavePreset,
+	"gefs-wave": {
+		Description: "GEFS-Wave 0.25 degree sea state for all members",
+		Dataset: Dataset{
+			IdxURL:        "s3://noaa-gefs-pds/gefs.{yyyymmdd}/{cycle}/wave/gridded/gefs.wave.t{cycle}z.{member}.global.0p25.f{fhr}.grib2.idx",
+			Mirrors:       []string{"https://nomads.ncep.noaa.gov/pub/data/nccf/com/gens/prod/gefs.{yyyymmdd}/{cycle}/wave/gridded/gefs.wave.t{cycle}z.{member}.global.0p25.f{fhr}.grib2.idx"},
+			CycleInterval: 6,
+			IndexFormat:   FormatNCEP,
+			Members:       []string{"c00", "p01..p30"},
+		},
+		AvailableHours: append(hourRange(0, 240, 3), hourRange(246, 384, 6)...),
+	},
+	// The icing, turbulence and cumulonimbus forecasts blended from the
+	// Washington and London centres; see the aviation parameter aliases
+	"wafs-0p25-blended": {
+		Description: "WAFS 0.25 degree blended aviation hazards",
+		Dataset: Dataset{
+			IdxURL:        "https://nomads.ncep.noaa.gov/pub/data/nccf/com/wafs/prod/wafs.{yyyymmdd}/{cycle}/grib2/0p25/blending/WAFS_0p25_blended_{yyyymmdd}{cycle}f{fhr}.grib2.idx",
+			CycleInterval: 6,
+			IndexFormat:   FormatNCEP,
+		},
+		AvailableHours: hourRange(6, 48, 3),
+	},
+	// The MSC Datamart of Environment Canada publishes a file per field and
+	// keeps about a day of runs. Parameters and levels are written as in
+	// the file names, e.g. "TMP": ["AGL-2m", "IsbL-0500"] for the GDPS and
+	// "TMP": ["TGL_2m", "ISBL_0500"] for the GEPS.
+	"cmc-gdps": {
+		Description: "CMC GDPS 15 km global deterministic, a file per field",
+		Dataset: Dataset{
+			FieldURL:      "https://dd.weather.gc.ca/model_gdps/15km/{cycle}/{fhr}/{yyyymmdd}T{cycle}Z_MSC_GDPS_{param}_{level}_LatLon0.15_PT{fhr}H.grib2",
+			CycleInterval: 12,
+		},
+		AvailableHours: hourRange(0, 240, 3),
+	},
+	"cmc-geps": {
+		Description: "CMC GEPS 0.5 degree global ensemble, a file per field holding all members",
+		Dataset: Dataset{
+			FieldURL:      "https://dd.weather.gc.ca/ensemble/geps/grib2/raw/{cycle}/{fhr}/CMC_geps-raw_{param}_{level}_latlon0p5x0p5_{yyyymmdd}{cycle}_P{fhr}_allmbrs.grib2",
+			CycleInterval: 12,
+		},
+		AvailableHours: append(hourRange(0, 192, 3), hourRange(198, 384, 6)...),
+	},
+	"rap":           rapPreset,
+	"nbm-conus-qmd": nbmPreset("qmd", "percentiles and probabilities", hourRange(6, 264, 6)),
+}
+
+// PresetNames returns the names of the built-in presets in sorted order
+func PresetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupPreset returns the built-in preset with the given name
+func LookupPreset(name string) (Preset, error) {
+	preset, ok := presets[name]
+	if !ok {
+		return Preset{}, fmt.Errorf("unknown preset %q (available: %v)", name, PresetNames())
+	}
+	return preset, nil
+}
+
+// applyPreset fills the settings of the dataset that are not set from its
+// preset, and checks the forecast hours against those the product publishes.
+// A dataset without forecast hours gets the first published hour, the
+// analysis where there is one.
+func (ds *Dataset) applyPreset() error {
+	if ds.Preset == "" {
+		return nil
+	}
+	preset, err := LookupPreset(ds.Preset)
+	if err != nil {
+		return err
+	}
+
+	if ds.IdxURL == "" && ds.FieldURL == "" {
+		ds.IdxURL = preset.Dataset.IdxURL
+		ds.FieldURL = preset.Dataset.FieldURL
+		if len(ds.Mirrors) == 0 {
+			ds.Mirrors = preset.Dataset.Mirrors
+		}
+	}
+	if ds.CycleInterval == 0 {
+		ds.CycleInterval = preset.Dataset.CycleInterval
+	}
+	if ds.IndexFormat == "" {
+		ds.IndexFormat = preset.Dataset.IndexFormat
+	}
+	if len(ds.Members) == 0 {
+		ds.Members = preset.Dataset.Members
+	}
+	if len(preset.Domains) > 0 {
+		if ds.Domain == "" {
+			return fmt.Errorf("preset %q requires a domain (available: %v)", ds.Preset, preset.DomainNames())
+		}
+		value, ok := preset.Domains[ds.Domain]
+		if !ok {
+			return fmt.Errorf("domain %q is not available for preset %q (available: %v)", ds.Domain, ds.Preset, preset.DomainNames())
+		}
+		ds.domainValue = value
+	}
+	if len(ds.ForecastHours) == 0 {
+		ds.ForecastHours = []int{preset.AvailableHours[0]}
+	}
+
+	available := map[int]bool{}
+	for _, hour := range preset.AvailableHours {
+		available[hour] = true
+	}
+	for _, hour := range ds.ForecastHours {
+		if !available[hour] {
+			return fmt.Errorf("forecast hour %d is not published for preset %q", hour, ds.Preset)
+		}
+	}
+
+	return nil
+}
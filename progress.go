@@ -0,0 +1,101 @@
+package gribdownloader
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often the Progress callback is invoked
+const progressInterval = 500 * time.Millisecond
+
+// Progress is a snapshot of a running range download
+type Progress struct {
+	TotalBytes   int64
+	DoneBytes    int64
+	TotalRanges  int
+	DoneRanges   int
+	ActiveRanges int
+	FailedRanges int
+	Elapsed      time.Duration
+}
+
+// Rate returns the average transfer rate in bytes per second
+func (p Progress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.DoneBytes) / p.Elapsed.Seconds()
+}
+
+// ETA estimates the time remaining at the current average rate
+func (p Progress) ETA() time.Duration {
+	rate := p.Rate()
+	if rate <= 0 || p.DoneBytes >= p.TotalBytes {
+		return 0
+	}
+	return time.Duration(float64(p.TotalBytes-p.DoneBytes) / rate * float64(time.Second))
+}
+
+// progressTracker accumulates progress counters shared by the range workers
+type progressTracker struct {
+	start        time.Time
+	totalBytes   int64
+	totalRanges  int
+	doneBytes    atomic.Int64
+	doneRanges   atomic.Int32
+	activeRanges atomic.Int32
+	failedRanges atomic.Int32
+}
+
+// newProgressTracker creates a tracker for the given ranges
+func newProgressTracker(ranges []RangeDownload) *progressTracker {
+	t := &progressTracker{start: time.Now(), totalRanges: len(ranges)}
+	for _, r := range ranges {
+		t.totalBytes += r.Size()
+	}
+	return t
+}
+
+// snapshot returns the current progress
+func (t *progressTracker) snapshot() Progress {
+	return Progress{
+		TotalBytes:   t.totalBytes,
+		DoneBytes:    t.doneBytes.Load(),
+		TotalRanges:  t.totalRanges,
+		DoneRanges:   int(t.doneRanges.Load()),
+		ActiveRanges: int(t.activeRanges.Load()),
+		FailedRanges: int(t.failedRanges.Load()),
+		Elapsed:      time.Since(t.start),
+	}
+}
+
+// report calls fn with the current progress every progressInterval until
+// done is closed, then once more with the final state
+func (t *progressTracker) report(fn func(Progress), done <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fn(t.snapshot())
+		case <-done:
+			fn(t.snapshot())
+			return
+		}
+	}
+}
+
+// countingReader adds the number of bytes read to a shared counter
+type countingReader struct {
+	r     io.Reader
+	total *atomic.Int64
+	read  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	c.total.Add(int64(n))
+	return n, err
+}
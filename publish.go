@@ -0,0 +1,46 @@
+package gribdownloader
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Message brokers that file ready events can be published to
+const (
+	BrokerNATS  = "nats"
+	BrokerKafka = "kafka"
+)
+
+// PublishTarget is a message broker notified when each file is downloaded.
+// NATS is reached at a nats:// or tls:// URL, which may carry a user and
+// password or a token; Kafka through its REST Proxy at an http:// or
+// https:// URL.
+type PublishTarget struct {
+	Broker string `json:"broker"` // "nats" or "kafka"
+	URL    string `json:"url"`
+	Topic  string `json:"topic"` // NATS subject or Kafka topic
+}
+
+// validate checks the broker, URL and topic of the target
+func (t PublishTarget) validate() error {
+	u, err := url.Parse(t.URL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid url %q", t.URL)
+	}
+	switch t.Broker {
+	case BrokerNATS:
+		if u.Scheme != "nats" && u.Scheme != "tls" {
+			return fmt.Errorf("invalid url %q: expected nats:// or tls://", t.URL)
+		}
+	case BrokerKafka:
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid url %q: expected the http:// or https:// URL of a Kafka REST Proxy", t.URL)
+		}
+	default:
+		return fmt.Errorf("invalid broker %q: expected %q or %q", t.Broker, BrokerNATS, BrokerKafka)
+	}
+	if t.Topic == "" {
+		return fmt.Errorf("topic is required")
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package gribdownloader
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// levelPattern matches the level of a record and, when written as
+// "LEVEL:TYPE:EXTRA...", also its type and extra fields, following the
+// columns of idx lines. This picks out the probabilistic fields of the
+// National Blend of Models, e.g.
+//
+//	"surface:0-6 hour acc fcst:prob >0.254"
+//	"2 m above ground:*:p90"
+//
+// An empty or "*" column matches anything, and each extra pattern must
+// match one of the extra fields of the record, in any order.
+type levelPattern struct {
+	text   string
+	level  fieldPattern
+	typ    *fieldPattern
+	extras []fieldPattern
+}
+
+// compileLevelPattern parses a level entry of a parameter
+func compileLevelPattern(pattern string) (levelPattern, error) {
+	p := levelPattern{text: pattern}
+	columns := splitColumns(pattern)
+
+	var err error
+	if p.level, err = compileFieldPattern(columns[0]); err != nil {
+		return p, err
+	}
+	if len(columns) > 1 && !anyColumn(columns[1]) {
+		typ, err := compileFieldPattern(columns[1])
+		if err != nil {
+			return p, err
+		}
+		p.typ = &typ
+	}
+	for _, column := range columns[min(len(columns), 2):] {
+		if anyColumn(column) {
+			continue
+		}
+		extra, err := compileFieldPattern(expandQualifier(column))
+		if err != nil {
+			return p, err
+		}
+		p.extras = append(p.extras, extra)
+	}
+	return p, nil
+}
+
+// anyColumn reports whether a column of a level pattern matches anything
+func anyColumn(column string) bool {
+	return column == "" || column == "*"
+}
+
+// Match reports whether a record has the level, type and extra fields of
+// the pattern
+func (p levelPattern) Match(param GFSParameter) bool {
+	if !p.level.Match(param.Level) {
+		return false
+	}
+	if p.typ != nil && !p.typ.Match(param.Type) {
+		return false
+	}
+	for _, extra := range p.extras {
+		found := false
+		for _, value := range param.Extra {
+			if extra.Match(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// splitColumns splits a level pattern at its colons, leaving the colons
+// inside regular expressions enclosed in slashes alone
+func splitColumns(pattern string) []string {
+	var columns []string
+	for _, part := range strings.Split(pattern, ":") {
+		if n := len(columns); n > 0 {
+			last := columns[n-1]
+			if strings.HasPrefix(last, "/") && (len(last) < 2 || !strings.HasSuffix(last, "/")) {
+				columns[n-1] = last + ":" + part
+				continue
+			}
+		}
+		columns = append(columns, part)
+	}
+	return columns
+}
+
+// percentileShorthand recognises percentiles written as "p10"
+var percentileShorthand = regexp.MustCompile(`^[pP]([0-9]+)$`)
+
+// expandQualifier expands the shorthand "pNN" into the "NN% level" that
+// wgrib2 writes for percentile fields
+func expandQualifier(column string) string {
+	if m := percentileShorthand.FindStringSubmatch(column); m != nil {
+		return m[1] + "% level"
+	}
+	return column
+}
+
+// thresholdPattern recognises probability thresholds such as "prob >0.254"
+// or "prob <=273.15"
+var thresholdPattern = regexp.MustCompile(`^prob *(>=|<=|>|<|=) *([-+0-9.eE]+)$`)
+
+// probThreshold is the threshold of a probability forecast
+type probThreshold struct {
+	op    string
+	value float64
+}
+
+// parseThreshold parses a probability threshold, reporting false if s is
+// not one
+func parseThreshold(s string) (probThreshold, bool) {
+	m := thresholdPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return probThreshold{}, false
+	}
+	value, err := strconv.ParseFloat(m[2], 64)
+	if err != nil {
+		return probThreshold{}, false
+	}
+	return probThreshold{op: m[1], value: value}, true
+}
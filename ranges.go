@@ -0,0 +1,185 @@
+package gribdownloader
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// RangeDownload represents a byte range to download
+type RangeDownload struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// Size returns the number of bytes covered by the range
+func (r RangeDownload) Size() int64 {
+	return r.End - r.Start + 1
+}
+
+// Contains reports whether offset lies within the range
+func (r RangeDownload) Contains(offset int64) bool {
+	return offset >= r.Start && offset <= r.End
+}
+
+// Record is a selected idx entry together with its byte range in the GRIB file
+type Record struct {
+	GFSParameter
+	Range RangeDownload
+	// Fields lists every field of the message when the idx gives several
+	// at the same offset, e.g. UGRD and VGRD sharing one message
+	Fields []GFSParameter
+}
+
+// FieldNames describes the fields of a message holding several as
+// "PARAMETER:level:type", or returns nil for a single-field message
+func (r Record) FieldNames() []string {
+	var names []string
+	for _, f := range r.Fields {
+		names = append(names, f.String())
+	}
+	return names
+}
+
+// ErrUnknownEnd is returned when the last record of an idx file is selected
+// but where it ends is unknown: the idx gives no length and the size of the
+// GRIB file is unknown. Setting the Length of the record from
+// Downloader.MessageLength resolves it.
+var ErrUnknownEnd = errors.New("end of the last record unknown")
+
+// SelectRecords returns the idx records matching the selection along with
+// their byte ranges. fileSize is the total size of the GRIB file and is used
+// to compute the end of the final record; pass 0 if it is unknown.
+func SelectRecords(parameters []GFSParameter, selection Selection, fileSize int64) ([]Record, error) {
+	sel, err := selection.compile()
+	if err != nil {
+		return nil, err
+	}
+	return SelectRecordsBy(parameters, sel, fileSize)
+}
+
+// SelectRecordsBy is SelectRecords for the records matched by a Selector
+func SelectRecordsBy(parameters []GFSParameter, selector Selector, fileSize int64) ([]Record, error) {
+	var records []Record
+	if sel, ok := selector.(*selection); ok {
+		resolved, err := sel.resolve(parameters)
+		if err != nil {
+			return nil, err
+		}
+		selector = resolved
+	}
+
+	// Distinct entries per offset; more than one means the message holds
+	// several fields
+	fields := make(map[int64][]GFSParameter)
+	for _, param := range parameters {
+		if !slices.ContainsFunc(fields[param.Offset], func(p GFSParameter) bool { return p.String() == param.String() }) {
+			fields[param.Offset] = append(fields[param.Offset], param)
+		}
+	}
+
+	selected := make(map[int64]bool)
+	for i, param := range parameters {
+		// Check if this parameter and level are requested
+		if !selector.Match(param) {
+			continue
+		}
+
+		// Some idx files list the same message more than once
+		if selected[param.Offset] {
+			continue
+		}
+		selected[param.Offset] = true
+
+		// Calculate the end offset
+		var endOffset int64
+		if param.Length > 0 {
+			// The index gives the message length
+			endOffset = param.Offset + param.Length - 1
+		} else if next := nextOffset(parameters, i); next > 0 {
+			endOffset = next - 1
+		} else if fileSize > 0 {
+			// The last parameter runs to the end of the file
+			endOffset = fileSize - 1
+		} else {
+			return nil, fmt.Errorf("%w: record at offset %d", ErrUnknownEnd, param.Offset)
+		}
+
+		record := Record{
+			GFSParameter: param,
+			Range: RangeDownload{
+				Start: param.Offset,
+				End:   endOffset,
+			},
+		}
+		if len(fields[param.Offset]) > 1 {
+			record.Fields = fields[param.Offset]
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// nextOffset returns the offset of the first record after parameters[i]
+// that starts beyond it, skipping duplicate entries, or 0 if there is none
+func nextOffset(parameters []GFSParameter, i int) int64 {
+	for _, next := range parameters[i+1:] {
+		if next.Offset > parameters[i].Offset {
+			return next.Offset
+		}
+	}
+	return 0
+}
+
+// MergeRanges returns the ranges of the records sorted by offset, with
+// overlapping or adjacent ranges merged
+func MergeRanges(records []Record) []RangeDownload {
+	ranges := make([]RangeDownload, 0, len(records))
+	for _, rec := range records {
+		ranges = append(ranges, rec.Range)
+	}
+
+	// Merge overlapping or adjacent ranges
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	if len(ranges) > 1 {
+		merged := []RangeDownload{ranges[0]}
+		for i := 1; i < len(ranges); i++ {
+			last := &merged[len(merged)-1]
+			current := ranges[i]
+
+			// If ranges overlap or are adjacent, merge them
+			if current.Start <= last.End+1 {
+				if current.End > last.End {
+					last.End = current.End
+				}
+			} else {
+				merged = append(merged, current)
+			}
+		}
+		ranges = merged
+	}
+
+	return ranges
+}
+
+// GenerateRanges creates download ranges for the selected parameters. fileSize
+// is the total size of the GRIB file and is used to compute the end of the
+// final record; pass 0 if it is unknown.
+func GenerateRanges(parameters []GFSParameter, selection Selection, fileSize int64) ([]RangeDownload, error) {
+	sel, err := selection.compile()
+	if err != nil {
+		return nil, err
+	}
+	return GenerateRangesBy(parameters, sel, fileSize)
+}
+
+// GenerateRangesBy is GenerateRanges for the records matched by a Selector
+func GenerateRangesBy(parameters []GFSParameter, selector Selector, fileSize int64) ([]RangeDownload, error) {
+	records, err := SelectRecordsBy(parameters, selector, fileSize)
+	if err != nil {
+		return nil, err
+	}
+	return MergeRanges(records), nil
+}
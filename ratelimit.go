@@ -0,0 +1,156 @@
+package gribdownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateUnits maps the size suffixes accepted by ParseRate and ParseSize to
+// their multipliers
+var rateUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1 << 10,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1 << 20,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1 << 30,
+	"gib": 1 << 30,
+}
+
+// ParseRate parses a transfer rate such as "10MB/s", "512k" or "1048576"
+// into bytes per second. Units are binary, so 1MB is 1048576 bytes.
+func ParseRate(s string) (int64, error) {
+	value, err := parseBytes(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/s"))
+	if errors.Is(err, errUnknownUnit) {
+		return 0, fmt.Errorf("invalid rate %q: unknown unit", s)
+	}
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return value, nil
+}
+
+// ParseSize parses a size such as "2GB", "512k" or "1048576" into bytes,
+// with the units of ParseRate
+func ParseSize(s string) (int64, error) {
+	value, err := parseBytes(strings.ToLower(strings.TrimSpace(s)))
+	if errors.Is(err, errUnknownUnit) {
+		return 0, fmt.Errorf("invalid size %q: unknown unit", s)
+	}
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return value, nil
+}
+
+var errUnknownUnit = errors.New("unknown unit")
+
+// parseBytes parses a lower case number of bytes with an optional unit
+func parseBytes(text string) (int64, error) {
+	i := strings.IndexFunc(text, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(text)
+	}
+
+	value, err := strconv.ParseFloat(text[:i], 64)
+	if err != nil {
+		return 0, err
+	}
+	unit, ok := rateUnits[strings.TrimSpace(text[i:])]
+	if !ok {
+		return 0, errUnknownUnit
+	}
+
+	return int64(value * unit), nil
+}
+
+// rateLimiter is a token bucket shared by all transfers of a downloader.
+// Tokens are bytes; a transfer may take more tokens than are available and
+// then waits until the bucket has refilled the deficit.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a limiter allowing rate bytes per second with a
+// burst of one second's worth of data
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// wait takes n tokens, sleeping until they are available or ctx is done
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(deficit / l.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedReader throttles reads from r through a shared rateLimiter
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	// Keep single reads small so the limit applies smoothly
+	if limit := int(l.limiter.burst); len(p) > limit && limit > 0 {
+		p = p[:limit]
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if werr := l.limiter.wait(l.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// limit wraps r so that reads count against the MaxRate of the downloader
+func (d *Downloader) limit(ctx context.Context, r io.Reader) io.Reader {
+	d.httpClient()
+	if d.limiter == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: d.limiter}
+}
@@ -0,0 +1,333 @@
+package gribdownloader
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Region is a latitude/longitude bounding box. Longitudes run eastwards
+// from West to East, so a box may cross the antimeridian.
+type Region struct {
+	South, West, North, East float64
+}
+
+// NewRegion returns the region spanned by two corners given as
+// lat1, lon1, lat2, lon2 in degrees
+func NewRegion(corners []float64) (Region, error) {
+	if len(corners) != 4 {
+		return Region{}, fmt.Errorf("invalid region %v: expected lat1,lon1,lat2,lon2", corners)
+	}
+	lat1, lon1, lat2, lon2 := corners[0], corners[1], corners[2], corners[3]
+	for _, lat := range []float64{lat1, lat2} {
+		if lat < -90 || lat > 90 {
+			return Region{}, fmt.Errorf("invalid region latitude %g: must be within -90 and 90", lat)
+		}
+	}
+	for _, lon := range []float64{lon1, lon2} {
+		if lon < -180 || lon > 360 {
+			return Region{}, fmt.Errorf("invalid region longitude %g: must be within -180 and 360", lon)
+		}
+	}
+	return Region{
+		South: math.Min(lat1, lat2),
+		North: math.Max(lat1, lat2),
+		West:  lon1,
+		East:  lon2,
+	}, nil
+}
+
+// ParseRegion parses a region given as "lat1,lon1,lat2,lon2"
+func ParseRegion(s string) (Region, error) {
+	parts := strings.Split(s, ",")
+	corners := make([]float64, len(parts))
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return Region{}, fmt.Errorf("invalid region %q: expected lat1,lon1,lat2,lon2", s)
+		}
+		corners[i] = v
+	}
+	return NewRegion(corners)
+}
+
+// String formats the region the way ParseRegion accepts it
+func (r Region) String() string {
+	return fmt.Sprintf("%g,%g,%g,%g", r.South, r.West, r.North, r.East)
+}
+
+// lonSpan returns the longitude extent of the region in degrees
+func (r Region) lonSpan() float64 {
+	span := r.East - r.West
+	if span >= 360 {
+		return 360
+	}
+	return math.Mod(span+360, 360)
+}
+
+// microdegrees is the unit of latitudes and longitudes in grid template 3.0
+const microdegrees = 1e6
+
+// degreeTolerance absorbs rounding when comparing grid coordinates
+const degreeTolerance = 1e-6
+
+// wrap360 normalizes a longitude to [0, 360)
+func wrap360(lon float64) float64 {
+	lon = math.Mod(lon, 360)
+	if lon < 0 {
+		lon += 360
+	}
+	return lon
+}
+
+// latLonGrid is a regular latitude/longitude grid (template 3.0)
+type latLonGrid struct {
+	ni, nj     int
+	la1, lo1   float64 // Degrees
+	di, dj     float64 // Degrees, signed in the scanning direction
+	global     bool    // The grid wraps around in longitude
+	scanning   byte
+	definition []byte // Section 3
+}
+
+// parseLatLonGrid reads a grid definition section using template 3.0
+func parseLatLonGrid(s3 []byte) (*latLonGrid, error) {
+	if len(s3) < 14 {
+		return nil, fmt.Errorf("%w: short grid definition section", ErrInvalidGRIB)
+	}
+	if template := binary.BigEndian.Uint16(s3[12:14]); template != 0 {
+		return nil, fmt.Errorf("%w: grid definition template 3.%d", ErrUnsupportedGRIB, template)
+	}
+	if len(s3) < 72 || s3[10] != 0 {
+		return nil, fmt.Errorf("%w: grid definition with a list of points", ErrUnsupportedGRIB)
+	}
+	if angle := binary.BigEndian.Uint32(s3[38:42]); angle != 0 && angle != math.MaxUint32 {
+		return nil, fmt.Errorf("%w: grid with a basic angle of %d", ErrUnsupportedGRIB, angle)
+	}
+
+	g := &latLonGrid{
+		ni:         int(binary.BigEndian.Uint32(s3[30:34])),
+		nj:         int(binary.BigEndian.Uint32(s3[34:38])),
+		la1:        float64(signed(s3[46:50])) / microdegrees,
+		lo1:        float64(signed(s3[50:54])) / microdegrees,
+		di:         float64(binary.BigEndian.Uint32(s3[63:67])) / microdegrees,
+		dj:         float64(binary.BigEndian.Uint32(s3[67:71])) / microdegrees,
+		scanning:   s3[71],
+		definition: s3,
+	}
+	// Only row-by-row scanning from west to east is supported
+	if g.scanning&^0x40 != 0 {
+		return nil, fmt.Errorf("%w: scanning mode %#x", ErrUnsupportedGRIB, g.scanning)
+	}
+	if g.scanning&0x40 == 0 {
+		g.dj = -g.dj
+	}
+	if g.ni <= 0 || g.nj <= 0 || g.di <= 0 || g.ni == math.MaxUint32 || g.nj == math.MaxUint32 {
+		return nil, fmt.Errorf("%w: grid without a regular size", ErrUnsupportedGRIB)
+	}
+	g.global = math.Abs(float64(g.ni)*g.di-360) < degreeTolerance
+	return g, nil
+}
+
+// gridSubset selects the rows and columns of a grid within a region
+type gridSubset struct {
+	grid    *latLonGrid
+	rows    []int
+	columns []int
+}
+
+// subset works out the rows and columns of the grid within the region
+func (g *latLonGrid) subset(region Region) (*gridSubset, error) {
+	s := &gridSubset{grid: g}
+	for j := 0; j < g.nj; j++ {
+		lat := g.la1 + float64(j)*g.dj
+		if lat >= region.South-degreeTolerance && lat <= region.North+degreeTolerance {
+			s.rows = append(s.rows, j)
+		}
+	}
+
+	// Start at the column closest to the western edge and walk east
+	span := region.lonSpan()
+	offset := func(i int) float64 {
+		o := wrap360(g.lo1 + float64(i)*g.di - region.West)
+		if o > 360-degreeTolerance {
+			o = 0
+		}
+		return o
+	}
+	start := -1
+	for i := 0; i < g.ni; i++ {
+		if offset(i) <= span+degreeTolerance && (start < 0 || offset(i) < offset(start)) {
+			start = i
+		}
+	}
+	for k := 0; start >= 0 && k < g.ni; k++ {
+		i := start + k
+		if i >= g.ni {
+			if !g.global {
+				break
+			}
+			i -= g.ni
+		}
+		if offset(i) > span+degreeTolerance {
+			break
+		}
+		s.columns = append(s.columns, i)
+	}
+
+	if len(s.rows) == 0 || len(s.columns) == 0 {
+		return nil, fmt.Errorf("region %v does not overlap the grid", region)
+	}
+	return s, nil
+}
+
+// definition returns the grid definition section of the subset grid
+func (s *gridSubset) definition() []byte {
+	g := s.grid
+	s3 := append([]byte(nil), g.definition...)
+	lat := func(j int) int64 { return int64(math.Round((g.la1 + float64(j)*g.dj) * microdegrees)) }
+	lon := func(i int) int64 { return int64(math.Round(wrap360(g.lo1+float64(i)*g.di) * microdegrees)) }
+
+	binary.BigEndian.PutUint32(s3[6:10], uint32(len(s.rows)*len(s.columns)))
+	binary.BigEndian.PutUint32(s3[30:34], uint32(len(s.columns)))
+	binary.BigEndian.PutUint32(s3[34:38], uint32(len(s.rows)))
+	putSigned(s3[46:50], lat(s.rows[0]))
+	putSigned(s3[50:54], lon(s.columns[0]))
+	putSigned(s3[55:59], lat(s.rows[len(s.rows)-1]))
+	putSigned(s3[59:63], lon(s.columns[len(s.columns)-1]))
+	return s3
+}
+
+// values picks the values of the subset from those of the whole grid
+func (s *gridSubset) values(values []float64) []float64 {
+	subset := make([]float64, 0, len(s.rows)*len(s.columns))
+	for _, j := range s.rows {
+		for _, i := range s.columns {
+			subset = append(subset, values[j*s.grid.ni+i])
+		}
+	}
+	return subset
+}
+
+// SubsetMessage cuts a GRIB2 message down to the points within a region.
+// Every field is decoded and re-encoded with simple packing at its original
+// precision. Only regular latitude/longitude grids can be subset; other
+// messages fail with ErrUnsupportedGRIB.
+func SubsetMessage(msg []byte, region Region) ([]byte, error) {
+	sections, err := grib2Sections(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var subset *gridSubset
+	var s5, bitmap []byte
+	var out []grib2Section
+	for _, s := range sections {
+		switch s.number {
+		case 3:
+			grid, err := parseLatLonGrid(s.data)
+			if err != nil {
+				return nil, err
+			}
+			if subset, err = grid.subset(region); err != nil {
+				return nil, err
+			}
+			s.data = subset.definition()
+
+		case 5:
+			s5 = s.data
+			continue
+
+		case 6:
+			if len(s.data) < 6 {
+				return nil, fmt.Errorf("%w: short bitmap section", ErrInvalidGRIB)
+			}
+			switch s.data[5] {
+			case 0:
+				bitmap = s.data[6:]
+			case 254: // The previous bitmap applies
+			case 255:
+				bitmap = nil
+			default:
+				return nil, fmt.Errorf("%w: predefined bitmap %d", ErrUnsupportedGRIB, s.data[5])
+			}
+			continue
+
+		case 7:
+			if subset == nil || s5 == nil {
+				return nil, fmt.Errorf("%w: data section without a grid or data representation", ErrInvalidGRIB)
+			}
+			values, err := decodeField(s5, bitmap, s.data, subset.grid.ni*subset.grid.nj)
+			if err != nil {
+				return nil, err
+			}
+			p, _ := parsePacking(s5)
+			n5, n6, n7 := encodeSimple(p, subset.values(values))
+			out = append(out, grib2Section{5, n5}, grib2Section{6, n6}, grib2Section{7, n7})
+			continue
+		}
+		out = append(out, s)
+	}
+
+	return joinGRIB2(out), nil
+}
+
+// SubsetResult describes where a message of a file rewritten by SubsetFile
+// ended up
+type SubsetResult struct {
+	Offset    int64 // Position of the message in the original file
+	Length    int64
+	NewOffset int64 // Position of the message in the subset file
+	NewLength int64
+	Skipped   error // Why the message was copied unchanged, if it was
+}
+
+// SubsetFile rewrites a file of GRIB messages, cutting each down to the
+// region with SubsetMessage. Messages that cannot be subset are copied
+// unchanged and reported through SubsetResult.Skipped. The file is replaced
+// atomically.
+func SubsetFile(path string, region Region) ([]SubsetResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading GRIB file: %v", err)
+	}
+	if err := ValidateGRIB(memoryBuffer(data), int64(len(data))); err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	var results []SubsetResult
+	for offset := int64(0); offset < int64(len(data)); {
+		length, _ := messageLength(memoryBuffer(data), offset)
+		msg := data[offset : offset+length]
+
+		result := SubsetResult{Offset: offset, Length: length, NewOffset: int64(len(out))}
+		subset, err := SubsetMessage(msg, region)
+		switch {
+		case err == nil:
+			msg = subset
+		case errors.Is(err, ErrUnsupportedGRIB) || errors.Is(err, ErrInvalidGRIB):
+			result.Skipped = err
+		default:
+			return nil, fmt.Errorf("error subsetting message at offset %d: %v", offset, err)
+		}
+		result.NewLength = int64(len(msg))
+		out = append(out, msg...)
+		results = append(results, result)
+		offset += length
+	}
+
+	part := PartPath(path)
+	if err := os.WriteFile(part, out, 0644); err != nil {
+		return nil, fmt.Errorf("error writing subset file: %v", err)
+	}
+	if err := os.Rename(part, path); err != nil {
+		os.Remove(part)
+		return nil, fmt.Errorf("error renaming subset file: %v", err)
+	}
+	return results, nil
+}
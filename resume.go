@@ -0,0 +1,70 @@
+package gribdownloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// resumeState is persisted next to the output file while ranges download so
+// that an interrupted run can continue where it left off
+type resumeState struct {
+	OutputMode OutputMode      `json:"output_mode"`
+	Ranges     []RangeDownload `json:"ranges"`
+	Completed  []RangeResult   `json:"completed"`
+}
+
+// StatePath returns the path of the resume state file for an output file
+func StatePath(outputFile string) string {
+	return outputFile + ".state"
+}
+
+// loadResumeState reads the resume state for outputFile. It returns nil if
+// there is no state, or if it was written for a different set of ranges or
+// output mode, or the partial output file is missing.
+func loadResumeState(outputFile string, ranges []RangeDownload, mode OutputMode) *resumeState {
+	data, err := os.ReadFile(StatePath(outputFile))
+	if err != nil {
+		return nil
+	}
+
+	var state resumeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil
+	}
+
+	if state.OutputMode != mode || !slices.Equal(state.Ranges, ranges) {
+		return nil
+	}
+
+	if _, err := os.Stat(PartPath(outputFile)); err != nil {
+		return nil
+	}
+
+	return &state
+}
+
+// completed reports whether a range has already been downloaded
+func (s *resumeState) completed(r RangeDownload) (RangeResult, bool) {
+	for _, result := range s.Completed {
+		if result.RangeDownload == r {
+			return result, true
+		}
+	}
+	return RangeResult{}, false
+}
+
+// save writes the state next to the output file
+func (s *resumeState) save(outputFile string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("error encoding resume state: %v", err)
+	}
+
+	if err := os.WriteFile(StatePath(outputFile), data, 0644); err != nil {
+		return fmt.Errorf("error writing resume state: %v", err)
+	}
+
+	return nil
+}
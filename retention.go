@@ -0,0 +1,153 @@
+package gribdownloader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultRetentionLookback is how far back before the retained cycles the
+// output of older cycles is looked for
+const DefaultRetentionLookback = 30 * 24 * time.Hour
+
+// CycleFiles lists the files on disk belonging to one run of a dataset
+type CycleFiles struct {
+	Run   time.Time
+	Files []string
+	Bytes int64
+}
+
+// Retention bounds the downloaded data kept for a dataset. A cycle is kept
+// only while it is among the newest KeepCycles cycles on disk and no older
+// than KeepDays days; a zero value does not limit.
+type Retention struct {
+	KeepCycles int
+	KeepDays   int
+}
+
+// Retention returns the keep_cycles and keep_days settings of the dataset
+func (ds *Dataset) Retention() Retention {
+	return Retention{KeepCycles: ds.KeepCycles, KeepDays: ds.KeepDays}
+}
+
+// IsZero reports whether the retention keeps everything
+func (r Retention) IsZero() bool {
+	return r.KeepCycles <= 0 && r.KeepDays <= 0
+}
+
+// runFiles returns every file the tool may write for the targets of a run:
+// outputs with their manifests, conversions, idx copies and done files,
+// interrupted downloads and combined files
+func (ds *Dataset) runFiles(run time.Time) []string {
+	seen := map[string]bool{}
+	var files []string
+	add := func(paths ...string) {
+		for _, path := range paths {
+			if !seen[path] {
+				seen[path] = true
+				files = append(files, path)
+			}
+		}
+	}
+	for _, target := range ds.TargetsForRun(run) {
+		for _, output := range []string{target.Output, ds.CombinedPath(target)} {
+			add(output, ManifestPath(output), NetCDFPath(output), KerchunkPath(output),
+				output+".done", PartPath(output), StatePath(output))
+		}
+		if !target.Field {
+			add(filepath.Join(filepath.Dir(target.Output), filepath.Base(target.IdxURL)))
+		}
+	}
+	return files
+}
+
+// CyclesOnDisk finds the runs with files on disk, newest first, from the run
+// at or before now back to lookback before the oldest retained run
+func (ds *Dataset) CyclesOnDisk(now time.Time, lookback time.Duration) []CycleFiles {
+	interval := time.Duration(ds.CycleInterval) * time.Hour
+	if interval <= 0 {
+		interval = DefaultCycleInterval * time.Hour
+	}
+	window := time.Duration(ds.KeepDays) * 24 * time.Hour
+	window = max(window, time.Duration(ds.KeepCycles)*interval) + lookback
+
+	now = now.UTC()
+	var cycles []CycleFiles
+	for run := now.Truncate(interval); now.Sub(run) <= window; run = run.Add(-interval) {
+		cycle := CycleFiles{Run: run}
+		for _, path := range ds.runFiles(run) {
+			info, err := os.Stat(path)
+			if err != nil || info.IsDir() {
+				continue
+			}
+			cycle.Files = append(cycle.Files, path)
+			cycle.Bytes += info.Size()
+		}
+		if len(cycle.Files) > 0 {
+			cycles = append(cycles, cycle)
+		}
+	}
+	return cycles
+}
+
+// Expired returns the cycles that the retention no longer keeps, given the
+// cycles on disk
+func (r Retention) Expired(cycles []CycleFiles, now time.Time) []CycleFiles {
+	sorted := append([]CycleFiles(nil), cycles...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Run.After(sorted[j].Run) })
+
+	var expired []CycleFiles
+	cutoff := now.Add(-time.Duration(r.KeepDays) * 24 * time.Hour)
+	for i, cycle := range sorted {
+		if (r.KeepCycles > 0 && i >= r.KeepCycles) || (r.KeepDays > 0 && cycle.Run.Before(cutoff)) {
+			expired = append(expired, cycle)
+		}
+	}
+	return expired
+}
+
+// within reports whether dir lies strictly below root
+func within(root, dir string) bool {
+	rel, err := filepath.Rel(root, dir)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// RemoveCycle deletes the files of a cycle, and then the directories left
+// empty by it below the fixed part of output_dir, such as the date and cycle
+// directories of an output_dir of "data/{date}/{cycle}"
+func (ds *Dataset) RemoveCycle(cycle CycleFiles) error {
+	root := filepath.Clean(ds.OutputDir)
+	if prefix := templatePrefix(ds.OutputDir); prefix != ds.OutputDir {
+		// The directory holding the first name with a placeholder, e.g.
+		// "data" for both "data/{date}" and "data/gfs_{date}"
+		root = filepath.Dir(prefix)
+	}
+
+	dirs := map[string]bool{}
+	for _, path := range cycle.Files {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing %s: %v", path, err)
+		}
+		dirs[filepath.Dir(path)] = true
+	}
+
+	// Remove the deepest directories first; Remove fails on those that are
+	// not empty, which stops the walk up
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	for _, dir := range sorted {
+		for within(root, dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+	}
+	return nil
+}
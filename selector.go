@@ -0,0 +1,68 @@
+package gribdownloader
+
+import "regexp"
+
+// Selector decides which idx records are downloaded. Library users may
+// implement it for selection logic beyond what a Selection can express.
+type Selector interface {
+	Match(param GFSParameter) bool
+}
+
+// Selector compiles the selection, as used by SelectRecords, into a
+// Selector
+func (s Selection) Selector() (Selector, error) {
+	return s.compile()
+}
+
+// SelectorFunc adapts a function to a Selector
+type SelectorFunc func(param GFSParameter) bool
+
+// Match implements Selector
+func (f SelectorFunc) Match(param GFSParameter) bool {
+	return f(param)
+}
+
+// RegexSelector selects the records whose "PARAMETER:level:type"
+// description matches a regular expression, like wgrib2 -match, e.g.
+// `^(TMP|RH):2 m above ground:`
+type RegexSelector struct {
+	Pattern *regexp.Regexp
+}
+
+// NewRegexSelector compiles a pattern into a RegexSelector
+func NewRegexSelector(pattern string) (*RegexSelector, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &RegexSelector{Pattern: re}, nil
+}
+
+// Match implements Selector
+func (s *RegexSelector) Match(param GFSParameter) bool {
+	return s.Pattern.MatchString(param.String())
+}
+
+// AllOf selects the records matched by every one of the selectors
+func AllOf(selectors ...Selector) Selector {
+	return SelectorFunc(func(param GFSParameter) bool {
+		for _, s := range selectors {
+			if !s.Match(param) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// AnyOf selects the records matched by any of the selectors
+func AnyOf(selectors ...Selector) Selector {
+	return SelectorFunc(func(param GFSParameter) bool {
+		for _, s := range selectors {
+			if s.Match(param) {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,37 @@
+package gribdownloader
+
+import "sync/atomic"
+
+// Stats accumulates counters over all downloads of a Downloader, e.g. for
+// exporting as metrics. All fields are safe for concurrent use.
+type Stats struct {
+	BytesDownloaded  atomic.Int64 // Bytes written to outputs
+	RangesDownloaded atomic.Int64 // Ranges downloaded successfully
+	RangeRetries     atomic.Int64 // Failed attempts that were retried
+	RangeFailures    atomic.Int64 // Ranges that failed on every mirror
+}
+
+// downloaded counts successfully downloaded ranges; s may be nil
+func (s *Stats) downloaded(written []int64) {
+	if s == nil {
+		return
+	}
+	for _, n := range written {
+		s.BytesDownloaded.Add(n)
+	}
+	s.RangesDownloaded.Add(int64(len(written)))
+}
+
+// retried counts a failed attempt that is retried; s may be nil
+func (s *Stats) retried() {
+	if s != nil {
+		s.RangeRetries.Add(1)
+	}
+}
+
+// failed counts ranges that could not be downloaded; s may be nil
+func (s *Stats) failed(ranges int) {
+	if s != nil {
+		s.RangeFailures.Add(int64(ranges))
+	}
+}
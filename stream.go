@@ -0,0 +1,219 @@
+package gribdownloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// memoryBuffer is a fixed-size in-memory rangeWriter
+type memoryBuffer []byte
+
+func (b memoryBuffer) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(b)) {
+		return 0, fmt.Errorf("write of %d bytes at offset %d exceeds buffer of %d bytes", len(p), off, len(b))
+	}
+	return copy(b[off:], p), nil
+}
+
+func (b memoryBuffer) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// flightWindow bounds how far the downloads of streamRanges run ahead of
+// the writer, in bytes or in ranges
+type flightWindow struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+// newFlightWindow returns a window admitting up to limit bytes or ranges
+func newFlightWindow(limit int64) *flightWindow {
+	w := &flightWindow{limit: limit}
+	w.cond = sync.NewCond(&w.mutex)
+	return w
+}
+
+// acquire waits until n more fit in the window, or the window is empty,
+// returning false if ctx is cancelled first
+func (w *flightWindow) acquire(ctx context.Context, n int64) bool {
+	stop := context.AfterFunc(ctx, func() {
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		w.cond.Broadcast()
+	})
+	defer stop()
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for w.used > 0 && w.used+n > w.limit {
+		if ctx.Err() != nil {
+			return false
+		}
+		w.cond.Wait()
+	}
+	w.used += n
+	return true
+}
+
+// release frees n of the window once written
+func (w *flightWindow) release(n int64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.used -= n
+	w.cond.Broadcast()
+}
+
+// streamedRange is a downloaded range waiting to be written to the stream
+type streamedRange struct {
+	data   []byte
+	result RangeResult
+	err    error
+}
+
+// StreamRanges downloads ranges like DownloadRangesFromMirrors, but writes
+// the data to w in the order the ranges are given instead of to a file.
+// Ranges are fetched concurrently and buffered in memory until their turn
+// comes; at most InFlightBytes, or twice the number of workers ranges, are
+// held at once. Nothing is written to disk, so neither resuming nor sparse
+// output is available.
+func (d *Downloader) StreamRanges(ctx context.Context, mirrors []string, ranges []RangeDownload, w io.Writer) ([]RangeResult, error) {
+	results := make([]RangeResult, 0, len(ranges))
+	err := d.streamRanges(ctx, mirrors, ranges, func(data []byte, result RangeResult) error {
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("error writing output: %v", err)
+		}
+		results = append(results, result)
+		return nil
+	})
+	return results, err
+}
+
+// streamRanges downloads ranges concurrently and passes each to emit in the
+// order given, stopping at the first error of a download or of emit
+func (d *Downloader) streamRanges(ctx context.Context, mirrors []string, ranges []RangeDownload, emit func(data []byte, result RangeResult) error) error {
+	if len(mirrors) == 0 {
+		return fmt.Errorf("no source URLs given")
+	}
+
+	workers := d.concurrencyFor(mirrors[0])
+	urls := make([]string, len(mirrors))
+	for i, mirror := range mirrors {
+		url, err := d.resolveURL(mirror)
+		if err != nil {
+			return err
+		}
+		urls[i] = url
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tracker := newProgressTracker(ranges)
+	pending := make([]chan streamedRange, len(ranges))
+	for i := range pending {
+		pending[i] = make(chan streamedRange, 1)
+	}
+	queue := make(chan int)
+	window := newFlightWindow(int64(2 * workers))
+	weight := func(RangeDownload) int64 { return 1 }
+	if d.InFlightBytes > 0 {
+		window = newFlightWindow(d.InFlightBytes)
+		weight = RangeDownload.Size
+	}
+
+	// Start a bounded pool of workers
+	var wg sync.WaitGroup
+	for i := 0; i < min(workers, len(ranges)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				if ctx.Err() != nil || !d.acquire(ctx) {
+					pending[i] <- streamedRange{err: ctx.Err()}
+					continue
+				}
+				r := ranges[i]
+				buffer := make(memoryBuffer, r.Size())
+				request := rangeRequest{RangeDownload: r, Jobs: []rangeJob{{RangeDownload: r}}}
+				tracker.activeRanges.Add(1)
+				mirror, written, err := d.downloadRequestFromMirrors(ctx, urls, request, buffer, tracker)
+				tracker.activeRanges.Add(-1)
+				d.release()
+				if err != nil {
+					tracker.failedRanges.Add(1)
+					pending[i] <- streamedRange{err: fmt.Errorf("error downloading range %d-%d: %v", r.Start, r.End, err)}
+					continue
+				}
+				tracker.doneRanges.Add(1)
+				pending[i] <- streamedRange{
+					data:   buffer[:written[0]],
+					result: RangeResult{RangeDownload: r, Source: mirrors[mirror], Bytes: written[0]},
+				}
+			}
+		}()
+	}
+
+	// Report progress while the workers run
+	reported := make(chan struct{})
+	finished := make(chan struct{})
+	if d.Progress != nil {
+		go func() {
+			tracker.report(d.Progress, finished)
+			close(reported)
+		}()
+	} else {
+		close(reported)
+	}
+
+	// Queue the ranges, staying at most the window size ahead of the writer
+	go func() {
+		defer close(queue)
+		for i := range ranges {
+			if !window.acquire(ctx, weight(ranges[i])) {
+				return
+			}
+			select {
+			case queue <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Pass on the ranges in order as they become available
+	var err error
+	for i := range ranges {
+		var next streamedRange
+		select {
+		case next = <-pending[i]:
+		case <-ctx.Done():
+			next.err = ctx.Err()
+		}
+		if next.err != nil {
+			err = next.err
+			break
+		}
+		if err = emit(next.data, next.result); err != nil {
+			break
+		}
+		window.release(weight(ranges[i]))
+	}
+
+	cancel()
+	wg.Wait()
+	close(finished)
+	<-reported
+
+	return err
+}
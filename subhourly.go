@@ -0,0 +1,86 @@
+package gribdownloader
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// leadMinutes returns the lead time in minutes of a minute of a sub-hourly
+// file. The file of forecast hour H holds the times after hour H-1 up to
+// H:00, so minute 0 is the end of hour H and the others fall in the hour
+// before it. It returns a negative value for the minutes before the
+// analysis.
+func leadMinutes(hour, minute int) int {
+	if minute == 0 {
+		return hour * 60
+	}
+	return (hour-1)*60 + minute
+}
+
+// setMinuteVars sets the template variables of a minute of a sub-hourly
+// file: {minute} as two digits and {fmin} as the lead time in minutes
+func setMinuteVars(vars map[string]string, lead int) {
+	vars["minute"] = fmt.Sprintf("%02d", lead%60)
+	vars["fmin"] = strconv.Itoa(lead)
+}
+
+// minuteTypes returns the type patterns selecting the records valid at a
+// lead time in minutes: instantaneous fields ("45 min fcst") and those
+// accumulated or averaged up to it ("30-45 min ave fcst")
+func minuteTypes(lead int) []string {
+	if lead == 0 {
+		return []string{"anl", "0 min fcst"}
+	}
+	types := []string{
+		fmt.Sprintf("%d min fcst", lead),
+		fmt.Sprintf("*-%d min * fcst", lead),
+	}
+	if lead%60 == 0 {
+		types = append(types, fmt.Sprintf("%d hour fcst", lead/60), fmt.Sprintf("*-%d hour * fcst", lead/60))
+	}
+	return types
+}
+
+// minuteTypes returns the type filter of a sub-hourly target: the types of
+// the dataset with {minute} and {fmin} expanded, or by default those valid
+// at the lead time of the target
+func (ds *Dataset) minuteTypes(target Target) []string {
+	if len(ds.Types) == 0 {
+		return minuteTypes(target.Minute)
+	}
+	types := make([]string, len(ds.Types))
+	for i, t := range ds.Types {
+		types[i] = ExpandTemplate(t, target.Vars)
+	}
+	return types
+}
+
+// validateMinutes checks the minutes of a sub-hourly dataset
+func (ds *Dataset) validateMinutes() error {
+	if len(ds.Minutes) == 0 {
+		return nil
+	}
+	if len(ds.ForecastHours) == 0 {
+		return fmt.Errorf("minutes requires forecast_hours")
+	}
+	seen := map[int]bool{}
+	for _, minute := range ds.Minutes {
+		if minute < 0 || minute > 59 {
+			return fmt.Errorf("invalid minute %d: must be from 0 to 59", minute)
+		}
+		if seen[minute] {
+			return fmt.Errorf("minute %d is listed twice", minute)
+		}
+		seen[minute] = true
+	}
+	// Without a filename the output is named after the URL
+	name := ds.Filename
+	if name == "" {
+		name = ds.urlTemplate()
+	}
+	if names := ds.OutputDir + "/" + name; !strings.Contains(names, "{minute}") && !strings.Contains(names, "{fmin}") {
+		return fmt.Errorf("minutes requires a {minute} or {fmin} placeholder in filename or output_dir, as each minute is written to its own file")
+	}
+	return nil
+}
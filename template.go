@@ -0,0 +1,36 @@
+package gribdownloader
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// placeholder matches a {name} template placeholder
+var placeholder = regexp.MustCompile(`\{[A-Za-z0-9_]+\}`)
+
+// ExpandTemplate replaces {name} placeholders in s with the matching values
+func ExpandTemplate(s string, vars map[string]string) string {
+	for name, value := range vars {
+		s = strings.ReplaceAll(s, "{"+name+"}", value)
+	}
+	return s
+}
+
+// UnresolvedPlaceholders returns the placeholders left in s after expansion,
+// e.g. misspelled variable names
+func UnresolvedPlaceholders(s string) []string {
+	return placeholder.FindAllString(s, -1)
+}
+
+// FormatForecastHour formats a forecast hour the way NCEP file names do (e.g. 003)
+func FormatForecastHour(hour int) string {
+	return fmt.Sprintf("%03d", hour)
+}
+
+// setHourVars sets the forecast hour template variables: {fhr} as three
+// digits and {fhr2} as two, as used by HRRR file names
+func setHourVars(vars map[string]string, hour int) {
+	vars["fhr"] = FormatForecastHour(hour)
+	vars["fhr2"] = fmt.Sprintf("%02d", hour)
+}
@@ -0,0 +1,155 @@
+package gribdownloader
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxRetryAfter is the longest cooldown applied after a rate limiting
+// response when no limit is configured
+const DefaultMaxRetryAfter = 2 * time.Minute
+
+// throttleBaseDelay is the first cooldown after a rate limiting response
+// without a Retry-After header; it doubles with each such response in a row
+const throttleBaseDelay = 5 * time.Second
+
+// throttleAttempts is how many times a rate limited request is repeated
+const throttleAttempts = 3
+
+// hostCooldown is the rate limiting state of a host
+type hostCooldown struct {
+	until    time.Time // No requests are sent before this
+	failures int       // Rate limiting responses since the last success
+}
+
+// throttle pauses all requests to a host once it answers 429 Too Many
+// Requests or 503 Service Unavailable, so that the workers wait out one
+// shared cooldown instead of each retrying on their own
+type throttle struct {
+	max    time.Duration
+	logger *slog.Logger
+
+	mutex sync.Mutex
+	hosts map[string]*hostCooldown
+}
+
+// wait blocks until the cooldown of a host has passed. Waiters resume at
+// jittered times so they do not all hit the host at once.
+func (t *throttle) wait(ctx context.Context, host string) error {
+	for {
+		t.mutex.Lock()
+		var until time.Time
+		if h := t.hosts[host]; h != nil {
+			until = h.until
+		}
+		t.mutex.Unlock()
+
+		remaining := time.Until(until)
+		if remaining <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(remaining + time.Duration(rand.Int63n(int64(remaining/4)+1)))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		// The cooldown may have been extended meanwhile
+	}
+}
+
+// limited starts or extends the cooldown of a host after a rate limiting
+// response. The delay is that of the Retry-After header, or grows
+// exponentially without one, and is at most max.
+func (t *throttle) limited(host string, resp *http.Response) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	h := t.hosts[host]
+	if h == nil {
+		h = &hostCooldown{}
+		t.hosts[host] = h
+	}
+	h.failures++
+
+	delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok {
+		delay = throttleBaseDelay << min(h.failures-1, 16)
+	}
+	delay = min(delay, t.max)
+	if until := time.Now().Add(delay); until.After(h.until) {
+		h.until = until
+		t.logger.Warn("rate limited, pausing requests to host",
+			"host", host, "status", resp.StatusCode, "delay", delay, "in_a_row", h.failures)
+	}
+}
+
+// succeeded resets the backoff of a host
+func (t *throttle) succeeded(host string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if h := t.hosts[host]; h != nil {
+		h.failures = 0
+	}
+}
+
+// throttleTransport sends requests through a throttle, repeating those
+// answered with 429 or 503 once the cooldown of their host has passed
+type throttleTransport struct {
+	base     http.RoundTripper
+	throttle *throttle
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	for attempt := 0; ; attempt++ {
+		if err := t.throttle.wait(req.Context(), host); err != nil {
+			return nil, err
+		}
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return resp, err
+		}
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+			t.throttle.succeeded(host)
+			return resp, nil
+		}
+		t.throttle.limited(host, resp)
+		if attempt >= throttleAttempts || req.Body != nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+}
+
+// CloseIdleConnections closes the idle connections of the base transport
+func (t *throttleTransport) CloseIdleConnections() {
+	closeIdleConnections(t.base)
+}
+
+// parseRetryAfter parses a Retry-After header, given either as seconds or as
+// an HTTP date, into the delay from now
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(date.Sub(now), 0), true
+}
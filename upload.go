@@ -0,0 +1,647 @@
+package gribdownloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultUploadPartSize is the size of the parts of multipart uploads.
+// Files up to this size are uploaded with a single request.
+const DefaultUploadPartSize = 16 << 20
+
+// DefaultUploadRetries is the number of times a failed upload request is
+// repeated
+const DefaultUploadRetries = 3
+
+// Uploader copies local files to a storage service
+type Uploader interface {
+	// Upload stores the file at localPath as the object addressed by dest
+	Upload(ctx context.Context, localPath string, dest *url.URL) error
+}
+
+// UploadOptions are the settings shared by all uploaders
+type UploadOptions struct {
+	// PartSize is the size of the parts of multipart uploads; zero uses
+	// DefaultUploadPartSize
+	PartSize int64
+	// Retries is the number of times a failed request is repeated, with
+	// exponential backoff; zero uses DefaultUploadRetries
+	Retries int
+	// Client sends the requests; nil uses http.DefaultClient
+	Client *http.Client
+	// Logger receives retries; nil uses slog.Default()
+	Logger *slog.Logger
+}
+
+func (o UploadOptions) partSize() int64 {
+	if o.PartSize > 0 {
+		return o.PartSize
+	}
+	return DefaultUploadPartSize
+}
+
+// permanentError marks a failure that repeating the request cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// retry calls fn until it succeeds, repeating failures up to Retries times
+// with exponential backoff unless they are permanent
+func (o UploadOptions) retry(ctx context.Context, fn func() error) error {
+	logger := o.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	retries := o.Retries
+	if retries <= 0 {
+		retries = DefaultUploadRetries
+	}
+
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+		if attempt >= retries || ctx.Err() != nil {
+			return err
+		}
+		logger.Warn("upload failed, retrying", "attempt", attempt+1, "delay", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// do sends the request built by newRequest, repeating it after network
+// errors, throttling and server errors. Any other failure status is
+// returned as an error, with the body of the response.
+func (o UploadOptions) do(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var resp *http.Response
+	err := o.retry(ctx, func() error {
+		req, err := newRequest()
+		if err != nil {
+			return &permanentError{err}
+		}
+		r, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		if r.StatusCode < 300 {
+			resp = r
+			return nil
+		}
+		body, _ := io.ReadAll(io.LimitReader(r.Body, 1024))
+		r.Body.Close()
+		err = fmt.Errorf("%s %s: status code %d: %s", req.Method, req.URL.Redacted(), r.StatusCode, strings.TrimSpace(string(body)))
+		if r.StatusCode != http.StatusTooManyRequests && r.StatusCode < 500 {
+			return &permanentError{err}
+		}
+		return err
+	})
+	return resp, err
+}
+
+// readParts calls fn with each part of a file in turn. A file no larger than
+// a part, including an empty one, is passed as a single part.
+func readParts(localPath string, partSize int64, fn func(number int, data []byte, last bool) error) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("error opening upload: %v", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error opening upload: %v", err)
+	}
+
+	size := info.Size()
+	buf := make([]byte, min(partSize, max(size, 1)))
+	for number, offset := 1, int64(0); ; number++ {
+		n := min(partSize, size-offset)
+		if _, err := io.ReadFull(file, buf[:n]); err != nil {
+			return fmt.Errorf("error reading upload: %v", err)
+		}
+		offset += n
+		if err := fn(number, buf[:n], offset >= size); err != nil {
+			return err
+		}
+		if offset >= size {
+			return nil
+		}
+	}
+}
+
+// S3Uploader uploads to Amazon S3 or an S3-compatible service, signing the
+// requests with AWS Signature Version 4. Files larger than a part are sent
+// with a multipart upload, which is aborted if a part fails.
+type S3Uploader struct {
+	UploadOptions
+	Region string
+	// Endpoint, if set, is the URL of an S3-compatible service addressed
+	// with path-style requests, e.g. http://localhost:9000
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Encryption requests server-side encryption: "AES256" or "aws:kms"
+	// with the key KMSKeyID, or the bucket default when empty
+	Encryption string
+	KMSKeyID   string
+}
+
+// objectURL returns the HTTP URL of the object addressed by an s3:// URL
+func (u *S3Uploader) objectURL(dest *url.URL) (string, error) {
+	if u.Endpoint != "" {
+		return strings.TrimSuffix(u.Endpoint, "/") + "/" + dest.Host + "/" + strings.TrimPrefix(dest.Path, "/"), nil
+	}
+	return S3Backend{Region: u.Region}.HTTPURL(dest)
+}
+
+// sign adds the AWS Signature Version 4 headers to a request made at now
+func (u *S3Uploader) sign(req *http.Request, payload []byte, now time.Time) {
+	region := u.Region
+	if region == "" {
+		region = DefaultS3Region
+	}
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256.Sum256(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if u.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", u.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-amz-") || name == "content-type" {
+			headers[name] = strings.TrimSpace(values[0])
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+u.SecretAccessKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		u.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscape percent-encodes s as required by Signature Version 4, keeping
+// slashes unless escapeSlash is set
+func awsEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery returns the sorted, encoded query string of a request
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, awsEscape(name, true)+"="+awsEscape(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// request builds a signed request for an object, with the query given in
+// canonical form so that the URL matches the signature. Requests creating
+// the object carry the encryption headers, which are signed too.
+func (u *S3Uploader) request(ctx context.Context, method, objectURL string, query url.Values, body []byte, create bool) (*http.Request, error) {
+	target, err := url.Parse(objectURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload URL: %v", err)
+	}
+	target.RawPath = awsEscape(target.Path, false)
+	target.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	if create {
+		u.encryptionHeaders(req)
+	}
+	u.sign(req, body, time.Now())
+	return req, nil
+}
+
+// encryptionHeaders adds the server-side encryption headers to the request
+// creating an object
+func (u *S3Uploader) encryptionHeaders(req *http.Request) {
+	if u.Encryption == "" {
+		return
+	}
+	req.Header.Set("X-Amz-Server-Side-Encryption", u.Encryption)
+	if u.KMSKeyID != "" {
+		req.Header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", u.KMSKeyID)
+	}
+}
+
+// Upload implements Uploader
+func (u *S3Uploader) Upload(ctx context.Context, localPath string, dest *url.URL) error {
+	objectURL, err := u.objectURL(dest)
+	if err != nil {
+		return err
+	}
+	return uploadMultipart(ctx, u.UploadOptions, localPath, multipartAPI{
+		newRequest: func(method string, query url.Values, body []byte, create bool) (*http.Request, error) {
+			return u.request(ctx, method, objectURL, query, body, create)
+		},
+	})
+}
+
+// GCSUploader uploads to Google Cloud Storage through the XML API, which
+// accepts the multipart uploads of S3. Requests carry an OAuth 2.0 access
+// token, e.g. from "gcloud auth print-access-token".
+type GCSUploader struct {
+	UploadOptions
+	AccessToken string
+}
+
+// Upload implements Uploader
+func (u *GCSUploader) Upload(ctx context.Context, localPath string, dest *url.URL) error {
+	objectURL, err := GCSBackend{}.HTTPURL(dest)
+	if err != nil {
+		return err
+	}
+	return uploadMultipart(ctx, u.UploadOptions, localPath, multipartAPI{
+		newRequest: func(method string, query url.Values, body []byte, create bool) (*http.Request, error) {
+			target, err := url.Parse(objectURL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid upload URL: %v", err)
+			}
+			target.RawQuery = query.Encode()
+			req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+			if err != nil {
+				return nil, fmt.Errorf("error creating request: %v", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+u.AccessToken)
+			return req, nil
+		},
+	})
+}
+
+// multipartAPI builds the requests of the S3 multipart upload protocol. The
+// create flag marks requests that create the object, which carry its
+// settings.
+type multipartAPI struct {
+	newRequest func(method string, query url.Values, body []byte, create bool) (*http.Request, error)
+}
+
+// initiateResult is the response to CreateMultipartUpload
+type initiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+// completedPart lists a part in CompleteMultipartUpload
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// completeUpload is the body of CompleteMultipartUpload
+type completeUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// uploadMultipart uploads a file with a single PUT when it fits in a part,
+// and otherwise with a multipart upload
+func uploadMultipart(ctx context.Context, opts UploadOptions, localPath string, api multipartAPI) error {
+	var uploadID string
+	var parts []completedPart
+	err := readParts(localPath, opts.partSize(), func(number int, data []byte, last bool) error {
+		if number == 1 && last {
+			resp, err := opts.do(ctx, func() (*http.Request, error) {
+				return api.newRequest(http.MethodPut, nil, data, true)
+			})
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			return nil
+		}
+
+		if number == 1 {
+			resp, err := opts.do(ctx, func() (*http.Request, error) {
+				return api.newRequest(http.MethodPost, url.Values{"uploads": {""}}, nil, true)
+			})
+			if err != nil {
+				return fmt.Errorf("error starting multipart upload: %v", err)
+			}
+			var result initiateResult
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+			resp.Body.Close()
+			if err != nil || result.UploadID == "" {
+				return fmt.Errorf("error starting multipart upload: no upload ID in response")
+			}
+			uploadID = result.UploadID
+		}
+
+		query := url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {uploadID}}
+		resp, err := opts.do(ctx, func() (*http.Request, error) {
+			return api.newRequest(http.MethodPut, query, data, false)
+		})
+		if err != nil {
+			return fmt.Errorf("error uploading part %d: %v", number, err)
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		return nil
+	})
+
+	if err == nil && uploadID != "" {
+		err = completeMultipart(ctx, opts, api, uploadID, parts)
+	}
+	if err != nil && uploadID != "" {
+		// Discard the parts, which would otherwise be stored (and billed)
+		// until a lifecycle rule removes them
+		resp, abortErr := opts.do(context.WithoutCancel(ctx), func() (*http.Request, error) {
+			return api.newRequest(http.MethodDelete, url.Values{"uploadId": {uploadID}}, nil, false)
+		})
+		if abortErr == nil {
+			resp.Body.Close()
+		}
+	}
+	return err
+}
+
+// completeMultipart assembles the uploaded parts into the object
+func completeMultipart(ctx context.Context, opts UploadOptions, api multipartAPI, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(completeUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := opts.do(ctx, func() (*http.Request, error) {
+		return api.newRequest(http.MethodPost, url.Values{"uploadId": {uploadID}}, body, false)
+	})
+	if err != nil {
+		return fmt.Errorf("error completing multipart upload: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// S3 reports some failures with status 200 and an error document
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error completing multipart upload: %v", err)
+	}
+	var result struct {
+		XMLName xml.Name
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(data, &result) == nil && result.XMLName.Local == "Error" {
+		return fmt.Errorf("error completing multipart upload: %s", result.Message)
+	}
+	return nil
+}
+
+// AzureUploader uploads to Azure Blob Storage as block blobs, authorized
+// with a shared access signature. Files larger than a part are staged as
+// blocks and committed with a block list.
+type AzureUploader struct {
+	UploadOptions
+	SASToken string // Query string of the SAS, with or without a leading "?"
+}
+
+// azureVersion is the Blob Storage REST API version used for uploads
+const azureVersion = "2021-08-06"
+
+// Upload implements Uploader
+func (u *AzureUploader) Upload(ctx context.Context, localPath string, dest *url.URL) error {
+	blobURL, err := AzureBackend{}.HTTPURL(dest)
+	if err != nil {
+		return err
+	}
+	sas, err := url.ParseQuery(strings.TrimPrefix(u.SASToken, "?"))
+	if err != nil {
+		return fmt.Errorf("invalid SAS token: %v", err)
+	}
+
+	newRequest := func(query url.Values, body []byte) (*http.Request, error) {
+		values := url.Values{}
+		for name, v := range sas {
+			values[name] = v
+		}
+		for name, v := range query {
+			values[name] = v
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, blobURL+"?"+values.Encode(), bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("error creating request: %v", err)
+		}
+		req.Header.Set("X-Ms-Version", azureVersion)
+		return req, nil
+	}
+
+	var blockIDs []string
+	err = readParts(localPath, u.partSize(), func(number int, data []byte, last bool) error {
+		if number == 1 && last {
+			resp, err := u.do(ctx, func() (*http.Request, error) {
+				req, err := newRequest(nil, data)
+				if err == nil {
+					req.Header.Set("X-Ms-Blob-Type", "BlockBlob")
+				}
+				return req, err
+			})
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			return nil
+		}
+
+		// Block IDs must all have the same length
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", number)))
+		resp, err := u.do(ctx, func() (*http.Request, error) {
+			return newRequest(url.Values{"comp": {"block"}, "blockid": {id}}, data)
+		})
+		if err != nil {
+			return fmt.Errorf("error uploading block %d: %v", number, err)
+		}
+		resp.Body.Close()
+		blockIDs = append(blockIDs, id)
+		return nil
+	})
+	if err != nil || len(blockIDs) == 0 {
+		// Uncommitted blocks are discarded by the service after a week
+		return err
+	}
+
+	var blockList bytes.Buffer
+	blockList.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range blockIDs {
+		blockList.WriteString("<Latest>" + id + "</Latest>")
+	}
+	blockList.WriteString("</BlockList>")
+	resp, err := u.do(ctx, func() (*http.Request, error) {
+		return newRequest(url.Values{"comp": {"blocklist"}}, blockList.Bytes())
+	})
+	if err != nil {
+		return fmt.Errorf("error committing block list: %v", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// IsStorageURL reports whether an output directory is a storage URL that
+// files are uploaded to rather than a local directory
+func IsStorageURL(dir string) bool {
+	scheme, _, ok := strings.Cut(dir, "://")
+	return ok && (scheme == "s3" || scheme == "gs" || scheme == "az")
+}
+
+// stagingPath returns the local directory that files bound for a storage
+// URL are written to before they are uploaded
+func stagingPath(stagingDir, storageURL string) string {
+	scheme, rest, _ := strings.Cut(storageURL, "://")
+	return filepath.Join(stagingDir, scheme, filepath.FromSlash(rest))
+}
+
+// UploadURL returns the storage URL a local output file is uploaded to. It
+// reports false when the dataset writes to a local output_dir.
+func (ds *Dataset) UploadURL(localPath string) (string, bool) {
+	if !IsStorageURL(ds.OutputDir) {
+		return "", false
+	}
+	rel, err := filepath.Rel(ds.stagingDir, localPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	scheme, rest, ok := strings.Cut(filepath.ToSlash(rel), "/")
+	if !ok {
+		return "", false
+	}
+	return scheme + "://" + rest, true
+}
+
+// DefaultStagingDir is where files bound for a storage URL are written
+// before they are uploaded when staging_dir is not set
+func DefaultStagingDir() string {
+	return filepath.Join(os.TempDir(), "gribdownloader")
+}
+
+// NewUploader returns the uploader for the scheme of a storage URL, taking
+// the credentials from the environment: AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN for s3, an OAuth access token
+// in GOOGLE_OAUTH_ACCESS_TOKEN for gs, and a shared access signature in
+// AZURE_STORAGE_SAS_TOKEN for az. FTP passwords missing from the URL are
+// taken from FTP_PASSWORD, and sftp authenticates with the SSH keys or agent.
+func (c *Config) NewUploader(scheme string, client *http.Client, logger *slog.Logger) (Uploader, error) {
+	opts := UploadOptions{
+		PartSize: int64(c.UploadPartSizeMB) << 20,
+		Retries:  c.UploadRetries,
+		Client:   client,
+		Logger:   logger,
+	}
+	switch scheme {
+	case "s3":
+		u := &S3Uploader{
+			UploadOptions:   opts,
+			Region:          c.S3Region,
+			Endpoint:        c.UploadEndpoint,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			Encryption:      c.UploadEncryption,
+			KMSKeyID:        c.UploadKMSKeyID,
+		}
+		if u.AccessKeyID == "" || u.SecretAccessKey == "" {
+			return nil, fmt.Errorf("uploading to s3 requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		return u, nil
+	case "gs":
+		token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+		if token == "" {
+			return nil, fmt.Errorf("uploading to gs requires GOOGLE_OAUTH_ACCESS_TOKEN")
+		}
+		return &GCSUploader{UploadOptions: opts, AccessToken: token}, nil
+	case "az":
+		token := os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+		if token == "" {
+			return nil, fmt.Errorf("uploading to az requires AZURE_STORAGE_SAS_TOKEN")
+		}
+		return &AzureUploader{UploadOptions: opts, SASToken: token}, nil
+	case "ftp":
+		return &FTPUploader{UploadOptions: opts, Password: os.Getenv("FTP_PASSWORD")}, nil
+	case "sftp":
+		return &SFTPUploader{UploadOptions: opts}, nil
+	}
+	return nil, fmt.Errorf("cannot upload to %q URLs", scheme)
+}
@@ -0,0 +1,46 @@
+package gribdownloader
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+// projectURL identifies the project in the default User-Agent so data
+// providers know whom to contact
+const projectURL = "https://github.com/mrauhala/gribdownloader"
+
+var version = sync.OnceValue(func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+			return "devel-" + setting.Value[:12]
+		}
+	}
+	return "devel"
+})
+
+// Version returns the module version the program was built from, or
+// "devel" with the VCS revision if known for development builds
+func Version() string {
+	return version()
+}
+
+// DefaultUserAgent is sent with every request unless UserAgent is set, as
+// NOMADS asks automated clients to identify themselves
+func DefaultUserAgent() string {
+	return "gribdownloader/" + Version() + " (+" + projectURL + ")"
+}
+
+// userAgent returns the User-Agent sent with requests
+func (d *Downloader) userAgent() string {
+	if d.UserAgent != "" {
+		return d.UserAgent
+	}
+	return DefaultUserAgent()
+}
@@ -0,0 +1,136 @@
+package gribdownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// rangesUnsupported reports whether a host is known to ignore Range headers
+func (d *Downloader) rangesUnsupported(rawURL string) bool {
+	host, err := urlHost(rawURL)
+	if err != nil {
+		return false
+	}
+	_, ok := d.noRanges.Load(host)
+	return ok
+}
+
+// markRangesUnsupported remembers that a host ignores Range headers, so
+// further requests go straight to the whole-file fallback
+func (d *Downloader) markRangesUnsupported(rawURL string) {
+	if host, err := urlHost(rawURL); err == nil {
+		d.noRanges.Store(host, true)
+	}
+}
+
+// rangeIgnored reports whether a request failed because no mirror serves
+// byte ranges
+func rangeIgnored(err error) bool {
+	return errors.Is(err, ErrRangeIgnored)
+}
+
+// downloadWhole fetches the whole file in a single request and writes the
+// requests from it in one pass, for servers that ignore Range headers. It
+// tries each mirror in turn and returns the index of the mirror that
+// succeeded along with the bytes written per job of each request.
+func (d *Downloader) downloadWhole(ctx context.Context, urls []string, requests []rangeRequest, out rangeWriter, tracker *progressTracker) (int, [][]int64, error) {
+	order := make([]int, len(requests))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return requests[order[a]].Start < requests[order[b]].Start })
+
+	var errs []error
+	for i, url := range urls {
+		start := time.Now()
+		written, err := d.writeWhole(ctx, url, requests, order, out, tracker)
+		if err == nil {
+			for _, w := range written {
+				d.Stats.downloaded(w)
+			}
+			d.logger().Debug("ranges extracted from whole file",
+				"ranges", len(requests), "duration", time.Since(start), "source", url, "attempt", i+1)
+			return i, written, nil
+		}
+		if ctx.Err() != nil {
+			return -1, nil, ctx.Err()
+		}
+		d.logger().Warn("whole file download failed", "source", url,
+			"attempt", i+1, "remaining_mirrors", len(urls)-i-1, "error", err)
+		errs = append(errs, err)
+	}
+	for _, request := range requests {
+		d.Stats.failed(len(request.Jobs))
+	}
+	return -1, nil, fmt.Errorf("all mirrors failed: %v", errs)
+}
+
+// writeWhole streams the whole file from a URL, writing the requests in the
+// given order as their bytes go by. With VerifyChecksums the file is read to
+// the end and checked against its checksum sidecar, if the source has one.
+func (d *Downloader) writeWhole(ctx context.Context, url string, requests []rangeRequest, order []int, out rangeWriter, tracker *progressTracker) ([][]int64, error) {
+	var checksum *fileChecksum
+	if d.VerifyChecksums {
+		var err error
+		checksum, err = d.fetchChecksum(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		if checksum == nil {
+			d.logger().Debug("no checksum file published", "source", url)
+		}
+	}
+
+	resp, err := d.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var r io.Reader = resp.Body
+	var h hash.Hash
+	if checksum != nil {
+		h = checksum.hash()
+		r = io.TeeReader(r, h)
+	}
+	var received atomic.Int64
+	body := &countingReader{r: d.limit(ctx, r), total: &received}
+	written := make([][]int64, len(requests))
+	var counted int64
+	for _, i := range order {
+		request := requests[i]
+		if request.Start < body.read {
+			tracker.doneBytes.Add(-counted)
+			return nil, fmt.Errorf("range %d-%d overlaps the previous range", request.Start, request.End)
+		}
+		if _, err := io.CopyN(io.Discard, body, request.Start-body.read); err != nil {
+			tracker.doneBytes.Add(-counted)
+			return nil, fmt.Errorf("error skipping to range %d-%d: %v", request.Start, request.End, err)
+		}
+		written[i], err = d.writeRequest(body, out, request, tracker)
+		if err != nil {
+			tracker.doneBytes.Add(-counted)
+			return nil, err
+		}
+		counted += sum(written[i])
+	}
+
+	if checksum != nil {
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			tracker.doneBytes.Add(-counted)
+			return nil, fmt.Errorf("error reading to the end of the file: %v", err)
+		}
+		if err := checksum.verify(h); err != nil {
+			tracker.doneBytes.Add(-counted)
+			return nil, err
+		}
+		d.logger().Debug("whole file matches its checksum", "source", url, "checksum", checksum.url)
+	}
+	return written, nil
+}